@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
+	"os"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 )
@@ -193,6 +197,21 @@ func BenchmarkVectorOperations(b *testing.B) {
 		}
 	})
 	
+	b.Run("NormalizeUnit", func(b *testing.B) {
+		// Stored cosine embeddings are already unit length and are copied, not divided again
+		vec := make([]float32, 384)
+		for j := range vec {
+			vec[j] = rand.Float32()*2 - 1
+		}
+		unit := normalizeVector(vec)
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			_ = normalizeVector(unit)
+		}
+	})
+
 	b.Run("DotProduct", func(b *testing.B) {
 		// Create normalized vectors
 		vectors := make([][]float32, 100)
@@ -310,4 +329,277 @@ func BenchmarkMemoryEviction(b *testing.B) {
 		}
 		store.Store(memory)
 	}
-}
\ No newline at end of file
+}
+
+// Benchmark one batched similarity scan against sequential scans
+func BenchmarkSimilarityBatch(b *testing.B) {
+	store := NewMemoryStore(5100)
+	defer store.Shutdown()
+
+	for i := 0; i < 5000; i++ {
+		embedding := make([]float32, 384)
+		for j := range embedding {
+			embedding[j] = rand.Float32()*2 - 1
+		}
+		store.Store(&Memory{
+			ID:         fmt.Sprintf("vec-%d", i),
+			Type:       ShortTerm,
+			Content:    fmt.Sprintf("Memory %d", i),
+			Embedding:  embedding,
+			Importance: 0.5,
+		})
+	}
+
+	queries := make([][]float32, 5)
+	for i := range queries {
+		queries[i] = make([]float32, 384)
+		for j := range queries[i] {
+			queries[i][j] = rand.Float32()*2 - 1
+		}
+	}
+
+	b.Run("Batch5", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_ = store.findSimilarBatch(queries, 10)
+		}
+	})
+
+	b.Run("Sequential5", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, query := range queries {
+				_ = store.findSimilar(query, 10)
+			}
+		}
+	})
+}
+
+// Benchmark write latency while similarity scans run concurrently
+func BenchmarkWriteDuringSimilarityScan(b *testing.B) {
+	store := NewMemoryStore(b.N + 10100)
+	defer store.Shutdown()
+
+	for i := 0; i < 10000; i++ {
+		embedding := make([]float32, 384)
+		for j := range embedding {
+			embedding[j] = rand.Float32()*2 - 1
+		}
+		store.Store(&Memory{
+			ID:         fmt.Sprintf("vec-%d", i),
+			Type:       ShortTerm,
+			Content:    fmt.Sprintf("Memory %d", i),
+			Embedding:  embedding,
+			Importance: 0.5,
+		})
+	}
+
+	query := make([]float32, 384)
+	for i := range query {
+		query[i] = rand.Float32()*2 - 1
+	}
+
+	done := make(chan struct{})
+	scanning := make(chan struct{})
+	go func() {
+		close(scanning)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				store.Query(QueryCriteria{Type: "similarity", Embedding: query, Limit: 10})
+			}
+		}
+	}()
+	<-scanning
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		store.Store(&Memory{
+			ID:         fmt.Sprintf("write-%d", i),
+			Type:       ShortTerm,
+			Content:    fmt.Sprintf("Write %d", i),
+			Importance: 0.5,
+		})
+	}
+	b.StopTimer()
+	close(done)
+}
+
+// Benchmark reindexing memories with long repetitive content
+func BenchmarkKeywordReindex(b *testing.B) {
+	store := NewMemoryStore(200)
+	defer store.Shutdown()
+
+	content := strings.Repeat("deploy service rollback deploy service monitor alert deploy ", 100)
+	memories := make([]*Memory, 100)
+	for i := range memories {
+		memories[i] = &Memory{
+			ID:         fmt.Sprintf("repeat-%d", i),
+			Type:       ShortTerm,
+			Content:    fmt.Sprintf("%s unique%d", content, i),
+			Importance: 0.5,
+		}
+		store.Store(memories[i])
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		mem := memories[i%len(memories)]
+		store.removeFromKeywordIndex(mem)
+		store.addToKeywordIndex(mem)
+	}
+}
+
+// Benchmark graph traversal over a densely connected store
+func BenchmarkFindRelatedDenseGraph(b *testing.B) {
+	const nodes = 200
+	store := NewMemoryStore(nodes)
+	defer store.Shutdown()
+
+	for i := 0; i < nodes; i++ {
+		store.Store(&Memory{
+			ID:         fmt.Sprintf("node-%d", i),
+			Type:       Semantic,
+			Content:    fmt.Sprintf("Node %d", i),
+			Importance: 0.5,
+		})
+	}
+
+	store.mu.Lock()
+	for i := 0; i < nodes; i++ {
+		for j := 0; j < nodes; j++ {
+			if i != j {
+				store.addRelation(CreateRelationArgs{
+					FromID:       fmt.Sprintf("node-%d", i),
+					ToID:         fmt.Sprintf("node-%d", j),
+					RelationType: "related_to",
+					Strength:     rand.Float32(),
+				})
+			}
+		}
+	}
+	store.mu.Unlock()
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = store.findRelated("node-0", 3)
+	}
+}
+
+// Benchmark keyword index heap footprint for 5k memories with rich content
+func BenchmarkKeywordIndexFootprint(b *testing.B) {
+	const count = 5000
+	rng := rand.New(rand.NewSource(1))
+	vocabulary := make([]string, 20000)
+	for i := range vocabulary {
+		vocabulary[i] = fmt.Sprintf("term%d", i)
+	}
+
+	memories := make([]*Memory, count)
+	for i := range memories {
+		words := make([]string, 80)
+		for j := range words {
+			// Skew toward common words like natural text
+			words[j] = vocabulary[int(float64(len(vocabulary))*rng.Float64()*rng.Float64())]
+		}
+		memories[i] = &Memory{
+			ID:         fmt.Sprintf("rich-%d", i),
+			Type:       ShortTerm,
+			Content:    strings.Join(words, " "),
+			Importance: 0.5,
+		}
+	}
+
+	var bytesPerMemory float64
+	for i := 0; i < b.N; i++ {
+		store := NewMemoryStore(count)
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		for _, mem := range memories {
+			store.addToKeywordIndex(mem)
+		}
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		bytesPerMemory = float64(after.HeapAlloc-before.HeapAlloc) / count
+		runtime.KeepAlive(store)
+		store.Shutdown()
+	}
+	b.ReportMetric(bytesPerMemory, "index-B/memory")
+}
+
+// Benchmark stdio throughput for 10k rapid tool calls, flushing each
+// response versus flushing in batches
+func BenchmarkStdioFlushPolicy(b *testing.B) {
+	const calls = 10000
+	request := `{"jsonrpc":"2.0","id":1,"method":"tools/call","params":{"name":"health","arguments":{}}}` + "\n"
+	input := strings.Repeat(request, calls)
+
+	// Write to a real file so each flush costs a syscall, as on stdout
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		b.Fatalf("Failed to open %s: %v", os.DevNull, err)
+	}
+	defer devNull.Close()
+
+	for _, policy := range []struct {
+		name          string
+		flushMessages int
+	}{
+		{"EachMessage", 1},
+		{"Every64", 64},
+	} {
+		b.Run(policy.name, func(b *testing.B) {
+			store := NewMemoryStore(100)
+			defer store.Shutdown()
+			server := &MCPServer{store: store, compactJSON: true, flushMessages: policy.flushMessages}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := serveStream(server, strings.NewReader(input), devNull); err != nil {
+					b.Fatalf("serveStream failed: %v", err)
+				}
+			}
+			b.ReportMetric(float64(calls*b.N)/b.Elapsed().Seconds(), "calls/s")
+		})
+	}
+}
+
+// Benchmark the heap and quickselect top-K paths over a 50k embedding scan
+func BenchmarkSimilarityTopK(b *testing.B) {
+	const size = 50000
+	snapshot := make([]embeddingEntry, size)
+	for i := range snapshot {
+		embedding := make([]float32, 384)
+		for j := range embedding {
+			embedding[j] = rand.Float32()*2 - 1
+		}
+		snapshot[i] = embeddingEntry{
+			memory: &Memory{ID: fmt.Sprintf("vec-%d", i)},
+			vector: MetricCosine.prepare(embedding),
+		}
+	}
+	query := make([]float32, 384)
+	for i := range query {
+		query[i] = rand.Float32()*2 - 1
+	}
+
+	for _, k := range []int{10, 500} {
+		// A tiny ratio forces quickselect for any limit
+		for _, path := range []struct {
+			name  string
+			ratio float32
+		}{{"Heap", 0}, {"Select", 1e-9}} {
+			b.Run(fmt.Sprintf("K%d/%s", k, path.name), func(b *testing.B) {
+				ei := &EmbeddingIndex{metric: MetricCosine, selectRatio: path.ratio}
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					_, _ = scoreSimilar(context.Background(), snapshot, ei, query, k, 0)
+				}
+			})
+		}
+	}
+}
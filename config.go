@@ -1,36 +1,406 @@
 package main
 
 import (
+	"errors"
 	"flag"
+	"fmt"
 	"runtime"
 	"runtime/debug"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type Config struct {
-	MaxMemories     int
-	MaxMemoryMB     int
-	DecayInterval   time.Duration
-	Port            int
-	EnableProfiling bool
-	EnableSharing   bool
+	MaxMemories                      int
+	TypeCapacities                   map[MemoryType]int
+	TypePolicies                     map[MemoryType]string
+	ImportanceFloors                 map[MemoryType]float32
+	DecayGracePeriod                 time.Duration
+	MaxMemoryMB                      int
+	OnFull                           string
+	CapacityWarning                  float32
+	DecayInterval                    time.Duration
+	DecayRemovalThreshold            float32
+	AccessHalfLife                   time.Duration
+	ConsolidationInterval            time.Duration
+	ConsolidationAccessThreshold     float32
+	ConsolidationImportanceThreshold float32
+	ConsolidationTarget              string
+	QuantizeEmbeddings               bool
+	IndexWorkers                     int
+	IndexQueueSize                   int
+	SimilarityMetric                 string
+	TopKSelectRatio                  float32
+	IdentifierTokens                 bool
+	PositionalIndex                  bool
+	KeywordPrune                     string
+	KeywordPruneImportance           float32
+	KeywordPruneInterval             time.Duration
+	CompactJSON                      bool
+	LegacyResourceErrors             bool
+	FlushMessages                    int
+	FlushInterval                    time.Duration
+	TimeBucket                       string
+	TimeRetention                    time.Duration
+	MaxContentLength                 int
+	ContentOverflow                  string
+	ContentNormalization             string
+	LogFormat                        string
+	RequestTimeout                   time.Duration
+	LogFile                          string
+	IDMode                           string
+	IDNamespace                      string
+	EmptyKeywordQuery                string
+	MaxMetadataBytes                 int
+	MaxMetadataDepth                 int
+	MaxRelatedDepth                  int
+	ImportanceOverflow               string
+	QueryCacheSize                   int
+	MaxConcurrentQueries             int
+	QueryCacheTTL                    time.Duration
+	RecentCacheSize                  int
+	Port                             int
+	EnableProfiling                  bool
+	ProfileAddr                      string
+	MaxProcs                         int
+	EnableSharing                    bool
+	PipeFraming                      string
+	AllowSelfRelations               bool
+	ReadOnly                         bool
+	LoadPath                         string
+	SnapshotPath                     string
+	ExportDir                        string
+}
+
+// DefaultConfig returns the configuration used when no flags are given
+func DefaultConfig() *Config {
+	return &Config{
+		MaxMemories:                      1000,
+		MaxMemoryMB:                      100,
+		OnFull:                           "evict",
+		CapacityWarning:                  0.9,
+		DecayInterval:                    5 * time.Minute,
+		DecayRemovalThreshold:            0.1,
+		DecayGracePeriod:                 time.Hour,
+		AccessHalfLife:                   24 * time.Hour,
+		ConsolidationInterval:            10 * time.Minute,
+		ConsolidationAccessThreshold:     3,
+		ConsolidationImportanceThreshold: 0.7,
+		ConsolidationTarget:              string(LongTerm),
+		SimilarityMetric:                 string(MetricCosine),
+		TopKSelectRatio:                  0.05,
+		IndexQueueSize:                   1024,
+		TimeBucket:                       "hour",
+		TimeRetention:                    7 * 24 * time.Hour,
+		ContentOverflow:                  "reject",
+		ContentNormalization:             "none",
+		LogFormat:                        "text",
+		RequestTimeout:                   30 * time.Second,
+		IDMode:                           "timestamp",
+		EmptyKeywordQuery:                "reject",
+		KeywordPrune:                     "off",
+		KeywordPruneImportance:           0.3,
+		KeywordPruneInterval:             time.Hour,
+		MaxMetadataBytes:                 64 * 1024,
+		MaxMetadataDepth:                 8,
+		MaxRelatedDepth:                  10,
+		ImportanceOverflow:               "default",
+		QueryCacheTTL:                    30 * time.Second,
+		FlushMessages:                    1,
+		ProfileAddr:                      "localhost:6060",
+		MaxProcs:                         2,
+		PipeFraming:                      "line",
+	}
 }
 
 func LoadConfig() *Config {
-	config := &Config{}
+	config := DefaultConfig()
+	var consolidationAccess, consolidationImportance, capacityWarning, decayRemoval, topKSelect, keywordPruneImportance float64
 
-	flag.IntVar(&config.MaxMemories, "max-memories", 1000, "Maximum number of memories to store")
-	flag.IntVar(&config.MaxMemoryMB, "max-memory-mb", 100, "Maximum memory usage in MB")
-	flag.DurationVar(&config.DecayInterval, "decay-interval", 5*time.Minute, "Memory decay check interval")
+	flag.IntVar(&config.MaxMemories, "max-memories", config.MaxMemories, "Maximum number of memories to store")
+	flag.IntVar(&config.MaxMemoryMB, "max-memory-mb", config.MaxMemoryMB, "Maximum memory usage in MB")
+	flag.Func("type-capacity", "Per-type memory cap as type=N, e.g. short_term=200; repeat or comma-separate for several types", func(value string) error {
+		return parseTypeCapacities(value, config)
+	})
+	flag.Func("type-policy", "What a type does at its --type-capacity, as type=evict|reject|global, e.g. semantic=reject; reject types are also never evicted for other types, and global follows --on-full", func(value string) error {
+		return parseTypePolicies(value, config)
+	})
+	flag.StringVar(&config.OnFull, "on-full", config.OnFull, "What to do when storing into a full store (evict, reject)")
+	flag.Float64Var(&capacityWarning, "capacity-warning", float64(config.CapacityWarning), "Fraction of max memories at which a capacity warning is logged (0 disables)")
+	flag.DurationVar(&config.DecayInterval, "decay-interval", config.DecayInterval, "Memory decay check interval")
+	flag.Float64Var(&decayRemoval, "decay-removal-threshold", float64(config.DecayRemovalThreshold), "Importance below which decay removes a memory (between 0 and 1, exclusive)")
+	flag.DurationVar(&config.DecayGracePeriod, "decay-grace-period", config.DecayGracePeriod, "How long after an access a memory is protected from decay (0 decays from the access on)")
+	flag.Func("importance-floor", "Importance below which decay cannot push a memory type, as type=F, e.g. semantic=0.3; repeat or comma-separate for several types", func(value string) error {
+		return parseImportanceFloors(value, config)
+	})
+	flag.DurationVar(&config.AccessHalfLife, "access-half-life", config.AccessHalfLife, "Period after which a memory's access score halves (0 disables)")
+	flag.DurationVar(&config.ConsolidationInterval, "consolidation-interval", config.ConsolidationInterval, "Memory consolidation check interval")
+	flag.Float64Var(&consolidationAccess, "consolidation-access-threshold", float64(config.ConsolidationAccessThreshold), "Decayed access score above which short_term memories are promoted")
+	flag.Float64Var(&consolidationImportance, "consolidation-importance-threshold", float64(config.ConsolidationImportanceThreshold), "Importance above which short_term memories are promoted")
+	flag.StringVar(&config.ConsolidationTarget, "consolidation-target", config.ConsolidationTarget, "Memory type short_term memories are promoted to")
+	flag.BoolVar(&config.QuantizeEmbeddings, "quantize-embeddings", false, "Store embeddings as int8 to reduce memory footprint")
+	flag.IntVar(&config.IndexWorkers, "index-workers", 0, "Workers that index embeddings in the background so bursts of embedded stores don't stall writes (0 indexes synchronously)")
+	flag.IntVar(&config.IndexQueueSize, "index-queue-size", config.IndexQueueSize, "Embedding updates that can wait for index workers before stores block")
+	flag.BoolVar(&config.IdentifierTokens, "identifier-tokens", false, "Index identifiers like user_id, config.yaml, and v1.2.3 as single words instead of splitting on _, ., and -")
+	flag.StringVar(&config.KeywordPrune, "keyword-prune", config.KeywordPrune, "Periodic pass over keywords found in a single unimportant memory, such as IDs and typos (off, report, prune); report only logs them")
+	flag.Float64Var(&keywordPruneImportance, "keyword-prune-importance", float64(config.KeywordPruneImportance), "Importance below which a memory's one-off keywords count as noise for --keyword-prune")
+	flag.DurationVar(&config.KeywordPruneInterval, "keyword-prune-interval", config.KeywordPruneInterval, "How often the --keyword-prune pass runs")
+	flag.BoolVar(&config.PositionalIndex, "positional-index", false, "Index word positions so phrase queries are answered from the index, at the cost of an index entry per word occurrence")
+	flag.StringVar(&config.SimilarityMetric, "similarity-metric", config.SimilarityMetric, "Embedding similarity metric (cosine, dot, euclidean)")
+	flag.Float64Var(&topKSelect, "topk-select-ratio", float64(config.TopKSelectRatio), "Fraction of scanned embeddings at or above which a similarity limit is served by quickselect instead of a heap (0 always uses the heap)")
+	flag.StringVar(&config.TimeBucket, "time-bucket", config.TimeBucket, "Time index bucket granularity (minute, hour, day)")
+	flag.DurationVar(&config.TimeRetention, "time-retention", config.TimeRetention, "Age after which time buckets are compacted of removed memories")
+	flag.IntVar(&config.MaxContentLength, "max-content-length", config.MaxContentLength, "Maximum memory content length in characters (0 for unlimited)")
+	flag.IntVar(&config.MaxMetadataBytes, "max-metadata-bytes", config.MaxMetadataBytes, "Maximum serialized metadata size per memory in bytes (0 for unlimited)")
+	flag.IntVar(&config.MaxMetadataDepth, "max-metadata-depth", config.MaxMetadataDepth, "Maximum metadata nesting depth, counting the top-level object (0 for unlimited)")
+	flag.IntVar(&config.MaxRelatedDepth, "max-related-depth", config.MaxRelatedDepth, "Maximum traversal depth for related queries and clusters; deeper requests are clamped (0 for unlimited)")
+	flag.StringVar(&config.ContentOverflow, "content-overflow", config.ContentOverflow, "What to do with oversized content (reject, truncate)")
+	flag.StringVar(&config.ContentNormalization, "normalize-content", config.ContentNormalization, "Reject memories whose content matches another's after normalizing (none, whitespace, lowercase)")
+	flag.StringVar(&config.IDMode, "id-mode", config.IDMode, "How store_memory generates IDs when none is given (timestamp, content); content IDs make re-storing the same content a duplicate")
+	flag.StringVar(&config.IDNamespace, "id-namespace", "", "Namespace hashed into content IDs, so separate stores can derive distinct IDs for the same content")
+	flag.StringVar(&config.EmptyKeywordQuery, "empty-keyword-query", config.EmptyKeywordQuery, "What a keyword query without keywords does (reject, all); all returns every memory up to the limit, most important first")
+	flag.StringVar(&config.ImportanceOverflow, "importance-overflow", config.ImportanceOverflow, "What to do with importance outside 0-1 (clamp, default, reject)")
+	flag.IntVar(&config.QueryCacheSize, "query-cache-size", config.QueryCacheSize, "Number of keyword query results to cache (0 disables)")
+	flag.DurationVar(&config.QueryCacheTTL, "query-cache-ttl", config.QueryCacheTTL, "How long cached keyword query results stay valid")
+	flag.IntVar(&config.RecentCacheSize, "recent-cache-size", config.RecentCacheSize, "Number of recently read memories to serve by ID without taking the store lock (0 disables)")
+	flag.IntVar(&config.MaxConcurrentQueries, "max-concurrent-queries", 0, "Maximum similarity and keyword queries running at once; the rest wait their turn (0 for unlimited)")
 	flag.IntVar(&config.Port, "port", 0, "Port for HTTP transport (0 for stdio)")
-	flag.BoolVar(&config.EnableProfiling, "profile", false, "Enable memory profiling")
+	flag.BoolVar(&config.CompactJSON, "compact-json", false, "Emit tool and resource results as compact JSON to save tokens (default is indented)")
+	flag.BoolVar(&config.LegacyResourceErrors, "legacy-resource-errors", false, "Report unknown resource URIs as invalid params (-32602) and missing memories as -32001 instead of the MCP resource-not-found code (-32002)")
+	flag.IntVar(&config.FlushMessages, "flush-messages", config.FlushMessages, "Flush stdio responses after this many; raise for scripted batch sessions (responses are always flushed when input pauses)")
+	flag.DurationVar(&config.FlushInterval, "flush-interval", 0, "With --flush-messages above 1, also flush buffered responses this long after the first (0 disables)")
+	flag.DurationVar(&config.RequestTimeout, "request-timeout", config.RequestTimeout, "Deadline for each tool call, after which long scans such as similarity queries give up (0 for none)")
+	flag.StringVar(&config.LogFormat, "log-format", config.LogFormat, "Log format (text, json); json writes one object per line with time, level, msg, and fields")
+	flag.StringVar(&config.LogFile, "log-file", "", "File to append logs to instead of stderr")
+	flag.BoolVar(&config.EnableProfiling, "profile", false, "Serve pprof CPU and heap profiles on --profile-addr")
+	flag.StringVar(&config.ProfileAddr, "profile-addr", config.ProfileAddr, "Address for the pprof server when profiling is enabled")
+	flag.IntVar(&config.MaxProcs, "max-procs", config.MaxProcs, "Maximum number of OS threads executing Go code simultaneously (GOMAXPROCS)")
 	flag.BoolVar(&config.EnableSharing, "enable-sharing", false, "Enable memory sharing between clients")
+	flag.StringVar(&config.PipeFraming, "pipe-framing", config.PipeFraming, "Message framing on the shared-mode pipe (line, length); every process sharing the server must use the same")
+	flag.BoolVar(&config.AllowSelfRelations, "allow-self-relations", false, "Allow relations from a memory to itself")
+	flag.BoolVar(&config.ReadOnly, "read-only", false, "Reject every write and pause decay and consolidation, e.g. to serve a snapshot loaded with --load")
+	flag.StringVar(&config.ExportDir, "export-dir", "", "Directory export_memories and import_memories read and write in; their paths are relative to it (empty disables both tools)")
+	flag.StringVar(&config.SnapshotPath, "snapshot-path", "", "File the persist tool writes a snapshot of every memory and relation to, restored at startup when present; cannot be combined with --load")
+	flag.StringVar(&config.LoadPath, "load", "", "JSON Lines file of memories to import at startup, such as an export_memories snapshot")
 
 	flag.Parse()
 
+	config.ConsolidationAccessThreshold = float32(consolidationAccess)
+	config.ConsolidationImportanceThreshold = float32(consolidationImportance)
+	config.CapacityWarning = float32(capacityWarning)
+	config.DecayRemovalThreshold = float32(decayRemoval)
+	config.TopKSelectRatio = float32(topKSelect)
+	config.KeywordPruneImportance = float32(keywordPruneImportance)
+
 	return config
 }
 
+// parseTypeCapacities adds comma-separated type=N caps to the configuration
+func parseTypeCapacities(value string, config *Config) error {
+	if config.TypeCapacities == nil {
+		config.TypeCapacities = make(map[MemoryType]int)
+	}
+	for _, entry := range strings.Split(value, ",") {
+		name, limit, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			return fmt.Errorf("invalid type capacity %q: must be type=N", entry)
+		}
+		n, err := strconv.Atoi(limit)
+		if err != nil {
+			return fmt.Errorf("invalid type capacity %q: %v", entry, err)
+		}
+		config.TypeCapacities[MemoryType(name)] = n
+	}
+	return nil
+}
+
+// parseTypePolicies adds comma-separated type=policy entries to the configuration
+func parseTypePolicies(value string, config *Config) error {
+	if config.TypePolicies == nil {
+		config.TypePolicies = make(map[MemoryType]string)
+	}
+	for _, entry := range strings.Split(value, ",") {
+		name, policy, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			return fmt.Errorf("invalid type policy %q: must be type=policy", entry)
+		}
+		config.TypePolicies[MemoryType(name)] = policy
+	}
+	return nil
+}
+
+// parseImportanceFloors adds comma-separated type=F decay floors to the configuration
+func parseImportanceFloors(value string, config *Config) error {
+	if config.ImportanceFloors == nil {
+		config.ImportanceFloors = make(map[MemoryType]float32)
+	}
+	for _, entry := range strings.Split(value, ",") {
+		name, floor, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			return fmt.Errorf("invalid importance floor %q: must be type=F", entry)
+		}
+		f, err := strconv.ParseFloat(floor, 32)
+		if err != nil {
+			return fmt.Errorf("invalid importance floor %q: %v", entry, err)
+		}
+		config.ImportanceFloors[MemoryType(name)] = float32(f)
+	}
+	return nil
+}
+
+// Validate checks option values that flags cannot constrain on their own
+func (c *Config) Validate() error {
+	if c.OnFull != "evict" && c.OnFull != "reject" {
+		return fmt.Errorf("invalid on-full behavior %q: must be evict or reject", c.OnFull)
+	}
+	for memoryType, limit := range c.TypeCapacities {
+		if !isValidMemoryType(memoryType) {
+			return fmt.Errorf("invalid type capacity: unknown memory type %q", memoryType)
+		}
+		if limit < 1 {
+			return fmt.Errorf("invalid type capacity for %s: must be at least 1", memoryType)
+		}
+	}
+	for memoryType, policy := range c.TypePolicies {
+		if !isValidMemoryType(memoryType) {
+			return fmt.Errorf("invalid type policy: unknown memory type %q", memoryType)
+		}
+		if policy != "evict" && policy != "reject" && policy != "global" {
+			return fmt.Errorf("invalid type policy %q for %s: must be evict, reject, or global", policy, memoryType)
+		}
+	}
+	if c.DecayGracePeriod < 0 {
+		return errors.New("decay grace period cannot be negative")
+	}
+	for memoryType, floor := range c.ImportanceFloors {
+		if !isValidMemoryType(memoryType) {
+			return fmt.Errorf("invalid importance floor: unknown memory type %q", memoryType)
+		}
+		if floor < 0 || floor > 1 {
+			return fmt.Errorf("invalid importance floor for %s: must be between 0 and 1", memoryType)
+		}
+	}
+	if c.DecayRemovalThreshold <= 0 || c.DecayRemovalThreshold >= 1 {
+		return fmt.Errorf("invalid decay removal threshold %v: must be between 0 and 1, exclusive", c.DecayRemovalThreshold)
+	}
+	if c.CapacityWarning < 0 || c.CapacityWarning > 1 {
+		return fmt.Errorf("invalid capacity warning %v: must be between 0 and 1", c.CapacityWarning)
+	}
+	if _, ok := timeBucketFormats[c.TimeBucket]; !ok {
+		return fmt.Errorf("invalid time bucket %q: must be minute, hour, or day", c.TimeBucket)
+	}
+	if c.ConsolidationAccessThreshold < 0 {
+		return errors.New("consolidation access threshold cannot be negative")
+	}
+	if c.ConsolidationImportanceThreshold < 0 || c.ConsolidationImportanceThreshold > 1 {
+		return fmt.Errorf("invalid consolidation importance threshold %v: must be between 0 and 1", c.ConsolidationImportanceThreshold)
+	}
+	if target := MemoryType(c.ConsolidationTarget); !isValidMemoryType(target) || target == ShortTerm {
+		return fmt.Errorf("invalid consolidation target %q: must be a memory type other than short_term", c.ConsolidationTarget)
+	}
+	if !isValidSimilarityMetric(SimilarityMetric(c.SimilarityMetric)) {
+		return fmt.Errorf("invalid similarity metric %q: must be cosine, dot, or euclidean", c.SimilarityMetric)
+	}
+	if c.TimeRetention < 0 {
+		return errors.New("time retention cannot be negative")
+	}
+	if c.MaxContentLength < 0 {
+		return errors.New("max content length cannot be negative")
+	}
+	if c.MaxMetadataBytes < 0 {
+		return errors.New("max metadata bytes cannot be negative")
+	}
+	if c.MaxMetadataDepth < 0 {
+		return errors.New("max metadata depth cannot be negative")
+	}
+	if c.MaxRelatedDepth < 0 {
+		return errors.New("max related depth cannot be negative")
+	}
+	switch c.ImportanceOverflow {
+	case "clamp", "default", "reject":
+	default:
+		return fmt.Errorf("invalid importance overflow %q: must be clamp, default, or reject", c.ImportanceOverflow)
+	}
+	if c.FlushMessages < 1 {
+		return errors.New("flush messages must be at least 1")
+	}
+	if c.FlushInterval < 0 {
+		return errors.New("flush interval cannot be negative")
+	}
+	if c.EnableProfiling && c.ProfileAddr == "" {
+		return errors.New("profile address cannot be empty when profiling is enabled")
+	}
+	if c.MaxProcs < 1 {
+		return errors.New("max procs must be at least 1")
+	}
+	if c.IndexWorkers < 0 {
+		return errors.New("index workers cannot be negative")
+	}
+	if c.IndexWorkers > 0 && c.IndexQueueSize < 1 {
+		return errors.New("index queue size must be at least 1 when index workers are enabled")
+	}
+	if c.TopKSelectRatio < 0 || c.TopKSelectRatio > 1 {
+		return fmt.Errorf("invalid top-K select ratio %v: must be between 0 and 1", c.TopKSelectRatio)
+	}
+	if c.MaxConcurrentQueries < 0 {
+		return errors.New("max concurrent queries cannot be negative")
+	}
+	if c.QueryCacheSize < 0 {
+		return errors.New("query cache size cannot be negative")
+	}
+	if c.QueryCacheSize > 0 && c.QueryCacheTTL <= 0 {
+		return errors.New("query cache TTL must be positive when the cache is enabled")
+	}
+	if c.RecentCacheSize < 0 {
+		return errors.New("recent cache size cannot be negative")
+	}
+	if c.RequestTimeout < 0 {
+		return errors.New("request timeout cannot be negative")
+	}
+	if c.LogFormat != "text" && c.LogFormat != "json" {
+		return fmt.Errorf("invalid log format %q: must be text or json", c.LogFormat)
+	}
+	if c.PipeFraming != "line" && c.PipeFraming != "length" {
+		return fmt.Errorf("invalid pipe framing %q: must be line or length", c.PipeFraming)
+	}
+	if c.ContentOverflow != "reject" && c.ContentOverflow != "truncate" {
+		return fmt.Errorf("invalid content overflow %q: must be reject or truncate", c.ContentOverflow)
+	}
+	if c.ContentNormalization != "none" && c.ContentNormalization != "whitespace" && c.ContentNormalization != "lowercase" {
+		return fmt.Errorf("invalid content normalization %q: must be none, whitespace, or lowercase", c.ContentNormalization)
+	}
+	if c.IDMode != "timestamp" && c.IDMode != "content" {
+		return fmt.Errorf("invalid ID mode %q: must be timestamp or content", c.IDMode)
+	}
+	if c.EmptyKeywordQuery != "reject" && c.EmptyKeywordQuery != "all" {
+		return fmt.Errorf("invalid empty keyword query %q: must be reject or all", c.EmptyKeywordQuery)
+	}
+	if c.KeywordPrune != "off" && c.KeywordPrune != "report" && c.KeywordPrune != "prune" {
+		return fmt.Errorf("invalid keyword prune mode %q: must be off, report, or prune", c.KeywordPrune)
+	}
+	if c.KeywordPruneImportance < 0 || c.KeywordPruneImportance > 1 {
+		return errors.New("keyword prune importance must be between 0 and 1")
+	}
+	if c.LoadPath != "" && c.SnapshotPath != "" {
+		return errors.New("--load and --snapshot-path cannot be combined: restoring the snapshot would replace the loaded memories")
+	}
+	if c.KeywordPrune != "off" && c.KeywordPruneInterval <= 0 {
+		return errors.New("keyword prune interval must be positive when pruning is enabled")
+	}
+	if c.KeywordPrune == "prune" && c.ReadOnly {
+		return errors.New("--keyword-prune=prune changes the index and cannot be used with --read-only; use report")
+	}
+	return nil
+}
+
+// timeBucketFormats maps bucket granularity to a layout whose strings sort chronologically
+var timeBucketFormats = map[string]string{
+	"minute": "2006-01-02-15-04",
+	"hour":   "2006-01-02-15",
+	"day":    "2006-01-02",
+}
+
 // Memory-efficient initialization
 func InitializeMemoryLimits(config *Config) {
 	// Set memory limit
@@ -40,5 +410,5 @@ func InitializeMemoryLimits(config *Config) {
 	debug.SetGCPercent(50) // Run GC more frequently
 
 	// Limit number of OS threads
-	runtime.GOMAXPROCS(2) // Use only 2 CPU cores
+	runtime.GOMAXPROCS(config.MaxProcs)
 }
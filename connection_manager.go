@@ -2,10 +2,14 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"os"
 	"sync"
@@ -14,9 +18,12 @@ import (
 
 const (
 	// Named pipe path for inter-process communication
-	pipePath = "/tmp/mcp-memory-server.pipe"
+	defaultPipePath = "/tmp/mcp-memory-server.pipe"
 	// Connection timeout
 	connectionTimeout = 5 * time.Second
+	// How long a session token resumes its session after its last handoff
+	// once no client is connected to the session
+	sessionTokenTTL = 24 * time.Hour
 )
 
 // ConnectionManager handles multi-client connections and server discovery
@@ -27,6 +34,57 @@ type ConnectionManager struct {
 	clientsMu sync.RWMutex
 	store     *MemoryStore
 	server    *MCPServer
+	pipePath  string
+
+	// The primary client's stdio, replaceable in tests
+	stdin  io.Reader
+	stdout io.Writer
+
+	// Frame pipe messages with a 4-byte big-endian length instead of a
+	// newline; both the server and connecting clients must agree
+	lengthPrefixed bool
+
+	// Session tokens handed out by handoff; guarded by clientsMu
+	sessionTokens map[string]*issuedToken
+
+	// Token from the last handoff when forwarding, sent to resume the same
+	// session on a later connection
+	sessionToken string
+}
+
+// issuedToken is the session a handoff token resumes, when a handoff last
+// used it, and the store_memory defaults last set in that session
+type issuedToken struct {
+	sessionID string
+	lastUsed  time.Time
+	defaults  StoreDefaults
+}
+
+// HandoffRequest is the first message a forwarding process sends. A session
+// token from an earlier handoff resumes that session.
+type HandoffRequest struct {
+	ClientID     string `json:"client_id"`
+	SessionToken string `json:"session_token,omitempty"`
+}
+
+// HandoffResult tells a forwarding process how the server will treat the
+// stdio client it forwards
+type HandoffResult struct {
+	Status       string          `json:"status"` // connected, or resumed for a known session token
+	ClientID     string          `json:"client_id"`
+	SessionID    string          `json:"session_id"`
+	SessionToken string          `json:"session_token"`
+	Capabilities MCPCapabilities `json:"capabilities"`
+	Framing      string          `json:"framing"`   // line or length
+	Streaming    bool            `json:"streaming"` // query results may arrive as notifications
+	ServerInfo   HandoffInfo     `json:"server_info"`
+}
+
+// HandoffInfo describes the running server at handoff
+type HandoffInfo struct {
+	UptimeSeconds float64 `json:"uptime_seconds"`
+	ActiveClients int     `json:"active_clients"`
+	MemoryCount   int     `json:"memory_count"`
 }
 
 // ClientConnection represents a connected MCP client
@@ -35,85 +93,204 @@ type ClientConnection struct {
 	Conn     net.Conn
 	Reader   *bufio.Reader
 	Writer   *bufio.Writer
+	Server   *MCPServer // stamps memories with this client's own session
+	Framed   bool       // messages are length-prefixed rather than newline-delimited
 	LastSeen time.Time
 }
 
 // NewConnectionManager creates a new connection manager
 func NewConnectionManager(store *MemoryStore, server *MCPServer) *ConnectionManager {
 	return &ConnectionManager{
-		clients: make(map[string]*ClientConnection),
-		store:   store,
-		server:  server,
+		clients:       make(map[string]*ClientConnection),
+		sessionTokens: make(map[string]*issuedToken),
+		store:         store,
+		server:        server,
+		pipePath:      defaultPipePath,
+		stdin:         os.Stdin,
+		stdout:        os.Stdout,
 	}
 }
 
 // Start attempts to connect to existing server or starts a new one
 func (cm *ConnectionManager) Start() error {
 	// Try to connect to existing server first
-	conn, err := net.DialTimeout("unix", pipePath, connectionTimeout)
+	conn, err := net.DialTimeout("unix", cm.pipePath, connectionTimeout)
 	if err == nil {
 		// Server exists, run as client
-		log.Println("Connecting to existing memory server...")
+		slog.Info("Connecting to existing memory server...")
 		return cm.runAsClient(conn)
 	}
 
 	// No existing server, start as server
-	log.Println("Starting new memory server instance...")
+	slog.Info("Starting new memory server instance...")
 	return cm.runAsServer()
 }
 
-// runAsClient forwards stdio to existing server
+// runAsClient forwards stdio to existing server. If the server drops the
+// connection while stdin is still open, it reconnects and hands off again
+// with the token from the last handoff, so the client resumes its session.
 func (cm *ConnectionManager) runAsClient(conn net.Conn) error {
-	defer conn.Close()
+	// Read stdin in one place for the life of the process, so no message is
+	// lost between connections
+	lines := make(chan []byte)
+	stdinErr := make(chan error, 1)
+	go func() {
+		reader := bufio.NewReader(cm.stdin)
+		for {
+			line, err := reader.ReadBytes('\n')
+			if line = bytes.TrimSpace(line); len(line) > 0 {
+				lines <- line
+			}
+			if err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				stdinErr <- err
+				close(lines)
+				return
+			}
+		}
+	}()
 
-	// Create handoff request
-	handoffMsg := MCPMessage{
-		Jsonrpc: "2.0",
-		Method:  "handoff/request",
-		Params:  json.RawMessage(`{"client_id": "stdio"}`),
-	}
+	var pending []byte
+	for {
+		lost, err := cm.forward(conn, lines, stdinErr, &pending)
+		conn.Close()
+		if !lost {
+			return err
+		}
 
-	// Send handoff request
-	encoder := json.NewEncoder(conn)
-	if err := encoder.Encode(handoffMsg); err != nil {
-		return fmt.Errorf("failed to send handoff request: %w", err)
+		slog.Warn("Lost the memory server connection; reconnecting to resume the session", "err", err)
+		if conn, err = net.DialTimeout("unix", cm.pipePath, connectionTimeout); err != nil {
+			return fmt.Errorf("failed to reconnect to memory server: %w", err)
+		}
 	}
+}
 
-	// Set up bidirectional forwarding
-	errChan := make(chan error, 2)
-
-	// Forward stdin to server
-	go func() {
-		_, err := io.Copy(conn, os.Stdin)
-		errChan <- err
-	}()
+// forward hands off to the server over conn, then relays stdin lines to it
+// and its replies to stdout, which stays line-delimited for the MCP client.
+// It returns once stdin closes, or with lost set once the connection fails;
+// a line not yet written to the server is left in pending for the next one.
+func (cm *ConnectionManager) forward(conn net.Conn, lines <-chan []byte, stdinErr <-chan error, pending *[]byte) (lost bool, err error) {
+	reader, handoff, err := cm.requestHandoff(conn)
+	if err != nil && cm.sessionToken != "" {
+		// The token expired, so carry on in a new session
+		slog.Warn("Cannot resume the session; starting a new one", "err", err)
+		cm.sessionToken = ""
+		reader, handoff, err = cm.requestHandoff(conn)
+	}
+	if err != nil {
+		return false, err
+	}
+	slog.Info("Handed off to memory server", "client", handoff.ClientID, "session", handoff.SessionID, "status", handoff.Status)
 
 	// Forward server responses to stdout
+	replies := make(chan error, 1)
 	go func() {
-		_, err := io.Copy(os.Stdout, conn)
-		errChan <- err
+		if cm.lengthPrefixed {
+			replies <- framesToLines(cm.stdout, reader)
+			return
+		}
+		_, err := io.Copy(cm.stdout, reader)
+		replies <- err
 	}()
 
-	// Wait for either direction to fail
-	err := <-errChan
-	return err
+	// Forward stdin to server
+	writer := bufio.NewWriter(conn)
+	for {
+		if *pending == nil {
+			select {
+			case line, ok := <-lines:
+				if !ok {
+					return false, <-stdinErr
+				}
+				*pending = line
+			case err := <-replies:
+				return true, err
+			}
+		}
+
+		if cm.lengthPrefixed {
+			err = writeFrame(writer, *pending)
+		} else {
+			err = writeLine(writer, *pending)
+		}
+		if err != nil {
+			return true, err
+		}
+		*pending = nil
+	}
 }
 
-// runAsServer starts the server and accepts connections
-func (cm *ConnectionManager) runAsServer() error {
-	cm.isServer = true
+// requestHandoff announces this process to the server and waits for the
+// result before any stdio is forwarded, so the reply never reaches the MCP
+// client. Later server output must be read from the returned reader, which
+// may already hold some of it.
+func (cm *ConnectionManager) requestHandoff(conn net.Conn) (*bufio.Reader, *HandoffResult, error) {
+	params, err := json.Marshal(HandoffRequest{ClientID: "stdio", SessionToken: cm.sessionToken})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to send handoff request: %w", err)
+	}
+	data, err := json.Marshal(MCPMessage{Jsonrpc: "2.0", ID: "handoff", Method: "handoff/request", Params: params})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to send handoff request: %w", err)
+	}
+	writer := bufio.NewWriter(conn)
+	if cm.lengthPrefixed {
+		err = writeFrame(writer, data)
+	} else {
+		err = writeLine(writer, data)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to send handoff request: %w", err)
+	}
 
+	reader := bufio.NewReader(conn)
+	var reply []byte
+	if cm.lengthPrefixed {
+		reply, err = readFrame(reader)
+	} else {
+		reply, err = reader.ReadBytes('\n')
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read handoff result: %w", err)
+	}
+
+	var response struct {
+		Result *HandoffResult `json:"result"`
+		Error  *MCPError      `json:"error"`
+	}
+	if err := json.Unmarshal(reply, &response); err != nil {
+		return nil, nil, fmt.Errorf("failed to read handoff result: %w", err)
+	}
+	if response.Error != nil {
+		return nil, nil, fmt.Errorf("handoff refused: %s", response.Error.Message)
+	}
+	if response.Result == nil {
+		return nil, nil, errors.New("handoff result missing")
+	}
+	cm.sessionToken = response.Result.SessionToken
+	return reader, response.Result, nil
+}
+
+// runAsServer starts the server and accepts connections, falling back to
+// serving stdio alone when the pipe can't be created
+func (cm *ConnectionManager) runAsServer() error {
 	// Remove old pipe if exists
-	os.Remove(pipePath)
+	os.Remove(cm.pipePath)
 
 	// Create named pipe listener
-	listener, err := net.Listen("unix", pipePath)
+	listener, err := net.Listen("unix", cm.pipePath)
 	if err != nil {
-		return fmt.Errorf("failed to create pipe: %w", err)
+		// Typically a sandbox with an unwritable /tmp or unix sockets blocked
+		slog.Warn("Cannot create the shared-mode pipe; other clients will not be able to connect. Make its directory writable or run without --enable-sharing. Falling back to stdio-only mode",
+			"path", cm.pipePath, "err", err)
+		return serveStream(cm.server, cm.stdin, cm.stdout)
 	}
+	cm.isServer = true
 	cm.listener = listener
 	defer listener.Close()
-	defer os.Remove(pipePath)
+	defer os.Remove(cm.pipePath)
 
 	// Handle stdio as primary client
 	go cm.handleStdioClient()
@@ -127,10 +304,16 @@ func (cm *ConnectionManager) runAsServer() error {
 
 // handleStdioClient processes messages from stdin
 func (cm *ConnectionManager) handleStdioClient() {
+	cm.handleStreamClient("stdio", cm.stdin, cm.stdout)
+}
+
+// handleStreamClient processes newline-delimited messages from a reader/writer pair
+func (cm *ConnectionManager) handleStreamClient(id string, r io.Reader, w io.Writer) {
 	client := &ClientConnection{
-		ID:       "stdio",
-		Reader:   bufio.NewReader(os.Stdin),
-		Writer:   bufio.NewWriter(os.Stdout),
+		ID:       id,
+		Reader:   bufio.NewReader(r),
+		Writer:   bufio.NewWriter(w),
+		Server:   cm.server.withClient(id, newSessionID()),
 		LastSeen: time.Now(),
 	}
 
@@ -145,29 +328,28 @@ func (cm *ConnectionManager) handleStdioClient() {
 			if err == io.EOF {
 				break
 			}
-			log.Printf("Error reading from stdio: %v", err)
+			slog.Error("Error reading", "client", client.ID, "err", err)
 			continue
 		}
 
 		var msg MCPMessage
 		if err := json.Unmarshal([]byte(line), &msg); err != nil {
-			log.Printf("Error parsing message: %v", err)
+			slog.Error("Error parsing message", "client", client.ID, "err", err)
 			continue
 		}
 
 		// Update last seen
 		client.LastSeen = time.Now()
 
-		// Handle message
-		response := cm.handleMessage(msg, client)
-
-		// Send response if not a notification
-		if msg.Method != "" && response.Jsonrpc == "" {
+		// Handle message; notifications get no response
+		response, ok := replyTo(msg, cm.handleMessage(msg, client))
+		if !ok {
 			continue
 		}
 
 		if err := cm.sendResponse(client, response); err != nil {
-			log.Printf("Error sending response: %v", err)
+			slog.Error("Error sending response", "client", client.ID, "err", err)
+			break
 		}
 	}
 
@@ -182,7 +364,7 @@ func (cm *ConnectionManager) acceptConnections() {
 	for {
 		conn, err := cm.listener.Accept()
 		if err != nil {
-			log.Printf("Error accepting connection: %v", err)
+			slog.Error("Error accepting connection", "err", err)
 			continue
 		}
 
@@ -200,40 +382,69 @@ func (cm *ConnectionManager) handleClient(conn net.Conn) {
 		Conn:     conn,
 		Reader:   bufio.NewReader(conn),
 		Writer:   bufio.NewWriter(conn),
+		Server:   cm.server.withClient(clientID, newSessionID()),
+		Framed:   cm.lengthPrefixed,
 		LastSeen: time.Now(),
 	}
 
+	if client.Framed {
+		// Framed clients can take query results in chunks ahead of the response
+		client.Server.notify = func(notification MCPMessage) error {
+			return cm.sendResponse(client, notification)
+		}
+	}
+
 	cm.clientsMu.Lock()
 	cm.clients[clientID] = client
 	cm.clientsMu.Unlock()
 
-	log.Printf("Client connected: %s", clientID)
+	slog.Info("Client connected", "client", clientID)
 
 	// Process messages
 	decoder := json.NewDecoder(client.Reader)
 	for {
 		var msg MCPMessage
-		if err := decoder.Decode(&msg); err != nil {
-			if err == io.EOF {
+		if client.Framed {
+			frame, err := readFrame(client.Reader)
+			if err != nil {
+				if err != io.EOF {
+					slog.Error("Error reading frame", "client", clientID, "err", err)
+				}
 				break
 			}
-			log.Printf("Error decoding message from %s: %v", clientID, err)
-			continue
+			// A bad message never desynchronizes framing, so skip just this one
+			if err := json.Unmarshal(frame, &msg); err != nil {
+				slog.Error("Error decoding message", "client", clientID, "err", err)
+				continue
+			}
+		} else if err := decoder.Decode(&msg); err != nil {
+			// Read and syntax errors stick to the decoder, so only a
+			// well-formed message of the wrong shape can be skipped
+			var typeErr *json.UnmarshalTypeError
+			if err != io.EOF {
+				slog.Error("Error decoding message", "client", clientID, "err", err)
+			}
+			if errors.As(err, &typeErr) {
+				continue
+			}
+			break
 		}
 
 		// Update last seen
 		client.LastSeen = time.Now()
 
-		// Handle message
-		response := cm.handleMessage(msg, client)
-
-		// Send response if not a notification
-		if msg.Method != "" && response.Jsonrpc == "" {
+		// Handle message; notifications get no response
+		defaults := client.Server.defaults
+		response, ok := replyTo(msg, cm.handleMessage(msg, client))
+		if client.Server.defaults != defaults {
+			cm.keepDefaults(client)
+		}
+		if !ok {
 			continue
 		}
 
 		if err := cm.sendResponse(client, response); err != nil {
-			log.Printf("Error sending response to %s: %v", clientID, err)
+			slog.Error("Error sending response", "client", clientID, "err", err)
 			break
 		}
 	}
@@ -243,7 +454,7 @@ func (cm *ConnectionManager) handleClient(conn net.Conn) {
 	delete(cm.clients, clientID)
 	cm.clientsMu.Unlock()
 
-	log.Printf("Client disconnected: %s", clientID)
+	slog.Info("Client disconnected", "client", clientID)
 }
 
 // handleMessage routes messages to appropriate handlers
@@ -253,29 +464,126 @@ func (cm *ConnectionManager) handleMessage(msg MCPMessage, client *ClientConnect
 		return cm.handleHandoffRequest(msg, client)
 	}
 
-	// Regular message handling
-	return cm.server.handleMessage(msg)
+	// Regular message handling, in the client's session
+	return client.Server.handleMessage(msg)
 }
 
-// handleHandoffRequest processes handoff from stdio to pipe client
+// handleHandoffRequest takes over the stdio client a forwarding process
+// relays. A known session token moves the client back into the session it
+// was issued for; otherwise the client keeps its new session and gets a
+// token for it.
 func (cm *ConnectionManager) handleHandoffRequest(msg MCPMessage, client *ClientConnection) MCPMessage {
-	log.Printf("Handoff requested by %s", client.ID)
+	var request HandoffRequest
+	if len(msg.Params) > 0 {
+		if err := json.Unmarshal(msg.Params, &request); err != nil {
+			return MCPMessage{
+				Jsonrpc: "2.0",
+				ID:      msg.ID,
+				Error: &MCPError{
+					Code:    -32602,
+					Message: fmt.Sprintf("Invalid handoff request: %v", err),
+				},
+			}
+		}
+	}
+
+	status := "connected"
+	now := time.Now()
+	cm.clientsMu.Lock()
+	cm.pruneSessionTokens(now)
+	if request.SessionToken != "" {
+		issued, ok := cm.sessionTokens[request.SessionToken]
+		if !ok {
+			cm.clientsMu.Unlock()
+			return MCPMessage{
+				Jsonrpc: "2.0",
+				ID:      msg.ID,
+				Error: &MCPError{
+					Code:    -32602,
+					Message: "Unknown session token; it may have expired",
+				},
+			}
+		}
+		issued.lastUsed = now
+		resumed := cm.server.withClient(client.ID, issued.sessionID)
+		resumed.notify = client.Server.notify
+		// Defaults this connection already set win over the session's
+		resumed.defaults = client.Server.defaults
+		if resumed.defaults == (StoreDefaults{}) {
+			resumed.defaults = issued.defaults
+		}
+		client.Server = resumed
+		status = "resumed"
+	} else {
+		request.SessionToken = newSessionToken()
+		cm.sessionTokens[request.SessionToken] = &issuedToken{sessionID: client.Server.sessionID, lastUsed: now, defaults: client.Server.defaults}
+	}
+	activeClients := len(cm.clients)
+	cm.clientsMu.Unlock()
+
+	slog.Info("Handoff requested", "client", client.ID, "forwarding", request.ClientID, "session", client.Server.sessionID, "status", status)
+
+	framing := "line"
+	if client.Framed {
+		framing = "length"
+	}
+	cm.store.mu.RLock()
+	memoryCount := len(cm.store.memories)
+	cm.store.mu.RUnlock()
 
-	// Send acknowledgment
 	return MCPMessage{
 		Jsonrpc: "2.0",
 		ID:      msg.ID,
-		Result: map[string]interface{}{
-			"status": "connected",
-			"server_info": map[string]interface{}{
-				"uptime_seconds": time.Since(startTime).Seconds(),
-				"active_clients": len(cm.clients),
-				"memory_count":   len(cm.store.memories),
+		Result: HandoffResult{
+			Status:       status,
+			ClientID:     client.ID,
+			SessionID:    client.Server.sessionID,
+			SessionToken: request.SessionToken,
+			Capabilities: serverCapabilities(),
+			Framing:      framing,
+			Streaming:    client.Server.notify != nil,
+			ServerInfo: HandoffInfo{
+				UptimeSeconds: time.Since(startTime).Seconds(),
+				ActiveClients: activeClients,
+				MemoryCount:   memoryCount,
 			},
 		},
 	}
 }
 
+// pruneSessionTokens forgets tokens last used more than sessionTokenTTL ago
+// whose session has no connected client. Caller must hold clientsMu.
+func (cm *ConnectionManager) pruneSessionTokens(now time.Time) {
+	connected := make(map[string]bool, len(cm.clients))
+	for _, client := range cm.clients {
+		connected[client.Server.sessionID] = true
+	}
+	for token, issued := range cm.sessionTokens {
+		if now.Sub(issued.lastUsed) > sessionTokenTTL && !connected[issued.sessionID] {
+			delete(cm.sessionTokens, token)
+		}
+	}
+}
+
+// keepDefaults records the client's store_memory defaults with its session's
+// tokens, so a handoff resuming the session on a new connection restores them
+func (cm *ConnectionManager) keepDefaults(client *ClientConnection) {
+	cm.clientsMu.Lock()
+	defer cm.clientsMu.Unlock()
+	for _, issued := range cm.sessionTokens {
+		if issued.sessionID == client.Server.sessionID {
+			issued.defaults = client.Server.defaults
+		}
+	}
+}
+
+// newSessionToken returns an unguessable token for resuming a session
+func newSessionToken() string {
+	var token [16]byte
+	rand.Read(token[:])
+	return hex.EncodeToString(token[:])
+}
+
 // sendResponse sends a response to a client
 func (cm *ConnectionManager) sendResponse(client *ClientConnection, response MCPMessage) error {
 	responseBytes, err := json.Marshal(response)
@@ -283,9 +591,10 @@ func (cm *ConnectionManager) sendResponse(client *ClientConnection, response MCP
 		return err
 	}
 
-	client.Writer.Write(responseBytes)
-	client.Writer.WriteByte('\n')
-	return client.Writer.Flush()
+	if client.Framed {
+		return writeFrame(client.Writer, responseBytes)
+	}
+	return writeLine(client.Writer, responseBytes)
 }
 
 // Helper to track server start time
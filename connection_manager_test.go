@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test that a stream client is dropped when its writer fails
+func TestHandleStreamClientStopsOnWriteError(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+	cm := NewConnectionManager(store, &MCPServer{store: store})
+
+	reader := &repeatingReader{line: `{"jsonrpc":"2.0","id":1,"method":"tools/list"}` + "\n"}
+
+	done := make(chan struct{})
+	go func() {
+		cm.handleStreamClient("broken", reader, failingWriter{})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("handleStreamClient kept looping after write failure")
+	}
+
+	cm.clientsMu.RLock()
+	defer cm.clientsMu.RUnlock()
+	if _, exists := cm.clients["broken"]; exists {
+		t.Error("Client should be removed after write failure")
+	}
+}
+
+// Test that each shared-mode client stores and queries in its own session
+func TestClientsGetOwnSessions(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+	cm := NewConnectionManager(store, &MCPServer{store: store})
+
+	sessionResults := func(id string) string {
+		input := `{"jsonrpc":"2.0","id":1,"method":"tools/call","params":{"name":"store_memory","arguments":{"id":"` + id + `","content":"Note from ` + id + `","importance":0.5}}}` + "\n" +
+			`{"jsonrpc":"2.0","id":2,"method":"tools/call","params":{"name":"query_memories","arguments":{"query_type":"session","ids_only":true}}}` + "\n"
+		var output bytes.Buffer
+		cm.handleStreamClient(id, strings.NewReader(input), &output)
+
+		lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+		var response struct {
+			Result struct {
+				Content []struct {
+					Text string `json:"text"`
+				} `json:"content"`
+			} `json:"result"`
+		}
+		if len(lines) != 2 || json.Unmarshal([]byte(lines[1]), &response) != nil || len(response.Result.Content) != 1 {
+			t.Fatalf("Unexpected responses for %s: %q", id, output.String())
+		}
+		return strings.Join(strings.Fields(response.Result.Content[0].Text), "")
+	}
+
+	if got := sessionResults("alice"); got != `["alice"]` {
+		t.Errorf("Expected alice's session to hold only alice, got %s", got)
+	}
+	if got := sessionResults("bob"); got != `["bob"]` {
+		t.Errorf("Expected bob's session to hold only bob, got %s", got)
+	}
+}
+
+// Test round-tripping messages through a length-prefixed pipe client
+func TestLengthPrefixedFraming(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+	cm := NewConnectionManager(store, &MCPServer{store: store})
+	cm.lengthPrefixed = true
+
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	go cm.handleClient(serverConn)
+
+	reader := bufio.NewReader(clientConn)
+	writer := bufio.NewWriter(clientConn)
+	roundTrip := func(request []byte) MCPMessage {
+		t.Helper()
+		clientConn.SetDeadline(time.Now().Add(2 * time.Second))
+		if err := writeFrame(writer, request); err != nil {
+			t.Fatalf("Failed to write frame: %v", err)
+		}
+		frame, err := readFrame(reader)
+		if err != nil {
+			t.Fatalf("Failed to read frame: %v", err)
+		}
+		var response MCPMessage
+		if err := json.Unmarshal(frame, &response); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		return response
+	}
+
+	// Indented JSON spans lines, which line framing would split
+	request, _ := json.MarshalIndent(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      7,
+		"method":  "tools/call",
+		"params": map[string]interface{}{
+			"name":      "store_memory",
+			"arguments": map[string]interface{}{"id": "framed", "content": "Line one\nLine two", "importance": 0.5},
+		},
+	}, "", "  ")
+	response := roundTrip(request)
+	if response.Error != nil || fmt.Sprint(response.ID) != "7" {
+		t.Fatalf("Expected a successful response to id 7, got %+v", response)
+	}
+	if store.memories["framed"] == nil || store.memories["framed"].Content != "Line one\nLine two" {
+		t.Error("Expected the framed memory to be stored with its newline")
+	}
+
+	// A malformed message is skipped without losing the frame boundary
+	clientConn.SetDeadline(time.Now().Add(2 * time.Second))
+	if err := writeFrame(writer, []byte("not json")); err != nil {
+		t.Fatalf("Failed to write frame: %v", err)
+	}
+	response = roundTrip([]byte(`{"jsonrpc":"2.0","id":8,"method":"tools/list"}`))
+	if response.Error != nil || fmt.Sprint(response.ID) != "8" {
+		t.Errorf("Expected a successful response to id 8 after a bad frame, got %+v", response)
+	}
+
+	// A stdio client converts lines to frames and frames back to lines
+	var frames, lines bytes.Buffer
+	input := "{\"id\":1}\n\n{\"id\": 2}\n"
+	if err := linesToFrames(&frames, strings.NewReader(input)); err != nil {
+		t.Fatalf("linesToFrames failed: %v", err)
+	}
+	if err := framesToLines(&lines, &frames); err != nil {
+		t.Fatalf("framesToLines failed: %v", err)
+	}
+	if lines.String() != "{\"id\":1}\n{\"id\":2}\n" {
+		t.Errorf("Expected two compact lines back, got %q", lines.String())
+	}
+
+	if _, err := readFrame(bufio.NewReader(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff}))); err == nil {
+		t.Error("Expected an error for a frame over the size limit")
+	}
+}
+
+// Test that a framed client receives large query results in chunks that
+// reassemble into the full result set
+func TestStreamedQueryResults(t *testing.T) {
+	store := NewMemoryStore(100)
+	defer store.Shutdown()
+	cm := NewConnectionManager(store, &MCPServer{store: store})
+	cm.lengthPrefixed = true
+
+	for i := 0; i < 25; i++ {
+		store.Store(&Memory{ID: fmt.Sprintf("stream-%02d", i), Type: Semantic, Content: "Streamed note", Importance: 0.5})
+	}
+
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	go cm.handleClient(serverConn)
+
+	reader := bufio.NewReader(clientConn)
+	writer := bufio.NewWriter(clientConn)
+	clientConn.SetDeadline(time.Now().Add(2 * time.Second))
+	request := `{"jsonrpc":"2.0","id":3,"method":"tools/call","params":{"name":"query_memories","arguments":{"query_type":"type","memory_type":"semantic","ids_only":true,"chunk_size":10}}}`
+	if err := writeFrame(writer, []byte(request)); err != nil {
+		t.Fatalf("Failed to write frame: %v", err)
+	}
+
+	var ids []string
+	chunks := 0
+	for {
+		frame, err := readFrame(reader)
+		if err != nil {
+			t.Fatalf("Failed to read frame: %v", err)
+		}
+		var message MCPMessage
+		if err := json.Unmarshal(frame, &message); err != nil {
+			t.Fatalf("Failed to parse message: %v", err)
+		}
+		if message.Method != queryResultsMethod {
+			// The response follows every chunk
+			text := message.Result.(map[string]interface{})["content"].([]interface{})[0].(map[string]interface{})["text"].(string)
+			var stream QueryStream
+			if err := json.Unmarshal([]byte(text), &stream); err != nil || fmt.Sprint(message.ID) != "3" {
+				t.Fatalf("Expected a stream summary for id 3, got %s", frame)
+			}
+			if !stream.Streamed || stream.Chunks != 3 || stream.Total != 25 {
+				t.Errorf("Expected 3 chunks of 25 results, got %+v", stream)
+			}
+			break
+		}
+
+		var chunk struct {
+			RequestID int      `json:"request_id"`
+			Chunk     int      `json:"chunk"`
+			Results   []string `json:"results"`
+		}
+		if err := json.Unmarshal(message.Params, &chunk); err != nil || chunk.RequestID != 3 || chunk.Chunk != chunks {
+			t.Fatalf("Unexpected chunk %s (%v)", message.Params, err)
+		}
+		if len(chunk.Results) > 10 {
+			t.Errorf("Expected at most 10 results per chunk, got %d", len(chunk.Results))
+		}
+		ids = append(ids, chunk.Results...)
+		chunks++
+	}
+
+	sort.Strings(ids)
+	expected := make([]string, 25)
+	for i := range expected {
+		expected[i] = fmt.Sprintf("stream-%02d", i)
+	}
+	if !reflect.DeepEqual(ids, expected) {
+		t.Errorf("Expected chunks to reassemble into %v, got %v", expected, ids)
+	}
+
+	// Without a streaming transport the same query gets one response
+	server := &MCPServer{store: store}
+	var call MCPMessage
+	json.Unmarshal([]byte(request), &call)
+	response := server.handleMessage(call)
+	text := response.Result.(map[string]interface{})["content"].([]map[string]interface{})[0]["text"].(string)
+	var single []string
+	if err := json.Unmarshal([]byte(text), &single); err != nil || len(single) != 25 {
+		t.Errorf("Expected a single response with 25 IDs on stdio, got %s", text)
+	}
+}
+
+// Test that shared mode falls back to serving stdio when the pipe can't be created
+func TestPipeListenFallback(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+	cm := NewConnectionManager(store, &MCPServer{store: store})
+
+	// Listening fails because the pipe's directory does not exist
+	cm.pipePath = filepath.Join(t.TempDir(), "missing", "server.pipe")
+	cm.stdin = strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"tools/list"}` + "\n")
+	var output bytes.Buffer
+	cm.stdout = &output
+
+	done := make(chan error, 1)
+	go func() { done <- cm.Start() }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Expected the stdio fallback to run until EOF, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Start did not fall back to stdio mode")
+	}
+
+	var response MCPMessage
+	if err := json.Unmarshal(output.Bytes(), &response); err != nil || response.Error != nil {
+		t.Fatalf("Expected a tools/list response over stdio, got %q (%v)", output.String(), err)
+	}
+	if cm.isServer || cm.listener != nil {
+		t.Error("Expected no pipe server after the fallback")
+	}
+}
+
+// Test the handoff contract: a forwarding process gets capabilities and a
+// session token, and the token resumes that session on a later connection
+func TestHandoff(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+	cm := NewConnectionManager(store, &MCPServer{store: store})
+	forwarder := NewConnectionManager(store, &MCPServer{store: store})
+
+	handoff := func() (*HandoffResult, error) {
+		serverConn, clientConn := net.Pipe()
+		defer clientConn.Close()
+		go cm.handleClient(serverConn)
+		clientConn.SetDeadline(time.Now().Add(2 * time.Second))
+		_, result, err := forwarder.requestHandoff(clientConn)
+		return result, err
+	}
+
+	first, err := handoff()
+	if err != nil {
+		t.Fatalf("Handoff failed: %v", err)
+	}
+	if first.Status != "connected" || first.SessionToken == "" || first.SessionID == "" {
+		t.Errorf("Expected a new session with a token, got %+v", first)
+	}
+	if first.Capabilities.Tools == nil || first.Framing != "line" || first.Streaming {
+		t.Errorf("Expected tool capabilities over line framing without streaming, got %+v", first)
+	}
+	if forwarder.sessionToken != first.SessionToken {
+		t.Errorf("Expected the forwarder to keep token %q, got %q", first.SessionToken, forwarder.sessionToken)
+	}
+
+	// Reconnecting with the token resumes the same session
+	second, err := handoff()
+	if err != nil {
+		t.Fatalf("Resuming handoff failed: %v", err)
+	}
+	if second.Status != "resumed" || second.SessionID != first.SessionID || second.ClientID == first.ClientID {
+		t.Errorf("Expected session %s resumed on a new client, got %+v", first.SessionID, second)
+	}
+
+	// Defaults a connection set before resuming carry into the resumed session
+	preset := &ClientConnection{ID: "preset", Server: cm.server.withClient("preset", newSessionID())}
+	preset.Server.defaults = StoreDefaults{MemoryType: Episodic, Importance: 0.7}
+	params, _ := json.Marshal(HandoffRequest{ClientID: "stdio", SessionToken: first.SessionToken})
+	response := cm.handleHandoffRequest(MCPMessage{Jsonrpc: "2.0", ID: 1, Method: "handoff/request", Params: params}, preset)
+	if response.Error != nil || preset.Server.sessionID != first.SessionID {
+		t.Fatalf("Expected session %s resumed, got %+v", first.SessionID, response)
+	}
+	if preset.Server.defaults != (StoreDefaults{MemoryType: Episodic, Importance: 0.7}) {
+		t.Errorf("Expected the connection's defaults kept across the resume, got %+v", preset.Server.defaults)
+	}
+
+	forwarder.sessionToken = "bogus"
+	if _, err := handoff(); err == nil || !strings.Contains(err.Error(), "Unknown session token") {
+		t.Errorf("Expected an unknown token to be refused, got %v", err)
+	}
+
+	// A token unused past its TTL expires at the next handoff once its
+	// session's clients have gone
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		cm.clientsMu.RLock()
+		connected := len(cm.clients)
+		cm.clientsMu.RUnlock()
+		if connected == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cm.clientsMu.Lock()
+	cm.sessionTokens[first.SessionToken].lastUsed = time.Now().Add(-sessionTokenTTL - time.Minute)
+	cm.clientsMu.Unlock()
+	forwarder.sessionToken = ""
+	if _, err := handoff(); err != nil {
+		t.Fatalf("Handoff failed: %v", err)
+	}
+	cm.clientsMu.RLock()
+	_, kept := cm.sessionTokens[first.SessionToken]
+	cm.clientsMu.RUnlock()
+	if kept {
+		t.Error("Expected the expired token to be pruned")
+	}
+}
+
+// Test that a forwarding client whose server connection drops reconnects
+// with its session token and carries on in the same session
+func TestHandoffResume(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+	cm := NewConnectionManager(store, &MCPServer{store: store})
+
+	pipePath := filepath.Join(t.TempDir(), "server.pipe")
+	listener, err := net.Listen("unix", pipePath)
+	if err != nil {
+		t.Skipf("Unix sockets unavailable: %v", err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+			go cm.handleClient(conn)
+		}
+	}()
+
+	stdinReader, stdinWriter := io.Pipe()
+	stdoutReader, stdoutWriter := io.Pipe()
+	forwarder := NewConnectionManager(store, &MCPServer{store: store})
+	forwarder.pipePath = pipePath
+	forwarder.stdin = stdinReader
+	forwarder.stdout = stdoutWriter
+	replies := bufio.NewReader(stdoutReader)
+
+	conn, err := net.DialTimeout("unix", pipePath, connectionTimeout)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- forwarder.runAsClient(conn) }()
+
+	call := func(request string) string {
+		t.Helper()
+		result := make(chan string, 1)
+		go func() {
+			stdinWriter.Write([]byte(request + "\n"))
+			line, _ := replies.ReadString('\n')
+			result <- line
+		}()
+		select {
+		case line := <-result:
+			return line
+		case <-time.After(2 * time.Second):
+			t.Fatalf("No reply to %s", request)
+			return ""
+		}
+	}
+	// sessionOf waits for the connection's handoff, after which its session has a token
+	sessionOf := func(clientConn net.Conn) string {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			cm.clientsMu.RLock()
+			for _, client := range cm.clients {
+				for _, issued := range cm.sessionTokens {
+					if client.Conn == clientConn && issued.sessionID == client.Server.sessionID {
+						cm.clientsMu.RUnlock()
+						return issued.sessionID
+					}
+				}
+			}
+			cm.clientsMu.RUnlock()
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatal("Client never handed off")
+		return ""
+	}
+
+	first := <-accepted
+	if reply := call(`{"jsonrpc":"2.0","id":1,"method":"tools/call","params":{"name":"store_memory","arguments":{"id":"before","content":"Stored before the drop","importance":0.5}}}`); !strings.Contains(reply, `"id":1`) {
+		t.Fatalf("Unexpected store reply %q", reply)
+	}
+	session := sessionOf(first)
+	if reply := call(`{"jsonrpc":"2.0","id":3,"method":"tools/call","params":{"name":"set_client_defaults","arguments":{"memory_type":"semantic"}}}`); !strings.Contains(reply, `"id":3`) || strings.Contains(reply, `"error"`) {
+		t.Fatalf("Unexpected set_client_defaults reply %q", reply)
+	}
+
+	// The server drops the connection; the forwarder reconnects and resumes
+	first.Close()
+	var second net.Conn
+	select {
+	case second = <-accepted:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Forwarder did not reconnect")
+	}
+	if resumed := sessionOf(second); resumed != session {
+		t.Fatalf("Expected session %s resumed, got %s", session, resumed)
+	}
+	reply := call(`{"jsonrpc":"2.0","id":2,"method":"tools/call","params":{"name":"query_memories","arguments":{"query_type":"session","ids_only":true}}}`)
+	if !strings.Contains(reply, `\"before\"`) {
+		t.Errorf("Expected the resumed session to find its earlier memory, got %q", reply)
+	}
+	call(`{"jsonrpc":"2.0","id":4,"method":"tools/call","params":{"name":"store_memory","arguments":{"id":"after","content":"Stored after the resume"}}}`)
+	if after, err := store.GetByID("after"); err != nil || after.Type != Semantic {
+		t.Errorf("Expected the session's defaults to survive the reconnect, got %+v, %v", after, err)
+	}
+
+	stdinWriter.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected the forwarder to stop cleanly at EOF, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Forwarder did not stop at EOF")
+	}
+}
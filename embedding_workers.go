@@ -0,0 +1,143 @@
+package main
+
+// embeddingJob is a queued embedding index update for one memory
+type embeddingJob struct {
+	id        string
+	embedding []float32
+	seq       uint64 // applied only if still the memory's latest queued update
+}
+
+// startEmbeddingWorkers switches the embedding index to asynchronous updates
+// processed by a pool of workers. Normalizing and quantizing then happen off
+// the write path; a store only blocks when queueSize updates are already
+// waiting, which bounds memory during a burst.
+func (ms *MemoryStore) startEmbeddingWorkers(workers, queueSize int) {
+	ei := ms.embeddingIndex
+	ei.queue = make(chan embeddingJob, queueSize)
+	ei.pending = make(map[string]uint64)
+	for range workers {
+		go ms.runEmbeddingWorker()
+	}
+}
+
+// runEmbeddingWorker applies queued updates until shutdown
+func (ms *MemoryStore) runEmbeddingWorker() {
+	ei := ms.embeddingIndex
+	defer func() {
+		// Wake DrainIndexing callers, which stop waiting once shut down
+		ei.mu.Lock()
+		ei.drained.Broadcast()
+		ei.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case job := <-ei.queue:
+			ei.apply(job)
+		case <-ms.ctx.Done():
+			return
+		}
+	}
+}
+
+// indexEmbedding replaces the memory's entry in the embedding index, on a
+// worker when asynchronous indexing is enabled. Until a queued update lands,
+// queries keep seeing the memory's previous embedding, if any.
+func (ms *MemoryStore) indexEmbedding(memory *Memory) {
+	ei := ms.embeddingIndex
+	if ei.queue == nil || memory.Embedding == nil {
+		ei.put(memory.ID, memory.Embedding)
+		return
+	}
+
+	ei.mu.Lock()
+	ei.seq++
+	job := embeddingJob{id: memory.ID, embedding: memory.Embedding, seq: ei.seq}
+	ei.pending[memory.ID] = job.seq
+	ei.queued++
+	ei.mu.Unlock()
+
+	select {
+	case ei.queue <- job:
+	case <-ms.ctx.Done():
+		ei.mu.Lock()
+		ei.finishJob()
+		ei.mu.Unlock()
+	}
+}
+
+// DrainIndexing blocks until every queued embedding update has been applied,
+// or the store shuts down. It returns at once when indexing is synchronous.
+func (ms *MemoryStore) DrainIndexing() {
+	ei := ms.embeddingIndex
+	ei.mu.Lock()
+	defer ei.mu.Unlock()
+
+	for ei.queued > 0 && ms.ctx.Err() == nil {
+		ei.drained.Wait()
+	}
+}
+
+// put synchronously replaces id's entry with the prepared embedding, or drops
+// it when embedding is nil, superseding any queued update
+func (ei *EmbeddingIndex) put(id string, embedding []float32) {
+	ei.mu.Lock()
+	defer ei.mu.Unlock()
+
+	ei.remove(id)
+	if embedding != nil {
+		vector, quantized := ei.prepare(embedding)
+		ei.store(id, vector, quantized)
+	}
+}
+
+// apply stores a queued update unless a later update or removal superseded it
+func (ei *EmbeddingIndex) apply(job embeddingJob) {
+	// Prepare outside the lock so workers run in parallel
+	vector, quantized := ei.prepare(job.embedding)
+
+	ei.mu.Lock()
+	defer ei.mu.Unlock()
+
+	if ei.pending[job.id] == job.seq {
+		ei.remove(job.id)
+		ei.store(job.id, vector, quantized)
+	}
+	ei.finishJob()
+}
+
+// finishJob counts a queued update as done, waking DrainIndexing callers
+// when none remain. Caller must hold ei.mu.
+func (ei *EmbeddingIndex) finishJob() {
+	ei.queued--
+	if ei.queued == 0 {
+		ei.drained.Broadcast()
+	}
+}
+
+// prepare converts an embedding to the form the index scores: normalized for
+// cosine, then quantized when enabled
+func (ei *EmbeddingIndex) prepare(embedding []float32) ([]float32, QuantizedVector) {
+	// Cosine embeddings are normalized up front so scoring is a dot product
+	prepared := ei.metric.prepare(embedding)
+	if ei.quantize {
+		return nil, quantizeVector(prepared)
+	}
+	return prepared, QuantizedVector{}
+}
+
+// store saves a prepared vector. Caller must hold ei.mu.
+func (ei *EmbeddingIndex) store(id string, vector []float32, quantized QuantizedVector) {
+	if ei.quantize {
+		ei.quantized[id] = quantized
+	} else {
+		ei.embeddings[id] = vector
+	}
+}
+
+// remove drops id's entry and any queued update for it. Caller must hold ei.mu.
+func (ei *EmbeddingIndex) remove(id string) {
+	delete(ei.embeddings, id)
+	delete(ei.quantized, id)
+	delete(ei.pending, id)
+}
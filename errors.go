@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Error categories, matched with errors.Is and mapped to JSON-RPC error codes
+var (
+	ErrNotFound    = errors.New("not found")
+	ErrDuplicateID = errors.New("duplicate ID")
+	ErrValidation  = errors.New("validation failed")
+	ErrCapacity    = errors.New("capacity exceeded")
+	ErrConflict    = errors.New("version conflict")
+	ErrReadOnly    = errors.New("read-only")
+)
+
+// JSON-RPC error codes; the server-defined range is -32000 to -32099
+const (
+	errCodeInvalidParams = -32602
+	errCodeInternal      = -32603
+	errCodeNotFound      = -32001
+	errCodeCapacity      = -32003
+	errCodeConflict      = -32004
+	errCodeReadOnly      = -32005
+	errCodeDuplicateID   = -32006
+
+	// MCP's code for resources/read of a resource that doesn't exist
+	errCodeResourceNotFound = -32002
+)
+
+// categorizedError keeps its own message while matching a category with errors.Is
+type categorizedError struct {
+	category error
+	err      error
+}
+
+func (e *categorizedError) Error() string   { return e.err.Error() }
+func (e *categorizedError) Unwrap() []error { return []error{e.category, e.err} }
+
+// errorf formats an error that belongs to category
+func errorf(category error, format string, args ...interface{}) error {
+	return &categorizedError{category: category, err: fmt.Errorf(format, args...)}
+}
+
+// errorCode maps an error to the JSON-RPC code reported for it
+func errorCode(err error) int {
+	switch {
+	case errors.Is(err, ErrValidation):
+		return errCodeInvalidParams
+	case errors.Is(err, ErrNotFound):
+		return errCodeNotFound
+	case errors.Is(err, ErrDuplicateID):
+		return errCodeDuplicateID
+	case errors.Is(err, ErrCapacity):
+		return errCodeCapacity
+	case errors.Is(err, ErrConflict):
+		return errCodeConflict
+	case errors.Is(err, ErrReadOnly):
+		return errCodeReadOnly
+	default:
+		return errCodeInternal
+	}
+}
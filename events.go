@@ -0,0 +1,125 @@
+package main
+
+import "slices"
+
+// EventListener receives store lifecycle events, for programs that embed the
+// store directly rather than serving it over MCP. Callbacks run after the
+// store lock is released, so a listener may call back into the store, but
+// they run on the goroutine that made the change (including the background
+// decay and consolidation processes) and should return quickly. Memories are
+// passed as copies taken when the event happened.
+type EventListener interface {
+	// OnStore is called after a memory is inserted or updated in place
+	OnStore(memory Memory)
+	// OnQuery is called after a successful query with the IDs it returned
+	OnQuery(criteria QueryCriteria, ids []string)
+	// OnEvict is called after a memory is evicted for capacity or removed by decay
+	OnEvict(event RemovalEvent)
+	// OnConsolidate is called after consolidation promotes a short_term memory
+	OnConsolidate(memory Memory, from MemoryType)
+}
+
+// NopEventListener implements every EventListener method as a no-op. Embed it
+// to handle only the events you care about.
+type NopEventListener struct{}
+
+func (NopEventListener) OnStore(Memory)                   {}
+func (NopEventListener) OnQuery(QueryCriteria, []string)  {}
+func (NopEventListener) OnEvict(RemovalEvent)             {}
+func (NopEventListener) OnConsolidate(Memory, MemoryType) {}
+
+// AddEventListener registers a listener for all subsequent events
+func (ms *MemoryStore) AddEventListener(listener EventListener) {
+	ms.eventsMu.Lock()
+	defer ms.eventsMu.Unlock()
+
+	ms.listeners = append(ms.listeners, listener)
+}
+
+// queueEvent holds an event until the operation producing it releases the
+// store lock. Only the holder of the write lock queues, so the pending list
+// holds just that operation's events. It does nothing when no listener is
+// registered. Caller must hold ms.mu for writing.
+func (ms *MemoryStore) queueEvent(event func(EventListener)) {
+	ms.eventsMu.Lock()
+	hasListeners := len(ms.listeners) > 0
+	ms.eventsMu.Unlock()
+
+	if hasListeners {
+		ms.pendingEvents = append(ms.pendingEvents, event)
+	}
+}
+
+// unlockAndFlush releases the write lock and then delivers the events the
+// operation queued while holding it. Operations that queue events defer it
+// in place of ms.mu.Unlock, so their events are taken before another writer
+// can queue any and are delivered on their own goroutine once ms.mu is free.
+func (ms *MemoryStore) unlockAndFlush() {
+	events := ms.pendingEvents
+	ms.pendingEvents = nil
+	ms.mu.Unlock()
+
+	ms.deliverEvents(events)
+}
+
+// discardEvents drops the events queued so far by an operation that is
+// undoing its changes. Caller must hold ms.mu for writing.
+func (ms *MemoryStore) discardEvents() {
+	ms.pendingEvents = nil
+}
+
+// deliverEvents calls every listener with each event in order
+func (ms *MemoryStore) deliverEvents(events []func(EventListener)) {
+	if len(events) == 0 {
+		return
+	}
+
+	ms.eventsMu.Lock()
+	listeners := ms.listeners
+	ms.eventsMu.Unlock()
+
+	for _, event := range events {
+		for _, listener := range listeners {
+			event(listener)
+		}
+	}
+}
+
+// eventSnapshot deep-copies a memory for use outside the lock, leaving out
+// the unexported index caches and history, so listeners never share slices
+// or maps with the live memory. Caller must hold ms.mu.
+func eventSnapshot(mem *Memory) Memory {
+	snapshot := *mem
+	snapshot.Embedding = slices.Clone(mem.Embedding)
+	snapshot.Relations = slices.Clone(mem.Relations)
+	if mem.Metadata != nil {
+		snapshot.Metadata = deepCopyValue(mem.Metadata).(map[string]interface{})
+	}
+	snapshot.keywords = nil
+	snapshot.metadataKeywords = nil
+	snapshot.tags = nil
+	snapshot.history = nil
+	return snapshot
+}
+
+// deepCopyValue copies the maps and slices of a decoded JSON-like value
+func deepCopyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for key, child := range v {
+			copied[key] = deepCopyValue(child)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, child := range v {
+			copied[i] = deepCopyValue(child)
+		}
+		return copied
+	case []string:
+		return slices.Clone(v)
+	default:
+		return v
+	}
+}
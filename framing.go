@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// maxFrameBytes bounds a length-prefixed message so a corrupt header cannot
+// make the reader allocate unbounded memory
+const maxFrameBytes = 64 << 20
+
+// readFrame reads one length-prefixed message: a 4-byte big-endian length
+// followed by that many bytes of JSON. Unlike line framing, the body may
+// contain newlines. An oversized length is an error the stream cannot
+// recover from, since the next frame boundary is unknown.
+func readFrame(reader *bufio.Reader) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[:])
+	if size > maxFrameBytes {
+		return nil, fmt.Errorf("frame of %d bytes exceeds limit of %d", size, maxFrameBytes)
+	}
+
+	body := make([]byte, size)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return body, nil
+}
+
+// writeFrame writes a length-prefixed message and flushes it
+func writeFrame(writer *bufio.Writer, data []byte) error {
+	if len(data) > maxFrameBytes {
+		return fmt.Errorf("frame of %d bytes exceeds limit of %d", len(data), maxFrameBytes)
+	}
+
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(data)))
+	if _, err := writer.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := writer.Write(data); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// linesToFrames forwards newline-delimited messages from src as frames on
+// dst, for a stdio client talking to a length-prefixed server
+func linesToFrames(dst io.Writer, src io.Reader) error {
+	reader := bufio.NewReader(src)
+	writer := bufio.NewWriter(dst)
+	for {
+		line, err := reader.ReadString('\n')
+		if message := strings.TrimSpace(line); message != "" {
+			if err := writeFrame(writer, []byte(message)); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// framesToLines forwards frames from src as newline-delimited messages on dst
+func framesToLines(dst io.Writer, src io.Reader) error {
+	reader := bufio.NewReader(src)
+	writer := bufio.NewWriter(dst)
+	for {
+		frame, err := readFrame(reader)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		// Line framing cannot carry raw newlines, so strip insignificant whitespace
+		var line bytes.Buffer
+		if err := json.Compact(&line, frame); err != nil {
+			return fmt.Errorf("invalid message from server: %w", err)
+		}
+		if err := writeLine(writer, line.Bytes()); err != nil {
+			return err
+		}
+	}
+}
@@ -18,7 +18,15 @@ Run the server with --enable-sharing flag to allow multiple clients to share the
 1. **First Client**: Starts the server and creates a named pipe at /tmp/mcp-memory-server.pipe
 2. **Additional Clients**: Automatically detect the running server and connect via the pipe
 3. **Shared Memory**: All clients access the same in-memory store
-4. **Handoff Protocol**: Clients announce themselves and can transfer connections
+4. **Handoff Protocol**: A connecting process first sends a handoff/request
+   and waits for the result before forwarding its stdio client. The result
+   carries the server's capabilities, the pipe framing, whether query results
+   can stream, the client's session_id, and a session_token. Sending that
+   token in a later handoff/request ({"client_id", "session_token"}) resumes
+   the same session, so memories stored after a reconnect stay in it. A
+   forwarding process whose pipe connection drops reconnects and resumes
+   this way. Tokens expire 24 hours after their last handoff once no client
+   is connected to their session; an expired token starts a new session.
 
 ### Benefits
 - Share memories between Claude Desktop and Claude Code
@@ -84,31 +92,126 @@ Required parameters:
 - content: The information to store
 
 Optional parameters:
-- importance: 0.0-1.0 score (default: 0.5)
+- importance: 0.0-1.0 score (default: 0.5). Out-of-range values are
+  reset to 0.5 unless the server runs with --importance-overflow clamp or reject
   - 0.9-1.0: Critical (passwords, key preferences)
   - 0.7-0.8: Important (project details)
   - 0.5-0.6: Useful (general interests)
   - 0.1-0.4: Minor (small talk)
 - metadata: JSON object with additional context
+  - String values and a "tags" string array are indexed for search
+  - Limited to 64KB serialized and 8 levels of nesting by default
+    (--max-metadata-bytes, --max-metadata-depth)
+- decay: 0.0-1.0 importance lost per hour without access (default: 0.01),
+  counted once the grace period after an access (--decay-grace-period, default
+  1h) has passed
+  - Raise for volatile facts, lower for durable ones
+- id: Caller-chosen ID (generated when omitted). With --id-mode content the
+  generated ID is a hash of the content, so storing the same content again
+  fails as a duplicate, or updates the existing memory with upsert
+- upsert: true to update the memory with this id instead of failing on duplicates
+  - Useful when replaying events; access history is kept
+- expected_version: With upsert, only update if the memory's version still
+  matches. Every memory has a version that starts at 1 and increases on each
+  update, promotion, or demotion, so shared clients don't overwrite each
+  other's changes
+- session_id: Session recorded in metadata.session_id. Each connection gets
+  its own session automatically, so this is only needed to file a memory
+  under a different one
 
 ### query_memories
 Retrieves memories using different strategies.
 
 Required parameters:
 - query_type: Search strategy
-  - keywords: Search content for terms
+  - keywords: Search content for terms (with --identifier-tokens,
+    names like user_id or config.yaml are single terms). Needs at least one
+    keyword; a server started with --empty-keyword-query all instead
+    returns every memory up to limit, most important first
   - type: Get all of specific type
   - temporal: Find within time range
   - related: Traverse relationships
-  - similarity: Vector similarity (if embeddings)
+  - related_keywords: Traverse relationships, keep only memories matching
+    keywords; needs at least one keyword
+  - relation_type: Memories linked by a relation type (e.g. solved_by)
+  - session: Memories stored in a session, oldest first ("what did I learn
+    this session"); defaults to the current connection's session
+  - similarity: Vector similarity (if embeddings), scored with the server's
+    --similarity-metric (cosine by default)
+  - similar_to_id: Nearest neighbors of memory_id by its stored embedding,
+    excluding the memory itself
+  - phrase: Memories containing phrase's words adjacent and in order, or
+    with within set, in any order with the first and last at most within
+    positions apart; a repeated word must occur that many times. Words
+    under 3 characters are skipped but keep their place. Only on servers
+    started with --positional-index
+
+  Similarity queries given keywords or memory_type rank only the memories
+  matching any keyword and that type, which is faster and more relevant
+  than ranking every embedding.
 
 Optional parameters:
 - keywords: Array of search terms
 - memory_type: Filter by type
+- memory_types: For type queries, an array of types returned together
+  (e.g. ["semantic", "procedural"]), most important first and cut to limit
 - limit: Max results (default: 10)
-- start_time/end_time: For temporal queries
-- memory_id: Starting point for related queries
-- depth: Traversal depth for related queries
+- start_time/end_time: For temporal queries; both bounds are inclusive
+- memory_id: Starting point for related and similar_to_id queries
+- depth: Traversal depth for related queries; depths above the server's
+  --max-related-depth (default 10) are clamped to it
+- relation_type: Relation type for relation_type queries
+- session_id: Session for session queries (default: the current session)
+- phrase/within: For phrase queries, the words to find and how far apart
+  they may be (default within: 0, adjacent)
+- snippet: true to return short excerpts with **matches** marked instead of full content
+- snippet_length: Max characters excerpted per memory (default: 160)
+- importance_weight: 0.0-1.0 blend of importance into similarity ranking
+  (score = similarity*(1-w) + importance*w, default: 0); only with the
+  cosine --similarity-metric, whose scores share importance's scale
+- include_relations: true to attach each result's outbound relations (default: false)
+- ids_only: true to return just an array of matching memory IDs, skipping
+  content, embeddings, and metadata; cheapest way to list matches
+  (overrides snippet and include_relations)
+- chunk_size: Over a length-prefixed pipe connection (--pipe-framing length),
+  stream results larger than this in notifications/query_results
+  notifications ({"request_id", "chunk", "results"}) before a response of
+  {"streamed": true, "chunks", "total"}; ignored on stdio and line-framed
+  connections, which always get a single response
+- count_only: true to return just {"count": n}, the number of matches, e.g.
+  how many memories mention a keyword. Keyword and single-type counts come
+  straight from the indexes and are not capped by limit; counting never
+  records an access (overrides every other output option)
+- since_version: Only return memories created or updated (content, type,
+  embedding, decay, pinning, or outbound relations) after this store version.
+  Every query_memories response carries the current version in
+  _meta.store_version, read before the query runs, so passing it back next
+  time syncs just the delta. Decay and accesses don't count as changes, and
+  removed memories aren't reported; compare total_memories in get_stats
+
+### search
+The "just find relevant stuff" entry point. Tokenizes free text and matches
+it against content, string metadata values, and tags together.
+
+Required parameters:
+- query: Free text
+
+Optional parameters:
+- limit: Maximum results (default: 10)
+
+Results are ranked by matching terms, weighting tag matches above content
+matches above metadata matches, and report which surfaces matched.
+
+### query_similar_batch
+Finds the nearest memories for several embeddings with a single scan.
+
+Required parameters:
+- embeddings: Array of query vectors
+
+Optional parameters:
+- limit: Max results per vector (default: 10)
+
+Returns one result list per embedding, in request order.
 
 ### create_relation
 Links memories with typed relationships.
@@ -121,6 +224,9 @@ Required parameters:
 Optional parameters:
 - strength: 0.0-1.0 (default: 0.5)
 
+A memory cannot be related to itself unless the server runs with
+--allow-self-relations. Related queries never return the seed memory.
+
 Relation types:
 - related_to: General association
 - leads_to: Causal/temporal sequence
@@ -128,14 +234,314 @@ Relation types:
 - influences: Affects handling
 - part_of: Component relationship
 
+### create_relations
+Creates many relations in one call, e.g. linking a hub memory to all its
+details. Takes a "relations" array whose items have the create_relation
+parameters. Each relation succeeds or fails on its own; the result lists a
+status (and error, if any) per relation, in order.
+
+### delete_relation
+Removes relationships between two memories.
+
+Required parameters:
+- from_id: Source memory ID
+- to_id: Target memory ID
+
+Optional parameters:
+- relation_type: Only remove relations of this type
+
+### list_memory_types
+Lists the five memory types, each with a short description, an example, and
+the recommended importance range and decay rate for store_memory. Also
+reports how many memories of each type are stored, and any per-type
+capacity, policy, importance floor, or consolidation target the server
+sets. A type with the reject policy refuses new memories once full, and its
+memories are never evicted to make room. Call it first to choose a type
+without reading this whole guide.
+
 ### get_stats
 Returns system statistics. No parameters required.
 
 Returns:
 - total_memories: Count of all memories
+- store_version: Incremented on every change, including removals; see
+  since_version in query_memories
 - by_type: Breakdown by memory type
 - total_relations: Number of relationships
 - capacity_used: Percentage of max capacity
+- pending_embeddings: With --index-workers, embedding updates not yet indexed;
+  similarity queries don't see these memories until they are
+- capacity_warning: Whether usage is at or above the warning threshold
+  (--capacity-warning, default 90%) and how many times it has been crossed
+
+### aging_report
+Lists memories whose importance will fall below the removal threshold
+(--decay-removal-threshold, default 0.1)
+within a time horizon if they are not accessed again. Types with an
+--importance-floor at or above the threshold never appear.
+
+Optional parameters:
+- horizon_hours: How far ahead to project (default: 24)
+
+Returns each fading memory with its projected importance and hours until
+removal, soonest first. Projections follow the decay ticks
+(--decay-interval), each of which subtracts the decay rate times the hours
+since last access, so losses grow the longer a memory goes untouched. Query
+or re-store memories worth keeping.
+
+### export_memories / import_memories
+Move memories between servers or keep a backup. export_memories writes one
+JSON memory per line to a file, so very large stores stream out without one
+huge response and the file is easy to grep or split. import_memories stores
+each line of such a file and stops at the first invalid line or duplicate ID.
+Both work only on servers started with --export-dir, and only on files
+inside that directory.
+
+Required parameters:
+- path: File to write or read, relative to the export directory
+
+Optional parameters:
+- overwrite: For export_memories, replace an existing file (default: false,
+  an existing file is an error)
+
+Returns the path and the number of memories written or imported.
+
+### snapshot / restore_snapshot
+Back up the whole store inline, for clients that keep the backup themselves
+rather than on the server's disk. snapshot returns every memory and relation
+as of one moment along with the store_version. restore_snapshot replaces
+everything in the store with a snapshot's contents. It checks the snapshot
+first, so a bad one leaves the store untouched.
+
+snapshot optional parameters:
+- compress: Return the snapshot gzipped and base64-encoded in data instead
+  of as JSON in snapshot (default: false)
+
+restore_snapshot parameters (exactly one):
+- snapshot: Snapshot as returned uncompressed
+- data: Snapshot as returned compressed
+
+### persist
+Forces a durable write before a risky operation or disconnect. Writes a
+snapshot to the file named by the server's --snapshot-path, which the
+server restores at startup. The new file replaces the old one only once it
+is fully written, and concurrent calls run one at a time. Fails if the
+server has no snapshot path.
+
+Returns the path, the bytes written, and the memories, relations, and
+store_version captured.
+
+### memory_lineage
+Explains a memory's journey for debugging: creation, updates, promotion by
+consolidation, and access milestones (1st, 10th, 100th, ... access), along
+with current access stats and projected hours until decay removes it.
+Only the most recent 20 events are kept.
+
+Required parameters:
+- memory_id: Memory ID
+
+### touch_memory
+Marks a memory as recently relevant so decay spares it, without returning
+its content. Counts as one access.
+
+Required parameters:
+- memory_id: Memory ID
+
+Returns the memory's new access_count and last_access.
+
+### promote_memory / demote_memory
+Move a memory between types without waiting for consolidation, e.g. promote
+a short_term fact you know will matter, or demote one that turned out to be
+temporary. Consolidation may promote a demoted short_term memory again if it
+is still important or frequently accessed.
+
+Required parameters:
+- memory_id: Memory ID
+
+Optional parameters:
+- target_type: Type to move to (default: long_term for promote, short_term
+  for demote). Promotion must move to a longer-lived type, in the order
+  short_term, episodic, long_term, semantic, procedural, and demotion to a
+  shorter-lived one.
+- decay: New decay rate (0-1, 0 never decays); omitted takes the target
+  type's recommended rate
+
+Returns the updated memory.
+
+### bulk_adjust
+Applies one operation to every memory matching a filter in a single pass,
+e.g. pin all semantic memories or slow the decay of old episodic ones.
+Pinned memories never decay and are never evicted; a store or type whose
+memories are all pinned rejects new memories at capacity.
+
+Required parameters:
+- operation: set_decay, scale_importance, pin, or unpin
+- value: New decay rate (0-1) for set_decay, or the importance multiplier for
+  scale_importance (results are clamped to 0-1)
+
+Optional parameters (all set filters must match):
+- memory_type: Only this type
+- keywords: Only memories matching any of these keywords
+- older_than_hours: Only memories created more than this many hours ago
+
+Returns the operation and the count of memories it changed.
+
+### set_embedding
+Attaches an embedding to a memory stored without one, or replaces or clears
+it, for clients that compute embeddings after storing content. The memory
+becomes findable by similarity and similar_to_id queries.
+
+Required parameters:
+- memory_id: Memory ID
+- embedding: Vector with the same dimension as other stored embeddings, or
+  an empty array to clear it
+
+Returns the memory_id, the new dimension (0 when cleared), and the version.
+
+### set_client_defaults
+Sets the memory type and importance store_memory uses for this client when
+a call leaves them out, e.g. procedural for a coding agent and episodic for
+a chat agent sharing one server. Each call replaces both defaults. The same
+object can be sent when connecting, as memoryDefaults in the initialize
+params.
+
+Optional parameters:
+- memory_type: Default type (omitted falls back to short_term)
+- importance: Default importance (0-1), also used when store_memory passes
+  importance 0 (omitted falls back to 0)
+
+Returns the defaults now in effect.
+
+### memory_cluster
+Loads a whole topic in one call: the seed memory, the memories related to
+it, the relations among them, and aggregate stats.
+
+Required parameters:
+- memory_id: Seed memory ID
+
+Optional parameters:
+- depth: Traversal depth, as for related queries (default: 2)
+
+Returns members (seed first), edges, count, average_importance, and
+dominant_type.
+
+### list_keywords
+Lists the indexed keywords and how many memories contain each, useful for
+discovering what the store knows before querying.
+
+Optional parameters:
+- prefix: Only keywords starting with this prefix
+- limit: Maximum keywords to return (default: all)
+- sort: "frequency" (default, most common first) or "alphabetical"
+
+### keyword_cooccurrence
+Lists the keywords that most often appear in the same memories as a given
+keyword, for topic discovery: follow a companion keyword with a keywords
+query to explore a related concept.
+
+Required parameters:
+- keyword: Keyword to find companions for (case-insensitive)
+
+Optional parameters:
+- limit: Maximum keywords to return (default: 10, at most 100)
+
+Returns keywords with the number of memories they share, most shared first.
+
+### find_orphans
+Lists memories with no relation to or from any other memory, oldest first,
+for graph hygiene: link them with create_relation so related queries can
+reach them, or let unimportant ones go.
+
+Optional parameters:
+- limit: Maximum orphans to return (default: all)
+
+Returns the orphans and the total number of orphans.
+
+### find_hubs
+Lists the most connected memories, ranked by how many relations point to or
+from them. These are the central concepts of the knowledge graph; relating
+new memories to them makes related queries more useful.
+
+Optional parameters:
+- limit: Maximum hubs to return (default: 10)
+
+Returns each hub with its outbound, inbound, and total (degree) relation counts.
+
+### compare_memories
+Computes the cosine similarity of two stored memories' embeddings, from -1
+(opposite) to 1 (same direction), regardless of --similarity-metric. Use it
+to decide whether two memories are close enough to link with create_relation.
+
+Required parameters:
+- id_a: ID of the first memory
+- id_b: ID of the second memory
+
+Returns both IDs and the similarity. Fails if either memory has no
+embedding or the embeddings differ in dimension.
+
+### suggest_relations
+Suggests relations from a memory to its nearest embedding neighbors, without
+creating them. Memories already related to it in either direction are left
+out. Review the candidates and link the right ones with create_relations.
+
+Required parameters:
+- memory_id: Memory to find relation candidates for (must have an embedding)
+
+Optional parameters:
+- threshold: Minimum cosine similarity, -1 to 1 (default: 0.8). An explicit
+  0 is used as given, admitting orthogonal neighbors
+- limit: Maximum suggestions (default: 5)
+
+Returns candidate IDs with their similarity, most similar first.
+
+### reload_config
+Changes runtime settings without restarting, so shared memories survive.
+Omitted parameters keep their current value.
+
+Optional parameters:
+- max_memories: Capacity (lowering it evicts least important memories)
+- decay_interval / consolidation_interval: Go durations such as "5m"
+- access_half_life: Go duration such as "24h"
+- consolidation_access_threshold / consolidation_importance_threshold
+
+Returns the settings now in effect.
+
+### rebuild_indexes
+Admin recovery tool. Rebuilds the type, time, keyword, and embedding indexes
+from the stored memories, in case they have drifted out of sync. No
+parameters required. Blocks other requests while it runs.
+
+Returns counts of memories, keywords, time buckets, and embeddings indexed.
+
+### health
+Cheap probe for orchestration. No parameters required, and it still answers
+while the server is shutting down.
+
+Returns:
+- live: Always true while the process responds
+- ready: Whether the store is accepting work
+- shutting_down, memory_count, max_memories, heap_mb
+- reasons: Why the store is not ready (shutting down, full with on-full
+  reject, or heap above the memory limit)
+
+## Error Codes
+
+Tool errors carry a JSON-RPC code telling you what went wrong:
+- -32602: Invalid arguments; fix the request before retrying
+- -32001: A referenced memory or relation does not exist
+- -32003: The store is full and configured to reject new memories
+- -32004: The memory changed since you read it (expected_version mismatch);
+  re-read it and retry
+- -32005: The server is read-only; queries work but nothing can be changed
+- -32006: A memory with that ID already exists (use upsert to update it),
+  or, with content normalization on, one with the same content does (the
+  message names it)
+- -32603: Anything else
+
+Resource reads (resources/read) try the fixed URIs first, then the templates
+(memory://memory/{id}, memory://type/{type}). A URI matching neither, or a
+templated memory that doesn't exist, fails with MCP's resource-not-found code
+-32002 (servers started with --legacy-resource-errors use -32602 and -32001).
 
 ## Best Practices
 
@@ -149,7 +555,8 @@ Returns:
 
 ### What NOT to Remember
 ✗ Sensitive data (passwords, keys, PII)
-✗ Large code blocks or file contents
+✗ Large code blocks or file contents (content over the server's
+  length limit, when one is set, is rejected or truncated)
 ✗ Information user asks to forget
 ✗ Low-value repetitive data
 
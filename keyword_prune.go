@@ -0,0 +1,86 @@
+package main
+
+import (
+	"log/slog"
+	"slices"
+	"sort"
+	"time"
+)
+
+// keywordPruneLogLimit caps how many noise keywords a pass names in its log
+const keywordPruneLogLimit = 20
+
+// KeywordPruneReport lists the noise keywords one pass found: those indexed
+// for a single memory whose importance is below the threshold
+type KeywordPruneReport struct {
+	Keywords []string `json:"keywords"`
+	Pruned   bool     `json:"pruned"`
+}
+
+// Keyword pruning process with graceful shutdown
+func (ms *MemoryStore) startKeywordPruneProcess() {
+	ticker := time.NewTicker(ms.keywordPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			report := ms.PruneKeywords(ms.keywordPrune == "report")
+			if len(report.Keywords) == 0 {
+				continue
+			}
+			sample := report.Keywords[:min(len(report.Keywords), keywordPruneLogLimit)]
+			slog.Info("Noise keywords", "count", len(report.Keywords), "pruned", report.Pruned, "sample", sample)
+		case <-ms.ctx.Done():
+			return
+		}
+	}
+}
+
+// PruneKeywords finds content keywords indexed for exactly one memory that
+// is unpinned and below the prune importance, such as random IDs and typos,
+// and unless reportOnly drops them from the keyword and positional indexes
+// and from the memory's own keywords. The memories are kept and a rebuild
+// restores their keywords. A read-only store only reports. Keywords are
+// returned sorted.
+func (ms *MemoryStore) PruneKeywords(reportOnly bool) KeywordPruneReport {
+	if ms.readOnly.Load() {
+		reportOnly = true
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.keywordIndex.mu.Lock()
+	defer ms.keywordIndex.mu.Unlock()
+
+	report := KeywordPruneReport{Keywords: []string{}, Pruned: !reportOnly}
+	owners := make(map[*Memory][]string)
+	for keyword, memories := range ms.keywordIndex.index {
+		if memories.len() != 1 {
+			continue
+		}
+		memories.each(func(mem *Memory) {
+			if !mem.Pinned && mem.Importance < ms.keywordPruneImportance {
+				report.Keywords = append(report.Keywords, keyword)
+				owners[mem] = append(owners[mem], keyword)
+			}
+		})
+	}
+	sort.Strings(report.Keywords)
+
+	if reportOnly || len(report.Keywords) == 0 {
+		return report
+	}
+	for mem, keywords := range owners {
+		for _, keyword := range keywords {
+			delete(ms.keywordIndex.index, keyword)
+			delete(ms.keywordIndex.positions, keyword)
+		}
+		mem.keywords = slices.DeleteFunc(mem.keywords, func(keyword string) bool {
+			return slices.Contains(keywords, keyword)
+		})
+	}
+	ms.queryCache.invalidate()
+	return report
+}
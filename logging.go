@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+)
+
+// setupLogging sends the server's logs to path, or stderr when path is empty,
+// so they never mix with protocol messages on stdout. Text logs keep the
+// standard log line format with fields appended; JSON logs are one object per
+// line with time, level, msg, and the fields as keys, for log aggregators.
+// The returned function closes the log file.
+func setupLogging(format, path string) (func() error, error) {
+	var w io.Writer = os.Stderr
+	closeLog := func() error { return nil }
+	if path != "" {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open log file: %w", err)
+		}
+		w = file
+		closeLog = file.Close
+	}
+
+	if format == "json" {
+		// Also routes any remaining log package output through the handler
+		slog.SetDefault(slog.New(slog.NewJSONHandler(w, nil)))
+	} else {
+		// The default slog logger writes through the log package
+		log.SetOutput(w)
+	}
+	return closeLog, nil
+}
+
+// fatal logs an error with its fields and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
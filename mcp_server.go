@@ -2,14 +2,19 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"net/url"
 	"os"
 	"os/signal"
+	"slices"
 	"sort"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -24,6 +29,57 @@ type MCPMessage struct {
 	Params  json.RawMessage `json:"params,omitempty"`
 	Result  interface{}     `json:"result,omitempty"`
 	Error   *MCPError       `json:"error,omitempty"`
+
+	hasID bool // set when the decoded message had an id member, even a null one
+}
+
+// UnmarshalJSON records whether the message carried an id so notifications
+// can be told apart from requests
+func (m *MCPMessage) UnmarshalJSON(data []byte) error {
+	type plainMessage MCPMessage
+	var raw struct {
+		plainMessage
+		ID json.RawMessage `json:"id"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	*m = MCPMessage(raw.plainMessage)
+	m.hasID = raw.ID != nil
+	if m.hasID {
+		// Keep numeric ids as json.Number so they echo back exactly as sent
+		decoder := json.NewDecoder(bytes.NewReader(raw.ID))
+		decoder.UseNumber()
+		if err := decoder.Decode(&m.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isRequest reports whether msg expects a response: it has a method and an id.
+// Messages without an id are notifications.
+func (m MCPMessage) isRequest() bool {
+	return m.Method != "" && m.hasID
+}
+
+// replyTo prepares the handler's response to msg for sending. Notifications
+// never get a reply, even on error; requests always do, echoing their id.
+func replyTo(msg MCPMessage, response MCPMessage) (MCPMessage, bool) {
+	if !msg.isRequest() {
+		return MCPMessage{}, false
+	}
+	if response.Jsonrpc == "" {
+		// Handlers meant for notifications still acknowledge when sent as requests
+		response = MCPMessage{Jsonrpc: "2.0", Result: map[string]interface{}{}}
+	}
+	response.ID = msg.ID
+	if response.ID == nil {
+		// A null id must still be echoed, which omitempty would drop
+		response.ID = json.RawMessage("null")
+	}
+	return response, true
 }
 
 type MCPError struct {
@@ -31,6 +87,11 @@ type MCPError struct {
 	Message string `json:"message"`
 }
 
+// MCP Initialize Request; only the server-specific fields are read
+type InitializeParams struct {
+	MemoryDefaults *StoreDefaults `json:"memoryDefaults,omitempty"` // this client's store_memory defaults
+}
+
 // MCP Initialize Response
 type InitializeResult struct {
 	ProtocolVersion string          `json:"protocolVersion"`
@@ -71,21 +132,77 @@ type InputSchema struct {
 }
 
 type Property struct {
-	Type        string   `json:"type"`
-	Description string   `json:"description"`
-	Enum        []string `json:"enum,omitempty"`
+	Type        string              `json:"type"`
+	Description string              `json:"description,omitempty"`
+	Enum        []string            `json:"enum,omitempty"`
+	Items       *Property           `json:"items,omitempty"`      // element schema for arrays
+	Properties  map[string]Property `json:"properties,omitempty"` // known fields of objects
+	Required    []string            `json:"required,omitempty"`   // required fields of objects
 }
 
 // Main MCP server implementation
 func main() {
 	// Initialize memory store
 	config := LoadConfig()
+	if err := config.Validate(); err != nil {
+		fatal("Invalid configuration", "err", err)
+	}
+	closeLog, err := setupLogging(config.LogFormat, config.LogFile)
+	if err != nil {
+		fatal("Failed to set up logging", "err", err)
+	}
+	defer closeLog()
 	InitializeMemoryLimits(config)
 
-	store := NewMemoryStore(config.MaxMemories)
-	server := &MCPServer{store: store}
+	if config.EnableProfiling {
+		listener, err := startProfiling(config.ProfileAddr)
+		if err != nil {
+			fatal("Failed to start profiling", "err", err)
+		}
+		slog.Info("Profiling available", "url", fmt.Sprintf("http://%s/debug/pprof/", listener.Addr()))
+	}
 
-	log.SetOutput(os.Stderr) // Log to stderr to avoid interfering with protocol
+	store := NewMemoryStoreWithConfig(config)
+	if config.LoadPath != "" {
+		// Load before freezing, so a read-only server can serve a snapshot
+		store.SetReadOnly(false)
+		file, err := os.Open(config.LoadPath)
+		if err != nil {
+			fatal("Failed to load memories", "path", config.LoadPath, "err", err)
+		}
+		count, err := store.ImportJSONL(file)
+		file.Close()
+		if err != nil {
+			fatal("Failed to load memories", "path", config.LoadPath, "loaded", count, "err", err)
+		}
+		store.SetReadOnly(config.ReadOnly)
+		slog.Info("Loaded memories", "path", config.LoadPath, "count", count)
+	}
+	if config.SnapshotPath != "" {
+		snapshot, err := LoadSnapshotFile(config.SnapshotPath)
+		if err == nil {
+			store.SetReadOnly(false)
+			err = store.Restore(snapshot)
+			store.SetReadOnly(config.ReadOnly)
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			fatal("Failed to restore snapshot", "path", config.SnapshotPath, "err", err)
+		}
+		if err == nil {
+			slog.Info("Restored snapshot", "path", config.SnapshotPath, "memories", len(snapshot.Memories), "taken_at", snapshot.CreatedAt)
+		}
+	}
+	server := &MCPServer{
+		store:          store,
+		compactJSON:    config.CompactJSON,
+		flushMessages:  config.FlushMessages,
+		flushInterval:  config.FlushInterval,
+		sessionID:      newSessionID(),
+		clientID:       "stdio",
+		requestTimeout: config.RequestTimeout,
+
+		legacyResourceErrors: config.LegacyResourceErrors,
+	}
 
 	// Set up graceful shutdown
 	sigChan := make(chan os.Signal, 1)
@@ -93,7 +210,7 @@ func main() {
 
 	go func() {
 		<-sigChan
-		log.Println("Received shutdown signal, cleaning up...")
+		slog.Info("Received shutdown signal, cleaning up...")
 		store.Shutdown()
 		os.Exit(0)
 	}()
@@ -101,8 +218,9 @@ func main() {
 	// Use connection manager for multi-client support
 	if config.EnableSharing {
 		connManager := NewConnectionManager(store, server)
+		connManager.lengthPrefixed = config.PipeFraming == "length"
 		if err := connManager.Start(); err != nil {
-			log.Fatalf("Failed to start connection manager: %v", err)
+			fatal("Failed to start connection manager", "err", err)
 		}
 	} else {
 		// Original stdio-only mode
@@ -112,45 +230,162 @@ func main() {
 
 // runStdioMode runs the server in traditional stdio mode
 func runStdioMode(server *MCPServer) {
-	reader := bufio.NewReader(os.Stdin)
-	writer := bufio.NewWriter(os.Stdout)
+	slog.Info("Memory MCP Server started (stdio mode)")
+
+	if err := serveStream(server, os.Stdin, os.Stdout); err != nil {
+		slog.Error("Stopping stdio mode", "err", err)
+	}
+}
 
-	log.Println("Memory MCP Server started (stdio mode)")
+// serveStream processes newline-delimited messages until EOF or a write failure
+func serveStream(server *MCPServer, r io.Reader, w io.Writer) error {
+	reader := bufio.NewReader(r)
+	writer := newResponseWriter(w, server.flushMessages, server.flushInterval)
+	defer writer.stop()
 
 	// Main message loop
 	for {
+		// Never leave responses buffered while waiting on a client that may
+		// be waiting on them: flush whenever no further input is already read
+		if reader.Buffered() == 0 {
+			if err := writer.flush(); err != nil {
+				return fmt.Errorf("write response: %w", err)
+			}
+		}
+
 		line, err := reader.ReadString('\n')
 		if err != nil {
 			if err == io.EOF {
-				break
+				if err := writer.flush(); err != nil {
+					return fmt.Errorf("write response: %w", err)
+				}
+				return nil
 			}
-			log.Printf("Error reading: %v", err)
+			slog.Error("Error reading", "err", err)
 			continue
 		}
 
 		var msg MCPMessage
 		if err := json.Unmarshal([]byte(line), &msg); err != nil {
-			log.Printf("Error parsing message: %v", err)
+			slog.Error("Error parsing message", "err", err)
 			continue
 		}
 
-		response := server.handleMessage(msg)
-
-		// Don't send response for notifications
-		if msg.Method != "" && response.Jsonrpc == "" {
+		response, ok := replyTo(msg, server.handleMessage(msg))
+		if !ok {
 			continue
 		}
 
 		responseBytes, err := json.Marshal(response)
 		if err != nil {
-			log.Printf("Error marshaling response: %v", err)
+			slog.Error("Error marshaling response", "err", err)
 			continue
 		}
 
-		writer.Write(responseBytes)
-		writer.WriteByte('\n')
-		writer.Flush()
+		// A failed bufio.Writer keeps returning its error, so stop on the first one
+		if err := writer.write(responseBytes); err != nil {
+			return fmt.Errorf("write response: %w", err)
+		}
+	}
+}
+
+// responseWriter buffers newline-delimited responses and flushes them after
+// every flushMessages responses, or flushInterval after the first unflushed
+// one when set. A timed flush runs on its own goroutine, hence the lock.
+type responseWriter struct {
+	mu            sync.Mutex
+	writer        *bufio.Writer
+	flushMessages int
+	flushInterval time.Duration
+	pending       int
+	timer         *time.Timer
+	err           error // first failed timed flush, returned by the next call
+}
+
+// newResponseWriter creates a writer; flushMessages below 1 flushes every response
+func newResponseWriter(w io.Writer, flushMessages int, flushInterval time.Duration) *responseWriter {
+	return &responseWriter{
+		writer:        bufio.NewWriter(w),
+		flushMessages: max(flushMessages, 1),
+		flushInterval: flushInterval,
+	}
+}
+
+// write buffers one response, flushing per the policy
+func (rw *responseWriter) write(data []byte) error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	if rw.err != nil {
+		return rw.err
+	}
+	if _, err := rw.writer.Write(data); err != nil {
+		return err
+	}
+	if err := rw.writer.WriteByte('\n'); err != nil {
+		return err
+	}
+
+	rw.pending++
+	if rw.pending >= rw.flushMessages {
+		return rw.flushLocked()
+	}
+	if rw.flushInterval > 0 && rw.timer == nil {
+		rw.timer = time.AfterFunc(rw.flushInterval, func() {
+			rw.mu.Lock()
+			defer rw.mu.Unlock()
+			if err := rw.flushLocked(); err != nil && rw.err == nil {
+				rw.err = err
+			}
+		})
+	}
+	return nil
+}
+
+// flush writes out any buffered responses
+func (rw *responseWriter) flush() error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	if rw.err != nil {
+		return rw.err
+	}
+	return rw.flushLocked()
+}
+
+// flushLocked flushes and cancels any pending timed flush. Caller must hold rw.mu.
+func (rw *responseWriter) flushLocked() error {
+	if rw.timer != nil {
+		rw.timer.Stop()
+		rw.timer = nil
 	}
+	if rw.pending == 0 {
+		return nil
+	}
+	rw.pending = 0
+	return rw.writer.Flush()
+}
+
+// stop cancels any pending timed flush once the stream ends
+func (rw *responseWriter) stop() {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	if rw.timer != nil {
+		rw.timer.Stop()
+		rw.timer = nil
+	}
+}
+
+// writeLine writes a newline-terminated message and flushes it
+func writeLine(writer *bufio.Writer, data []byte) error {
+	if _, err := writer.Write(data); err != nil {
+		return err
+	}
+	if err := writer.WriteByte('\n'); err != nil {
+		return err
+	}
+	return writer.Flush()
 }
 
 func (mcp *MCPServer) handleMessage(msg MCPMessage) MCPMessage {
@@ -165,9 +400,11 @@ func (mcp *MCPServer) handleMessage(msg MCPMessage) MCPMessage {
 		return mcp.handleResourcesList(msg)
 	case "resources/read":
 		return mcp.handleResourceRead(msg)
+	case "resources/templates/list":
+		return mcp.handleResourceTemplatesList(msg)
 	case "notifications/initialized":
 		// Client has initialized, just acknowledge
-		log.Println("Client initialized successfully")
+		slog.Info("Client initialized successfully")
 		return MCPMessage{} // Empty response for notifications
 	default:
 		return MCPMessage{
@@ -182,20 +419,38 @@ func (mcp *MCPServer) handleMessage(msg MCPMessage) MCPMessage {
 }
 
 func (mcp *MCPServer) handleInitialize(msg MCPMessage) MCPMessage {
+	var params InitializeParams
+	if len(msg.Params) > 0 {
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return MCPMessage{
+				Jsonrpc: "2.0",
+				ID:      msg.ID,
+				Error: &MCPError{
+					Code:    -32602,
+					Message: fmt.Sprintf("Invalid initialize params: %v", err),
+				},
+			}
+		}
+	}
+	if params.MemoryDefaults != nil {
+		if err := mcp.setDefaults(*params.MemoryDefaults); err != nil {
+			return MCPMessage{
+				Jsonrpc: "2.0",
+				ID:      msg.ID,
+				Error: &MCPError{
+					Code:    -32602,
+					Message: err.Error(),
+				},
+			}
+		}
+	}
+
 	return MCPMessage{
 		Jsonrpc: "2.0",
 		ID:      msg.ID,
 		Result: InitializeResult{
 			ProtocolVersion: "2024-11-05",
-			Capabilities: MCPCapabilities{
-				Tools: &ToolsCapability{
-					ListChanged: true,
-				},
-				Resources: &ResourcesCapability{
-					Subscribe:   true,
-					ListChanged: true,
-				},
-			},
+			Capabilities:    serverCapabilities(),
 			ServerInfo: ServerInfo{
 				Name:    "mcp-memory-server",
 				Version: "1.0.0",
@@ -204,8 +459,23 @@ func (mcp *MCPServer) handleInitialize(msg MCPMessage) MCPMessage {
 	}
 }
 
-func (mcp *MCPServer) handleToolsList(msg MCPMessage) MCPMessage {
-	tools := []Tool{
+// serverCapabilities is what the server supports, announced at initialize
+// and handoff
+func serverCapabilities() MCPCapabilities {
+	return MCPCapabilities{
+		Tools: &ToolsCapability{
+			ListChanged: true,
+		},
+		Resources: &ResourcesCapability{
+			Subscribe:   true,
+			ListChanged: true,
+		},
+	}
+}
+
+// toolDefinitions describes every tool and its input schema
+func toolDefinitions() []Tool {
+	return []Tool{
 		{
 			Name:        "store_memory",
 			Description: "Store a new memory with content, type, and metadata",
@@ -223,12 +493,43 @@ func (mcp *MCPServer) handleToolsList(msg MCPMessage) MCPMessage {
 					},
 					"metadata": {
 						Type:        "object",
-						Description: "Additional metadata",
+						Description: "Additional metadata; string values are indexed for search, and other fields are kept as given",
+						Properties: map[string]Property{
+							"tags": {
+								Type:        "array",
+								Description: "Labels matched as whole terms by keyword queries and search",
+								Items:       &Property{Type: "string"},
+							},
+							"session_id": {
+								Type:        "string",
+								Description: "Session the memory was stored in, set from the session_id argument",
+							},
+						},
 					},
 					"importance": {
 						Type:        "number",
 						Description: "Importance score (0-1)",
 					},
+					"decay": {
+						Type:        "number",
+						Description: "Importance lost per hour without access (0-1, default 0.01)",
+					},
+					"id": {
+						Type:        "string",
+						Description: "Caller-chosen memory ID (generated when omitted)",
+					},
+					"upsert": {
+						Type:        "boolean",
+						Description: "Update the memory in place if the ID already exists",
+					},
+					"expected_version": {
+						Type:        "integer",
+						Description: "With upsert, only update if the stored memory is at this version; otherwise fail with a conflict",
+					},
+					"session_id": {
+						Type:        "string",
+						Description: "Session to record in metadata.session_id (default: this client's session)",
+					},
 				},
 				Required: []string{"type", "content"},
 			},
@@ -242,15 +543,77 @@ func (mcp *MCPServer) handleToolsList(msg MCPMessage) MCPMessage {
 					"query_type": {
 						Type:        "string",
 						Description: "Type of query",
-						Enum:        []string{"similarity", "temporal", "type", "related", "keywords"},
+						Enum:        []string{"similarity", "similar_to_id", "temporal", "type", "related", "related_keywords", "relation_type", "session", "phrase", "keywords"},
 					},
 					"keywords": {
 						Type:        "array",
-						Description: "Keywords to search for",
+						Description: "Keywords to search for, required by related_keywords; with similarity queries, only memories matching one are ranked",
+						Items:       &Property{Type: "string"},
+					},
+					"memory_id": {
+						Type:        "string",
+						Description: "Starting memory for related queries, or the memory whose neighbors similar_to_id finds",
+					},
+					"depth": {
+						Type:        "integer",
+						Description: "Traversal depth for related queries",
+					},
+					"relation_type": {
+						Type:        "string",
+						Description: "Relation type for relation_type queries",
+					},
+					"session_id": {
+						Type:        "string",
+						Description: "Session for session queries (default: this client's session)",
+					},
+					"phrase": {
+						Type:        "string",
+						Description: "Words to find for phrase queries; needs a server started with --positional-index",
+					},
+					"within": {
+						Type:        "integer",
+						Description: "For phrase queries, match the words in any order, each at its own position, with the first and last at most this many positions apart (default 0: adjacent and in order)",
+					},
+					"snippet": {
+						Type:        "boolean",
+						Description: "Return excerpts around keyword matches instead of full content",
+					},
+					"snippet_length": {
+						Type:        "integer",
+						Description: "Maximum excerpt length in characters (default 160)",
+					},
+					"importance_weight": {
+						Type:        "number",
+						Description: "For similarity queries, blend importance into ranking (0-1, default 0 for pure similarity); needs the cosine metric",
+					},
+					"include_relations": {
+						Type:        "boolean",
+						Description: "Attach each result's outbound relations (default false)",
+					},
+					"ids_only": {
+						Type:        "boolean",
+						Description: "Return only the matching memory IDs, for listing (default false)",
+					},
+					"since_version": {
+						Type:        "integer",
+						Description: "Only return memories created or updated after this store version, from a previous response's _meta.store_version or get_stats",
+					},
+					"chunk_size": {
+						Type:        "integer",
+						Description: "Over length-prefixed pipe connections, send results in " + queryResultsMethod + " notifications of this many before a summary response; ignored on stdio",
+					},
+					"count_only": {
+						Type:        "boolean",
+						Description: "Return only the number of matches, as {\"count\": n}, without recording access (default false)",
 					},
 					"memory_type": {
 						Type:        "string",
-						Description: "Filter by memory type",
+						Description: "Filter by memory type; with similarity queries, only memories of this type are ranked",
+					},
+					"memory_types": {
+						Type:        "array",
+						Description: "For type queries, several memory types to return together, most important first and cut to limit",
+						Items:       &Property{Type: "string", Enum: []string{"short_term", "long_term", "episodic", "semantic", "procedural"}},
 					},
 					"limit": {
 						Type:        "integer",
@@ -260,6 +623,43 @@ func (mcp *MCPServer) handleToolsList(msg MCPMessage) MCPMessage {
 				Required: []string{"query_type"},
 			},
 		},
+		{
+			Name:        "search",
+			Description: "Find relevant memories from free text across content, metadata, and tags, ranked by match",
+			InputSchema: InputSchema{
+				Type: "object",
+				Properties: map[string]Property{
+					"query": {
+						Type:        "string",
+						Description: "Free text to search for",
+					},
+					"limit": {
+						Type:        "integer",
+						Description: "Maximum number of results (default 10)",
+					},
+				},
+				Required: []string{"query"},
+			},
+		},
+		{
+			Name:        "query_similar_batch",
+			Description: "Find the nearest memories for several embeddings in one pass",
+			InputSchema: InputSchema{
+				Type: "object",
+				Properties: map[string]Property{
+					"embeddings": {
+						Type:        "array",
+						Description: "Query embedding vectors",
+						Items:       &Property{Type: "array", Items: &Property{Type: "number"}},
+					},
+					"limit": {
+						Type:        "integer",
+						Description: "Maximum results per embedding",
+					},
+				},
+				Required: []string{"embeddings"},
+			},
+		},
 		{
 			Name:        "create_relation",
 			Description: "Create a relation between two memories",
@@ -287,8 +687,54 @@ func (mcp *MCPServer) handleToolsList(msg MCPMessage) MCPMessage {
 			},
 		},
 		{
-			Name:        "get_stats",
-			Description: "Get memory store statistics",
+			Name:        "create_relations",
+			Description: "Create many relations in one call, reporting a result per relation",
+			InputSchema: InputSchema{
+				Type: "object",
+				Properties: map[string]Property{
+					"relations": {
+						Type:        "array",
+						Description: "Relations to create, each with from_id, to_id, relation_type, and optional strength",
+						Items: &Property{
+							Type: "object",
+							Properties: map[string]Property{
+								"from_id":       {Type: "string", Description: "Source memory ID"},
+								"to_id":         {Type: "string", Description: "Target memory ID"},
+								"relation_type": {Type: "string", Description: "Type of relation"},
+								"strength":      {Type: "number", Description: "Relation strength (0-1)"},
+							},
+							Required: []string{"from_id", "to_id", "relation_type"},
+						},
+					},
+				},
+				Required: []string{"relations"},
+			},
+		},
+		{
+			Name:        "delete_relation",
+			Description: "Delete relations between two memories",
+			InputSchema: InputSchema{
+				Type: "object",
+				Properties: map[string]Property{
+					"from_id": {
+						Type:        "string",
+						Description: "Source memory ID",
+					},
+					"to_id": {
+						Type:        "string",
+						Description: "Target memory ID",
+					},
+					"relation_type": {
+						Type:        "string",
+						Description: "Only delete relations of this type",
+					},
+				},
+				Required: []string{"from_id", "to_id"},
+			},
+		},
+		{
+			Name:        "list_memory_types",
+			Description: "List the five memory types with what each is for, an example, and recommended importance and decay",
 			InputSchema: InputSchema{
 				Type:       "object",
 				Properties: map[string]Property{},
@@ -296,91 +742,907 @@ func (mcp *MCPServer) handleToolsList(msg MCPMessage) MCPMessage {
 			},
 		},
 		{
-			Name:        "wiki",
-			Description: "Get comprehensive documentation on how to use the memory system",
+			Name:        "get_stats",
+			Description: "Get memory store statistics",
 			InputSchema: InputSchema{
 				Type:       "object",
 				Properties: map[string]Property{},
 				Required:   []string{},
 			},
 		},
-	}
-
-	return MCPMessage{
-		Jsonrpc: "2.0",
-		ID:      msg.ID,
-		Result: map[string]interface{}{
-			"tools": tools,
+		{
+			Name:        "aging_report",
+			Description: "List memories projected to decay away within a time horizon",
+			InputSchema: InputSchema{
+				Type: "object",
+				Properties: map[string]Property{
+					"horizon_hours": {
+						Type:        "number",
+						Description: "How far ahead to project decay, in hours (default 24)",
+					},
+				},
+				Required: []string{},
+			},
 		},
-	}
-}
-
-func (mcp *MCPServer) handleToolCall(msg MCPMessage) MCPMessage {
-	var params struct {
-		Name      string          `json:"name"`
-		Arguments json.RawMessage `json:"arguments"`
-	}
-
-	if err := json.Unmarshal(msg.Params, &params); err != nil {
-		return MCPMessage{
-			Jsonrpc: "2.0",
-			ID:      msg.ID,
-			Error: &MCPError{
-				Code:    -32602,
-				Message: "Invalid params",
+		{
+			Name:        "export_memories",
+			Description: "Write all memories to a JSON Lines file, one memory per line",
+			InputSchema: InputSchema{
+				Type: "object",
+				Properties: map[string]Property{
+					"path": {
+						Type:        "string",
+						Description: "File to write, relative to the server's --export-dir",
+					},
+					"overwrite": {
+						Type:        "boolean",
+						Description: "Replace the file if it exists (default false: fail instead)",
+					},
+				},
+				Required: []string{"path"},
 			},
-		}
-	}
-
-	var result interface{}
-	var err error
-
-	switch params.Name {
-	case "store_memory":
-		var args StoreMemoryArgs
-		if err := json.Unmarshal(params.Arguments, &args); err != nil {
-			return MCPMessage{
-				Jsonrpc: "2.0",
-				ID:      msg.ID,
-				Error: &MCPError{
-					Code:    -32602,
-					Message: fmt.Sprintf("Invalid arguments for store_memory: %v", err),
+		},
+		{
+			Name:        "import_memories",
+			Description: "Store memories read from a JSON Lines file, one memory per line",
+			InputSchema: InputSchema{
+				Type: "object",
+				Properties: map[string]Property{
+					"path": {
+						Type:        "string",
+						Description: "File to read, as written by export_memories, relative to the server's --export-dir",
+					},
 				},
-			}
+				Required: []string{"path"},
+			},
+		},
+		{
+			Name:        "snapshot",
+			Description: "Return every memory and relation inline as a point-in-time backup, for clients that persist it themselves",
+			InputSchema: InputSchema{
+				Type: "object",
+				Properties: map[string]Property{
+					"compress": {
+						Type:        "boolean",
+						Description: "Return the snapshot gzipped and base64-encoded in data instead of as JSON in snapshot",
+					},
+				},
+				Required: []string{},
+			},
+		},
+		{
+			Name:        "persist",
+			Description: "Write a snapshot of every memory and relation to the server's --snapshot-path now, e.g. before a risky operation or disconnect",
+			InputSchema: InputSchema{
+				Type:       "object",
+				Properties: map[string]Property{},
+				Required:   []string{},
+			},
+		},
+		{
+			Name:        "restore_snapshot",
+			Description: "Replace every memory and relation with those of a snapshot returned by the snapshot tool",
+			InputSchema: InputSchema{
+				Type: "object",
+				Properties: map[string]Property{
+					"snapshot": {
+						Type:        "object",
+						Description: "Snapshot as returned uncompressed",
+					},
+					"data": {
+						Type:        "string",
+						Description: "Snapshot as returned compressed",
+					},
+				},
+				Required: []string{},
+			},
+		},
+		{
+			Name:        "memory_lineage",
+			Description: "Show a memory's history: creation, updates, promotions, access milestones, and projected decay",
+			InputSchema: InputSchema{
+				Type: "object",
+				Properties: map[string]Property{
+					"memory_id": {
+						Type:        "string",
+						Description: "ID of the memory",
+					},
+				},
+				Required: []string{"memory_id"},
+			},
+		},
+		{
+			Name:        "touch_memory",
+			Description: "Mark a memory as recently accessed, protecting it from decay, without retrieving it",
+			InputSchema: InputSchema{
+				Type: "object",
+				Properties: map[string]Property{
+					"memory_id": {
+						Type:        "string",
+						Description: "ID of the memory",
+					},
+				},
+				Required: []string{"memory_id"},
+			},
+		},
+		{
+			Name:        "promote_memory",
+			Description: "Move a memory to a longer-lived type immediately instead of waiting for consolidation",
+			InputSchema: InputSchema{
+				Type: "object",
+				Properties: map[string]Property{
+					"memory_id": {
+						Type:        "string",
+						Description: "ID of the memory",
+					},
+					"target_type": {
+						Type:        "string",
+						Description: "Type to promote to (default: the consolidation target, long_term)",
+						Enum:        []string{"short_term", "long_term", "episodic", "semantic", "procedural"},
+					},
+					"decay": {
+						Type:        "number",
+						Description: "New decay rate per hour (0-1); omit for the target type's recommended rate (see list_memory_types)",
+					},
+				},
+				Required: []string{"memory_id"},
+			},
+		},
+		{
+			Name:        "demote_memory",
+			Description: "Move a memory back to a shorter-lived type",
+			InputSchema: InputSchema{
+				Type: "object",
+				Properties: map[string]Property{
+					"memory_id": {
+						Type:        "string",
+						Description: "ID of the memory",
+					},
+					"target_type": {
+						Type:        "string",
+						Description: "Type to demote to (default: short_term)",
+						Enum:        []string{"short_term", "long_term", "episodic", "semantic", "procedural"},
+					},
+					"decay": {
+						Type:        "number",
+						Description: "New decay rate per hour (0-1); omit for the target type's recommended rate (see list_memory_types)",
+					},
+				},
+				Required: []string{"memory_id"},
+			},
+		},
+		{
+			Name:        "bulk_adjust",
+			Description: "Set decay, scale importance, or pin or unpin every memory matching a filter, returning how many changed. Pinned memories never decay or get evicted.",
+			InputSchema: InputSchema{
+				Type: "object",
+				Properties: map[string]Property{
+					"operation": {
+						Type:        "string",
+						Description: "Operation to apply",
+						Enum:        []string{"set_decay", "scale_importance", "pin", "unpin"},
+					},
+					"value": {
+						Type:        "number",
+						Description: "New decay rate (0-1) for set_decay, or importance multiplier for scale_importance",
+					},
+					"memory_type": {
+						Type:        "string",
+						Description: "Only adjust memories of this type",
+						Enum:        []string{"short_term", "long_term", "episodic", "semantic", "procedural"},
+					},
+					"keywords": {
+						Type:        "array",
+						Description: "Only adjust memories matching any of these keywords",
+						Items:       &Property{Type: "string"},
+					},
+					"older_than_hours": {
+						Type:        "number",
+						Description: "Only adjust memories created more than this many hours ago",
+					},
+				},
+				Required: []string{"operation"},
+			},
+		},
+		{
+			Name:        "set_embedding",
+			Description: "Set or clear a stored memory's embedding, e.g. once it has been computed, making the memory similarity-searchable",
+			InputSchema: InputSchema{
+				Type: "object",
+				Properties: map[string]Property{
+					"memory_id": {
+						Type:        "string",
+						Description: "ID of the memory",
+					},
+					"embedding": {
+						Type:        "array",
+						Description: "Embedding vector, matching the dimension of other stored embeddings; an empty array clears it",
+						Items:       &Property{Type: "number"},
+					},
+				},
+				Required: []string{"memory_id", "embedding"},
+			},
+		},
+		{
+			Name:        "set_client_defaults",
+			Description: "Set the memory type and importance store_memory uses for this client when a call omits them",
+			InputSchema: InputSchema{
+				Type: "object",
+				Properties: map[string]Property{
+					"memory_type": {
+						Type:        "string",
+						Description: "Default memory type; omitted falls back to short_term",
+						Enum:        []string{"short_term", "long_term", "episodic", "semantic", "procedural"},
+					},
+					"importance": {
+						Type:        "number",
+						Description: "Default importance (0-1), used when store_memory's importance is omitted or 0; omitted falls back to 0",
+					},
+				},
+				Required: []string{},
+			},
+		},
+		{
+			Name:        "memory_cluster",
+			Description: "Summarize a seed memory's connected cluster: members, edges, and aggregate stats",
+			InputSchema: InputSchema{
+				Type: "object",
+				Properties: map[string]Property{
+					"memory_id": {
+						Type:        "string",
+						Description: "ID of the seed memory",
+					},
+					"depth": {
+						Type:        "integer",
+						Description: "Traversal depth, as for related queries (default 2)",
+					},
+				},
+				Required: []string{"memory_id"},
+			},
+		},
+		{
+			Name:        "list_keywords",
+			Description: "List indexed keywords with the number of memories containing each",
+			InputSchema: InputSchema{
+				Type: "object",
+				Properties: map[string]Property{
+					"prefix": {
+						Type:        "string",
+						Description: "Only list keywords starting with this prefix",
+					},
+					"limit": {
+						Type:        "integer",
+						Description: "Maximum number of keywords to return (default all)",
+					},
+					"sort": {
+						Type:        "string",
+						Description: "Sort order: frequency (default, most common first) or alphabetical",
+						Enum:        []string{"frequency", "alphabetical"},
+					},
+				},
+				Required: []string{},
+			},
+		},
+		{
+			Name:        "keyword_cooccurrence",
+			Description: "List keywords that most often appear in the same memories as a keyword, to explore related concepts",
+			InputSchema: InputSchema{
+				Type: "object",
+				Properties: map[string]Property{
+					"keyword": {
+						Type:        "string",
+						Description: "Keyword to find companions for",
+					},
+					"limit": {
+						Type:        "integer",
+						Description: "Maximum number of keywords to return (default 10, at most 100)",
+					},
+				},
+				Required: []string{"keyword"},
+			},
+		},
+		{
+			Name:        "find_orphans",
+			Description: "List memories with no inbound or outbound relations, oldest first, to link or prune them",
+			InputSchema: InputSchema{
+				Type: "object",
+				Properties: map[string]Property{
+					"limit": {
+						Type:        "integer",
+						Description: "Maximum number of orphans to return (default all)",
+					},
+				},
+				Required: []string{},
+			},
+		},
+		{
+			Name:        "find_hubs",
+			Description: "List the most connected memories by inbound plus outbound relation count, to see the central concepts",
+			InputSchema: InputSchema{
+				Type: "object",
+				Properties: map[string]Property{
+					"limit": {
+						Type:        "integer",
+						Description: "Maximum number of hubs to return (default 10)",
+					},
+				},
+				Required: []string{},
+			},
+		},
+		{
+			Name:        "compare_memories",
+			Description: "Cosine similarity of two stored memories' embeddings, to decide whether to relate them",
+			InputSchema: InputSchema{
+				Type: "object",
+				Properties: map[string]Property{
+					"id_a": {
+						Type:        "string",
+						Description: "ID of the first memory",
+					},
+					"id_b": {
+						Type:        "string",
+						Description: "ID of the second memory",
+					},
+				},
+				Required: []string{"id_a", "id_b"},
+			},
+		},
+		{
+			Name:        "suggest_relations",
+			Description: "Suggest relations from a memory to its most similar neighbors by embedding, without creating them",
+			InputSchema: InputSchema{
+				Type: "object",
+				Properties: map[string]Property{
+					"memory_id": {
+						Type:        "string",
+						Description: "ID of the memory to find relation candidates for",
+					},
+					"threshold": {
+						Type:        "number",
+						Description: "Minimum cosine similarity for a suggestion, -1 to 1; 0 admits orthogonal neighbors (default 0.8 when omitted)",
+					},
+					"limit": {
+						Type:        "integer",
+						Description: "Maximum number of suggestions (default 5)",
+					},
+				},
+				Required: []string{"memory_id"},
+			},
+		},
+		{
+			Name:        "reload_config",
+			Description: "Change runtime settings (intervals, thresholds, capacity) without a restart",
+			InputSchema: InputSchema{
+				Type: "object",
+				Properties: map[string]Property{
+					"max_memories": {
+						Type:        "integer",
+						Description: "Maximum number of memories; lowering it evicts least important memories",
+					},
+					"decay_interval": {
+						Type:        "string",
+						Description: "Decay check interval as a Go duration, e.g. 5m",
+					},
+					"consolidation_interval": {
+						Type:        "string",
+						Description: "Consolidation check interval as a Go duration, e.g. 10m",
+					},
+					"access_half_life": {
+						Type:        "string",
+						Description: "Access score half-life as a Go duration, e.g. 24h",
+					},
+					"consolidation_access_threshold": {
+						Type:        "number",
+						Description: "Access score above which short_term memories are promoted",
+					},
+					"consolidation_importance_threshold": {
+						Type:        "number",
+						Description: "Importance above which short_term memories are promoted (0-1)",
+					},
+				},
+				Required: []string{},
+			},
+		},
+		{
+			Name:        "rebuild_indexes",
+			Description: "Admin: rebuild the type, time, keyword, and embedding indexes from stored memories",
+			InputSchema: InputSchema{
+				Type:       "object",
+				Properties: map[string]Property{},
+				Required:   []string{},
+			},
+		},
+		{
+			Name:        "health",
+			Description: "Report liveness and readiness: whether the store is accepting work and within its capacity and memory limits",
+			InputSchema: InputSchema{
+				Type:       "object",
+				Properties: map[string]Property{},
+				Required:   []string{},
+			},
+		},
+		{
+			Name:        "wiki",
+			Description: "Get comprehensive documentation on how to use the memory system",
+			InputSchema: InputSchema{
+				Type:       "object",
+				Properties: map[string]Property{},
+				Required:   []string{},
+			},
+		},
+	}
+}
+
+func (mcp *MCPServer) handleToolsList(msg MCPMessage) MCPMessage {
+	return MCPMessage{
+		Jsonrpc: "2.0",
+		ID:      msg.ID,
+		Result: map[string]interface{}{
+			"tools": toolDefinitions(),
+		},
+	}
+}
+
+func (mcp *MCPServer) handleToolCall(msg MCPMessage) MCPMessage {
+	var params struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	}
+
+	if err := json.Unmarshal(msg.Params, &params); err != nil {
+		return MCPMessage{
+			Jsonrpc: "2.0",
+			ID:      msg.ID,
+			Error: &MCPError{
+				Code:    -32602,
+				Message: "Invalid params",
+			},
+		}
+	}
+
+	// Track the call so shutdown can drain it, and refuse calls once closing.
+	// Health checks are exempt so probes can observe the shutdown.
+	if params.Name != "health" {
+		if err := mcp.store.beginRequest(); err != nil {
+			return MCPMessage{
+				Jsonrpc: "2.0",
+				ID:      msg.ID,
+				Error: &MCPError{
+					Code:    -32603,
+					Message: err.Error(),
+				},
+			}
+		}
+		defer mcp.store.endRequest()
+	}
+
+	ctx, cancel := mcp.requestContext()
+	defer cancel()
+
+	var result interface{}
+	var meta map[string]interface{}
+	var err error
+
+	switch params.Name {
+	case "store_memory":
+		var args StoreMemoryArgs
+		if err := json.Unmarshal(params.Arguments, &args); err != nil {
+			return MCPMessage{
+				Jsonrpc: "2.0",
+				ID:      msg.ID,
+				Error: &MCPError{
+					Code:    -32602,
+					Message: fmt.Sprintf("Invalid arguments for store_memory: %v", err),
+				},
+			}
+		}
+		result, err = mcp.StoreMemory(ctx, args)
+
+	case "query_memories":
+		var args QueryMemoryArgs
+		if err := json.Unmarshal(params.Arguments, &args); err != nil {
+			return MCPMessage{
+				Jsonrpc: "2.0",
+				ID:      msg.ID,
+				Error: &MCPError{
+					Code:    -32602,
+					Message: fmt.Sprintf("Invalid arguments for query_memories: %v", err),
+				},
+			}
+		}
+		// Read the version first, so a client syncing from it never misses a
+		// change that lands during the query
+		meta = map[string]interface{}{"store_version": mcp.store.StoreVersion()}
+		if args.CountOnly {
+			result, err = mcp.CountMemories(ctx, args)
+			break
+		}
+		if args.ChunkSize < 0 {
+			err = errorf(ErrValidation, "chunk_size cannot be negative")
+			break
+		}
+		var memories []*Memory
+		memories, err = mcp.QueryMemories(ctx, args)
+		// Stream only when the transport can and it would take several chunks
+		if err == nil && mcp.notify != nil && args.ChunkSize > 0 && len(memories) > args.ChunkSize {
+			result, err = mcp.streamQueryResults(msg.ID, memories, args)
+		} else {
+			result = mcp.formatQueryResults(memories, args)
+		}
+
+	case "search":
+		var args SearchArgs
+		if err := json.Unmarshal(params.Arguments, &args); err != nil {
+			return MCPMessage{
+				Jsonrpc: "2.0",
+				ID:      msg.ID,
+				Error: &MCPError{
+					Code:    -32602,
+					Message: fmt.Sprintf("Invalid arguments for search: %v", err),
+				},
+			}
+		}
+		result, err = mcp.Search(ctx, args)
+
+	case "query_similar_batch":
+		var args SimilarityBatchArgs
+		if err := json.Unmarshal(params.Arguments, &args); err != nil {
+			return MCPMessage{
+				Jsonrpc: "2.0",
+				ID:      msg.ID,
+				Error: &MCPError{
+					Code:    -32602,
+					Message: fmt.Sprintf("Invalid arguments for query_similar_batch: %v", err),
+				},
+			}
+		}
+		result, err = mcp.QuerySimilarBatch(ctx, args)
+
+	case "create_relation":
+		var args CreateRelationArgs
+		if err := json.Unmarshal(params.Arguments, &args); err != nil {
+			return MCPMessage{
+				Jsonrpc: "2.0",
+				ID:      msg.ID,
+				Error: &MCPError{
+					Code:    -32602,
+					Message: fmt.Sprintf("Invalid arguments for create_relation: %v", err),
+				},
+			}
+		}
+		err = mcp.CreateRelation(ctx, args)
+		result = map[string]string{"status": "success"}
+
+	case "create_relations":
+		var args CreateRelationsArgs
+		if err := json.Unmarshal(params.Arguments, &args); err != nil {
+			return MCPMessage{
+				Jsonrpc: "2.0",
+				ID:      msg.ID,
+				Error: &MCPError{
+					Code:    -32602,
+					Message: fmt.Sprintf("Invalid arguments for create_relations: %v", err),
+				},
+			}
+		}
+		results := make([]RelationResult, len(args.Relations))
+		for i, relErr := range mcp.CreateRelations(ctx, args.Relations) {
+			results[i] = RelationResult{Index: i, Status: "success"}
+			if relErr != nil {
+				results[i] = RelationResult{Index: i, Status: "error", Error: relErr.Error()}
+			}
+		}
+		result = results
+
+	case "delete_relation":
+		var args DeleteRelationArgs
+		if err := json.Unmarshal(params.Arguments, &args); err != nil {
+			return MCPMessage{
+				Jsonrpc: "2.0",
+				ID:      msg.ID,
+				Error: &MCPError{
+					Code:    -32602,
+					Message: fmt.Sprintf("Invalid arguments for delete_relation: %v", err),
+				},
+			}
+		}
+		err = mcp.DeleteRelation(ctx, args)
+		result = map[string]string{"status": "success"}
+
+	case "list_memory_types":
+		result, err = mcp.ListMemoryTypes(ctx)
+
+	case "get_stats":
+		result, err = mcp.GetStats(ctx)
+
+	case "health":
+		result, err = mcp.Health(ctx)
+
+	case "aging_report":
+		var args AgingReportArgs
+		if err := json.Unmarshal(params.Arguments, &args); err != nil {
+			return MCPMessage{
+				Jsonrpc: "2.0",
+				ID:      msg.ID,
+				Error: &MCPError{
+					Code:    -32602,
+					Message: fmt.Sprintf("Invalid arguments for aging_report: %v", err),
+				},
+			}
+		}
+		result, err = mcp.AgingReport(ctx, args)
+
+	case "export_memories":
+		var args ExportMemoriesArgs
+		if err := json.Unmarshal(params.Arguments, &args); err != nil {
+			return MCPMessage{
+				Jsonrpc: "2.0",
+				ID:      msg.ID,
+				Error: &MCPError{
+					Code:    -32602,
+					Message: fmt.Sprintf("Invalid arguments for export_memories: %v", err),
+				},
+			}
+		}
+		result, err = mcp.ExportMemories(ctx, args)
+
+	case "import_memories":
+		var args ImportMemoriesArgs
+		if err := json.Unmarshal(params.Arguments, &args); err != nil {
+			return MCPMessage{
+				Jsonrpc: "2.0",
+				ID:      msg.ID,
+				Error: &MCPError{
+					Code:    -32602,
+					Message: fmt.Sprintf("Invalid arguments for import_memories: %v", err),
+				},
+			}
+		}
+		result, err = mcp.ImportMemories(ctx, args)
+
+	case "snapshot":
+		var args SnapshotArgs
+		if err := json.Unmarshal(params.Arguments, &args); err != nil {
+			return MCPMessage{
+				Jsonrpc: "2.0",
+				ID:      msg.ID,
+				Error: &MCPError{
+					Code:    -32602,
+					Message: fmt.Sprintf("Invalid arguments for snapshot: %v", err),
+				},
+			}
+		}
+		result, err = mcp.SnapshotStore(ctx, args)
+
+	case "persist":
+		result, err = mcp.Persist(ctx)
+
+	case "restore_snapshot":
+		var args RestoreSnapshotArgs
+		if err := json.Unmarshal(params.Arguments, &args); err != nil {
+			return MCPMessage{
+				Jsonrpc: "2.0",
+				ID:      msg.ID,
+				Error: &MCPError{
+					Code:    -32602,
+					Message: fmt.Sprintf("Invalid arguments for restore_snapshot: %v", err),
+				},
+			}
+		}
+		result, err = mcp.RestoreSnapshot(ctx, args)
+
+	case "memory_lineage":
+		var args MemoryLineageArgs
+		if err := json.Unmarshal(params.Arguments, &args); err != nil {
+			return MCPMessage{
+				Jsonrpc: "2.0",
+				ID:      msg.ID,
+				Error: &MCPError{
+					Code:    -32602,
+					Message: fmt.Sprintf("Invalid arguments for memory_lineage: %v", err),
+				},
+			}
+		}
+		result, err = mcp.MemoryLineage(ctx, args)
+
+	case "memory_cluster":
+		var args MemoryClusterArgs
+		if err := json.Unmarshal(params.Arguments, &args); err != nil {
+			return MCPMessage{
+				Jsonrpc: "2.0",
+				ID:      msg.ID,
+				Error: &MCPError{
+					Code:    -32602,
+					Message: fmt.Sprintf("Invalid arguments for memory_cluster: %v", err),
+				},
+			}
+		}
+		result, err = mcp.MemoryCluster(ctx, args)
+
+	case "list_keywords":
+		var args ListKeywordsArgs
+		if err := json.Unmarshal(params.Arguments, &args); err != nil {
+			return MCPMessage{
+				Jsonrpc: "2.0",
+				ID:      msg.ID,
+				Error: &MCPError{
+					Code:    -32602,
+					Message: fmt.Sprintf("Invalid arguments for list_keywords: %v", err),
+				},
+			}
 		}
-		result, err = mcp.StoreMemory(nil, args)
+		result, err = mcp.ListKeywords(ctx, args)
 
-	case "query_memories":
-		var args QueryMemoryArgs
+	case "keyword_cooccurrence":
+		var args KeywordCooccurrenceArgs
 		if err := json.Unmarshal(params.Arguments, &args); err != nil {
 			return MCPMessage{
 				Jsonrpc: "2.0",
 				ID:      msg.ID,
 				Error: &MCPError{
 					Code:    -32602,
-					Message: fmt.Sprintf("Invalid arguments for query_memories: %v", err),
+					Message: fmt.Sprintf("Invalid arguments for keyword_cooccurrence: %v", err),
 				},
 			}
 		}
-		result, err = mcp.QueryMemories(nil, args)
+		result, err = mcp.KeywordCooccurrence(ctx, args)
 
-	case "create_relation":
-		var args CreateRelationArgs
+	case "find_orphans":
+		var args FindOrphansArgs
 		if err := json.Unmarshal(params.Arguments, &args); err != nil {
 			return MCPMessage{
 				Jsonrpc: "2.0",
 				ID:      msg.ID,
 				Error: &MCPError{
 					Code:    -32602,
-					Message: fmt.Sprintf("Invalid arguments for create_relation: %v", err),
+					Message: fmt.Sprintf("Invalid arguments for find_orphans: %v", err),
 				},
 			}
 		}
-		err = mcp.CreateRelation(nil, args)
-		result = map[string]string{"status": "success"}
+		result, err = mcp.FindOrphans(ctx, args)
 
-	case "get_stats":
-		result, err = mcp.GetStats(nil)
+	case "find_hubs":
+		var args FindHubsArgs
+		if err := json.Unmarshal(params.Arguments, &args); err != nil {
+			return MCPMessage{
+				Jsonrpc: "2.0",
+				ID:      msg.ID,
+				Error: &MCPError{
+					Code:    -32602,
+					Message: fmt.Sprintf("Invalid arguments for find_hubs: %v", err),
+				},
+			}
+		}
+		result, err = mcp.FindHubs(ctx, args)
+
+	case "compare_memories":
+		var args CompareMemoriesArgs
+		if err := json.Unmarshal(params.Arguments, &args); err != nil {
+			return MCPMessage{
+				Jsonrpc: "2.0",
+				ID:      msg.ID,
+				Error: &MCPError{
+					Code:    -32602,
+					Message: fmt.Sprintf("Invalid arguments for compare_memories: %v", err),
+				},
+			}
+		}
+		result, err = mcp.CompareMemories(ctx, args)
+
+	case "suggest_relations":
+		var args SuggestRelationsArgs
+		if err := json.Unmarshal(params.Arguments, &args); err != nil {
+			return MCPMessage{
+				Jsonrpc: "2.0",
+				ID:      msg.ID,
+				Error: &MCPError{
+					Code:    -32602,
+					Message: fmt.Sprintf("Invalid arguments for suggest_relations: %v", err),
+				},
+			}
+		}
+		result, err = mcp.SuggestRelations(ctx, args)
+
+	case "reload_config":
+		var args ReloadConfigArgs
+		if err := json.Unmarshal(params.Arguments, &args); err != nil {
+			return MCPMessage{
+				Jsonrpc: "2.0",
+				ID:      msg.ID,
+				Error: &MCPError{
+					Code:    -32602,
+					Message: fmt.Sprintf("Invalid arguments for reload_config: %v", err),
+				},
+			}
+		}
+		result, err = mcp.ReloadConfig(ctx, args)
+
+	case "touch_memory":
+		var args TouchMemoryArgs
+		if err := json.Unmarshal(params.Arguments, &args); err != nil {
+			return MCPMessage{
+				Jsonrpc: "2.0",
+				ID:      msg.ID,
+				Error: &MCPError{
+					Code:    -32602,
+					Message: fmt.Sprintf("Invalid arguments for touch_memory: %v", err),
+				},
+			}
+		}
+		result, err = mcp.TouchMemory(ctx, args)
+
+	case "promote_memory":
+		var args ChangeTypeArgs
+		if err := json.Unmarshal(params.Arguments, &args); err != nil {
+			return MCPMessage{
+				Jsonrpc: "2.0",
+				ID:      msg.ID,
+				Error: &MCPError{
+					Code:    -32602,
+					Message: fmt.Sprintf("Invalid arguments for promote_memory: %v", err),
+				},
+			}
+		}
+		result, err = mcp.PromoteMemory(ctx, args)
+
+	case "demote_memory":
+		var args ChangeTypeArgs
+		if err := json.Unmarshal(params.Arguments, &args); err != nil {
+			return MCPMessage{
+				Jsonrpc: "2.0",
+				ID:      msg.ID,
+				Error: &MCPError{
+					Code:    -32602,
+					Message: fmt.Sprintf("Invalid arguments for demote_memory: %v", err),
+				},
+			}
+		}
+		result, err = mcp.DemoteMemory(ctx, args)
+
+	case "bulk_adjust":
+		var args BulkAdjustArgs
+		if err := json.Unmarshal(params.Arguments, &args); err != nil {
+			return MCPMessage{
+				Jsonrpc: "2.0",
+				ID:      msg.ID,
+				Error: &MCPError{
+					Code:    -32602,
+					Message: fmt.Sprintf("Invalid arguments for bulk_adjust: %v", err),
+				},
+			}
+		}
+		result, err = mcp.BulkAdjust(ctx, args)
+
+	case "set_embedding":
+		var args SetEmbeddingArgs
+		if err := json.Unmarshal(params.Arguments, &args); err != nil {
+			return MCPMessage{
+				Jsonrpc: "2.0",
+				ID:      msg.ID,
+				Error: &MCPError{
+					Code:    -32602,
+					Message: fmt.Sprintf("Invalid arguments for set_embedding: %v", err),
+				},
+			}
+		}
+		result, err = mcp.SetEmbedding(ctx, args)
+
+	case "set_client_defaults":
+		var args StoreDefaults
+		if err := json.Unmarshal(params.Arguments, &args); err != nil {
+			return MCPMessage{
+				Jsonrpc: "2.0",
+				ID:      msg.ID,
+				Error: &MCPError{
+					Code:    -32602,
+					Message: fmt.Sprintf("Invalid arguments for set_client_defaults: %v", err),
+				},
+			}
+		}
+		result, err = mcp.SetClientDefaults(ctx, args)
+
+	case "rebuild_indexes":
+		result, err = mcp.RebuildIndexes(ctx)
 
 	case "wiki":
 		result = docs.GetWiki()
@@ -401,23 +1663,27 @@ func (mcp *MCPServer) handleToolCall(msg MCPMessage) MCPMessage {
 			Jsonrpc: "2.0",
 			ID:      msg.ID,
 			Error: &MCPError{
-				Code:    -32603,
+				Code:    errorCode(err),
 				Message: err.Error(),
 			},
 		}
 	}
 
+	response := map[string]interface{}{
+		"content": []map[string]interface{}{
+			{
+				"type": "text",
+				"text": mcp.formatResult(result),
+			},
+		},
+	}
+	if meta != nil {
+		response["_meta"] = meta
+	}
 	return MCPMessage{
 		Jsonrpc: "2.0",
 		ID:      msg.ID,
-		Result: map[string]interface{}{
-			"content": []map[string]interface{}{
-				{
-					"type": "text",
-					"text": formatResult(result),
-				},
-			},
-		},
+		Result:  response,
 	}
 }
 
@@ -435,6 +1701,18 @@ func (mcp *MCPServer) handleResourcesList(msg MCPMessage) MCPMessage {
 			"description": "Memory relationship graph",
 			"mimeType":    "application/json",
 		},
+		{
+			"uri":         "memory://events",
+			"name":        "Removal Events",
+			"description": "Recent memories removed by eviction or decay, newest first",
+			"mimeType":    "application/json",
+		},
+		{
+			"uri":         "memory://schema",
+			"name":        "Tool Schemas",
+			"description": "Every tool with the JSON Schema of its input, for generating typed clients",
+			"mimeType":    "application/json",
+		},
 	}
 
 	return MCPMessage{
@@ -446,6 +1724,31 @@ func (mcp *MCPServer) handleResourcesList(msg MCPMessage) MCPMessage {
 	}
 }
 
+func (mcp *MCPServer) handleResourceTemplatesList(msg MCPMessage) MCPMessage {
+	templates := []map[string]string{
+		{
+			"uriTemplate": "memory://memory/{id}",
+			"name":        "Memory",
+			"description": "A single memory by ID",
+			"mimeType":    "application/json",
+		},
+		{
+			"uriTemplate": "memory://type/{type}",
+			"name":        "Memories by Type",
+			"description": "All memories of one type, oldest first",
+			"mimeType":    "application/json",
+		},
+	}
+
+	return MCPMessage{
+		Jsonrpc: "2.0",
+		ID:      msg.ID,
+		Result: map[string]interface{}{
+			"resourceTemplates": templates,
+		},
+	}
+}
+
 func (mcp *MCPServer) handleResourceRead(msg MCPMessage) MCPMessage {
 	var params struct {
 		URI string `json:"uri"`
@@ -453,30 +1756,14 @@ func (mcp *MCPServer) handleResourceRead(msg MCPMessage) MCPMessage {
 
 	json.Unmarshal(msg.Params, &params)
 
-	var content interface{}
-
-	switch params.URI {
-	case "memory://stats":
-		stats, _ := mcp.GetStats(nil)
-		content = stats
-
-	case "memory://graph":
-		// Return a simplified graph representation
-		mcp.store.mu.RLock()
-		graph := map[string]interface{}{
-			"nodes": len(mcp.store.memories),
-			"edges": len(mcp.store.relations),
-		}
-		mcp.store.mu.RUnlock()
-		content = graph
-
-	default:
+	content, err := mcp.readResource(params.URI)
+	if err != nil {
 		return MCPMessage{
 			Jsonrpc: "2.0",
 			ID:      msg.ID,
 			Error: &MCPError{
-				Code:    -32602,
-				Message: "Unknown resource",
+				Code:    mcp.resourceErrorCode(err),
+				Message: err.Error(),
 			},
 		}
 	}
@@ -489,17 +1776,113 @@ func (mcp *MCPServer) handleResourceRead(msg MCPMessage) MCPMessage {
 				{
 					"uri":      params.URI,
 					"mimeType": "application/json",
-					"text":     formatResult(content),
+					"text":     mcp.formatResult(content),
 				},
 			},
 		},
 	}
 }
 
+// errUnknownResource is returned for a URI matching no resource or template
+var errUnknownResource = errorf(ErrNotFound, "Unknown resource")
+
+// readResource resolves a URI against the fixed resources first, then the
+// resource templates
+func (mcp *MCPServer) readResource(uri string) (interface{}, error) {
+	if content, ok := mcp.readFixedResource(uri); ok {
+		return content, nil
+	}
+	content, ok, err := mcp.readTemplatedResource(uri)
+	if !ok {
+		return nil, errUnknownResource
+	}
+	return content, err
+}
+
+// resourceErrorCode maps a resource read error to its JSON-RPC code. Unknown
+// URIs and missing resources both get MCP's resource-not-found code.
+func (mcp *MCPServer) resourceErrorCode(err error) int {
+	switch {
+	case mcp.legacyResourceErrors && errors.Is(err, errUnknownResource):
+		return errCodeInvalidParams
+	case !mcp.legacyResourceErrors && errors.Is(err, ErrNotFound):
+		return errCodeResourceNotFound
+	}
+	return errorCode(err)
+}
+
+// readFixedResource returns the content of one of the listed resources. ok
+// is false when the URI is not one of them.
+func (mcp *MCPServer) readFixedResource(uri string) (content interface{}, ok bool) {
+	switch uri {
+	case "memory://stats":
+		stats, _ := mcp.GetStats(nil)
+		return stats, true
+
+	case "memory://graph":
+		// Return a simplified graph representation
+		mcp.store.mu.RLock()
+		defer mcp.store.mu.RUnlock()
+		return map[string]interface{}{
+			"nodes": len(mcp.store.memories),
+			"edges": len(mcp.store.relations),
+		}, true
+
+	case "memory://events":
+		return mcp.store.RemovalEvents(), true
+
+	case "memory://schema":
+		return map[string]interface{}{"tools": toolDefinitions()}, true
+	}
+	return nil, false
+}
+
+// readTemplatedResource resolves a URI matching one of the resource
+// templates. ok is false when the URI matches none of them.
+func (mcp *MCPServer) readTemplatedResource(uri string) (content interface{}, ok bool, err error) {
+	if id, found := strings.CutPrefix(uri, "memory://memory/"); found {
+		if id, err = url.PathUnescape(id); err != nil {
+			return nil, true, errorf(ErrValidation, "invalid memory ID in %s: %v", uri, err)
+		}
+		mem, err := mcp.store.GetByID(id)
+		return mem, true, err
+	}
+
+	if memType, found := strings.CutPrefix(uri, "memory://type/"); found {
+		if !isValidMemoryType(MemoryType(memType)) {
+			return nil, true, errorf(ErrValidation, "invalid memory type: %s", memType)
+		}
+		mcp.store.mu.RLock()
+		defer mcp.store.mu.RUnlock()
+		memories := make([]Memory, 0)
+		for _, mem := range mcp.store.findByType(MemoryType(memType)) {
+			memories = append(memories, eventSnapshot(mem))
+		}
+		sort.Slice(memories, func(i, j int) bool {
+			if !memories[i].Timestamp.Equal(memories[j].Timestamp) {
+				return memories[i].Timestamp.Before(memories[j].Timestamp)
+			}
+			return memories[i].ID < memories[j].ID
+		})
+		return map[string]interface{}{
+			"type":     memType,
+			"count":    len(memories),
+			"memories": memories,
+		}, true, nil
+	}
+
+	return nil, false, nil
+}
 
 // Helper functions
 
-func formatResult(v interface{}) string {
+// formatResult renders a tool or resource result as JSON text, compact when
+// configured to save tokens and indented otherwise for readability
+func (mcp *MCPServer) formatResult(v interface{}) string {
+	if mcp.compactJSON {
+		bytes, _ := json.Marshal(v)
+		return string(bytes)
+	}
 	bytes, _ := json.MarshalIndent(v, "", "  ")
 	return string(bytes)
 }
@@ -511,19 +1894,28 @@ func sortByScore(scores []ScoredMemory) {
 }
 
 func (ms *MemoryStore) addToTimeIndex(memory *Memory) {
-	bucket := memory.Timestamp.Format("2006-01-02-15")
+	bucket := memory.Timestamp.UTC().Format(ms.timeIndex.format)
 	ms.timeIndex.mu.Lock()
 	ms.timeIndex.buckets[bucket] = append(ms.timeIndex.buckets[bucket], memory)
 	ms.timeIndex.mu.Unlock()
 }
 
+// Find memories stored between start and end. Both bounds are inclusive, so
+// a range starting at a memory's own timestamp returns it.
 func (ms *MemoryStore) findTemporal(start, end time.Time) []*Memory {
 	var results []*Memory
 
+	// Bucket keys sort chronologically, so skip buckets outside the range
+	firstBucket := start.UTC().Format(ms.timeIndex.format)
+	lastBucket := end.UTC().Format(ms.timeIndex.format)
+
 	ms.timeIndex.mu.RLock()
-	for _, memories := range ms.timeIndex.buckets {
+	for bucket, memories := range ms.timeIndex.buckets {
+		if bucket < firstBucket || bucket > lastBucket {
+			continue
+		}
 		for _, mem := range memories {
-			if mem.Timestamp.After(start) && mem.Timestamp.Before(end) {
+			if !mem.Timestamp.Before(start) && !mem.Timestamp.After(end) {
 				results = append(results, mem)
 			}
 		}
@@ -545,6 +1937,39 @@ func (ms *MemoryStore) findByType(memType MemoryType) []*Memory {
 	return results
 }
 
+// Find memories of any of several types, most important first, then newest.
+// Unlike a single-type listing, the combined set is cut to limit, after
+// dropping memories unchanged since a nonzero since version.
+func (ms *MemoryStore) findByTypes(memTypes []MemoryType, since uint64, limit int) []*Memory {
+	var results []*Memory
+	seen := make(map[MemoryType]bool, len(memTypes))
+	for _, memType := range memTypes {
+		if memType == "" || seen[memType] {
+			continue
+		}
+		seen[memType] = true
+		results = append(results, ms.findByType(memType)...)
+	}
+	if since > 0 {
+		results = ms.changedSince(results, since)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Importance != results[j].Importance {
+			return results[i].Importance > results[j].Importance
+		}
+		if !results[i].Timestamp.Equal(results[j].Timestamp) {
+			return results[i].Timestamp.After(results[j].Timestamp)
+		}
+		return results[i].ID < results[j].ID
+	})
+
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
 func (ms *MemoryStore) findByKeywords(keywords []string) []*Memory {
 	resultMap := make(map[string]*Memory)
 
@@ -555,9 +1980,9 @@ func (ms *MemoryStore) findByKeywords(keywords []string) []*Memory {
 	for _, keyword := range keywords {
 		lowerKeyword := strings.ToLower(keyword)
 		if memories, exists := ms.keywordIndex.index[lowerKeyword]; exists {
-			for id, mem := range memories {
-				resultMap[id] = mem
-			}
+			memories.each(func(mem *Memory) {
+				resultMap[mem.ID] = mem
+			})
 		}
 	}
 
@@ -570,34 +1995,185 @@ func (ms *MemoryStore) findByKeywords(keywords []string) []*Memory {
 	return results
 }
 
-func (ms *MemoryStore) evictLeastImportant() {
+// findByPhrase returns memories containing the phrase's words from the
+// positional index, most important first and cut to limit. With within 0
+// the words must appear adjacent and in order; otherwise they may appear in
+// any order at distinct positions, the first and last at most within
+// positions apart. Caller must hold ms.mu.
+func (ms *MemoryStore) findByPhrase(phrase string, within, limit int) []*Memory {
+	terms := wordPositions(phrase, ms.keywordIndex.identifiers)
+	if len(terms) == 0 {
+		return nil
+	}
+
+	ms.keywordIndex.mu.RLock()
+	lists := make([]map[string][]int, len(terms))
+	for i, term := range terms {
+		lists[i] = ms.keywordIndex.positions[term.word]
+		if len(lists[i]) == 0 {
+			ms.keywordIndex.mu.RUnlock()
+			return nil
+		}
+	}
+
+	var results []*Memory
+	for id := range lists[0] {
+		occurrences := make([][]int, len(terms))
+		for i := range terms {
+			if occurrences[i] = lists[i][id]; occurrences[i] == nil {
+				break
+			}
+		}
+		if occurrences[len(terms)-1] == nil {
+			continue
+		}
+
+		var matched bool
+		if within == 0 {
+			matched = phraseAt(terms, occurrences)
+		} else {
+			matched = phraseWithin(terms, occurrences, within)
+		}
+		if mem, ok := ms.memories[id]; ok && matched {
+			results = append(results, mem)
+		}
+	}
+	ms.keywordIndex.mu.RUnlock()
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Importance != results[j].Importance {
+			return results[i].Importance > results[j].Importance
+		}
+		return results[i].ID < results[j].ID
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// phraseAt reports whether the terms occur at the same relative offsets as
+// in the phrase, given each term's ascending occurrences
+func phraseAt(terms []wordPosition, occurrences [][]int) bool {
+	for _, start := range occurrences[0] {
+		found := true
+		for i := 1; i < len(terms) && found; i++ {
+			_, found = slices.BinarySearch(occurrences[i], start+terms[i].position-terms[0].position)
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// phraseWithin reports whether some window whose first and last positions
+// are at most within apart holds every term at a distinct position, so a
+// word repeated in the phrase needs as many occurrences. It slides over all
+// occurrences in content order.
+func phraseWithin(terms []wordPosition, occurrences [][]int, within int) bool {
+	type hit struct {
+		position int
+		word     string
+	}
+	need := make(map[string]int)
+	var hits []hit
+	for i, term := range terms {
+		if need[term.word]++; need[term.word] > 1 {
+			continue
+		}
+		for _, position := range occurrences[i] {
+			hits = append(hits, hit{position, term.word})
+		}
+	}
+	sort.Slice(hits, func(i, j int) bool { return hits[i].position < hits[j].position })
+
+	counts := make(map[string]int)
+	covered := 0
+	for left, right := 0, 0; right < len(hits); right++ {
+		if counts[hits[right].word]++; counts[hits[right].word] == need[hits[right].word] {
+			covered++
+		}
+		for hits[right].position-hits[left].position > within {
+			if counts[hits[left].word] == need[hits[left].word] {
+				covered--
+			}
+			counts[hits[left].word]--
+			left++
+		}
+		if covered == len(need) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ms *MemoryStore) evictLeastImportant() bool {
+	return ms.evictLeastImportantOf(ms.memories)
+}
+
+// evictLeastImportantOf evicts the least important unpinned memory among
+// candidates, e.g. one type's index when that type is at its own capacity.
+// Memories of types with the reject policy are never evicted. It reports
+// false when every candidate is protected.
+func (ms *MemoryStore) evictLeastImportantOf(candidates map[string]*Memory) bool {
 	var leastImportant *Memory
 	var leastID string
 
-	for id, mem := range ms.memories {
-		if leastImportant == nil || mem.Importance < leastImportant.Importance {
+	for id, mem := range candidates {
+		if mem.Pinned || ms.typePolicy[mem.Type] == "reject" {
+			continue
+		}
+		if leastImportant == nil || evictsBefore(mem, leastImportant) {
 			leastImportant = mem
 			leastID = id
 		}
 	}
 
-	if leastID != "" {
-		ms.removeMemory(leastID)
+	if leastID == "" {
+		return false
+	}
+	ms.recordRemoval(leastImportant, RemovalEvicted)
+	ms.removeMemory(leastID)
+	return true
+}
+
+// evictsBefore orders eviction candidates: lowest importance first, then
+// least recently accessed, then fewest accesses, then ID, so the choice never
+// depends on map iteration order
+func evictsBefore(a, b *Memory) bool {
+	if a.Importance != b.Importance {
+		return a.Importance < b.Importance
+	}
+	if !a.LastAccess.Equal(b.LastAccess) {
+		return a.LastAccess.Before(b.LastAccess)
 	}
+	if a.AccessCount != b.AccessCount {
+		return a.AccessCount < b.AccessCount
+	}
+	return a.ID < b.ID
 }
 
 func (ms *MemoryStore) removeMemory(id string) {
 	if mem, ok := ms.memories[id]; ok {
+		ms.markChanged(nil)
+		ms.recentCache.invalidate(id)
 		delete(ms.memories, id)
 		delete(ms.typeIndex[mem.Type], id)
+		for _, rel := range ms.relations[id] {
+			ms.removeFromRelationTypeIndex(rel)
+		}
 		delete(ms.relations, id)
 
 		ms.embeddingIndex.mu.Lock()
-		delete(ms.embeddingIndex.embeddings, id)
+		ms.embeddingIndex.remove(id)
 		ms.embeddingIndex.mu.Unlock()
 
-		// Remove from keyword index
+		// Remove from keyword, content, and time indexes
 		ms.removeFromKeywordIndex(mem)
+		ms.removeFromContentIndex(mem)
+		ms.removeFromTimeIndex(mem)
+		ms.queryCache.invalidate()
 
 		// Clean up old time buckets
 		ms.cleanupTimeBuckets()
@@ -1,9 +1,20 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -85,7 +96,7 @@ func TestHandleToolsList(t *testing.T) {
 	}
 	
 	// Verify we have the expected tools
-	expectedTools := []string{"store_memory", "query_memories", "create_relation", "get_stats", "wiki"}
+	expectedTools := []string{"store_memory", "query_memories", "search", "query_similar_batch", "create_relation", "create_relations", "delete_relation", "list_memory_types", "get_stats", "aging_report", "export_memories", "import_memories", "snapshot", "persist", "restore_snapshot", "memory_lineage", "touch_memory", "promote_memory", "demote_memory", "bulk_adjust", "set_embedding", "set_client_defaults", "memory_cluster", "list_keywords", "keyword_cooccurrence", "find_orphans", "find_hubs", "compare_memories", "suggest_relations", "reload_config", "rebuild_indexes", "health", "wiki"}
 	
 	if len(tools) != len(expectedTools) {
 		t.Errorf("Expected %d tools, got %d", len(expectedTools), len(tools))
@@ -104,6 +115,54 @@ func TestHandleToolsList(t *testing.T) {
 	}
 }
 
+// Test that nested array and object schemas survive marshaling a tool
+func TestToolNestedSchemas(t *testing.T) {
+	tools := make(map[string]Tool)
+	for _, tool := range toolDefinitions() {
+		tools[tool.Name] = tool
+	}
+
+	propertiesOf := func(name string) map[string]map[string]interface{} {
+		t.Helper()
+		data, err := json.Marshal(tools[name])
+		if err != nil {
+			t.Fatalf("Failed to marshal %s: %v", name, err)
+		}
+		var tool struct {
+			InputSchema struct {
+				Properties map[string]map[string]interface{} `json:"properties"`
+			} `json:"inputSchema"`
+		}
+		if err := json.Unmarshal(data, &tool); err != nil {
+			t.Fatalf("Failed to unmarshal %s: %v", name, err)
+		}
+		return tool.InputSchema.Properties
+	}
+
+	keywords := propertiesOf("query_memories")["keywords"]
+	if items, _ := keywords["items"].(map[string]interface{}); items["type"] != "string" {
+		t.Errorf("Expected keywords to have string items, got %v", keywords)
+	}
+
+	metadata := propertiesOf("store_memory")["metadata"]
+	fields, _ := metadata["properties"].(map[string]interface{})
+	tags, _ := fields["tags"].(map[string]interface{})
+	if metadata["type"] != "object" || tags["type"] != "array" || tags["items"].(map[string]interface{})["type"] != "string" {
+		t.Errorf("Expected metadata to declare a tags string array, got %v", metadata)
+	}
+
+	relations := propertiesOf("create_relations")["relations"]
+	item, _ := relations["items"].(map[string]interface{})
+	if _, ok := item["properties"].(map[string]interface{})["from_id"]; !ok || len(item["required"].([]interface{})) != 3 {
+		t.Errorf("Expected relation items to declare their fields, got %v", relations)
+	}
+
+	// Flat properties don't gain empty nested fields
+	if content := propertiesOf("store_memory")["content"]; len(content) != 2 {
+		t.Errorf("Expected content to have only type and description, got %v", content)
+	}
+}
+
 // Test store_memory tool call
 func TestHandleStoreMemoryTool(t *testing.T) {
 	store := NewMemoryStore(10)
@@ -175,6 +234,16 @@ func TestStoreMemoryValidation(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "decay out of range",
+			args: StoreMemoryArgs{
+				Type:       ShortTerm,
+				Content:    "test",
+				Importance: 0.5,
+				Decay:      1.5,
+			},
+			wantErr: true,
+		},
 		{
 			name: "valid memory",
 			args: StoreMemoryArgs{
@@ -196,6 +265,54 @@ func TestStoreMemoryValidation(t *testing.T) {
 	}
 }
 
+// Test that a custom decay rate is applied to stored memories
+func TestStoreMemoryCustomDecay(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+	server := &MCPServer{store: store}
+
+	volatile, err := server.StoreMemory(context.Background(), StoreMemoryArgs{
+		Type:       ShortTerm,
+		Content:    "Volatile build status",
+		Importance: 0.8,
+		Decay:      0.2,
+	})
+	if err != nil {
+		t.Fatalf("Failed to store volatile memory: %v", err)
+	}
+
+	durable, err := server.StoreMemory(context.Background(), StoreMemoryArgs{
+		Type:       ShortTerm,
+		Content:    "Durable user preference",
+		Importance: 0.8,
+	})
+	if err != nil {
+		t.Fatalf("Failed to store default memory: %v", err)
+	}
+
+	if volatile.Decay != 0.2 {
+		t.Errorf("Expected decay 0.2, got %f", volatile.Decay)
+	}
+	if durable.Decay != 0.01 {
+		t.Errorf("Expected default decay 0.01, got %f", durable.Decay)
+	}
+
+	store.mu.Lock()
+	twoHoursAgo := time.Now().Add(-2 * time.Hour)
+	volatile.LastAccess = twoHoursAgo
+	durable.LastAccess = twoHoursAgo
+	store.mu.Unlock()
+
+	store.applyDecay()
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	if volatile.Importance >= durable.Importance {
+		t.Errorf("Expected volatile importance %f to fall below durable importance %f",
+			volatile.Importance, durable.Importance)
+	}
+}
+
 // Test query_memories tool call
 func TestHandleQueryMemoriesTool(t *testing.T) {
 	store := NewMemoryStore(10)
@@ -295,6 +412,371 @@ func TestCreateRelation(t *testing.T) {
 }
 
 // Test relation validation
+func TestCreateRelations(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+	server := &MCPServer{store: store}
+
+	for _, id := range []string{"hub", "spoke-1", "spoke-2", "spoke-3"} {
+		store.Store(&Memory{ID: id, Type: Semantic, Content: "Memory " + id, Importance: 0.5})
+	}
+
+	args := []CreateRelationArgs{
+		{FromID: "hub", ToID: "spoke-1", RelationType: "part_of", Strength: 0.8},
+		{FromID: "hub", ToID: "spoke-2", RelationType: "part_of", Strength: 0.8},
+		{FromID: "hub", ToID: "missing", RelationType: "part_of", Strength: 0.8},
+		{FromID: "hub", ToID: "spoke-3", RelationType: "part_of", Strength: 0.8},
+	}
+	errs := server.CreateRelations(context.Background(), args)
+
+	if len(errs) != len(args) {
+		t.Fatalf("Expected %d results, got %d", len(args), len(errs))
+	}
+	for i, err := range errs {
+		if (err != nil) != (i == 2) {
+			t.Errorf("Relation %d: unexpected error state %v", i, err)
+		}
+	}
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	if len(store.relations["hub"]) != 3 {
+		t.Errorf("Expected 3 edges from hub, got %d", len(store.relations["hub"]))
+	}
+	if len(store.relationTypeIndex["part_of"]) != 3 {
+		t.Errorf("Expected 3 indexed part_of relations, got %d", len(store.relationTypeIndex["part_of"]))
+	}
+}
+
+// Test query_memories with relations attached to each result
+func TestQueryIncludeRelations(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+	server := &MCPServer{store: store}
+
+	store.Store(&Memory{ID: "cause", Type: Episodic, Content: "Deploy failed", Importance: 0.5})
+	store.Store(&Memory{ID: "effect", Type: Episodic, Content: "Rollback ran", Importance: 0.5})
+	server.CreateRelation(context.Background(), CreateRelationArgs{FromID: "cause", ToID: "effect", RelationType: "leads_to", Strength: 0.9})
+
+	params, _ := json.Marshal(map[string]interface{}{
+		"name": "query_memories",
+		"arguments": map[string]interface{}{
+			"query_type":        "keywords",
+			"keywords":          []string{"deploy"},
+			"include_relations": true,
+		},
+	})
+	response := server.handleMessage(MCPMessage{Jsonrpc: "2.0", ID: 1, Method: "tools/call", Params: params})
+	if response.Error != nil {
+		t.Fatalf("Expected no error, got %v", response.Error)
+	}
+
+	text := response.Result.(map[string]interface{})["content"].([]map[string]interface{})[0]["text"].(string)
+	var results []MemoryWithRelations
+	if err := json.Unmarshal([]byte(text), &results); err != nil {
+		t.Fatalf("Failed to parse results: %v", err)
+	}
+	if len(results) != 1 || results[0].ID != "cause" {
+		t.Fatalf("Expected the cause memory, got %+v", results)
+	}
+	if len(results[0].OutboundRelations) != 1 || results[0].OutboundRelations[0].To != "effect" {
+		t.Errorf("Expected leads_to relation to effect, got %+v", results[0].OutboundRelations)
+	}
+
+	// Relations stay off by default
+	plain := server.formatQueryResults([]*Memory{store.memories["cause"]}, QueryMemoryArgs{})
+	if _, ok := plain.([]*Memory); !ok {
+		t.Errorf("Expected plain memories without include_relations, got %T", plain)
+	}
+}
+
+// Test that ids_only returns the full query's IDs without content
+func TestQueryIDsOnly(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+	server := &MCPServer{store: store}
+
+	for _, id := range []string{"a", "b", "c"} {
+		store.Store(&Memory{ID: id, Type: Semantic, Content: "Shared deploy note " + id, Importance: 0.5, Embedding: []float32{1, 0}})
+	}
+
+	query := func(idsOnly bool) string {
+		params, _ := json.Marshal(map[string]interface{}{
+			"name": "query_memories",
+			"arguments": map[string]interface{}{
+				"query_type":  "type",
+				"memory_type": "semantic",
+				"ids_only":    idsOnly,
+			},
+		})
+		response := server.handleMessage(MCPMessage{Jsonrpc: "2.0", ID: 1, Method: "tools/call", Params: params})
+		if response.Error != nil {
+			t.Fatalf("Expected no error, got %v", response.Error)
+		}
+		return response.Result.(map[string]interface{})["content"].([]map[string]interface{})[0]["text"].(string)
+	}
+
+	var full []*Memory
+	if err := json.Unmarshal([]byte(query(false)), &full); err != nil {
+		t.Fatalf("Failed to parse full results: %v", err)
+	}
+	text := query(true)
+	var ids []string
+	if err := json.Unmarshal([]byte(text), &ids); err != nil {
+		t.Fatalf("Failed to parse ID results: %v", err)
+	}
+
+	fullIDs := make([]string, len(full))
+	for i, mem := range full {
+		fullIDs[i] = mem.ID
+	}
+	sort.Strings(fullIDs)
+	sort.Strings(ids)
+	if !reflect.DeepEqual(ids, fullIDs) || len(ids) != 3 {
+		t.Errorf("Expected IDs %v to match full query IDs %v", ids, fullIDs)
+	}
+	if strings.Contains(text, "deploy") || strings.Contains(text, "embedding") {
+		t.Errorf("Expected IDs-only response to omit content and embeddings, got %s", text)
+	}
+}
+
+// Test that count_only returns the full query's result count without content
+func TestQueryCountOnly(t *testing.T) {
+	store := NewMemoryStore(20)
+	defer store.Shutdown()
+	server := &MCPServer{store: store}
+
+	for i := 0; i < 5; i++ {
+		store.Store(&Memory{ID: fmt.Sprintf("deploy-%d", i), Type: Semantic, Content: "Deploy pipeline note", Importance: 0.5})
+	}
+	store.Store(&Memory{ID: "both", Type: Procedural, Content: "Deploy the kubernetes cluster", Importance: 0.5})
+	store.Store(&Memory{ID: "other", Type: Procedural, Content: "Kubernetes upgrade steps", Importance: 0.5})
+
+	for _, args := range []QueryMemoryArgs{
+		{QueryType: "keywords", Keywords: []string{"deploy"}},
+		{QueryType: "keywords", Keywords: []string{"deploy", "kubernetes", "Deploy"}},
+		{QueryType: "type", MemoryType: "procedural"},
+		{QueryType: "type", MemoryTypes: []string{"semantic", "procedural"}, Limit: 4},
+	} {
+		full, err := server.QueryMemories(nil, args)
+		if err != nil {
+			t.Fatalf("Query %+v failed: %v", args, err)
+		}
+		counted, err := server.CountMemories(nil, args)
+		if err != nil {
+			t.Fatalf("Count %+v failed: %v", args, err)
+		}
+		if counted["count"] != len(full) {
+			t.Errorf("Expected count %d for %+v, got %d", len(full), args, counted["count"])
+		}
+	}
+
+	// Counting is not an access
+	before := store.memories["other"].AccessCount
+	params, _ := json.Marshal(map[string]interface{}{
+		"name":      "query_memories",
+		"arguments": map[string]interface{}{"query_type": "keywords", "keywords": []string{"kubernetes"}, "count_only": true},
+	})
+	response := server.handleMessage(MCPMessage{Jsonrpc: "2.0", ID: 1, Method: "tools/call", Params: params})
+	if response.Error != nil {
+		t.Fatalf("Expected no error, got %v", response.Error)
+	}
+	text := response.Result.(map[string]interface{})["content"].([]map[string]interface{})[0]["text"].(string)
+	var counted map[string]int
+	if err := json.Unmarshal([]byte(text), &counted); err != nil || counted["count"] != 2 {
+		t.Errorf("Expected {\"count\": 2}, got %s (%v)", text, err)
+	}
+	if after := store.memories["other"].AccessCount; after != before {
+		t.Errorf("Expected counting not to record access, count went from %d to %d", before, after)
+	}
+}
+
+// Test syncing only the memories changed since a store version
+func TestQuerySinceVersion(t *testing.T) {
+	store := NewMemoryStore(20)
+	defer store.Shutdown()
+	server := &MCPServer{store: store}
+
+	for i := 0; i < 3; i++ {
+		store.Store(&Memory{ID: fmt.Sprintf("old-%d", i), Type: Semantic, Content: "Release checklist", Importance: 0.5})
+	}
+
+	syncIDs := func(since uint64) ([]string, uint64) {
+		params, _ := json.Marshal(map[string]interface{}{
+			"name":      "query_memories",
+			"arguments": map[string]interface{}{"query_type": "type", "memory_type": "semantic", "ids_only": true, "since_version": since},
+		})
+		response := server.handleMessage(MCPMessage{Jsonrpc: "2.0", ID: 1, Method: "tools/call", Params: params})
+		if response.Error != nil {
+			t.Fatalf("Expected no error, got %v", response.Error)
+		}
+		result := response.Result.(map[string]interface{})
+		var ids []string
+		json.Unmarshal([]byte(result["content"].([]map[string]interface{})[0]["text"].(string)), &ids)
+		sort.Strings(ids)
+		return ids, result["_meta"].(map[string]interface{})["store_version"].(uint64)
+	}
+
+	ids, version := syncIDs(0)
+	if len(ids) != 3 || version != 3 {
+		t.Fatalf("Expected 3 memories at version 3, got %v at version %d", ids, version)
+	}
+
+	// Reads don't change the version; a new memory and an updated one do
+	if _, again := syncIDs(0); again != version {
+		t.Errorf("Expected queries to leave the version at %d, got %d", version, again)
+	}
+	store.Store(&Memory{ID: "new", Type: Semantic, Content: "Rollback steps", Importance: 0.5})
+	store.Upsert(&Memory{ID: "old-1", Type: Semantic, Content: "Release checklist, revised", Importance: 0.6})
+
+	delta, next := syncIDs(version)
+	if !reflect.DeepEqual(delta, []string{"new", "old-1"}) || next != version+2 {
+		t.Errorf("Expected only new and old-1 at version %d, got %v at version %d", version+2, delta, next)
+	}
+	if delta, _ := syncIDs(next); len(delta) != 0 {
+		t.Errorf("Expected nothing changed since version %d, got %v", next, delta)
+	}
+
+	if counted, _ := server.CountMemories(nil, QueryMemoryArgs{QueryType: "type", MemoryType: "semantic", SinceVersion: version}); counted["count"] != 2 {
+		t.Errorf("Expected a count of 2 changed memories, got %v", counted)
+	}
+	if stats, _ := server.GetStats(nil); stats["store_version"] != next {
+		t.Errorf("Expected stats to report store version %d, got %v", next, stats["store_version"])
+	}
+}
+
+// Test that memories are stamped with a session and session queries see only that session
+func TestSessionQuery(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+	server := &MCPServer{store: store}
+	first := server.withSession("first")
+	second := server.withSession("second")
+
+	metadata := map[string]interface{}{"topic": "deploys"}
+	first.StoreMemory(context.Background(), StoreMemoryArgs{ID: "a", Content: "Learned in the first session", Importance: 0.5, Metadata: metadata})
+	second.StoreMemory(context.Background(), StoreMemoryArgs{ID: "b", Content: "Learned in the second session", Importance: 0.5})
+	first.StoreMemory(context.Background(), StoreMemoryArgs{ID: "c", Content: "Filed under the second session", Importance: 0.5, SessionID: "second"})
+	server.StoreMemory(context.Background(), StoreMemoryArgs{ID: "d", Content: "Stored without a session", Importance: 0.5})
+
+	if _, stamped := metadata[sessionMetadataKey]; stamped {
+		t.Error("Expected the caller's metadata map to be left unchanged")
+	}
+	if store.memories["a"].Metadata["topic"] != "deploys" || store.memories["a"].Metadata[sessionMetadataKey] != "first" {
+		t.Errorf("Expected a's metadata to keep its topic and gain the session, got %v", store.memories["a"].Metadata)
+	}
+	if _, stamped := store.memories["d"].Metadata[sessionMetadataKey]; stamped {
+		t.Error("Expected no session on a memory stored outside a session")
+	}
+
+	ids := func(memories []*Memory) []string {
+		result := make([]string, len(memories))
+		for i, mem := range memories {
+			result[i] = mem.ID
+		}
+		return result
+	}
+
+	results, err := first.QueryMemories(context.Background(), QueryMemoryArgs{QueryType: "session"})
+	if err != nil {
+		t.Fatalf("Session query failed: %v", err)
+	}
+	if got := ids(results); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Errorf("Expected only a in the first session, got %v", got)
+	}
+
+	results, err = first.QueryMemories(context.Background(), QueryMemoryArgs{QueryType: "session", SessionID: "second"})
+	if err != nil {
+		t.Fatalf("Session query failed: %v", err)
+	}
+	if got := ids(results); !reflect.DeepEqual(got, []string{"b", "c"}) {
+		t.Errorf("Expected b and c in the second session, got %v", got)
+	}
+
+	if _, err := server.QueryMemories(context.Background(), QueryMemoryArgs{QueryType: "session"}); !errors.Is(err, ErrValidation) {
+		t.Errorf("Expected a validation error without a session, got %v", err)
+	}
+}
+
+// Test that each client's store_memory defaults apply only to its own stores
+func TestClientDefaults(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+	server := &MCPServer{store: store}
+	coder := server.withClient("coder", "coder-session")
+	chat := server.withClient("chat", "chat-session")
+
+	// One client sets defaults at initialize, the other with the tool
+	response := coder.handleMessage(MCPMessage{Jsonrpc: "2.0", ID: 1, Method: "initialize",
+		Params: json.RawMessage(`{"protocolVersion": "2024-11-05", "memoryDefaults": {"memory_type": "procedural", "importance": 0.8}}`)})
+	if response.Error != nil {
+		t.Fatalf("initialize failed: %v", response.Error.Message)
+	}
+	response = chat.handleMessage(MCPMessage{Jsonrpc: "2.0", ID: 1, Method: "tools/call",
+		Params: json.RawMessage(`{"name": "set_client_defaults", "arguments": {"memory_type": "episodic", "importance": 0.3}}`)})
+	if response.Error != nil {
+		t.Fatalf("set_client_defaults failed: %v", response.Error.Message)
+	}
+
+	coder.StoreMemory(context.Background(), StoreMemoryArgs{ID: "build", Content: "Run make before committing"})
+	chat.StoreMemory(context.Background(), StoreMemoryArgs{ID: "talk", Content: "Discussed the release plan"})
+	chat.StoreMemory(context.Background(), StoreMemoryArgs{ID: "explicit", Type: Semantic, Content: "Releases ship on Tuesdays", Importance: 0.6})
+	server.StoreMemory(context.Background(), StoreMemoryArgs{ID: "global", Content: "Stored without client defaults"})
+
+	for id, want := range map[string]struct {
+		memoryType MemoryType
+		importance float32
+	}{
+		"build":    {Procedural, 0.8},
+		"talk":     {Episodic, 0.3},
+		"explicit": {Semantic, 0.6},
+		"global":   {ShortTerm, 0},
+	} {
+		mem := store.memories[id]
+		if mem.Type != want.memoryType || mem.Importance != want.importance {
+			t.Errorf("Expected %s stored as %s with importance %v, got %s with %v", id, want.memoryType, want.importance, mem.Type, mem.Importance)
+		}
+	}
+
+	if _, err := chat.SetClientDefaults(context.Background(), StoreDefaults{Importance: 1.5}); !errors.Is(err, ErrValidation) {
+		t.Errorf("Expected a validation error for importance above 1, got %v", err)
+	}
+	if chat.defaults.Importance != 0.3 {
+		t.Errorf("Expected rejected defaults to leave the old ones, got %v", chat.defaults)
+	}
+}
+
+// Test that tool calls run with a context carrying the client ID and deadline
+func TestRequestContext(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+	server := (&MCPServer{store: store, requestTimeout: time.Minute}).withClient("client-7", "session-7")
+
+	ctx, cancel := server.requestContext()
+	if clientID, ok := clientIDFromContext(ctx); !ok || clientID != "client-7" {
+		t.Errorf("Expected client-7 in the request context, got %q", clientID)
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		t.Error("Expected the request context to have a deadline")
+	}
+	cancel()
+	if ctx.Err() == nil {
+		t.Error("Expected the request context to end when cancelled")
+	}
+
+	// The handler receives the context: an already expired deadline stops a similarity scan
+	store.Store(&Memory{ID: "a", Type: Semantic, Content: "Vector", Embedding: []float32{1, 0}, Importance: 0.5})
+	server.requestTimeout = time.Nanosecond
+	params, _ := json.Marshal(map[string]interface{}{
+		"name":      "query_memories",
+		"arguments": map[string]interface{}{"query_type": "similarity", "embedding": []float32{1, 0}},
+	})
+	response := server.handleMessage(MCPMessage{Jsonrpc: "2.0", ID: 1, Method: "tools/call", Params: params})
+	if response.Error == nil || !strings.Contains(response.Error.Message, "deadline exceeded") {
+		t.Errorf("Expected the expired deadline to reach the query, got %+v", response)
+	}
+}
+
 func TestCreateRelationValidation(t *testing.T) {
 	store := NewMemoryStore(10)
 	defer store.Shutdown()
@@ -339,6 +821,15 @@ func TestCreateRelationValidation(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "self relation",
+			args: CreateRelationArgs{
+				FromID:       mem1.ID,
+				ToID:         mem1.ID,
+				RelationType: "related_to",
+			},
+			wantErr: true,
+		},
 		{
 			name: "non-existent from memory",
 			args: CreateRelationArgs{
@@ -369,53 +860,638 @@ func TestCreateRelationValidation(t *testing.T) {
 	}
 }
 
-// Test get_stats tool
-func TestGetStats(t *testing.T) {
+// Test that compact mode emits tool and resource results without indentation
+func TestCompactJSON(t *testing.T) {
 	store := NewMemoryStore(10)
 	defer store.Shutdown()
-	server := &MCPServer{store: store}
-	
-	// Store memories of different types
-	types := []MemoryType{ShortTerm, ShortTerm, LongTerm, Episodic, Semantic, Procedural}
-	for i, memType := range types {
-		_, err := server.StoreMemory(context.Background(), StoreMemoryArgs{
-			Type:       memType,
-			Content:    fmt.Sprintf("Test memory %d", i),
-			Importance: 0.5,
-		})
-		if err != nil {
-			t.Fatalf("Failed to store memory %d: %v", i, err)
+	server := &MCPServer{store: store, compactJSON: true}
+
+	textOf := func(response MCPMessage, key string) string {
+		t.Helper()
+		if response.Error != nil {
+			t.Fatalf("Unexpected error: %+v", response.Error)
 		}
-		// Small delay to ensure unique IDs
-		time.Sleep(time.Microsecond)
+		return response.Result.(map[string]interface{})[key].([]map[string]interface{})[0]["text"].(string)
 	}
-	
-	stats, err := server.GetStats(context.Background())
-	if err != nil {
-		t.Fatalf("GetStats failed: %v", err)
+
+	tool := server.handleMessage(MCPMessage{Jsonrpc: "2.0", ID: 1, Method: "tools/call",
+		Params: json.RawMessage(`{"name": "get_stats", "arguments": {}}`)})
+	resource := server.handleMessage(MCPMessage{Jsonrpc: "2.0", ID: 2, Method: "resources/read",
+		Params: json.RawMessage(`{"uri": "memory://stats"}`)})
+
+	for name, text := range map[string]string{"tool": textOf(tool, "content"), "resource": textOf(resource, "contents")} {
+		if strings.Contains(text, "\n") || strings.Contains(text, "  ") {
+			t.Errorf("Expected compact %s result, got %q", name, text)
+		}
+		if !json.Valid([]byte(text)) {
+			t.Errorf("Expected valid JSON %s result, got %q", name, text)
+		}
 	}
-	
-	// Verify total count
-	totalMemories, ok := stats["total_memories"].(int)
-	if !ok {
-		t.Fatal("total_memories not found in stats")
+
+	server.compactJSON = false
+	if text := textOf(server.handleMessage(MCPMessage{Jsonrpc: "2.0", ID: 3, Method: "tools/call",
+		Params: json.RawMessage(`{"name": "get_stats", "arguments": {}}`)}), "content"); !strings.Contains(text, "\n  ") {
+		t.Errorf("Expected indented result by default, got %q", text)
 	}
-	
-	if totalMemories != len(types) {
-		t.Errorf("Expected %d total memories, got %d", len(types), totalMemories)
+}
+
+// Test that self-relations are allowed when enabled and never return the seed
+func TestAllowSelfRelations(t *testing.T) {
+	config := DefaultConfig()
+	config.AllowSelfRelations = true
+	store := NewMemoryStoreWithConfig(config)
+	defer store.Shutdown()
+	server := &MCPServer{store: store}
+
+	for _, id := range []string{"seed", "other"} {
+		if err := store.Store(&Memory{ID: id, Type: Semantic, Content: "Node " + id, Importance: 0.5}); err != nil {
+			t.Fatalf("Failed to store memory %s: %v", id, err)
+		}
 	}
-	
-	// Verify type breakdown
-	byType, ok := stats["by_type"].(map[string]int)
-	if !ok {
-		t.Fatal("by_type not found in stats")
+	for _, rel := range []CreateRelationArgs{
+		{FromID: "seed", ToID: "seed", RelationType: "related_to"},
+		{FromID: "seed", ToID: "other", RelationType: "related_to"},
+		{FromID: "other", ToID: "seed", RelationType: "related_to"},
+	} {
+		if err := server.CreateRelation(context.Background(), rel); err != nil {
+			t.Fatalf("Failed to create relation %+v: %v", rel, err)
+		}
 	}
-	
-	if byType["short_term"] != 2 {
-		t.Errorf("Expected 2 short_term memories, got %d", byType["short_term"])
+
+	results, err := store.Query(QueryCriteria{Type: "related", MemoryID: "seed", Depth: 3})
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
 	}
-	
-	// Verify capacity
+	if len(results) != 1 || results[0].ID != "other" {
+		ids := make([]string, len(results))
+		for i, mem := range results {
+			ids[i] = mem.ID
+		}
+		t.Errorf("Expected only other to be related, got %v", ids)
+	}
+}
+
+// Test querying relations and connected memories by relation type
+func TestRelationTypeIndex(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+	server := &MCPServer{store: store}
+
+	for _, id := range []string{"bug", "fix", "feature", "spec"} {
+		mem := &Memory{ID: id, Type: Episodic, Content: "Memory " + id, Importance: 0.5}
+		if err := store.Store(mem); err != nil {
+			t.Fatalf("Failed to store memory %s: %v", id, err)
+		}
+	}
+
+	relations := []CreateRelationArgs{
+		{FromID: "bug", ToID: "fix", RelationType: "solved_by", Strength: 0.8},
+		{FromID: "feature", ToID: "spec", RelationType: "derived_from", Strength: 0.6},
+	}
+	for _, rel := range relations {
+		if err := server.CreateRelation(context.Background(), rel); err != nil {
+			t.Fatalf("Failed to create relation: %v", err)
+		}
+	}
+
+	solved := store.RelationsByType("solved_by")
+	if len(solved) != 1 || solved[0].From != "bug" || solved[0].To != "fix" {
+		t.Errorf("Unexpected solved_by relations: %+v", solved)
+	}
+
+	results, err := store.Query(QueryCriteria{Type: "relation_type", RelationType: "derived_from"})
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if len(results) != 2 || results[0].ID != "feature" || results[1].ID != "spec" {
+		t.Errorf("Expected feature and spec, got %d results", len(results))
+	}
+
+	err = server.DeleteRelation(context.Background(), DeleteRelationArgs{FromID: "bug", ToID: "fix"})
+	if err != nil {
+		t.Fatalf("Failed to delete relation: %v", err)
+	}
+	if remaining := store.RelationsByType("solved_by"); len(remaining) != 0 {
+		t.Errorf("Expected no solved_by relations after delete, got %d", len(remaining))
+	}
+	if remaining := store.RelationsByType("derived_from"); len(remaining) != 1 {
+		t.Errorf("Expected derived_from relation to remain, got %d", len(remaining))
+	}
+}
+
+// Test that a near-threshold memory shows up in the aging report
+func TestAgingReport(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+	server := &MCPServer{store: store}
+
+	now := time.Now()
+	memories := []*Memory{
+		// Each tick subtracts 0.01 * ~4h past the grace period, crossing 0.1 in two ticks
+		{ID: "fading", Type: ShortTerm, Content: "Fading memory", Importance: 0.15, Decay: 0.01, LastAccess: now.Add(-5 * time.Hour)},
+		// 276 ticks past the grace period sum to ~3185 decaying hours: 0.9 - 0.0001*3185 = 0.58
+		{ID: "strong", Type: LongTerm, Content: "Strong memory", Importance: 0.9, Decay: 0.0001, LastAccess: now},
+	}
+	for _, m := range memories {
+		if err := store.Store(m); err != nil {
+			t.Fatalf("Failed to store memory: %v", err)
+		}
+	}
+
+	report, err := server.AgingReport(context.Background(), AgingReportArgs{HorizonHours: 24})
+	if err != nil {
+		t.Fatalf("AgingReport failed: %v", err)
+	}
+
+	if len(report) != 1 || report[0].ID != "fading" {
+		t.Fatalf("Expected only the fading memory in report, got %+v", report)
+	}
+	if report[0].ProjectedImportance >= store.decayRemovalThreshold {
+		t.Errorf("Projected importance %f should be below threshold", report[0].ProjectedImportance)
+	}
+	if report[0].HoursUntilRemoval > 24 {
+		t.Errorf("Expected removal within horizon, got %f hours", report[0].HoursUntilRemoval)
+	}
+}
+
+// Test search matching content, tags, and metadata together
+func TestSearch(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+	server := &MCPServer{store: store}
+
+	store.Store(&Memory{ID: "content", Type: Semantic, Content: "Postgres connection pooling notes", Importance: 0.5})
+	store.Store(&Memory{ID: "tagged", Type: Semantic, Content: "Database runbook", Importance: 0.5,
+		Metadata: map[string]interface{}{"tags": []interface{}{"Postgres", "ops"}}})
+	store.Store(&Memory{ID: "meta", Type: Semantic, Content: "Migration plan", Importance: 0.5,
+		Metadata: map[string]interface{}{"project": "postgres upgrade"}})
+	store.Store(&Memory{ID: "unrelated", Type: Semantic, Content: "Lunch order", Importance: 0.9})
+
+	results, err := server.Search(context.Background(), SearchArgs{Query: "postgres"})
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+
+	expected := []struct {
+		id      string
+		matched string
+	}{{"tagged", "tags"}, {"content", "content"}, {"meta", "metadata"}}
+	if len(results) != len(expected) {
+		t.Fatalf("Expected %d results, got %d", len(expected), len(results))
+	}
+	for i, want := range expected {
+		if results[i].ID != want.id || !reflect.DeepEqual(results[i].MatchedIn, []string{want.matched}) {
+			t.Errorf("Result %d: expected %s via %s, got %s via %v", i, want.id, want.matched, results[i].ID, results[i].MatchedIn)
+		}
+	}
+
+	if _, err := server.Search(context.Background(), SearchArgs{Query: "  "}); err == nil {
+		t.Error("Expected error for empty query")
+	}
+}
+
+// Test memory_lineage tool after a promotion
+func TestMemoryLineage(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+	server := &MCPServer{store: store}
+
+	stored, err := server.StoreMemory(context.Background(), StoreMemoryArgs{Type: ShortTerm, Content: "Key design decision", Importance: 0.9})
+	if err != nil {
+		t.Fatalf("StoreMemory failed: %v", err)
+	}
+	store.Query(QueryCriteria{Type: "keywords", Keywords: []string{"design"}})
+	store.consolidateMemories()
+
+	lineage, err := server.MemoryLineage(context.Background(), MemoryLineageArgs{MemoryID: stored.ID})
+	if err != nil {
+		t.Fatalf("MemoryLineage failed: %v", err)
+	}
+
+	var events []string
+	for _, event := range lineage.History {
+		events = append(events, event.Event)
+	}
+	if !reflect.DeepEqual(events, []string{"created", "accessed", "promoted"}) {
+		t.Errorf("Unexpected history events: %v", events)
+	}
+	if last := lineage.History[len(lineage.History)-1]; last.Detail != "short_term -> long_term" {
+		t.Errorf("Unexpected promotion detail: %q", last.Detail)
+	}
+	if lineage.Type != LongTerm || lineage.AccessCount != 1 || lineage.HoursUntilRemoval == nil {
+		t.Errorf("Unexpected lineage summary: %+v", lineage)
+	}
+}
+
+// Test that errors match their category and map to JSON-RPC codes
+func TestErrorCategories(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+	server := &MCPServer{store: store}
+
+	store.Store(&Memory{ID: "dup", Type: ShortTerm, Content: "First", Importance: 0.5})
+	err := store.Store(&Memory{ID: "dup", Type: ShortTerm, Content: "Second", Importance: 0.5})
+	if !errors.Is(err, ErrDuplicateID) || err.Error() != "memory with ID dup already exists" {
+		t.Errorf("Expected duplicate ID error with original message, got %v", err)
+	}
+	if _, err := store.Lineage("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected not found error, got %v", err)
+	}
+	if _, err := store.Query(QueryCriteria{}); !errors.Is(err, ErrValidation) {
+		t.Errorf("Expected validation error, got %v", err)
+	}
+	if !errors.Is(ErrStoreFull, ErrCapacity) {
+		t.Error("Expected ErrStoreFull to be a capacity error")
+	}
+
+	tests := []struct {
+		tool string
+		args map[string]interface{}
+		code int
+	}{
+		{"store_memory", map[string]interface{}{"content": ""}, -32602},
+		{"store_memory", map[string]interface{}{"id": "dup", "content": "Again"}, -32006},
+		{"memory_lineage", map[string]interface{}{"memory_id": "missing"}, -32001},
+	}
+	for _, tt := range tests {
+		params, _ := json.Marshal(map[string]interface{}{"name": tt.tool, "arguments": tt.args})
+		response := server.handleMessage(MCPMessage{Jsonrpc: "2.0", ID: 1, Method: "tools/call", Params: params})
+		if response.Error == nil || response.Error.Code != tt.code {
+			t.Errorf("%s %v: expected code %d, got %+v", tt.tool, tt.args, tt.code, response.Error)
+		}
+	}
+}
+
+// Test that a stale versioned upsert is rejected instead of clobbering a newer write
+func TestVersionedUpsert(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+	server := &MCPServer{store: store}
+
+	created, err := server.StoreMemory(context.Background(), StoreMemoryArgs{ID: "shared", Content: "Original", Importance: 0.5})
+	if err != nil {
+		t.Fatalf("Failed to store memory: %v", err)
+	}
+	if created.Version != 1 {
+		t.Fatalf("Expected a new memory at version 1, got %d", created.Version)
+	}
+
+	// Both clients read version 1; the first update wins
+	updated, err := server.StoreMemory(context.Background(), StoreMemoryArgs{ID: "shared", Content: "First client", Importance: 0.5, Upsert: true, ExpectedVersion: 1})
+	if err != nil {
+		t.Fatalf("First update failed: %v", err)
+	}
+	if updated.Version != 2 {
+		t.Errorf("Expected version 2 after update, got %d", updated.Version)
+	}
+
+	params, _ := json.Marshal(map[string]interface{}{
+		"name":      "store_memory",
+		"arguments": map[string]interface{}{"id": "shared", "content": "Second client", "upsert": true, "expected_version": 1},
+	})
+	response := server.handleMessage(MCPMessage{Jsonrpc: "2.0", ID: 1, Method: "tools/call", Params: params})
+	if response.Error == nil || response.Error.Code != -32004 {
+		t.Fatalf("Expected a conflict error for the stale update, got %+v", response.Error)
+	}
+	if content := store.memories["shared"].Content; content != "First client" {
+		t.Errorf("Stale update clobbered the memory: %q", content)
+	}
+
+	// Unversioned upserts still apply unconditionally
+	if err := store.Upsert(&Memory{ID: "shared", Type: ShortTerm, Content: "Last writer", Importance: 0.5}); err != nil {
+		t.Fatalf("Unversioned upsert failed: %v", err)
+	}
+	if v := store.memories["shared"].Version; v != 3 {
+		t.Errorf("Expected version 3, got %d", v)
+	}
+	if err := store.UpsertVersion(&Memory{ID: "new", Type: ShortTerm, Content: "Never stored", Importance: 0.5}, 1); !errors.Is(err, ErrConflict) {
+		t.Errorf("Expected conflict when expecting a version of a missing memory, got %v", err)
+	}
+}
+
+// Test memory_cluster tool
+func TestMemoryCluster(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+	server := &MCPServer{store: store}
+
+	memories := []*Memory{
+		{ID: "seed", Type: Semantic, Content: "Project uses Go", Importance: 0.9},
+		{ID: "a", Type: Semantic, Content: "Go modules", Importance: 0.6},
+		{ID: "b", Type: Episodic, Content: "Upgraded Go", Importance: 0.3},
+		{ID: "outside", Type: Episodic, Content: "Unrelated", Importance: 0.5},
+	}
+	for _, m := range memories {
+		store.Store(m)
+	}
+	relations := []CreateRelationArgs{
+		{FromID: "seed", ToID: "a", RelationType: "relates_to", Strength: 0.8},
+		{FromID: "a", ToID: "b", RelationType: "relates_to", Strength: 0.5},
+		{FromID: "b", ToID: "seed", RelationType: "relates_to", Strength: 0.5},
+		{FromID: "outside", ToID: "seed", RelationType: "relates_to", Strength: 0.5},
+	}
+	for _, rel := range relations {
+		if err := server.CreateRelation(context.Background(), rel); err != nil {
+			t.Fatalf("Failed to create relation: %v", err)
+		}
+	}
+
+	summary, err := server.MemoryCluster(context.Background(), MemoryClusterArgs{MemoryID: "seed", Depth: 3})
+	if err != nil {
+		t.Fatalf("MemoryCluster failed: %v", err)
+	}
+
+	if summary.Count != 3 || len(summary.Members) != 3 || summary.Members[0].ID != "seed" {
+		t.Errorf("Expected seed, a, and b as members, got %d members", summary.Count)
+	}
+	if len(summary.Edges) != 3 {
+		t.Errorf("Expected 3 edges within the cluster, got %d", len(summary.Edges))
+	}
+	if math.Abs(float64(summary.AverageImportance)-0.6) > 1e-6 {
+		t.Errorf("Expected average importance 0.6, got %f", summary.AverageImportance)
+	}
+	if summary.DominantType != Semantic {
+		t.Errorf("Expected dominant type semantic, got %s", summary.DominantType)
+	}
+
+	if _, err := server.MemoryCluster(context.Background(), MemoryClusterArgs{MemoryID: "missing"}); err == nil {
+		t.Error("Expected error for missing seed memory")
+	}
+}
+
+// Test list_keywords tool
+func TestListKeywords(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+	server := &MCPServer{store: store}
+
+	contents := []string{"Deploy the API", "Deploy the worker", "Debug the API"}
+	for i, content := range contents {
+		store.Store(&Memory{ID: fmt.Sprintf("kw-%d", i), Type: ShortTerm, Content: content, Importance: 0.5})
+	}
+
+	keywords, err := server.ListKeywords(context.Background(), ListKeywordsArgs{Prefix: "de"})
+	if err != nil {
+		t.Fatalf("ListKeywords failed: %v", err)
+	}
+	expected := []KeywordCount{{"deploy", 2}, {"debug", 1}}
+	if !reflect.DeepEqual(keywords, expected) {
+		t.Errorf("Expected %v, got %v", expected, keywords)
+	}
+
+	keywords, _ = server.ListKeywords(context.Background(), ListKeywordsArgs{Limit: 1})
+	if len(keywords) != 1 || keywords[0].Keyword != "the" || keywords[0].Count != 3 {
+		t.Errorf("Expected most frequent keyword 'the' with count 3, got %v", keywords)
+	}
+
+	if _, err := server.ListKeywords(context.Background(), ListKeywordsArgs{Sort: "random"}); err == nil {
+		t.Error("Expected error for invalid sort")
+	}
+}
+
+// Test that keywords always found together are the top co-occurrences
+func TestKeywordCooccurrence(t *testing.T) {
+	store := NewMemoryStore(20)
+	defer store.Shutdown()
+	server := &MCPServer{store: store}
+
+	contents := []string{
+		"kubernetes cluster upgrade",
+		"kubernetes cluster autoscaling",
+		"kubernetes cluster networking",
+		"docker image upgrade",
+	}
+	for i, content := range contents {
+		store.Store(&Memory{ID: fmt.Sprintf("co-%d", i), Type: Semantic, Content: content, Importance: 0.5})
+	}
+
+	counts, err := server.KeywordCooccurrence(context.Background(), KeywordCooccurrenceArgs{Keyword: "Kubernetes", Limit: 2})
+	if err != nil {
+		t.Fatalf("KeywordCooccurrence failed: %v", err)
+	}
+	expected := []KeywordCount{{Keyword: "cluster", Count: 3}, {Keyword: "autoscaling", Count: 1}}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Errorf("Expected %v, got %v", expected, counts)
+	}
+
+	if counts, _ := server.KeywordCooccurrence(context.Background(), KeywordCooccurrenceArgs{Keyword: "missing"}); len(counts) != 0 {
+		t.Errorf("Expected no co-occurrences for an unknown keyword, got %v", counts)
+	}
+	if _, err := server.KeywordCooccurrence(context.Background(), KeywordCooccurrenceArgs{Keyword: "kubernetes", Limit: 101}); !errors.Is(err, ErrValidation) {
+		t.Errorf("Expected a validation error above the limit cap, got %v", err)
+	}
+}
+
+// Test that find_orphans lists only memories without live relations
+func TestFindOrphans(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+	server := &MCPServer{store: store}
+
+	base := time.Now().Add(-time.Hour)
+	for i, id := range []string{"lonely", "source", "target", "quiet", "dangling", "gone"} {
+		store.Store(&Memory{ID: id, Type: Semantic, Content: "Graph node " + id, Importance: 0.5, Timestamp: base.Add(time.Duration(i) * time.Minute)})
+	}
+	server.CreateRelation(context.Background(), CreateRelationArgs{FromID: "source", ToID: "target", RelationType: "leads_to", Strength: 0.5})
+	server.CreateRelation(context.Background(), CreateRelationArgs{FromID: "dangling", ToID: "gone", RelationType: "leads_to", Strength: 0.5})
+
+	// Removing the target leaves dangling with a relation to nothing
+	store.mu.Lock()
+	store.removeMemory("gone")
+	store.mu.Unlock()
+
+	report, err := server.FindOrphans(context.Background(), FindOrphansArgs{})
+	if err != nil {
+		t.Fatalf("FindOrphans failed: %v", err)
+	}
+	var ids []string
+	for _, mem := range report.Orphans {
+		ids = append(ids, mem.ID)
+	}
+	if !reflect.DeepEqual(ids, []string{"lonely", "quiet", "dangling"}) || report.Total != 3 {
+		t.Errorf("Expected orphans lonely, quiet, dangling oldest first, got %v (total %d)", ids, report.Total)
+	}
+
+	limited, err := server.FindOrphans(context.Background(), FindOrphansArgs{Limit: 1})
+	if err != nil {
+		t.Fatalf("FindOrphans failed: %v", err)
+	}
+	if len(limited.Orphans) != 1 || limited.Orphans[0].ID != "lonely" || limited.Total != 3 {
+		t.Errorf("Expected the oldest orphan with the full total, got %+v", limited)
+	}
+
+	if _, err := server.FindOrphans(context.Background(), FindOrphansArgs{Limit: -1}); !errors.Is(err, ErrValidation) {
+		t.Errorf("Expected a validation error for a negative limit, got %v", err)
+	}
+}
+
+// Test that find_hubs ranks the center of a star graph first
+func TestFindHubs(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+	server := &MCPServer{store: store}
+
+	for _, id := range []string{"center", "a", "b", "c", "d", "lonely"} {
+		store.Store(&Memory{ID: id, Type: Semantic, Content: "Graph node " + id, Importance: 0.5})
+	}
+	// Edges in both directions count toward the center's degree
+	for _, id := range []string{"a", "b", "c"} {
+		server.CreateRelation(context.Background(), CreateRelationArgs{FromID: "center", ToID: id, RelationType: "includes", Strength: 0.5})
+	}
+	server.CreateRelation(context.Background(), CreateRelationArgs{FromID: "d", ToID: "center", RelationType: "part_of", Strength: 0.5})
+	server.CreateRelation(context.Background(), CreateRelationArgs{FromID: "a", ToID: "b", RelationType: "relates_to", Strength: 0.5})
+
+	hubs, err := server.FindHubs(context.Background(), FindHubsArgs{})
+	if err != nil {
+		t.Fatalf("FindHubs failed: %v", err)
+	}
+	var ids []string
+	for _, hub := range hubs {
+		ids = append(ids, hub.Memory.ID)
+	}
+	if !reflect.DeepEqual(ids, []string{"center", "a", "b", "c", "d"}) {
+		t.Errorf("Expected center first, then ties by ID without the unconnected memory, got %v", ids)
+	}
+	if center := hubs[0]; center.Outbound != 3 || center.Inbound != 1 || center.Degree != 4 {
+		t.Errorf("Expected center with 3 outbound and 1 inbound, got %+v", center)
+	}
+
+	limited, err := server.FindHubs(context.Background(), FindHubsArgs{Limit: 1})
+	if err != nil || len(limited) != 1 || limited[0].Memory.ID != "center" {
+		t.Errorf("Expected only the center with limit 1, got %+v, %v", limited, err)
+	}
+	if _, err := server.FindHubs(context.Background(), FindHubsArgs{Limit: -1}); !errors.Is(err, ErrValidation) {
+		t.Errorf("Expected a validation error for a negative limit, got %v", err)
+	}
+}
+
+// Test cosine similarity between two stored memories
+func TestCompareMemories(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+	server := &MCPServer{store: store}
+
+	store.Store(&Memory{ID: "a", Type: Semantic, Content: "First", Embedding: []float32{1, 0, 0}, Importance: 0.5})
+	store.Store(&Memory{ID: "b", Type: Semantic, Content: "Second", Embedding: []float32{1, 1, 0}, Importance: 0.5})
+	store.Store(&Memory{ID: "plain", Type: Semantic, Content: "No embedding", Importance: 0.5})
+	if err := store.Store(&Memory{ID: "short", Type: Semantic, Content: "Shorter", Embedding: []float32{1, 0}, Importance: 0.5}); !errors.Is(err, ErrValidation) {
+		t.Errorf("Expected a validation error storing mismatched dimensions, got %v", err)
+	}
+	// Stores now reject mixed dimensions, so plant one to check Compare still does
+	store.Store(&Memory{ID: "short", Type: Semantic, Content: "Shorter", Importance: 0.5})
+	store.memories["short"].Embedding = []float32{1, 0}
+
+	// cos 45 degrees, regardless of vector length
+	comparison, err := server.CompareMemories(context.Background(), CompareMemoriesArgs{IDA: "a", IDB: "b"})
+	if err != nil {
+		t.Fatalf("CompareMemories failed: %v", err)
+	}
+	if want := float32(1 / math.Sqrt2); math.Abs(float64(comparison.Similarity-want)) > 1e-6 {
+		t.Errorf("Expected similarity %v, got %v", want, comparison.Similarity)
+	}
+	if self, _ := store.Compare("b", "b"); math.Abs(float64(self-1)) > 1e-6 {
+		t.Errorf("Expected a memory to be identical to itself, got %v", self)
+	}
+
+	if _, err := store.Compare("a", "plain"); !errors.Is(err, ErrValidation) {
+		t.Errorf("Expected a validation error without an embedding, got %v", err)
+	}
+	if _, err := store.Compare("a", "short"); !errors.Is(err, ErrValidation) {
+		t.Errorf("Expected a validation error for mismatched dimensions, got %v", err)
+	}
+	if _, err := store.Compare("a", "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected not found for a missing memory, got %v", err)
+	}
+}
+
+// Test that near neighbors are suggested as relations and distant ones aren't
+func TestSuggestRelations(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+	server := &MCPServer{store: store}
+
+	store.Store(&Memory{ID: "seed", Type: Semantic, Content: "Seed", Embedding: []float32{1, 0, 0}, Importance: 0.5})
+	store.Store(&Memory{ID: "near", Type: Semantic, Content: "Near", Embedding: []float32{0.95, 0.1, 0}, Importance: 0.5})
+	store.Store(&Memory{ID: "linked", Type: Semantic, Content: "Linked", Embedding: []float32{0.9, 0.1, 0}, Importance: 0.5})
+	store.Store(&Memory{ID: "far", Type: Semantic, Content: "Far", Embedding: []float32{0, 0, 1}, Importance: 0.5})
+	server.CreateRelation(context.Background(), CreateRelationArgs{FromID: "linked", ToID: "seed", RelationType: "supports", Strength: 0.5})
+
+	suggestions, err := server.SuggestRelations(context.Background(), SuggestRelationsArgs{MemoryID: "seed"})
+	if err != nil {
+		t.Fatalf("SuggestRelations failed: %v", err)
+	}
+	if len(suggestions) != 1 || suggestions[0].ID != "near" || suggestions[0].Similarity < 0.8 {
+		t.Errorf("Expected only near to be suggested, got %+v", suggestions)
+	}
+	if len(store.relations["seed"]) != 0 {
+		t.Errorf("Expected no relations to be created, got %v", store.relations["seed"])
+	}
+
+	// A low enough threshold admits the distant memory too, ranked last
+	lowest := float32(-1)
+	suggestions, _ = server.SuggestRelations(context.Background(), SuggestRelationsArgs{MemoryID: "seed", Threshold: &lowest})
+	if len(suggestions) != 2 || suggestions[1].ID != "far" {
+		t.Errorf("Expected near then far, got %+v", suggestions)
+	}
+	// An explicit zero is a threshold, not a request for the default
+	zero := float32(0)
+	suggestions, _ = server.SuggestRelations(context.Background(), SuggestRelationsArgs{MemoryID: "seed", Threshold: &zero})
+	if len(suggestions) != 2 || suggestions[1].ID != "far" {
+		t.Errorf("Expected the orthogonal memory at threshold 0, got %+v", suggestions)
+	}
+
+	if _, err := server.SuggestRelations(context.Background(), SuggestRelationsArgs{MemoryID: "missing"}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected not found for a missing seed, got %v", err)
+	}
+}
+
+// Test get_stats tool
+func TestGetStats(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+	server := &MCPServer{store: store}
+	
+	// Store memories of different types
+	types := []MemoryType{ShortTerm, ShortTerm, LongTerm, Episodic, Semantic, Procedural}
+	for i, memType := range types {
+		_, err := server.StoreMemory(context.Background(), StoreMemoryArgs{
+			Type:       memType,
+			Content:    fmt.Sprintf("Test memory %d", i),
+			Importance: 0.5,
+		})
+		if err != nil {
+			t.Fatalf("Failed to store memory %d: %v", i, err)
+		}
+		// Small delay to ensure unique IDs
+		time.Sleep(time.Microsecond)
+	}
+	
+	stats, err := server.GetStats(context.Background())
+	if err != nil {
+		t.Fatalf("GetStats failed: %v", err)
+	}
+	
+	// Verify total count
+	totalMemories, ok := stats["total_memories"].(int)
+	if !ok {
+		t.Fatal("total_memories not found in stats")
+	}
+	
+	if totalMemories != len(types) {
+		t.Errorf("Expected %d total memories, got %d", len(types), totalMemories)
+	}
+	
+	// Verify type breakdown
+	byType, ok := stats["by_type"].(map[string]int)
+	if !ok {
+		t.Fatal("by_type not found in stats")
+	}
+	
+	if byType["short_term"] != 2 {
+		t.Errorf("Expected 2 short_term memories, got %d", byType["short_term"])
+	}
+	
+	// Verify capacity
 	capacityUsed, ok := stats["capacity_used"].(float32)
 	if !ok {
 		t.Fatal("capacity_used not found in stats")
@@ -427,6 +1503,46 @@ func TestGetStats(t *testing.T) {
 	}
 }
 
+// Test that list_memory_types describes all five types
+func TestListMemoryTypes(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxMemories = 10
+	config.TypeCapacities = map[MemoryType]int{Episodic: 3}
+	config.ImportanceFloors = map[MemoryType]float32{Semantic: 0.3}
+	store := NewMemoryStoreWithConfig(config)
+	defer store.Shutdown()
+	server := &MCPServer{store: store}
+
+	store.Store(&Memory{ID: "fact", Type: Semantic, Content: "User prefers Go", Importance: 0.7})
+
+	types, err := server.ListMemoryTypes(context.Background())
+	if err != nil {
+		t.Fatalf("ListMemoryTypes failed: %v", err)
+	}
+	if len(types) != len(allMemoryTypes) {
+		t.Fatalf("Expected %d memory types, got %d", len(allMemoryTypes), len(types))
+	}
+	byType := make(map[MemoryType]MemoryTypeInfo)
+	for _, info := range types {
+		if info.Description == "" || info.Example == "" || info.Importance == "" || info.Decay <= 0 {
+			t.Errorf("Expected full guidance for %s, got %+v", info.Type, info)
+		}
+		byType[info.Type] = info
+	}
+	for _, memoryType := range allMemoryTypes {
+		if _, ok := byType[memoryType]; !ok {
+			t.Errorf("Expected memory type %s to be listed", memoryType)
+		}
+	}
+
+	if semantic := byType[Semantic]; semantic.Count != 1 || semantic.ImportanceFloor == nil || *semantic.ImportanceFloor != 0.3 {
+		t.Errorf("Expected semantic with 1 memory and a 0.3 floor, got %+v", semantic)
+	}
+	if byType[Episodic].Capacity != 3 || byType[ShortTerm].ConsolidatesInto != LongTerm {
+		t.Errorf("Expected episodic capacity 3 and short_term consolidating into long_term, got %+v and %+v", byType[Episodic], byType[ShortTerm])
+	}
+}
+
 // Test wiki tool
 func TestGetWiki(t *testing.T) {
 	wiki := docs.GetWiki()
@@ -526,12 +1642,12 @@ func TestHandleResourcesList(t *testing.T) {
 	}
 	
 	// Verify we have the expected resources
-	if len(resources) != 2 {
-		t.Errorf("Expected 2 resources, got %d", len(resources))
+	if len(resources) != 4 {
+		t.Errorf("Expected 4 resources, got %d", len(resources))
 	}
 	
 	// Check resource URIs
-	expectedURIs := []string{"memory://stats", "memory://graph"}
+	expectedURIs := []string{"memory://stats", "memory://graph", "memory://events", "memory://schema"}
 	for i, resource := range resources {
 		if resource["uri"] != expectedURIs[i] {
 			t.Errorf("Expected URI %s, got %s", expectedURIs[i], resource["uri"])
@@ -539,6 +1655,142 @@ func TestHandleResourcesList(t *testing.T) {
 	}
 }
 
+// Test reading single memories and type listings through resource templates
+func TestResourceTemplates(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+	server := &MCPServer{store: store}
+
+	response := server.handleMessage(MCPMessage{Jsonrpc: "2.0", ID: 1, Method: "resources/templates/list"})
+	if response.Error != nil {
+		t.Fatalf("Expected no error, got %v", response.Error)
+	}
+	templates := response.Result.(map[string]interface{})["resourceTemplates"].([]map[string]string)
+	if len(templates) != 2 || templates[0]["uriTemplate"] != "memory://memory/{id}" || templates[1]["uriTemplate"] != "memory://type/{type}" {
+		t.Errorf("Unexpected resource templates: %v", templates)
+	}
+
+	for _, mem := range []*Memory{
+		{ID: "fact-1", Type: Semantic, Content: "Go has goroutines", Timestamp: time.Now().Add(-time.Hour)},
+		{ID: "fact-2", Type: Semantic, Content: "Go has channels", Timestamp: time.Now()},
+		{ID: "event-1", Type: Episodic, Content: "Met the team", Timestamp: time.Now()},
+	} {
+		if err := store.Store(mem); err != nil {
+			t.Fatalf("Failed to store memory: %v", err)
+		}
+	}
+
+	read := func(uri string) (string, *MCPError) {
+		t.Helper()
+		response := server.handleMessage(MCPMessage{Jsonrpc: "2.0", ID: 2, Method: "resources/read",
+			Params: json.RawMessage(`{"uri": "` + uri + `"}`)})
+		if response.Error != nil {
+			return "", response.Error
+		}
+		contents := response.Result.(map[string]interface{})["contents"].([]map[string]interface{})
+		if contents[0]["uri"] != uri {
+			t.Errorf("Expected contents URI %s, got %v", uri, contents[0]["uri"])
+		}
+		return contents[0]["text"].(string), nil
+	}
+
+	text, mcpErr := read("memory://memory/fact-1")
+	if mcpErr != nil {
+		t.Fatalf("Expected no error reading memory, got %v", mcpErr)
+	}
+	var mem Memory
+	if err := json.Unmarshal([]byte(text), &mem); err != nil {
+		t.Fatalf("Failed to parse memory: %v", err)
+	}
+	if mem.ID != "fact-1" || mem.Content != "Go has goroutines" {
+		t.Errorf("Expected fact-1, got %+v", mem)
+	}
+
+	text, mcpErr = read("memory://type/semantic")
+	if mcpErr != nil {
+		t.Fatalf("Expected no error reading type, got %v", mcpErr)
+	}
+	var listing struct {
+		Type     string   `json:"type"`
+		Count    int      `json:"count"`
+		Memories []Memory `json:"memories"`
+	}
+	if err := json.Unmarshal([]byte(text), &listing); err != nil {
+		t.Fatalf("Failed to parse type listing: %v", err)
+	}
+	if listing.Type != "semantic" || listing.Count != 2 || len(listing.Memories) != 2 ||
+		listing.Memories[0].ID != "fact-1" || listing.Memories[1].ID != "fact-2" {
+		t.Errorf("Expected fact-1 and fact-2 oldest first, got %+v", listing)
+	}
+
+	if _, mcpErr = read("memory://memory/missing"); mcpErr == nil || mcpErr.Code != errCodeResourceNotFound {
+		t.Errorf("Expected resource not found error for missing memory, got %v", mcpErr)
+	}
+	if _, mcpErr = read("memory://type/bogus"); mcpErr == nil || mcpErr.Code != errCodeInvalidParams {
+		t.Errorf("Expected invalid params error for unknown type, got %v", mcpErr)
+	}
+	if _, mcpErr = read("memory://unknown"); mcpErr == nil || mcpErr.Message != "Unknown resource" || mcpErr.Code != errCodeResourceNotFound {
+		t.Errorf("Expected resource not found error for unknown URI, got %v", mcpErr)
+	}
+
+	// Exact URIs are matched before templates
+	if text, mcpErr = read("memory://stats"); mcpErr != nil || !strings.Contains(text, "total_memories") {
+		t.Errorf("Expected stats from the exact URI, got %s (%v)", text, mcpErr)
+	}
+
+	// Legacy codes for clients that rely on them
+	server.legacyResourceErrors = true
+	if _, mcpErr = read("memory://memory/missing"); mcpErr == nil || mcpErr.Code != errCodeNotFound {
+		t.Errorf("Expected the legacy not found code for missing memory, got %v", mcpErr)
+	}
+	if _, mcpErr = read("memory://unknown"); mcpErr == nil || mcpErr.Code != errCodeInvalidParams {
+		t.Errorf("Expected the legacy invalid params code for unknown URI, got %v", mcpErr)
+	}
+}
+
+// Test that the schema resource exposes complete input schemas for every tool
+func TestSchemaResource(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+	server := &MCPServer{store: store}
+
+	response := server.handleMessage(MCPMessage{Jsonrpc: "2.0", ID: 1, Method: "resources/read",
+		Params: json.RawMessage(`{"uri": "memory://schema"}`)})
+	if response.Error != nil {
+		t.Fatalf("Expected no error, got %v", response.Error)
+	}
+	text := response.Result.(map[string]interface{})["contents"].([]map[string]interface{})[0]["text"].(string)
+
+	var schema struct {
+		Tools []struct {
+			Name        string `json:"name"`
+			InputSchema struct {
+				Properties map[string]map[string]interface{} `json:"properties"`
+			} `json:"inputSchema"`
+		} `json:"tools"`
+	}
+	if err := json.Unmarshal([]byte(text), &schema); err != nil {
+		t.Fatalf("Failed to parse schema: %v", err)
+	}
+	if len(schema.Tools) != len(toolDefinitions()) {
+		t.Errorf("Expected %d tools, got %d", len(toolDefinitions()), len(schema.Tools))
+	}
+
+	for _, tool := range schema.Tools {
+		for name, property := range tool.InputSchema.Properties {
+			if property["type"] == "array" && property["items"] == nil {
+				t.Errorf("Expected %s.%s to declare its item type", tool.Name, name)
+			}
+		}
+		if tool.Name == "query_memories" {
+			items, _ := tool.InputSchema.Properties["keywords"]["items"].(map[string]interface{})
+			if items["type"] != "string" {
+				t.Errorf("Expected keywords to declare string items, got %v", tool.InputSchema.Properties["keywords"])
+			}
+		}
+	}
+}
+
 // Test malformed JSON in tool arguments
 func TestMalformedToolArguments(t *testing.T) {
 	store := NewMemoryStore(10)
@@ -579,4 +1831,469 @@ func findSubstring(text, pattern string) bool {
 		}
 	}
 	return false
-}
\ No newline at end of file
+}
+
+// repeatingReader yields the same line forever, like a client that never stops sending
+type repeatingReader struct {
+	line string
+	pos  int
+}
+
+func (r *repeatingReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		copied := copy(p[n:], r.line[r.pos:])
+		n += copied
+		r.pos = (r.pos + copied) % len(r.line)
+	}
+	return n, nil
+}
+
+// failingWriter rejects every write, like a closed stdout pipe
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+// Test that notifications get no response and requests echo their id
+func TestServeStreamNotificationsAndRequestIDs(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+	server := &MCPServer{store: store}
+
+	input := strings.Join([]string{
+		`{"jsonrpc":"2.0","method":"notifications/initialized"}`,
+		`{"jsonrpc":"2.0","method":"no/such/method"}`,
+		`{"jsonrpc":"2.0","id":"req-abc","method":"tools/list"}`,
+	}, "\n") + "\n"
+
+	var output bytes.Buffer
+	if err := serveStream(server, strings.NewReader(input), &output); err != nil {
+		t.Fatalf("serveStream failed: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected a single response for the one request, got %d: %q", len(lines), output.String())
+	}
+
+	var response map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if response["id"] != "req-abc" {
+		t.Errorf("Expected id %q echoed, got %v", "req-abc", response["id"])
+	}
+	if response["error"] != nil {
+		t.Errorf("Unexpected error response: %v", response["error"])
+	}
+}
+
+// Test that string, integer, and null request ids are echoed with their type
+func TestServeStreamPreservesIDTypes(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+	server := &MCPServer{store: store}
+
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{id: `"abc"`, want: `"id":"abc"`},
+		{id: `3`, want: `"id":3,`},
+		{id: `9007199254740993`, want: `"id":9007199254740993,`},
+		{id: `null`, want: `"id":null`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			input := `{"jsonrpc":"2.0","id":` + tt.id + `,"method":"initialize"}` + "\n"
+
+			var output bytes.Buffer
+			if err := serveStream(server, strings.NewReader(input), &output); err != nil {
+				t.Fatalf("serveStream failed: %v", err)
+			}
+			if !strings.Contains(output.String(), tt.want) {
+				t.Errorf("Expected response containing %s, got %s", tt.want, output.String())
+			}
+		})
+	}
+}
+
+// Test that the stdio loop stops on write failure instead of spinning
+func TestServeStreamStopsOnWriteError(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+	server := &MCPServer{store: store}
+
+	reader := &repeatingReader{line: `{"jsonrpc":"2.0","id":1,"method":"tools/list"}` + "\n"}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- serveStream(server, reader, failingWriter{})
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Expected write error from serveStream, got nil")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("serveStream kept looping after write failure")
+	}
+}
+
+// countingWriter counts the writes reaching it, one per flush
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+// Test that batched flushing groups responses yet never holds them while input pauses
+func TestServeStreamBatchedFlush(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+	server := &MCPServer{store: store, flushMessages: 4}
+
+	request := `{"jsonrpc":"2.0","id":1,"method":"initialize"}` + "\n"
+	var output countingWriter
+	if err := serveStream(server, strings.NewReader(strings.Repeat(request, 10)), &output); err != nil {
+		t.Fatalf("serveStream failed: %v", err)
+	}
+	if lines := strings.Count(output.String(), "\n"); lines != 10 {
+		t.Fatalf("Expected 10 responses, got %d", lines)
+	}
+	if output.writes != 3 {
+		t.Errorf("Expected 3 flushes (4, 4, then the 2 left when input ran out), got %d", output.writes)
+	}
+
+	// One request at a time: each response must arrive before the next request
+	inReader, inWriter := io.Pipe()
+	outReader, outWriter := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- serveStream(server, inReader, outWriter)
+		outWriter.Close()
+	}()
+
+	responses := bufio.NewReader(outReader)
+	for i := 0; i < 2; i++ {
+		if _, err := io.WriteString(inWriter, request); err != nil {
+			t.Fatalf("Failed to send request: %v", err)
+		}
+		received := make(chan error, 1)
+		go func() {
+			_, err := responses.ReadString('\n')
+			received <- err
+		}()
+		select {
+		case err := <-received:
+			if err != nil {
+				t.Fatalf("Failed to read response: %v", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Response stayed buffered while the client waited")
+		}
+	}
+	inWriter.Close()
+	if err := <-done; err != nil {
+		t.Errorf("serveStream failed: %v", err)
+	}
+}
+
+// Test that bulk-pinned memories survive eviction and decay
+func TestBulkAdjustPin(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxMemories = 5
+	config.DecayGracePeriod = 0
+	store := NewMemoryStoreWithConfig(config)
+	defer store.Shutdown()
+	server := &MCPServer{store: store}
+
+	for i := 0; i < 3; i++ {
+		store.Store(&Memory{ID: fmt.Sprintf("fact-%d", i), Type: Semantic, Content: fmt.Sprintf("Fact %d", i), Importance: 0.1, Decay: 0.5, LastAccess: time.Now().Add(-time.Hour)})
+	}
+	store.Store(&Memory{ID: "note", Type: ShortTerm, Content: "A note", Importance: 0.9})
+
+	result, err := server.BulkAdjust(context.Background(), BulkAdjustArgs{Operation: BulkPin, MemoryType: Semantic})
+	if err != nil {
+		t.Fatalf("BulkAdjust failed: %v", err)
+	}
+	if result["count"] != 3 {
+		t.Errorf("Expected 3 memories pinned, got %v", result["count"])
+	}
+
+	// Filling the store evicts the more important unpinned memories instead
+	for i := 0; i < 3; i++ {
+		if err := store.Store(&Memory{ID: fmt.Sprintf("new-%d", i), Type: ShortTerm, Content: fmt.Sprintf("New %d", i), Importance: 0.5}); err != nil {
+			t.Fatalf("Failed to store memory: %v", err)
+		}
+	}
+	store.applyDecay()
+
+	store.mu.RLock()
+	for i := 0; i < 3; i++ {
+		mem, ok := store.memories[fmt.Sprintf("fact-%d", i)]
+		if !ok {
+			t.Errorf("Expected pinned fact-%d to survive eviction", i)
+		} else if mem.Importance != 0.1 || mem.Version != 2 {
+			t.Errorf("Expected pinned fact-%d untouched by decay at version 2, got importance %v version %d", i, mem.Importance, mem.Version)
+		}
+	}
+	store.mu.RUnlock()
+
+	// With everything pinned there is nothing left to evict
+	if _, err := server.BulkAdjust(context.Background(), BulkAdjustArgs{Operation: BulkPin}); err != nil {
+		t.Fatalf("BulkAdjust failed: %v", err)
+	}
+	if err := store.Store(&Memory{ID: "overflow", Type: ShortTerm, Content: "Overflow", Importance: 0.5}); !errors.Is(err, ErrStoreFull) {
+		t.Errorf("Expected ErrStoreFull when every memory is pinned, got %v", err)
+	}
+
+	if _, err := server.BulkAdjust(context.Background(), BulkAdjustArgs{Operation: BulkSetDecay}); !errors.Is(err, ErrValidation) {
+		t.Errorf("Expected a validation error without a value, got %v", err)
+	}
+}
+
+// Test that a snapshot, plain or compressed, restores the same memories and relations
+func TestSnapshotRestore(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+	server := &MCPServer{store: store}
+	ctx := context.Background()
+
+	store.Store(&Memory{ID: "fact", Type: Semantic, Content: "Paris is in France", Importance: 0.7, Pinned: true})
+	store.Store(&Memory{ID: "trip", Type: Episodic, Content: "Visited Paris in May", Importance: 0.5})
+	if err := server.CreateRelation(ctx, CreateRelationArgs{FromID: "trip", ToID: "fact", RelationType: "related_to", Strength: 0.8}); err != nil {
+		t.Fatalf("CreateRelation failed: %v", err)
+	}
+
+	plain, err := server.SnapshotStore(ctx, SnapshotArgs{})
+	if err != nil {
+		t.Fatalf("SnapshotStore failed: %v", err)
+	}
+	if plain.Memories != 2 || plain.Relations != 1 || plain.Snapshot == nil {
+		t.Fatalf("Unexpected snapshot: %+v", plain)
+	}
+	compressed, err := server.SnapshotStore(ctx, SnapshotArgs{Compress: true})
+	if err != nil {
+		t.Fatalf("SnapshotStore failed: %v", err)
+	}
+	if compressed.Format != "gzip+base64" || compressed.Data == "" || compressed.Snapshot != nil {
+		t.Fatalf("Expected compressed data only, got %+v", compressed)
+	}
+
+	for _, args := range []RestoreSnapshotArgs{{Snapshot: plain.Snapshot}, {Data: compressed.Data}} {
+		store.Store(&Memory{ID: "later", Type: ShortTerm, Content: "Added after the snapshot", Importance: 0.5})
+		if _, err := server.RestoreSnapshot(ctx, args); err != nil {
+			t.Fatalf("RestoreSnapshot failed: %v", err)
+		}
+
+		restored := store.Snapshot()
+		if len(restored.Memories) != 2 || len(restored.Relations) != 1 {
+			t.Fatalf("Expected 2 memories and 1 relation, got %d and %d", len(restored.Memories), len(restored.Relations))
+		}
+		fact := restored.Memories[0]
+		if fact.ID != "fact" || fact.Content != "Paris is in France" || fact.Importance != 0.7 || !fact.Pinned {
+			t.Errorf("Expected the fact restored as it was, got %+v", fact)
+		}
+		if rel := restored.Relations[0]; rel.From != "trip" || rel.To != "fact" || rel.Strength != 0.8 {
+			t.Errorf("Expected the relation restored as it was, got %+v", rel)
+		}
+		if results, _ := store.Query(QueryCriteria{Type: "keywords", Keywords: []string{"france"}, Limit: 5}); len(results) != 1 {
+			t.Errorf("Expected the restored fact to be indexed, got %d results", len(results))
+		}
+	}
+
+	// An invalid snapshot is rejected before anything is removed
+	bad := &StoreSnapshot{Relations: []MemoryRelation{{From: "a", To: "b", Type: "related_to"}}}
+	if _, err := server.RestoreSnapshot(ctx, RestoreSnapshotArgs{Snapshot: bad}); !errors.Is(err, ErrValidation) {
+		t.Errorf("Expected a validation error for a dangling relation, got %v", err)
+	}
+	if _, err := server.RestoreSnapshot(ctx, RestoreSnapshotArgs{}); !errors.Is(err, ErrValidation) {
+		t.Errorf("Expected a validation error without a snapshot, got %v", err)
+	}
+	if stats := store.Snapshot(); len(stats.Memories) != 2 {
+		t.Errorf("Expected a rejected restore to leave the store alone, got %d memories", len(stats.Memories))
+	}
+}
+
+// Test that a restore failing part way rolls the store back
+func TestSnapshotRestoreRollback(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxMemories = 10
+	config.ContentNormalization = "lowercase"
+	store := NewMemoryStoreWithConfig(config)
+	defer store.Shutdown()
+	server := &MCPServer{store: store}
+	ctx := context.Background()
+
+	store.Store(&Memory{ID: "fact", Type: Semantic, Content: "Paris is in France", Importance: 0.7})
+	store.Store(&Memory{ID: "trip", Type: Episodic, Content: "Visited Paris in May", Importance: 0.5})
+	server.CreateRelation(ctx, CreateRelationArgs{FromID: "trip", ToID: "fact", RelationType: "related_to", Strength: 0.8})
+	before := store.Snapshot()
+
+	// The second memory duplicates the first once lowercased, so its insert fails
+	snapshot := &StoreSnapshot{Memories: []Memory{
+		{ID: "a", Type: Semantic, Content: "Berlin is in Germany", Importance: 0.5},
+		{ID: "b", Type: Semantic, Content: "berlin is in germany", Importance: 0.5},
+	}}
+	if err := store.Restore(snapshot); !errors.Is(err, ErrDuplicateID) {
+		t.Fatalf("Expected a duplicate content error, got %v", err)
+	}
+
+	after := store.Snapshot()
+	if len(after.Memories) != 2 || after.Memories[0].ID != "fact" || after.Memories[1].ID != "trip" {
+		t.Fatalf("Expected the original memories back, got %+v", after.Memories)
+	}
+	if !reflect.DeepEqual(after.Relations, before.Relations) {
+		t.Errorf("Expected the original relations back, got %+v", after.Relations)
+	}
+	if results, _ := store.Query(QueryCriteria{Type: "keywords", Keywords: []string{"france"}, Limit: 5}); len(results) != 1 {
+		t.Errorf("Expected the original fact to stay indexed, got %d results", len(results))
+	}
+	if results, _ := store.Query(QueryCriteria{Type: "keywords", Keywords: []string{"germany"}, Limit: 5}); len(results) != 0 {
+		t.Errorf("Expected nothing from the failed restore to stay indexed, got %d results", len(results))
+	}
+	if _, err := store.GetByID("a"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the partly restored memory to be gone, got %v", err)
+	}
+	// The content index was rolled back too
+	if err := store.Store(&Memory{ID: "dup", Type: Semantic, Content: "paris is in france", Importance: 0.5}); !errors.Is(err, ErrDuplicateID) {
+		t.Errorf("Expected the original content to still count as a duplicate, got %v", err)
+	}
+}
+
+// Test that persist writes a snapshot file that restores into a fresh store
+func TestPersist(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxMemories = 10
+	config.SnapshotPath = filepath.Join(t.TempDir(), "memories.snapshot")
+	store := NewMemoryStoreWithConfig(config)
+	defer store.Shutdown()
+	server := &MCPServer{store: store}
+	ctx := context.Background()
+
+	store.Store(&Memory{ID: "fact", Type: Semantic, Content: "Backups run nightly", Importance: 0.7})
+	store.Store(&Memory{ID: "step", Type: Procedural, Content: "Check the backup log each morning", Importance: 0.6})
+	server.CreateRelation(ctx, CreateRelationArgs{FromID: "step", ToID: "fact", RelationType: "related_to", Strength: 0.9})
+
+	// Concurrent persists each write a whole snapshot
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := server.Persist(ctx); err != nil {
+				t.Errorf("Persist failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	result, err := server.Persist(ctx)
+	if err != nil {
+		t.Fatalf("Persist failed: %v", err)
+	}
+	info, err := os.Stat(config.SnapshotPath)
+	if err != nil {
+		t.Fatalf("Expected the snapshot file to exist: %v", err)
+	}
+	if result["path"] != config.SnapshotPath || result["bytes"] != info.Size() || result["memories"] != 2 {
+		t.Errorf("Unexpected persist result %v for a %d-byte file", result, info.Size())
+	}
+	if leftovers, _ := filepath.Glob(config.SnapshotPath + ".*.tmp"); len(leftovers) != 0 {
+		t.Errorf("Expected no temporary files left behind, got %v", leftovers)
+	}
+
+	snapshot, err := LoadSnapshotFile(config.SnapshotPath)
+	if err != nil {
+		t.Fatalf("LoadSnapshotFile failed: %v", err)
+	}
+	reloaded := NewMemoryStore(10)
+	defer reloaded.Shutdown()
+	if err := reloaded.Restore(snapshot); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	restored := reloaded.Snapshot()
+	if len(restored.Memories) != 2 || restored.Memories[0].Content != "Backups run nightly" || len(restored.Relations) != 1 {
+		t.Errorf("Expected the persisted memories and relation back, got %+v", restored)
+	}
+
+	unconfigured := &MCPServer{store: reloaded}
+	if _, err := unconfigured.Persist(ctx); !errors.Is(err, ErrValidation) {
+		t.Errorf("Expected a validation error without a snapshot path, got %v", err)
+	}
+
+	// Restoring the snapshot at startup would wipe memories loaded with --load
+	config.LoadPath = filepath.Join(t.TempDir(), "memories.jsonl")
+	if err := config.Validate(); err == nil {
+		t.Error("Expected --load with --snapshot-path to fail validation")
+	}
+}
+
+// Test that export and import stay inside the export directory and never silently overwrite
+func TestExportDir(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxMemories = 10
+	config.ExportDir = t.TempDir()
+	store := NewMemoryStoreWithConfig(config)
+	defer store.Shutdown()
+	server := &MCPServer{store: store}
+	ctx := context.Background()
+
+	store.Store(&Memory{ID: "fact", Type: Semantic, Content: "Exports stay in their directory", Importance: 0.5})
+
+	if _, err := server.ExportMemories(ctx, ExportMemoriesArgs{Path: "backup/../memories.jsonl"}); err != nil {
+		t.Fatalf("ExportMemories failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(config.ExportDir, "memories.jsonl")); err != nil {
+		t.Fatalf("Expected the export inside the export directory: %v", err)
+	}
+	if _, err := server.ExportMemories(ctx, ExportMemoriesArgs{Path: "memories.jsonl"}); !errors.Is(err, ErrValidation) {
+		t.Errorf("Expected a validation error overwriting without overwrite, got %v", err)
+	}
+	if _, err := server.ExportMemories(ctx, ExportMemoriesArgs{Path: "memories.jsonl", Overwrite: true}); err != nil {
+		t.Errorf("Expected overwrite to replace the file, got %v", err)
+	}
+
+	outside := filepath.Join(t.TempDir(), "outside.jsonl")
+	for _, path := range []string{outside, "../outside.jsonl", ""} {
+		if _, err := server.ExportMemories(ctx, ExportMemoriesArgs{Path: path}); !errors.Is(err, ErrValidation) {
+			t.Errorf("Expected a validation error exporting to %q, got %v", path, err)
+		}
+		if _, err := server.ImportMemories(ctx, ImportMemoriesArgs{Path: path}); !errors.Is(err, ErrValidation) {
+			t.Errorf("Expected a validation error importing from %q, got %v", path, err)
+		}
+	}
+	if _, err := os.Stat(outside); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected nothing written outside the export directory, got %v", err)
+	}
+
+	// A symlink cannot lead out of the directory either
+	if err := os.Symlink(filepath.Dir(outside), filepath.Join(config.ExportDir, "escape")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	if _, err := server.ExportMemories(ctx, ExportMemoriesArgs{Path: "escape/outside.jsonl"}); err == nil {
+		t.Error("Expected exporting through a symlink out of the directory to fail")
+	}
+
+	target := NewMemoryStoreWithConfig(config)
+	defer target.Shutdown()
+	result, err := (&MCPServer{store: target}).ImportMemories(ctx, ImportMemoriesArgs{Path: "memories.jsonl"})
+	if err != nil || result["count"] != 1 {
+		t.Errorf("Expected 1 memory imported, got %v, %v", result, err)
+	}
+
+	disabled := &MCPServer{store: NewMemoryStore(10)}
+	defer disabled.store.Shutdown()
+	if _, err := disabled.ExportMemories(ctx, ExportMemoriesArgs{Path: "memories.jsonl"}); !errors.Is(err, ErrValidation) {
+		t.Errorf("Expected export disabled without an export directory, got %v", err)
+	}
+}
@@ -1,13 +1,28 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"cmp"
 	"container/heap"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"maps"
 	"math"
+	"os"
+	"path/filepath"
+	"runtime/metrics"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -22,6 +37,65 @@ const (
 	Procedural MemoryType = "procedural"
 )
 
+// allMemoryTypes lists every supported memory type
+var allMemoryTypes = []MemoryType{ShortTerm, LongTerm, Episodic, Semantic, Procedural}
+
+// typesByLifetime orders the memory types from shortest- to longest-lived,
+// the direction promotions move in
+var typesByLifetime = []MemoryType{ShortTerm, Episodic, LongTerm, Semantic, Procedural}
+
+// memoryTypeGuide is the usage guidance list_memory_types returns for a type
+type memoryTypeGuide struct {
+	description string
+	example     string
+	importance  string  // recommended importance range
+	decay       float32 // recommended decay per hour without access
+}
+
+// memoryTypeGuides describes when to use each memory type
+var memoryTypeGuides = map[MemoryType]memoryTypeGuide{
+	ShortTerm: {
+		description: "Temporary information from the current conversation; promoted to long_term when accessed often, and fades quickly otherwise",
+		example:     "User is debugging a failing login test right now",
+		importance:  "0.1-0.5",
+		decay:       0.05,
+	},
+	LongTerm: {
+		description: "Important facts to keep; consolidation promotes frequently accessed short_term memories here",
+		example:     "User's main project is a Go service deployed on Kubernetes",
+		importance:  "0.6-0.9",
+		decay:       0.005,
+	},
+	Episodic: {
+		description: "Specific events or interactions, keeping their temporal context",
+		example:     "User asked about connection pooling before the Friday release",
+		importance:  "0.3-0.7",
+		decay:       0.02,
+	},
+	Semantic: {
+		description: "Facts, knowledge, and concepts forming the core knowledge base",
+		example:     "User prefers Python over Java",
+		importance:  "0.5-0.9",
+		decay:       0.005,
+	},
+	Procedural: {
+		description: "How-to knowledge and patterns that guide future behavior",
+		example:     "Always format code with 4 spaces for this user",
+		importance:  "0.6-1.0",
+		decay:       0.001,
+	},
+}
+
+// isValidMemoryType reports whether t is a supported memory type
+func isValidMemoryType(t MemoryType) bool {
+	for _, validType := range allMemoryTypes {
+		if t == validType {
+			return true
+		}
+	}
+	return false
+}
+
 // Core Memory Structure
 type Memory struct {
 	ID          string                 `json:"id"`
@@ -33,8 +107,19 @@ type Memory struct {
 	Timestamp   time.Time              `json:"timestamp"`
 	LastAccess  time.Time              `json:"last_access"`
 	AccessCount int                    `json:"access_count"`
+	AccessScore float32                `json:"access_score"`
 	Importance  float32                `json:"importance"`
 	Decay       float32                `json:"decay"`
+	Truncated   bool                   `json:"truncated,omitempty"`
+	Pinned      bool                   `json:"pinned,omitempty"`
+	Version     int                    `json:"version"` // starts at 1, incremented on each update, type change, or promotion
+
+	keywords         []string // unique indexed words, cached for symmetric reindexing
+	metadataKeywords []string // unique indexed metadata words, cached likewise
+	tags             []string // unique indexed tags, cached likewise
+	changed          uint64   // store version of the last change, guarded by MemoryStore.mu
+
+	history []HistoryEvent // bounded lifecycle log, guarded by MemoryStore.historyMu
 }
 
 // Graph-like structure for relationships
@@ -53,8 +138,20 @@ type ScoredMemory struct {
 
 // Keyword index for fast text search
 type KeywordIndex struct {
-	mu    sync.RWMutex
-	index map[string]map[string]*Memory // keyword -> memoryID -> Memory
+	mu       sync.RWMutex
+	index    map[string]*postingList // keyword -> memories
+	metadata map[string]*postingList // word in a metadata string value -> memories
+	tags     map[string]*postingList // lowercase tag -> memories
+
+	// Keep identifiers such as user_id and config.yaml as single words;
+	// fixed at construction, so read without the lock
+	identifiers bool
+
+	// Word offsets in each memory's content for phrase queries, as
+	// word -> memory ID -> ascending positions. Costs an entry per word
+	// occurrence, so it is only kept when positional is set at construction.
+	positional bool
+	positions  map[string]map[string][]int
 }
 
 // Priority queue for top-K similarity search
@@ -83,6 +180,9 @@ type MemoryStore struct {
 	// Primary storage
 	memories map[string]*Memory
 
+	// Bumped on every mutation, so clients can sync only what changed
+	version uint64
+
 	// Indexes for fast lookup
 	typeIndex      map[MemoryType]map[string]*Memory
 	timeIndex      *TimeIndex
@@ -90,311 +190,2836 @@ type MemoryStore struct {
 	keywordIndex   *KeywordIndex
 
 	// Relationship graph
-	relations map[string][]*MemoryRelation
+	relations          map[string][]*MemoryRelation
+	relationTypeIndex  map[string][]*MemoryRelation // relation type -> relations
+	allowSelfRelations bool
 
 	// Memory management
-	maxMemories   int
-	decayInterval time.Duration
-	shutdownChan  chan struct{}
-	ctx           context.Context
-	cancel        context.CancelFunc
+	maxMemories                      int
+	typeCapacity                     map[MemoryType]int    // per-type caps within maxMemories; absent means uncapped
+	typePolicy                       map[MemoryType]string // evict, reject, or global (absent) at a type's cap
+	rejectWhenFull                   bool
+	decayInterval                    time.Duration
+	decayRemovalThreshold            float32                // importance below which decay removes a memory
+	importanceFloors                 map[MemoryType]float32 // per-type importance decay stops at; absent means none
+	decayGracePeriod                 time.Duration          // time after an access before decay starts
+	consolidationInterval            time.Duration
+	consolidationAccessThreshold     float32
+	consolidationImportanceThreshold float32
+	accessHalfLife                   time.Duration
+	consolidationTarget              MemoryType
+	shutdownChan                     chan struct{}
+	ctx                              context.Context
+	cancel                           context.CancelFunc
+
+	// Wake background processes to pick up reconfigured intervals
+	decayReset         chan struct{}
+	consolidationReset chan struct{}
+
+	// Content limits
+	maxContentLength   int
+	truncateContent    bool
+	importanceOverflow string // clamp, default, or reject
+	maxMetadataBytes   int    // serialized size, 0 for unlimited
+	maxMetadataDepth   int    // nesting levels, 0 for unlimited
+	maxRelatedDepth    int    // relation traversal levels, 0 for unlimited
+
+	// Duplicate content detection: normalized content -> memory ID, nil when
+	// normalization is off
+	contentNormalization string // whitespace or lowercase
+	contentIndex         map[string]string
+
+	// Derive generated IDs from a hash of namespace and normalized content
+	contentIDs  bool
+	idNamespace string
+
+	// Keyword queries without keywords list every memory rather than failing
+	emptyKeywordsListAll bool
+
+	// Periodic pass over one-off keywords of memories below the importance:
+	// off, report, or prune
+	keywordPrune           string
+	keywordPruneImportance float32
+	keywordPruneInterval   time.Duration
+
+	// Directory export_memories and import_memories paths are relative to,
+	// empty to disable them
+	exportDir string
+
+	// File persist writes snapshots to, empty for none; snapshotMu
+	// serializes the writes
+	snapshotPath string
+	snapshotMu   sync.Mutex
+
+	// Cached keyword query results, nil when disabled
+	queryCache *QueryCache
+
+	// Snapshots of memories recently read by ID, nil when disabled
+	recentCache *RecentCache
+
+	// Caps concurrent similarity and keyword queries, nil when unlimited
+	queryLimiter *QueryLimiter
+
+	// Rejects writes and pauses decay and consolidation while set
+	readOnly atomic.Bool
+
+	// Heap size above which the store reports itself not ready, 0 for no limit
+	memoryLimitBytes uint64
+
+	// Fraction of capacity at which a warning is logged, 0 to disable. The
+	// warning fires once per crossing and re-arms when usage drops below.
+	capacityWarningThreshold float32
+	capacityWarningActive    bool
+	capacityWarnings         int
+
+	// Ring buffer of recent removals, oldest at removalStart once full
+	removalEvents []RemovalEvent
+	removalStart  int
+
+	// Guards per-memory history, which access recording appends to under a read lock
+	historyMu sync.Mutex
+
+	// Registered event listeners, guarded by eventsMu, and the events of the
+	// operation holding ms.mu for writing, guarded by ms.mu
+	eventsMu      sync.Mutex
+	listeners     []EventListener
+	pendingEvents []func(EventListener)
+
+	// In-flight request tracking for draining on shutdown
+	lifecycleMu  sync.Mutex
+	closing      bool
+	inFlight     sync.WaitGroup
+	shutdownOnce sync.Once
 }
 
+// ErrShuttingDown is returned for requests that arrive after shutdown has begun
+var ErrShuttingDown = errors.New("memory store is shutting down")
+
+// ErrStoreFull is returned for new memories when the store is at capacity and
+// configured to reject rather than evict
+var ErrStoreFull = errorf(ErrCapacity, "memory store is at capacity")
+
+// ErrStoreReadOnly is returned for writes while the store is in read-only mode
+var ErrStoreReadOnly = errorf(ErrReadOnly, "memory store is read-only")
+
+// defaultShutdownTimeout bounds how long Shutdown waits for in-flight requests
+const defaultShutdownTimeout = 5 * time.Second
+
 // Time-based index for temporal queries
 type TimeIndex struct {
-	mu      sync.RWMutex
-	buckets map[string][]*Memory // hour buckets
+	mu        sync.RWMutex
+	buckets   map[string][]*Memory // time buckets keyed by format
+	format    string               // bucket layout, always applied to UTC times; keys sort chronologically
+	retention time.Duration        // buckets older than this are compacted on cleanup
 }
 
 // Embedding index for similarity search
 type EmbeddingIndex struct {
 	mu         sync.RWMutex
 	embeddings map[string][]float32
+	quantized  map[string]QuantizedVector // used instead of embeddings when quantize is set
+	quantize   bool
+	metric     SimilarityMetric // fixed at construction, so read without the lock
 	dimension  int
+
+	// Fraction of a scan's entries at or above which the limit is served by
+	// quickselect instead of a heap; 0 always uses the heap. Fixed at
+	// construction like metric.
+	selectRatio float32
+
+	// Asynchronous updates when --index-workers is set: the queue, each
+	// memory's latest queued sequence number (older updates are dropped),
+	// and the count of updates not yet processed
+	queue   chan embeddingJob
+	pending map[string]uint64
+	seq     uint64
+	queued  int
+	drained *sync.Cond // signaled on ei.mu when queued reaches 0
+}
+
+// SimilarityMetric selects how embeddings are compared during scoring
+type SimilarityMetric string
+
+const (
+	MetricCosine    SimilarityMetric = "cosine"
+	MetricDot       SimilarityMetric = "dot"
+	MetricEuclidean SimilarityMetric = "euclidean"
+)
+
+// isValidSimilarityMetric reports whether m is a supported metric
+func isValidSimilarityMetric(m SimilarityMetric) bool {
+	return m == MetricCosine || m == MetricDot || m == MetricEuclidean
+}
+
+// prepare returns the form of a vector the metric scores: unit length for
+// cosine, so a dot product gives the cosine, and unchanged otherwise since
+// dot and euclidean depend on magnitude
+func (m SimilarityMetric) prepare(v []float32) []float32 {
+	if m == MetricCosine {
+		return normalizeVector(v)
+	}
+	return v
+}
+
+// QuantizedVector is an int8 encoding of a normalized embedding
+type QuantizedVector struct {
+	Values []int8
+	Scale  float32
 }
 
 // MCP Server Tools
 type MCPServer struct {
-	store *MemoryStore
+	store       *MemoryStore
+	compactJSON bool // emit results without indentation
+
+	// Report unknown and missing resources with the codes used before
+	// resource-not-found
+	legacyResourceErrors bool
+
+	// Stdio response flushing: after this many responses (below 1 means
+	// every one), or this long after the first unflushed one when set
+	flushMessages int
+	flushInterval time.Duration
+
+	// Session stamped on memories this client stores, empty for none
+	sessionID string
+
+	// Identifies the connected client in each tool call's context
+	clientID string
+
+	// This client's store_memory defaults, set at initialize or with
+	// set_client_defaults
+	defaults StoreDefaults
+
+	// Deadline for each tool call, 0 for none
+	requestTimeout time.Duration
+
+	// Sends a notification ahead of the response, on transports that can
+	// stream query results; nil otherwise
+	notify func(MCPMessage) error
+}
+
+// clientIDKey is the context key for the ID of the client making a tool call
+type clientIDKey struct{}
+
+// clientIDFromContext returns the ID of the client making a tool call
+func clientIDFromContext(ctx context.Context) (string, bool) {
+	clientID, ok := ctx.Value(clientIDKey{}).(string)
+	return clientID, ok
+}
+
+// sessionMetadataKey is the metadata key recording the session that stored a memory
+const sessionMetadataKey = "session_id"
+
+// withSession returns a server sharing this one's store and settings whose
+// stores are stamped with the given session
+func (mcp *MCPServer) withSession(sessionID string) *MCPServer {
+	session := *mcp
+	session.sessionID = sessionID
+	return &session
+}
+
+// withClient is withSession for a connected client, whose ID every tool
+// call's context carries
+func (mcp *MCPServer) withClient(clientID, sessionID string) *MCPServer {
+	server := mcp.withSession(sessionID)
+	server.clientID = clientID
+	return server
+}
+
+// requestContext creates the context for one tool call. It carries the
+// client's ID and the request deadline, and is cancelled if the store shuts
+// down before the call finishes.
+func (mcp *MCPServer) requestContext() (context.Context, context.CancelFunc) {
+	ctx := context.WithValue(mcp.store.ctx, clientIDKey{}, mcp.clientID)
+	if mcp.requestTimeout > 0 {
+		return context.WithTimeout(ctx, mcp.requestTimeout)
+	}
+	return context.WithCancel(ctx)
 }
 
-// Initialize the memory store
+// Initialize the memory store. Unlike a configured server, which resets
+// out-of-range importance to 0.5 by default, it rejects it as Store always has.
 func NewMemoryStore(maxMemories int) *MemoryStore {
+	config := DefaultConfig()
+	config.MaxMemories = maxMemories
+	config.ImportanceOverflow = "reject"
+	return NewMemoryStoreWithConfig(config)
+}
+
+// NewMemoryStoreWithConfig initializes the memory store from a runtime configuration
+func NewMemoryStoreWithConfig(config *Config) *MemoryStore {
+	decayInterval := config.DecayInterval
+	if decayInterval <= 0 {
+		decayInterval = DefaultConfig().DecayInterval
+	}
+	consolidationInterval := config.ConsolidationInterval
+	if consolidationInterval <= 0 {
+		consolidationInterval = DefaultConfig().ConsolidationInterval
+	}
+	decayRemovalThreshold := config.DecayRemovalThreshold
+	if decayRemovalThreshold <= 0 || decayRemovalThreshold >= 1 {
+		decayRemovalThreshold = DefaultConfig().DecayRemovalThreshold
+	}
+	consolidationTarget := MemoryType(config.ConsolidationTarget)
+	if !isValidMemoryType(consolidationTarget) || consolidationTarget == ShortTerm {
+		consolidationTarget = LongTerm
+	}
+	bucketFormat, ok := timeBucketFormats[config.TimeBucket]
+	if !ok {
+		bucketFormat = timeBucketFormats[DefaultConfig().TimeBucket]
+	}
+	metric := SimilarityMetric(config.SimilarityMetric)
+	if !isValidSimilarityMetric(metric) {
+		metric = MetricCosine
+	}
+
 	store := &MemoryStore{
-		memories:       make(map[string]*Memory),
-		typeIndex:      make(map[MemoryType]map[string]*Memory),
-		timeIndex:      &TimeIndex{buckets: make(map[string][]*Memory)},
-		embeddingIndex: &EmbeddingIndex{embeddings: make(map[string][]float32), dimension: 384},
-		keywordIndex:   &KeywordIndex{index: make(map[string]map[string]*Memory)},
-		relations:      make(map[string][]*MemoryRelation),
-		maxMemories:    maxMemories,
-		decayInterval:  5 * time.Minute,
-		shutdownChan:   make(chan struct{}),
+		memories:  make(map[string]*Memory),
+		typeIndex: make(map[MemoryType]map[string]*Memory),
+		timeIndex: &TimeIndex{
+			buckets:   make(map[string][]*Memory),
+			format:    bucketFormat,
+			retention: config.TimeRetention,
+		},
+		embeddingIndex: &EmbeddingIndex{
+			embeddings: make(map[string][]float32),
+			quantized:  make(map[string]QuantizedVector),
+			quantize:   config.QuantizeEmbeddings,
+			metric:     metric,
+			dimension:  384,
+
+			selectRatio: config.TopKSelectRatio,
+		},
+		keywordIndex: &KeywordIndex{
+			index:       make(map[string]*postingList),
+			metadata:    make(map[string]*postingList),
+			tags:        make(map[string]*postingList),
+			identifiers: config.IdentifierTokens,
+			positional:  config.PositionalIndex,
+			positions:   make(map[string]map[string][]int),
+		},
+		relations:                        make(map[string][]*MemoryRelation),
+		relationTypeIndex:                make(map[string][]*MemoryRelation),
+		allowSelfRelations:               config.AllowSelfRelations,
+		maxMemories:                      config.MaxMemories,
+		typeCapacity:                     config.TypeCapacities,
+		typePolicy:                       config.TypePolicies,
+		importanceFloors:                 config.ImportanceFloors,
+		decayGracePeriod:                 config.DecayGracePeriod,
+		rejectWhenFull:                   config.OnFull == "reject",
+		decayInterval:                    decayInterval,
+		decayRemovalThreshold:            decayRemovalThreshold,
+		consolidationInterval:            consolidationInterval,
+		consolidationAccessThreshold:     config.ConsolidationAccessThreshold,
+		consolidationImportanceThreshold: config.ConsolidationImportanceThreshold,
+		decayReset:                       make(chan struct{}, 1),
+		consolidationReset:               make(chan struct{}, 1),
+		accessHalfLife:                   config.AccessHalfLife,
+		consolidationTarget:              consolidationTarget,
+		maxContentLength:                 config.MaxContentLength,
+		maxMetadataBytes:                 config.MaxMetadataBytes,
+		maxMetadataDepth:                 config.MaxMetadataDepth,
+		maxRelatedDepth:                  config.MaxRelatedDepth,
+		truncateContent:                  config.ContentOverflow == "truncate",
+		importanceOverflow:               config.ImportanceOverflow,
+		queryCache:                       NewQueryCache(config.QueryCacheSize, config.QueryCacheTTL),
+		recentCache:                      NewRecentCache(config.RecentCacheSize),
+		queryLimiter:                     NewQueryLimiter(config.MaxConcurrentQueries),
+		contentNormalization:             config.ContentNormalization,
+		contentIDs:                       config.IDMode == "content",
+		idNamespace:                      config.IDNamespace,
+		emptyKeywordsListAll:             config.EmptyKeywordQuery == "all",
+		keywordPrune:                     config.KeywordPrune,
+		keywordPruneImportance:           config.KeywordPruneImportance,
+		keywordPruneInterval:             config.KeywordPruneInterval,
+		snapshotPath:                     config.SnapshotPath,
+		exportDir:                        config.ExportDir,
+		memoryLimitBytes:                 uint64(max(config.MaxMemoryMB, 0)) * 1024 * 1024,
+		capacityWarningThreshold:         config.CapacityWarning,
+		shutdownChan:                     make(chan struct{}),
 	}
 
 	// Set up context for graceful shutdown
 	store.ctx, store.cancel = context.WithCancel(context.Background())
 
 	// Initialize type indexes
-	for _, t := range []MemoryType{ShortTerm, LongTerm, Episodic, Semantic, Procedural} {
+	for _, t := range allMemoryTypes {
 		store.typeIndex[t] = make(map[string]*Memory)
 	}
+	store.embeddingIndex.drained = sync.NewCond(&store.embeddingIndex.mu)
+	store.readOnly.Store(config.ReadOnly)
+	if config.ContentNormalization == "whitespace" || config.ContentNormalization == "lowercase" {
+		store.contentIndex = make(map[string]string)
+	}
 
 	// Start background processes
+	if config.IndexWorkers > 0 {
+		store.startEmbeddingWorkers(config.IndexWorkers, max(config.IndexQueueSize, 1))
+	}
 	go store.startDecayProcess()
 	go store.startConsolidationProcess()
+	if config.KeywordPrune != "off" {
+		go store.startKeywordPruneProcess()
+	}
 
 	return store
 }
 
 // Shutdown gracefully stops all background processes
 func (ms *MemoryStore) Shutdown() {
-	ms.cancel()
-	close(ms.shutdownChan)
+	if err := ms.ShutdownWithTimeout(defaultShutdownTimeout); err != nil {
+		slog.Warn("Shutdown", "err", err)
+	}
+}
+
+// ShutdownWithTimeout rejects new requests, waits up to timeout for in-flight
+// requests to finish, then stops background processes. It returns an error if
+// requests were still running when the timeout expired. Calls after the
+// first are no-ops, so a deferred Shutdown and a signal handler can both fire.
+func (ms *MemoryStore) ShutdownWithTimeout(timeout time.Duration) error {
+	var err error
+	ms.shutdownOnce.Do(func() {
+		ms.lifecycleMu.Lock()
+		ms.closing = true
+		ms.lifecycleMu.Unlock()
+
+		drained := make(chan struct{})
+		go func() {
+			ms.inFlight.Wait()
+			close(drained)
+		}()
+
+		select {
+		case <-drained:
+		case <-time.After(timeout):
+			err = fmt.Errorf("timed out after %v waiting for in-flight requests", timeout)
+		}
+
+		ms.cancel()
+		close(ms.shutdownChan)
+	})
+	return err
+}
+
+// beginRequest registers an in-flight request, failing once shutdown has begun
+func (ms *MemoryStore) beginRequest() error {
+	ms.lifecycleMu.Lock()
+	defer ms.lifecycleMu.Unlock()
+
+	if ms.closing {
+		return ErrShuttingDown
+	}
+	ms.inFlight.Add(1)
+	return nil
+}
+
+// endRequest marks an in-flight request as finished
+func (ms *MemoryStore) endRequest() {
+	ms.inFlight.Done()
+}
+
+// SetReadOnly switches read-only mode, in which writes fail with
+// ErrStoreReadOnly and decay and consolidation are paused so a loaded
+// snapshot stays frozen. Queries still record accesses.
+func (ms *MemoryStore) SetReadOnly(readOnly bool) {
+	ms.readOnly.Store(readOnly)
+}
+
+// checkWritable fails when the store is in read-only mode
+func (ms *MemoryStore) checkWritable() error {
+	if ms.readOnly.Load() {
+		return ErrStoreReadOnly
+	}
+	return nil
 }
 
 // Store a new memory with validation
 func (ms *MemoryStore) Store(memory *Memory) error {
-	// Validate input
-	if memory == nil {
-		return errors.New("memory cannot be nil")
+	if err := ms.checkWritable(); err != nil {
+		return err
 	}
-	if memory.ID == "" {
-		return errors.New("memory ID cannot be empty")
+	ms.applyImportanceOverflow(memory)
+	if err := validateMemory(memory); err != nil {
+		return err
 	}
-	if memory.Content == "" {
-		return errors.New("memory content cannot be empty")
+	if err := ms.enforceContentLength(memory); err != nil {
+		return err
 	}
-	if memory.Importance < 0 || memory.Importance > 1 {
-		return errors.New("memory importance must be between 0 and 1")
+	if err := ms.enforceMetadataLimits(memory); err != nil {
+		return err
 	}
 
 	ms.mu.Lock()
-	defer ms.mu.Unlock()
+	defer ms.unlockAndFlush()
 
 	// Check for duplicate ID
 	if _, exists := ms.memories[memory.ID]; exists {
-		return fmt.Errorf("memory with ID %s already exists", memory.ID)
-	}
-
-	// Check capacity
-	if len(ms.memories) >= ms.maxMemories {
-		ms.evictLeastImportant()
+		return errorf(ErrDuplicateID, "memory with ID %s already exists", memory.ID)
 	}
 
-	// Store in primary map
-	ms.memories[memory.ID] = memory
-
-	// Update indexes
-	ms.typeIndex[memory.Type][memory.ID] = memory
-	ms.addToTimeIndex(memory)
-	ms.addToKeywordIndex(memory)
-
-	if memory.Embedding != nil {
-		// Normalize embedding for faster cosine similarity
-		normalizedEmbedding := normalizeVector(memory.Embedding)
-		ms.embeddingIndex.mu.Lock()
-		ms.embeddingIndex.embeddings[memory.ID] = normalizedEmbedding
-		ms.embeddingIndex.mu.Unlock()
-	}
+	return ms.insertMemory(memory)
+}
 
-	return nil
+// Upsert stores a memory, or updates the existing memory with the same ID in
+// place and re-indexes it. Access history and creation time are preserved.
+func (ms *MemoryStore) Upsert(memory *Memory) error {
+	return ms.UpsertVersion(memory, 0)
 }
 
-// Retrieve memories by various criteria with validation
-func (ms *MemoryStore) Query(criteria QueryCriteria) ([]*Memory, error) {
-	// Validate query criteria
-	if criteria.Type == "" {
-		return nil, errors.New("query type cannot be empty")
+// UpsertVersion is Upsert with compare-and-swap: a positive expectedVersion
+// must match the stored memory's version or the write fails with a conflict
+// error, so a client cannot clobber a change it has not seen. Zero skips the
+// check.
+func (ms *MemoryStore) UpsertVersion(memory *Memory, expectedVersion int) error {
+	if err := ms.checkWritable(); err != nil {
+		return err
 	}
-	if criteria.Limit < 0 {
-		return nil, errors.New("query limit cannot be negative")
+	if expectedVersion < 0 {
+		return errorf(ErrValidation, "expected version cannot be negative")
 	}
-	if criteria.Limit == 0 {
-		criteria.Limit = 10 // Default limit
+	ms.applyImportanceOverflow(memory)
+	if err := validateMemory(memory); err != nil {
+		return err
 	}
-	if criteria.Limit > 1000 {
-		return nil, errors.New("query limit cannot exceed 1000")
+	if err := ms.enforceContentLength(memory); err != nil {
+		return err
+	}
+	if err := ms.enforceMetadataLimits(memory); err != nil {
+		return err
 	}
 
-	ms.mu.RLock()
-	defer ms.mu.RUnlock()
+	ms.mu.Lock()
+	defer ms.unlockAndFlush()
 
-	var results []*Memory
+	existing, exists := ms.memories[memory.ID]
+	if expectedVersion > 0 {
+		if !exists {
+			return errorf(ErrConflict, "memory %s does not exist, expected version %d", memory.ID, expectedVersion)
+		}
+		if existing.Version != expectedVersion {
+			return errorf(ErrConflict, "memory %s is at version %d, expected version %d", memory.ID, existing.Version, expectedVersion)
+		}
+	}
+	if !exists {
+		return ms.insertMemory(memory)
+	}
+	if err := ms.checkEmbeddingDimension(memory.ID, memory.Embedding); err != nil {
+		return err
+	}
+	if err := ms.checkDuplicateContent(memory); err != nil {
+		return err
+	}
 
-	switch criteria.Type {
-	case "similarity":
-		results = ms.findSimilar(criteria.Embedding, criteria.Limit)
-	case "temporal":
-		results = ms.findTemporal(criteria.StartTime, criteria.EndTime)
-	case "type":
-		results = ms.findByType(criteria.MemoryType)
-	case "related":
-		results = ms.findRelated(criteria.MemoryID, criteria.Depth)
-	default:
-		results = ms.findByKeywords(criteria.Keywords)
+	if existing.Type != memory.Type {
+		if err := ms.makeRoomInType(memory.Type); err != nil {
+			return err
+		}
 	}
 
-	// Update access patterns
-	for _, mem := range results {
-		mem.LastAccess = time.Now()
-		mem.AccessCount++
+	// Drop stale index entries before changing indexed fields
+	ms.removeFromKeywordIndex(existing)
+	ms.removeFromContentIndex(existing)
+	if existing.Type != memory.Type {
+		delete(ms.typeIndex[existing.Type], existing.ID)
+		ms.typeIndex[memory.Type][existing.ID] = existing
 	}
 
-	return results, nil
-}
+	existing.Type = memory.Type
+	existing.Content = memory.Content
+	existing.Embedding = memory.Embedding
+	existing.Metadata = memory.Metadata
+	existing.Relations = memory.Relations
+	existing.Importance = memory.Importance
+	existing.Decay = memory.Decay
+	existing.Truncated = memory.Truncated
+	existing.Version++
+	ms.appendHistory(existing, "updated", "")
+	ms.markChanged(existing)
 
-// Find similar memories using embedding similarity with heap-based top-K
-func (ms *MemoryStore) findSimilar(embedding []float32, limit int) []*Memory {
-	// Normalize query embedding
-	normalizedQuery := normalizeVector(embedding)
+	ms.addToKeywordIndex(existing)
+	ms.addToContentIndex(existing)
+	ms.indexEmbedding(existing)
+	ms.queryCache.invalidate()
 
-	// Use min-heap to maintain top-K efficiently
-	h := &ScoredMemoryHeap{}
-	heap.Init(h)
+	snapshot := eventSnapshot(existing)
+	ms.queueEvent(func(l EventListener) { l.OnStore(snapshot) })
 
-	ms.embeddingIndex.mu.RLock()
-	for id, emb := range ms.embeddingIndex.embeddings {
-		if mem, ok := ms.memories[id]; ok {
-			// Since both vectors are normalized, dot product = cosine similarity
-			score := dotProduct(normalizedQuery, emb)
-
-			if h.Len() < limit {
-				heap.Push(h, &ScoredMemory{Memory: mem, Score: score})
-			} else if score > (*h)[0].Score {
-				heap.Pop(h)
-				heap.Push(h, &ScoredMemory{Memory: mem, Score: score})
-			}
+	return nil
+}
+
+// storedDimension returns the dimension of the stored embeddings, skipping
+// the memory with skipID, or 0 when none is stored. Every stored embedding
+// has the same dimension. Callers hold ms.mu.
+func (ms *MemoryStore) storedDimension(skipID string) int {
+	for _, mem := range ms.memories {
+		if mem.Embedding != nil && mem.ID != skipID {
+			return len(mem.Embedding)
 		}
 	}
-	ms.embeddingIndex.mu.RUnlock()
+	return 0
+}
 
-	// Extract results in descending order
-	results := make([]*Memory, 0, h.Len())
-	for h.Len() > 0 {
-		scored := heap.Pop(h).(*ScoredMemory)
-		results = append([]*Memory{scored.Memory}, results...)
+// checkEmbeddingDimension rejects an embedding for memory id whose dimension
+// differs from the other stored embeddings. Callers hold ms.mu.
+func (ms *MemoryStore) checkEmbeddingDimension(id string, embedding []float32) error {
+	if dim := ms.storedDimension(id); len(embedding) > 0 && dim > 0 && len(embedding) != dim {
+		return errorf(ErrValidation, "embedding dimension %d does not match the stored dimension %d", len(embedding), dim)
 	}
+	return nil
+}
 
-	return results
+// checkQueryDimension rejects a query embedding whose dimension differs from
+// the stored embeddings, which the scorers assume match. Callers hold ms.mu.
+func (ms *MemoryStore) checkQueryDimension(embedding []float32) error {
+	if dim := ms.storedDimension(""); dim > 0 && len(embedding) != dim {
+		return errorf(ErrValidation, "query embedding dimension %d does not match the stored dimension %d", len(embedding), dim)
+	}
+	return nil
 }
 
-// Find related memories using graph traversal
-func (ms *MemoryStore) findRelated(memoryID string, depth int) []*Memory {
-	visited := make(map[string]bool)
-	queue := []string{memoryID}
-	results := make([]*Memory, 0)
+// validateMemory checks the fields every stored memory must have
+func validateMemory(memory *Memory) error {
+	if memory == nil {
+		return errorf(ErrValidation, "memory cannot be nil")
+	}
+	if memory.ID == "" {
+		return errorf(ErrValidation, "memory ID cannot be empty")
+	}
+	if memory.Content == "" {
+		return errorf(ErrValidation, "memory content cannot be empty")
+	}
+	if !isValidMemoryType(memory.Type) {
+		return errorf(ErrValidation, "invalid memory type: %q", memory.Type)
+	}
+	if memory.Importance < 0 || memory.Importance > 1 {
+		return errorf(ErrValidation, "memory importance must be between 0 and 1")
+	}
+	return nil
+}
 
-	for d := 0; d < depth && len(queue) > 0; d++ {
-		nextQueue := []string{}
+// applyImportanceOverflow coerces out-of-range importance according to the
+// configured mode; in reject mode it leaves the value for validation to refuse
+func (ms *MemoryStore) applyImportanceOverflow(memory *Memory) {
+	if memory == nil || (memory.Importance >= 0 && memory.Importance <= 1) {
+		return
+	}
 
-		for _, id := range queue {
-			if visited[id] {
-				continue
-			}
-			visited[id] = true
+	switch ms.importanceOverflow {
+	case "clamp":
+		memory.Importance = float32(math.Max(0, math.Min(1, float64(memory.Importance))))
+	case "default":
+		memory.Importance = 0.5
+	}
+}
 
-			if mem, ok := ms.memories[id]; ok && id != memoryID {
-				results = append(results, mem)
-			}
+// enforceContentLength rejects or truncates content over the configured limit
+func (ms *MemoryStore) enforceContentLength(memory *Memory) error {
+	if ms.maxContentLength == 0 {
+		return nil
+	}
 
-			// Add related memories to next queue
-			if relations, ok := ms.relations[id]; ok {
-				for _, rel := range relations {
-					if !visited[rel.To] {
-						nextQueue = append(nextQueue, rel.To)
-					}
-				}
-			}
-		}
+	runes := []rune(memory.Content)
+	if len(runes) <= ms.maxContentLength {
+		return nil
+	}
 
-		queue = nextQueue
+	if !ms.truncateContent {
+		return errorf(ErrValidation, "memory content length %d exceeds limit of %d characters", len(runes), ms.maxContentLength)
 	}
 
-	return results
+	memory.Content = string(runes[:ms.maxContentLength])
+	memory.Truncated = true
+	return nil
 }
 
-// Memory consolidation process with graceful shutdown
-func (ms *MemoryStore) startConsolidationProcess() {
-	ticker := time.NewTicker(10 * time.Minute)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ticker.C:
-			ms.consolidateMemories()
-		case <-ms.ctx.Done():
-			return
-		}
+// normalizeContent returns the form of content compared for duplicates:
+// trimmed, with whitespace runs collapsed to one space, and lowercased in
+// lowercase mode. Memories keep their original content for display.
+func (ms *MemoryStore) normalizeContent(content string) string {
+	normalized := strings.Join(strings.Fields(content), " ")
+	if ms.contentNormalization == "lowercase" {
+		normalized = strings.ToLower(normalized)
 	}
+	return normalized
 }
 
-// Consolidate short-term memories into long-term
-func (ms *MemoryStore) consolidateMemories() {
-	ms.mu.Lock()
-	defer ms.mu.Unlock()
-
-	shortTermMemories := ms.typeIndex[ShortTerm]
-
-	for id, mem := range shortTermMemories {
-		// Check if memory should be consolidated
-		if mem.AccessCount > 3 || mem.Importance > 0.7 {
-			// Convert to long-term memory
-			mem.Type = LongTerm
-			delete(ms.typeIndex[ShortTerm], id)
-			ms.typeIndex[LongTerm][id] = mem
+// contentID derives a memory ID from the ID namespace and normalized content,
+// so storing the same content again yields the same ID
+func (ms *MemoryStore) contentID(content string) string {
+	sum := sha256.Sum256([]byte(ms.idNamespace + "\x00" + ms.normalizeContent(content)))
+	return "mem_" + hex.EncodeToString(sum[:16])
+}
 
-			// Strengthen relations
-			if relations, ok := ms.relations[id]; ok {
-				for _, rel := range relations {
-					rel.Strength *= 1.2
-				}
-			}
-		}
+// checkDuplicateContent rejects content that normalizes to the same form as
+// another memory's. Caller must hold ms.mu.
+func (ms *MemoryStore) checkDuplicateContent(memory *Memory) error {
+	if ms.contentIndex == nil {
+		return nil
+	}
+	if id, ok := ms.contentIndex[ms.normalizeContent(memory.Content)]; ok && id != memory.ID {
+		return errorf(ErrDuplicateID, "memory %s already has the same content", id)
 	}
+	return nil
 }
 
-// Memory decay process with graceful shutdown
-func (ms *MemoryStore) startDecayProcess() {
-	ticker := time.NewTicker(ms.decayInterval)
-	defer ticker.Stop()
+// addToContentIndex records a memory's normalized content. Caller must hold ms.mu.
+func (ms *MemoryStore) addToContentIndex(memory *Memory) {
+	if ms.contentIndex != nil {
+		ms.contentIndex[ms.normalizeContent(memory.Content)] = memory.ID
+	}
+}
 
-	for {
-		select {
-		case <-ticker.C:
-			ms.applyDecay()
-		case <-ms.ctx.Done():
-			return
-		}
+// removeFromContentIndex drops a memory's normalized content, before its
+// content changes or it is removed. Caller must hold ms.mu.
+func (ms *MemoryStore) removeFromContentIndex(memory *Memory) {
+	if ms.contentIndex == nil {
+		return
+	}
+	key := ms.normalizeContent(memory.Content)
+	if ms.contentIndex[key] == memory.ID {
+		delete(ms.contentIndex, key)
 	}
 }
 
-// Apply decay to memories
-func (ms *MemoryStore) applyDecay() {
-	ms.mu.Lock()
+// enforceMetadataLimits rejects metadata nested too deeply or too large
+// once serialized
+func (ms *MemoryStore) enforceMetadataLimits(memory *Memory) error {
+	if memory.Metadata == nil {
+		return nil
+	}
+	if ms.maxMetadataDepth > 0 {
+		if depth := metadataDepth(memory.Metadata); depth > ms.maxMetadataDepth {
+			return errorf(ErrValidation, "memory metadata nesting depth %d exceeds limit of %d", depth, ms.maxMetadataDepth)
+		}
+	}
+	if ms.maxMetadataBytes > 0 {
+		data, err := json.Marshal(memory.Metadata)
+		if err != nil {
+			return errorf(ErrValidation, "memory metadata cannot be serialized: %v", err)
+		}
+		if len(data) > ms.maxMetadataBytes {
+			return errorf(ErrValidation, "memory metadata size %d bytes exceeds limit of %d bytes", len(data), ms.maxMetadataBytes)
+		}
+	}
+	return nil
+}
+
+// metadataDepth counts the levels of objects and arrays in a metadata value;
+// a flat metadata object has depth 1
+func metadataDepth(value interface{}) int {
+	deepest := 0
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, child := range v {
+			deepest = max(deepest, metadataDepth(child))
+		}
+	case []interface{}:
+		for _, child := range v {
+			deepest = max(deepest, metadataDepth(child))
+		}
+	default:
+		return 0
+	}
+	return deepest + 1
+}
+
+// insertMemory adds a new memory to primary storage and all indexes, making
+// room first or failing with ErrStoreFull per the full-store policy.
+// Caller must hold ms.mu.
+func (ms *MemoryStore) insertMemory(memory *Memory) error {
+	if err := ms.checkEmbeddingDimension(memory.ID, memory.Embedding); err != nil {
+		return err
+	}
+	// Reject duplicate content before evicting anything to make room
+	if err := ms.checkDuplicateContent(memory); err != nil {
+		return err
+	}
+
+	// Check capacity, first of the memory's type and then of the whole store
+	if err := ms.makeRoomInType(memory.Type); err != nil {
+		return err
+	}
+	if len(ms.memories) >= ms.maxMemories {
+		if ms.rejectWhenFull || !ms.evictLeastImportant() {
+			return ErrStoreFull
+		}
+	}
+
+	// Seed the access score from a pre-existing access count
+	if memory.AccessScore == 0 && memory.AccessCount > 0 {
+		memory.AccessScore = float32(memory.AccessCount)
+	}
+	// Imported memories keep their version; new ones start at 1
+	if memory.Version <= 0 {
+		memory.Version = 1
+	}
+
+	// Store in primary map
+	ms.memories[memory.ID] = memory
+	ms.appendHistory(memory, "created", string(memory.Type))
+	ms.markChanged(memory)
+
+	// Update indexes
+	ms.typeIndex[memory.Type][memory.ID] = memory
+	ms.addToTimeIndex(memory)
+	ms.addToKeywordIndex(memory)
+	ms.addToContentIndex(memory)
+	ms.indexEmbedding(memory)
+	ms.queryCache.invalidate()
+	ms.updateCapacityWarning()
+
+	snapshot := eventSnapshot(memory)
+	ms.queueEvent(func(l EventListener) { l.OnStore(snapshot) })
+	return nil
+}
+
+// updateCapacityWarning logs a warning when usage first reaches the warning
+// threshold and re-arms it once usage falls back below. It runs after whole
+// operations rather than per removal, so an eviction that makes room for an
+// insert does not re-arm the warning. Caller must hold ms.mu.
+func (ms *MemoryStore) updateCapacityWarning() {
+	if ms.capacityWarningThreshold <= 0 || ms.maxMemories <= 0 {
+		return
+	}
+
+	used := float32(len(ms.memories)) / float32(ms.maxMemories)
+	if used < ms.capacityWarningThreshold {
+		ms.capacityWarningActive = false
+		return
+	}
+	if !ms.capacityWarningActive {
+		ms.capacityWarningActive = true
+		ms.capacityWarnings++
+		slog.Warn("Capacity warning: least important memories will be evicted or rejected at capacity",
+			"stored", len(ms.memories), "capacity", ms.maxMemories, "percent", math.Round(float64(used)*100))
+	}
+}
+
+// makeRoomInType ensures one more memory fits within the type's own capacity,
+// evicting the type's least important memory, or failing when the type's
+// policy rejects (with the global policy, when the store rejects). Types
+// without a cap only share the global limit. Caller must hold ms.mu.
+func (ms *MemoryStore) makeRoomInType(memoryType MemoryType) error {
+	limit := ms.typeCapacity[memoryType]
+	if limit <= 0 || len(ms.typeIndex[memoryType]) < limit {
+		return nil
+	}
+	if policy := ms.typePolicy[memoryType]; policy == "reject" || (policy != "evict" && ms.rejectWhenFull) {
+		return errorf(ErrCapacity, "%s memories are at their capacity of %d", memoryType, limit)
+	}
+	for len(ms.typeIndex[memoryType]) >= limit {
+		if !ms.evictLeastImportantOf(ms.typeIndex[memoryType]) {
+			return errorf(ErrCapacity, "%s memories are at their capacity of %d and all are pinned", memoryType, limit)
+		}
+	}
+	return nil
+}
+
+// Retrieve memories by various criteria with validation
+func (ms *MemoryStore) Query(criteria QueryCriteria) ([]*Memory, error) {
+	return ms.QueryContext(context.Background(), criteria)
+}
+
+// QueryContext is Query with a context that can cancel long similarity scans
+func (ms *MemoryStore) QueryContext(ctx context.Context, criteria QueryCriteria) ([]*Memory, error) {
+	results, err := ms.query(ctx, criteria, true)
+	if err == nil {
+		ids := make([]string, len(results))
+		for i, mem := range results {
+			ids[i] = mem.ID
+		}
+		ms.deliverEvents([]func(EventListener){func(l EventListener) { l.OnQuery(criteria, ids) }})
+	}
+	return results, err
+}
+
+// Count returns how many memories a query matches, without recording access
+// or returning them. Single-type and keyword queries are counted straight
+// from the indexes; other strategies run the query, so their count is capped
+// by its limit where the query applies one.
+func (ms *MemoryStore) Count(ctx context.Context, criteria QueryCriteria) (int, error) {
+	if err := validateQuery(&criteria); err != nil {
+		return 0, err
+	}
+
+	// The indexes don't know when memories changed, so a since version
+	// always runs the query
+	switch criteria.Type {
+	case "similarity", "similar_to_id", "temporal", "related", "related_keywords", "relation_type", "session", "phrase":
+	case "type":
+		if len(criteria.MemoryTypes) == 0 && criteria.SinceVersion == 0 {
+			ms.mu.RLock()
+			defer ms.mu.RUnlock()
+			return len(ms.typeIndex[criteria.MemoryType]), nil
+		}
+	default:
+		if criteria.SinceVersion == 0 && len(criteria.Keywords) > 0 {
+			ms.mu.RLock()
+			defer ms.mu.RUnlock()
+			return ms.countKeywordMatches(criteria.Keywords), nil
+		}
+	}
+
+	results, err := ms.query(ctx, criteria, false)
+	return len(results), err
+}
+
+// countKeywordMatches counts memories whose content has any of the keywords,
+// as findByKeywords would return them. Caller must hold ms.mu.
+func (ms *MemoryStore) countKeywordMatches(keywords []string) int {
+	ms.keywordIndex.mu.RLock()
+	defer ms.keywordIndex.mu.RUnlock()
+
+	var lists []*postingList
+	for _, keyword := range uniqueStrings(keywords) {
+		if memories, exists := ms.keywordIndex.index[strings.ToLower(keyword)]; exists {
+			lists = append(lists, memories)
+		}
+	}
+	if len(lists) == 1 {
+		return lists[0].len()
+	}
+
+	matched := make(map[string]bool)
+	for _, memories := range lists {
+		memories.each(func(mem *Memory) {
+			matched[mem.ID] = true
+		})
+	}
+	return len(matched)
+}
+
+// validateQuery checks query criteria and fills in the default limit
+func validateQuery(criteria *QueryCriteria) error {
+	if criteria.Type == "" {
+		return errorf(ErrValidation, "query type cannot be empty")
+	}
+	if criteria.Limit < 0 {
+		return errorf(ErrValidation, "query limit cannot be negative")
+	}
+	if criteria.Limit == 0 {
+		criteria.Limit = 10 // Default limit
+	}
+	if criteria.Limit > 1000 {
+		return errorf(ErrValidation, "query limit cannot exceed 1000")
+	}
+	if criteria.ImportanceWeight < 0 || criteria.ImportanceWeight > 1 {
+		return errorf(ErrValidation, "importance weight must be between 0 and 1")
+	}
+	if criteria.Type == "session" && criteria.SessionID == "" {
+		return errorf(ErrValidation, "session queries need a session_id")
+	}
+	if criteria.Type == "phrase" && strings.TrimSpace(criteria.Phrase) == "" {
+		return errorf(ErrValidation, "phrase queries need a phrase")
+	}
+	if criteria.Type == "related_keywords" && len(criteria.Keywords) == 0 {
+		return errorf(ErrValidation, "related_keywords queries need at least one keyword")
+	}
+	if criteria.Within < 0 {
+		return errorf(ErrValidation, "within cannot be negative")
+	}
+	for _, memoryType := range criteria.MemoryTypes {
+		if !isValidMemoryType(memoryType) {
+			return errorf(ErrValidation, "invalid memory type: %s", memoryType)
+		}
+	}
+	return nil
+}
+
+// isKeywordQuery reports whether a query type falls through to the keyword
+// strategy, which every unrecognized type does
+func isKeywordQuery(queryType string) bool {
+	switch queryType {
+	case "similarity", "similar_to_id", "temporal", "type", "related", "related_keywords", "relation_type", "session", "phrase":
+		return false
+	}
+	return true
+}
+
+// query runs a validated query, recording access to the results unless
+// only counting them
+func (ms *MemoryStore) query(ctx context.Context, criteria QueryCriteria, recordAccess bool) ([]*Memory, error) {
+	if err := validateQuery(&criteria); err != nil {
+		return nil, err
+	}
+	if isKeywordQuery(criteria.Type) && len(criteria.Keywords) == 0 && !ms.emptyKeywordsListAll {
+		return nil, errorf(ErrValidation, "keyword queries need at least one keyword")
+	}
+	if criteria.Type == "phrase" && !ms.keywordIndex.positional {
+		return nil, errorf(ErrValidation, "phrase queries need the positional index, enabled with --positional-index")
+	}
+	// Only cosine scores share importance's 0-1 scale, so only they can be blended with it
+	isSimilarity := criteria.Type == "similarity" || criteria.Type == "similar_to_id"
+	if isSimilarity && criteria.ImportanceWeight != 0 && ms.embeddingIndex.metric != MetricCosine {
+		return nil, errorf(ErrValidation, "importance_weight needs the cosine similarity metric, not %s", ms.embeddingIndex.metric)
+	}
+
+	// Similarity and keyword scans are the expensive strategies, so only they
+	// wait for a limiter slot; index lookups run straight away
+	switch criteria.Type {
+	case "temporal", "type", "related", "related_keywords", "relation_type", "session", "phrase":
+	default:
+		if err := ms.queryLimiter.acquire(ctx); err != nil {
+			return nil, err
+		}
+		defer ms.queryLimiter.release()
+	}
+
+	// Similarity scans score a snapshot so long scans don't stall writers;
+	// results may be slightly stale if memories change mid-scan
+	if criteria.Type == "similarity" || criteria.Type == "similar_to_id" {
+		ms.mu.RLock()
+		embedding := criteria.Embedding
+		if criteria.Type == "similar_to_id" {
+			seed, ok := ms.memories[criteria.MemoryID]
+			if !ok {
+				ms.mu.RUnlock()
+				return nil, errorf(ErrNotFound, "memory with ID %s does not exist", criteria.MemoryID)
+			}
+			if seed.Embedding == nil {
+				ms.mu.RUnlock()
+				return nil, errorf(ErrValidation, "memory %s has no embedding", criteria.MemoryID)
+			}
+			embedding = seed.Embedding
+		} else if err := ms.checkQueryDimension(embedding); err != nil {
+			ms.mu.RUnlock()
+			return nil, err
+		}
+		var snapshot []embeddingEntry
+		if len(criteria.Keywords) > 0 || criteria.MemoryType != "" {
+			snapshot = ms.snapshotCandidateEmbeddings(ms.similarityCandidates(criteria))
+		} else {
+			snapshot = ms.snapshotEmbeddings()
+		}
+		if criteria.SinceVersion > 0 {
+			snapshot = slices.DeleteFunc(snapshot, func(entry embeddingEntry) bool {
+				return entry.memory.changed <= criteria.SinceVersion
+			})
+		}
+		ms.mu.RUnlock()
+
+		if criteria.Type == "similar_to_id" {
+			// The seed is always its own nearest neighbor, so leave it out
+			snapshot = slices.DeleteFunc(snapshot, func(entry embeddingEntry) bool {
+				return entry.memory.ID == criteria.MemoryID
+			})
+		}
+
+		results, err := scoreSimilar(ctx, snapshot, ms.embeddingIndex, embedding, criteria.Limit, criteria.ImportanceWeight)
+		if err != nil {
+			return nil, err
+		}
+
+		if !recordAccess {
+			return dedupeResults(results), nil
+		}
+		return ms.finishQuery(results, time.Now()), nil
+	}
+
+	ms.mu.RLock()
+	var results []*Memory
+	now := time.Now()
+
+	switch criteria.Type {
+	case "temporal":
+		results = ms.findTemporal(criteria.StartTime, criteria.EndTime)
+	case "type":
+		if len(criteria.MemoryTypes) > 0 {
+			results = ms.findByTypes(append([]MemoryType{criteria.MemoryType}, criteria.MemoryTypes...), criteria.SinceVersion, criteria.Limit)
+		} else {
+			results = ms.findByType(criteria.MemoryType)
+		}
+	case "related":
+		results = ms.findRelated(criteria.MemoryID, criteria.Depth)
+	case "related_keywords":
+		results = ms.findRelatedByKeywords(criteria.MemoryID, criteria.Depth, criteria.Keywords)
+	case "relation_type":
+		results = ms.findByRelationType(criteria.RelationType)
+	case "session":
+		results = ms.findBySession(criteria.SessionID)
+	case "phrase":
+		results = ms.findByPhrase(criteria.Phrase, criteria.Within, criteria.Limit)
+	default:
+		if len(criteria.Keywords) == 0 {
+			// Configured to treat no keywords as "everything", limited
+			results = ms.findByTypes(allMemoryTypes, criteria.SinceVersion, criteria.Limit)
+		} else {
+			results = ms.findByKeywordsCached(criteria, now)
+		}
+	}
+	if criteria.SinceVersion > 0 {
+		results = ms.changedSince(results, criteria.SinceVersion)
+	}
+	ms.mu.RUnlock()
+
+	if !recordAccess {
+		return dedupeResults(results), nil
+	}
+	return ms.finishQuery(results, now), nil
+}
+
+// finishQuery is the single step every query strategy's results pass
+// through: it drops repeats of a memory, keeping its first (best ranked)
+// position, so a memory reached more than once is returned and counted as
+// accessed once. It takes the write lock to record the accesses, dropping
+// memories removed since the query ran.
+func (ms *MemoryStore) finishQuery(results []*Memory, now time.Time) []*Memory {
+	results = dedupeResults(results)
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	// Update access patterns
+	results = slices.DeleteFunc(results, func(mem *Memory) bool { return ms.memories[mem.ID] != mem })
+	for _, mem := range results {
+		ms.recordAccess(mem, now)
+	}
+	return results
+}
+
+// changedSince keeps the memories changed after version. Caller must hold ms.mu.
+func (ms *MemoryStore) changedSince(results []*Memory, version uint64) []*Memory {
+	return slices.DeleteFunc(results, func(mem *Memory) bool {
+		return mem.changed <= version
+	})
+}
+
+// dedupeResults drops repeats of a memory, keeping its first position
+func dedupeResults(results []*Memory) []*Memory {
+	seen := make(map[string]bool, len(results))
+	return slices.DeleteFunc(results, func(mem *Memory) bool {
+		if seen[mem.ID] {
+			return true
+		}
+		seen[mem.ID] = true
+		return false
+	})
+}
+
+// findByKeywordsCached serves keyword queries from the query cache when
+// possible. Caller must hold ms.mu.
+func (ms *MemoryStore) findByKeywordsCached(criteria QueryCriteria, now time.Time) []*Memory {
+	key := queryCacheKey(criteria)
+	if ids, ok := ms.queryCache.get(key, now); ok {
+		results := make([]*Memory, 0, len(ids))
+		for _, id := range ids {
+			if mem, exists := ms.memories[id]; exists {
+				results = append(results, mem)
+			}
+		}
+		return results
+	}
+
+	results := ms.findByKeywords(criteria.Keywords)
+	ms.queryCache.put(key, results, now)
+	return results
+}
+
+// embeddingEntry pairs a memory with its indexed embedding for lock-free scoring
+type embeddingEntry struct {
+	memory     *Memory
+	importance float32 // captured with the snapshot so scoring never reads live memories
+	vector     []float32
+	quantized  QuantizedVector
+}
+
+// score compares the entry with a query prepared for the same metric.
+// Higher is always more similar, so euclidean scores are negated distances.
+func (e embeddingEntry) score(query []float32, metric SimilarityMetric) float32 {
+	if metric == MetricEuclidean {
+		if e.vector != nil {
+			return -euclideanDistance(query, e.vector)
+		}
+		return -e.quantized.distance(query)
+	}
+	if e.vector != nil {
+		// For cosine both vectors are normalized, so dot product = cosine similarity
+		return dotProduct(query, e.vector)
+	}
+	return e.quantized.dot(query)
+}
+
+// snapshotEmbeddings copies embedding references under a brief lock so scans
+// can score without blocking writers. Caller must hold ms.mu.
+func (ms *MemoryStore) snapshotEmbeddings() []embeddingEntry {
+	ms.embeddingIndex.mu.RLock()
+	defer ms.embeddingIndex.mu.RUnlock()
+
+	snapshot := make([]embeddingEntry, 0, len(ms.embeddingIndex.embeddings)+len(ms.embeddingIndex.quantized))
+	for id, emb := range ms.embeddingIndex.embeddings {
+		if mem, ok := ms.memories[id]; ok {
+			snapshot = append(snapshot, embeddingEntry{memory: mem, importance: mem.Importance, vector: emb})
+		}
+	}
+	for id, qv := range ms.embeddingIndex.quantized {
+		if mem, ok := ms.memories[id]; ok {
+			snapshot = append(snapshot, embeddingEntry{memory: mem, importance: mem.Importance, quantized: qv})
+		}
+	}
+	return snapshot
+}
+
+// similarityCandidates narrows a similarity query to the memories matching any
+// of its keywords and its memory type, whichever are set. Caller must hold ms.mu.
+func (ms *MemoryStore) similarityCandidates(criteria QueryCriteria) []*Memory {
+	if len(criteria.Keywords) == 0 {
+		return ms.findByType(criteria.MemoryType)
+	}
+	candidates := ms.findByKeywords(criteria.Keywords)
+	if criteria.MemoryType != "" {
+		candidates = slices.DeleteFunc(candidates, func(mem *Memory) bool {
+			return mem.Type != criteria.MemoryType
+		})
+	}
+	return candidates
+}
+
+// snapshotCandidateEmbeddings is snapshotEmbeddings for a candidate subset,
+// looking each candidate up rather than scanning the whole index, so a
+// narrow filter scores only a few embeddings. Caller must hold ms.mu.
+func (ms *MemoryStore) snapshotCandidateEmbeddings(candidates []*Memory) []embeddingEntry {
+	ms.embeddingIndex.mu.RLock()
+	defer ms.embeddingIndex.mu.RUnlock()
+
+	snapshot := make([]embeddingEntry, 0, len(candidates))
+	for _, mem := range candidates {
+		if emb, ok := ms.embeddingIndex.embeddings[mem.ID]; ok {
+			snapshot = append(snapshot, embeddingEntry{memory: mem, importance: mem.Importance, vector: emb})
+		} else if qv, ok := ms.embeddingIndex.quantized[mem.ID]; ok {
+			snapshot = append(snapshot, embeddingEntry{memory: mem, importance: mem.Importance, quantized: qv})
+		}
+	}
+	return snapshot
+}
+
+// Find similar memories using embedding similarity with heap-based top-K
+func (ms *MemoryStore) findSimilar(embedding []float32, limit int) []*Memory {
+	results, _ := ms.findSimilarContext(context.Background(), embedding, limit)
+	return results
+}
+
+// findSimilarContext is findSimilar with a context that can cancel the scan
+func (ms *MemoryStore) findSimilarContext(ctx context.Context, embedding []float32, limit int) ([]*Memory, error) {
+	return scoreSimilar(ctx, ms.snapshotEmbeddings(), ms.embeddingIndex, embedding, limit, 0)
+}
+
+// similarityCancelCheckInterval is how many entries a scan scores between context checks
+const similarityCancelCheckInterval = 1024
+
+// scoreSimilar selects the top-K entries of a snapshot without holding any lock.
+// A non-zero importanceWeight blends importance into the ranking:
+// score = similarity*(1-w) + importance*w, which assumes the cosine metric
+// so both are on the same scale. If ctx is cancelled mid-scan it
+// returns no results and the context's error.
+//
+// Limits that are small next to the scan keep a min-heap of the best K seen
+// so far, which needs no memory beyond K entries. Once the limit reaches the
+// index's select ratio of the scan (5% by default), heap push/pop churn costs
+// more than keeping every score, so the top K are found with quickselect
+// instead. BenchmarkSimilarityTopK measures both paths.
+func scoreSimilar(ctx context.Context, snapshot []embeddingEntry, ei *EmbeddingIndex, embedding []float32, limit int, importanceWeight float32) ([]*Memory, error) {
+	metric := ei.metric
+	query := metric.prepare(embedding)
+
+	useSelect := ei.selectRatio > 0 && float32(limit) >= ei.selectRatio*float32(len(snapshot))
+	var scored []ScoredMemory
+	if useSelect {
+		scored = make([]ScoredMemory, 0, len(snapshot))
+	}
+
+	// Use min-heap to maintain top-K efficiently
+	h := &ScoredMemoryHeap{}
+	heap.Init(h)
+
+	for i, entry := range snapshot {
+		if i%similarityCancelCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+
+		score := entry.score(query, metric)
+		if importanceWeight != 0 {
+			score = score*(1-importanceWeight) + entry.importance*importanceWeight
+		}
+		if useSelect {
+			scored = append(scored, ScoredMemory{Memory: entry.memory, Score: score})
+		} else {
+			pushTopK(h, entry.memory, score, limit)
+		}
+	}
+
+	if useSelect {
+		return selectTopK(scored, limit), nil
+	}
+	return drainTopK(h), nil
+}
+
+// FindSimilarBatch finds the nearest memories for several query vectors in a
+// single pass over the embedding index, keeping a top-K heap per query
+func (ms *MemoryStore) FindSimilarBatch(queries [][]float32, limit int) ([][]*Memory, error) {
+	if len(queries) == 0 {
+		return nil, errorf(ErrValidation, "at least one query embedding is required")
+	}
+	if limit < 0 {
+		return nil, errorf(ErrValidation, "query limit cannot be negative")
+	}
+	if limit == 0 {
+		limit = 10 // Default limit
+	}
+	if limit > 1000 {
+		return nil, errorf(ErrValidation, "query limit cannot exceed 1000")
+	}
+
+	ms.mu.RLock()
+	for _, query := range queries {
+		if err := ms.checkQueryDimension(query); err != nil {
+			ms.mu.RUnlock()
+			return nil, err
+		}
+	}
+	snapshot := ms.snapshotEmbeddings()
+	ms.mu.RUnlock()
+
+	results := scoreSimilarBatch(snapshot, ms.embeddingIndex.metric, queries, limit)
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	// Update access patterns
+	now := time.Now()
+	for _, batch := range results {
+		for _, mem := range batch {
+			ms.recordAccess(mem, now)
+		}
+	}
+
+	return results, nil
+}
+
+// findSimilarBatch scores every indexed embedding against all queries at once
+func (ms *MemoryStore) findSimilarBatch(queries [][]float32, limit int) [][]*Memory {
+	return scoreSimilarBatch(ms.snapshotEmbeddings(), ms.embeddingIndex.metric, queries, limit)
+}
+
+// scoreSimilarBatch keeps one top-K heap per distinct query over a single
+// snapshot pass. Repeated queries are prepared and scored once and share
+// copies of the same results.
+func scoreSimilarBatch(snapshot []embeddingEntry, metric SimilarityMetric, queries [][]float32, limit int) [][]*Memory {
+	var preparedQueries [][]float32
+	distinct := make([]int, len(queries)) // query index -> prepared query index
+	for i, query := range queries {
+		distinct[i] = -1
+		for j := 0; j < i; j++ {
+			if slices.Equal(query, queries[j]) {
+				distinct[i] = distinct[j]
+				break
+			}
+		}
+		if distinct[i] < 0 {
+			distinct[i] = len(preparedQueries)
+			preparedQueries = append(preparedQueries, metric.prepare(query))
+		}
+	}
+
+	heaps := make([]*ScoredMemoryHeap, len(preparedQueries))
+	for i := range heaps {
+		heaps[i] = &ScoredMemoryHeap{}
+	}
+	for _, entry := range snapshot {
+		for i, query := range preparedQueries {
+			pushTopK(heaps[i], entry.memory, entry.score(query, metric), limit)
+		}
+	}
+
+	scored := make([][]*Memory, len(heaps))
+	for i, h := range heaps {
+		scored[i] = drainTopK(h)
+	}
+	results := make([][]*Memory, len(queries))
+	for i, d := range distinct {
+		results[i] = slices.Clone(scored[d])
+	}
+	return results
+}
+
+// pushTopK offers a scored memory to a min-heap holding at most limit entries
+func pushTopK(h *ScoredMemoryHeap, mem *Memory, score float32, limit int) {
+	if h.Len() < limit {
+		heap.Push(h, &ScoredMemory{Memory: mem, Score: score})
+	} else if score > (*h)[0].Score {
+		heap.Pop(h)
+		heap.Push(h, &ScoredMemory{Memory: mem, Score: score})
+	}
+}
+
+// drainTopK empties a top-K min-heap into a slice ordered by descending score
+func drainTopK(h *ScoredMemoryHeap) []*Memory {
+	results := make([]*Memory, h.Len())
+	for i := len(results) - 1; i >= 0; i-- {
+		results[i] = heap.Pop(h).(*ScoredMemory).Memory
+	}
+	return results
+}
+
+// selectTopK returns the limit highest-scored memories ordered by descending
+// score, reordering scored in place
+func selectTopK(scored []ScoredMemory, limit int) []*Memory {
+	if limit < len(scored) {
+		partitionTopK(scored, limit)
+		scored = scored[:limit]
+	}
+	sort.Slice(scored, func(i, j int) bool { return scored[i].Score > scored[j].Score })
+
+	results := make([]*Memory, len(scored))
+	for i := range scored {
+		results[i] = scored[i].Memory
+	}
+	return results
+}
+
+// partitionTopK quickselects so the first k entries hold the k highest
+// scores, in no particular order
+func partitionTopK(scored []ScoredMemory, k int) {
+	lo, hi := 0, len(scored)
+	for hi-lo > 1 {
+		// Median of three keeps already-ordered input from going quadratic
+		a, b, c := scored[lo].Score, scored[lo+(hi-lo)/2].Score, scored[hi-1].Score
+		pivot := max(min(a, b), min(max(a, b), c))
+
+		// Three-way partition into [lo,above) scoring above the pivot,
+		// [above,below) equal to it and [below,hi) under it, so runs of equal
+		// scores are settled in one pass
+		above, i, below := lo, lo, hi
+		for i < below {
+			switch score := scored[i].Score; {
+			case score > pivot:
+				scored[i], scored[above] = scored[above], scored[i]
+				above++
+				i++
+			case score < pivot:
+				below--
+				scored[i], scored[below] = scored[below], scored[i]
+			default:
+				i++
+			}
+		}
+
+		switch {
+		case k < above:
+			hi = above
+		case k > below:
+			lo = below
+		default:
+			return
+		}
+	}
+}
+
+// relatedCandidate is a memory reached during traversal and the strength of the edge that reached it
+type relatedCandidate struct {
+	id       string
+	strength float32
+}
+
+// Find related memories using graph traversal.
+// Each BFS level is ordered by relation strength then ID so results are stable.
+// Memories are marked visited when enqueued, so a memory reached by several
+// edges is queued once, ranked by its strongest edge, and dense graphs cannot
+// grow the queue beyond the number of memories. Depth is clamped to the
+// configured maximum so one client cannot tie up the store walking the graph.
+func (ms *MemoryStore) findRelated(memoryID string, depth int) []*Memory {
+	if ms.maxRelatedDepth > 0 {
+		depth = min(depth, ms.maxRelatedDepth)
+	}
+	visited := map[string]bool{memoryID: true}
+	queue := []relatedCandidate{{id: memoryID}}
+	results := make([]*Memory, 0)
+
+	for d := 0; d < depth && len(queue) > 0; d++ {
+		nextQueue := []relatedCandidate{}
+		queued := make(map[string]int) // ID -> position in nextQueue
+
+		for _, candidate := range queue {
+			id := candidate.id
+			if mem, ok := ms.memories[id]; ok && id != memoryID {
+				results = append(results, mem)
+			}
+
+			// Add related memories to next queue
+			for _, rel := range ms.relations[id] {
+				if i, ok := queued[rel.To]; ok {
+					if rel.Strength > nextQueue[i].strength {
+						nextQueue[i].strength = rel.Strength
+					}
+					continue
+				}
+				if visited[rel.To] {
+					continue
+				}
+				visited[rel.To] = true
+				queued[rel.To] = len(nextQueue)
+				nextQueue = append(nextQueue, relatedCandidate{id: rel.To, strength: rel.Strength})
+			}
+		}
+
+		sort.SliceStable(nextQueue, func(i, j int) bool {
+			if nextQueue[i].strength != nextQueue[j].strength {
+				return nextQueue[i].strength > nextQueue[j].strength
+			}
+			return nextQueue[i].id < nextQueue[j].id
+		})
+		queue = nextQueue
+	}
+
+	return results
+}
+
+// ClusterSummary describes a seed memory and the memories reachable from it
+type ClusterSummary struct {
+	Members           []*Memory         `json:"members"`
+	Edges             []*MemoryRelation `json:"edges"`
+	Count             int               `json:"count"`
+	AverageImportance float32           `json:"average_importance"`
+	DominantType      MemoryType        `json:"dominant_type"`
+}
+
+// Cluster summarizes the seed memory and its related memories up to depth,
+// with the relations among them. Ties for dominant type go to the type listed
+// first in allMemoryTypes.
+func (ms *MemoryStore) Cluster(memoryID string, depth int) (*ClusterSummary, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	seed, ok := ms.memories[memoryID]
+	if !ok {
+		return nil, errorf(ErrNotFound, "memory with ID %s does not exist", memoryID)
+	}
+
+	members := append([]*Memory{seed}, ms.findRelated(memoryID, depth)...)
+	inCluster := make(map[string]bool, len(members))
+	typeCounts := make(map[MemoryType]int)
+	var totalImportance float32
+	for _, mem := range members {
+		inCluster[mem.ID] = true
+		typeCounts[mem.Type]++
+		totalImportance += mem.Importance
+	}
+
+	edges := make([]*MemoryRelation, 0)
+	for _, mem := range members {
+		for _, rel := range ms.relations[mem.ID] {
+			if inCluster[rel.To] {
+				edges = append(edges, rel)
+			}
+		}
+	}
+
+	var dominant MemoryType
+	for _, t := range allMemoryTypes {
+		if typeCounts[t] > typeCounts[dominant] {
+			dominant = t
+		}
+	}
+
+	return &ClusterSummary{
+		Members:           members,
+		Edges:             edges,
+		Count:             len(members),
+		AverageImportance: totalImportance / float32(len(members)),
+		DominantType:      dominant,
+	}, nil
+}
+
+// Find related memories that also mention at least one of the keywords
+func (ms *MemoryStore) findRelatedByKeywords(memoryID string, depth int, keywords []string) []*Memory {
+	related := ms.findRelated(memoryID, depth)
+
+	results := make([]*Memory, 0, len(related))
+	for _, mem := range related {
+		if ms.matchesKeywords(mem, keywords) {
+			results = append(results, mem)
+		}
+	}
+
+	return results
+}
+
+// Orphans returns memories with no relation to or from another stored
+// memory, oldest first, along with how many there are in total. Relations
+// whose other end has been removed don't count. A limit of 0 returns every
+// orphan.
+func (ms *MemoryStore) Orphans(limit int) ([]*Memory, int) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	connected := make(map[string]bool)
+	for from, relations := range ms.relations {
+		if _, ok := ms.memories[from]; !ok {
+			continue
+		}
+		for _, rel := range relations {
+			if _, ok := ms.memories[rel.To]; ok {
+				connected[from] = true
+				connected[rel.To] = true
+			}
+		}
+	}
+
+	orphans := make([]*Memory, 0)
+	for id, mem := range ms.memories {
+		if !connected[id] {
+			orphans = append(orphans, mem)
+		}
+	}
+	sort.Slice(orphans, func(i, j int) bool {
+		if !orphans[i].Timestamp.Equal(orphans[j].Timestamp) {
+			return orphans[i].Timestamp.Before(orphans[j].Timestamp)
+		}
+		return orphans[i].ID < orphans[j].ID
+	})
+
+	total := len(orphans)
+	if limit > 0 && len(orphans) > limit {
+		orphans = orphans[:limit]
+	}
+	return orphans, total
+}
+
+// Compare returns the cosine similarity of two memories' embeddings, from -1
+// to 1, whatever metric the index ranks by. It fails if either memory is
+// missing, has no embedding, or the embeddings differ in dimension.
+func (ms *MemoryStore) Compare(idA, idB string) (float32, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	var embeddings [2][]float32
+	for i, id := range []string{idA, idB} {
+		mem, ok := ms.memories[id]
+		if !ok {
+			return 0, errorf(ErrNotFound, "memory with ID %s does not exist", id)
+		}
+		if mem.Embedding == nil {
+			return 0, errorf(ErrValidation, "memory %s has no embedding", id)
+		}
+		embeddings[i] = mem.Embedding
+	}
+	if len(embeddings[0]) != len(embeddings[1]) {
+		return 0, errorf(ErrValidation, "embedding dimensions differ: %d and %d", len(embeddings[0]), len(embeddings[1]))
+	}
+
+	return comparableSimilarity(embeddings[0], embeddings[1]), nil
+}
+
+// comparableSimilarity is cosineSimilarity with a zero vector, which has no
+// direction to compare, scoring 0 instead of NaN
+func comparableSimilarity(a, b []float32) float32 {
+	similarity := cosineSimilarity(a, b)
+	if math.IsNaN(float64(similarity)) {
+		return 0
+	}
+	return similarity
+}
+
+// RelationSuggestion is a memory worth relating to a seed, with its similarity
+type RelationSuggestion struct {
+	ID         string  `json:"id"`
+	Similarity float32 `json:"similarity"`
+}
+
+// SuggestRelations proposes relations from a memory to its nearest embedding
+// neighbors whose cosine similarity is at least threshold, most similar
+// first, without creating them. Memories already related to the seed in
+// either direction are left out, as are embeddings of another dimension.
+func (ms *MemoryStore) SuggestRelations(id string, threshold float32, limit int) ([]RelationSuggestion, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	seed, ok := ms.memories[id]
+	if !ok {
+		return nil, errorf(ErrNotFound, "memory with ID %s does not exist", id)
+	}
+	if seed.Embedding == nil {
+		return nil, errorf(ErrValidation, "memory %s has no embedding", id)
+	}
+	if err := ms.checkEmbeddingDimension(id, seed.Embedding); err != nil {
+		return nil, err
+	}
+
+	related := make(map[string]bool)
+	for _, rel := range ms.relations[id] {
+		related[rel.To] = true
+	}
+	for from, relations := range ms.relations {
+		for _, rel := range relations {
+			if rel.To == id {
+				related[from] = true
+			}
+		}
+	}
+
+	// Neighbors are ranked by the index metric, so look past the seed and
+	// existing relations before filtering by cosine similarity
+	suggestions := make([]RelationSuggestion, 0)
+	for _, mem := range ms.findSimilar(seed.Embedding, min(limit+len(related)+1, maxSuggestionScan)) {
+		if mem.ID == id || related[mem.ID] || len(mem.Embedding) != len(seed.Embedding) {
+			continue
+		}
+		if similarity := comparableSimilarity(seed.Embedding, mem.Embedding); similarity >= threshold {
+			suggestions = append(suggestions, RelationSuggestion{ID: mem.ID, Similarity: similarity})
+		}
+	}
+	sort.SliceStable(suggestions, func(i, j int) bool {
+		return suggestions[i].Similarity > suggestions[j].Similarity
+	})
+
+	if len(suggestions) > limit {
+		suggestions = suggestions[:limit]
+	}
+	return suggestions, nil
+}
+
+// maxSuggestionScan bounds how many neighbors SuggestRelations considers
+const maxSuggestionScan = 1000
+
+// MemoryTypeInfo describes a memory type, how to use it, and how this store
+// treats it
+type MemoryTypeInfo struct {
+	Type             MemoryType `json:"type"`
+	Description      string     `json:"description"`
+	Example          string     `json:"example"`
+	Importance       string     `json:"recommended_importance"`
+	Decay            float32    `json:"recommended_decay"`
+	Count            int        `json:"count"`
+	Capacity         int        `json:"capacity,omitempty"`         // 0 when only the overall limit applies
+	Policy           string     `json:"policy,omitempty"`           // evict, reject, or global at capacity; empty is global
+	ImportanceFloor  *float32   `json:"importance_floor,omitempty"` // nil when decay has no floor
+	ConsolidatesInto MemoryType `json:"consolidates_into,omitempty"`
+}
+
+// MemoryTypes describes every memory type with its current count and any
+// capacity, policy, decay floor, or consolidation target configured for it
+func (ms *MemoryStore) MemoryTypes() []MemoryTypeInfo {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	types := make([]MemoryTypeInfo, 0, len(allMemoryTypes))
+	for _, memoryType := range allMemoryTypes {
+		guide := memoryTypeGuides[memoryType]
+		info := MemoryTypeInfo{
+			Type:        memoryType,
+			Description: guide.description,
+			Example:     guide.example,
+			Importance:  guide.importance,
+			Decay:       guide.decay,
+			Count:       len(ms.typeIndex[memoryType]),
+			Capacity:    ms.typeCapacity[memoryType],
+			Policy:      ms.typePolicy[memoryType],
+		}
+		if floor, ok := ms.importanceFloors[memoryType]; ok {
+			info.ImportanceFloor = &floor
+		}
+		if memoryType == ShortTerm {
+			info.ConsolidatesInto = ms.consolidationTarget
+		}
+		types = append(types, info)
+	}
+	return types
+}
+
+// HubEntry is a memory and the number of relations touching it
+type HubEntry struct {
+	Memory   *Memory `json:"memory"`
+	Outbound int     `json:"outbound"`
+	Inbound  int     `json:"inbound"`
+	Degree   int     `json:"degree"`
+}
+
+// Hubs returns the most connected memories, ranked by outbound plus inbound
+// relation count, then by ID. Like Orphans, relations whose other end has
+// been removed don't count, and unconnected memories are left out.
+func (ms *MemoryStore) Hubs(limit int) []HubEntry {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	degrees := make(map[string]*HubEntry)
+	entry := func(id string) *HubEntry {
+		if degrees[id] == nil {
+			degrees[id] = &HubEntry{Memory: ms.memories[id]}
+		}
+		return degrees[id]
+	}
+	for from, relations := range ms.relations {
+		if _, ok := ms.memories[from]; !ok {
+			continue
+		}
+		for _, rel := range relations {
+			if _, ok := ms.memories[rel.To]; ok {
+				entry(from).Outbound++
+				entry(rel.To).Inbound++
+			}
+		}
+	}
+
+	hubs := make([]HubEntry, 0, len(degrees))
+	for _, hub := range degrees {
+		hub.Degree = hub.Outbound + hub.Inbound
+		hubs = append(hubs, *hub)
+	}
+	sort.Slice(hubs, func(i, j int) bool {
+		if hubs[i].Degree != hubs[j].Degree {
+			return hubs[i].Degree > hubs[j].Degree
+		}
+		return hubs[i].Memory.ID < hubs[j].Memory.ID
+	})
+
+	if limit > 0 && len(hubs) > limit {
+		hubs = hubs[:limit]
+	}
+	return hubs
+}
+
+// Find the memories stored in a session, oldest first
+func (ms *MemoryStore) findBySession(sessionID string) []*Memory {
+	results := make([]*Memory, 0)
+	for _, mem := range ms.memories {
+		if id, _ := mem.Metadata[sessionMetadataKey].(string); id == sessionID {
+			results = append(results, mem)
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if !results[i].Timestamp.Equal(results[j].Timestamp) {
+			return results[i].Timestamp.Before(results[j].Timestamp)
+		}
+		return results[i].ID < results[j].ID
+	})
+	return results
+}
+
+// Find the memories connected by relations of the given type
+func (ms *MemoryStore) findByRelationType(relationType string) []*Memory {
+	seen := make(map[string]bool)
+	results := make([]*Memory, 0)
+
+	for _, rel := range ms.relationTypeIndex[relationType] {
+		for _, id := range []string{rel.From, rel.To} {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			if mem, ok := ms.memories[id]; ok {
+				results = append(results, mem)
+			}
+		}
+	}
+
+	return results
+}
+
+// RelationsByType returns all relations of the given type whose endpoints still exist
+func (ms *MemoryStore) RelationsByType(relationType string) []*MemoryRelation {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	results := make([]*MemoryRelation, 0, len(ms.relationTypeIndex[relationType]))
+	for _, rel := range ms.relationTypeIndex[relationType] {
+		_, fromExists := ms.memories[rel.From]
+		_, toExists := ms.memories[rel.To]
+		if fromExists && toExists {
+			results = append(results, rel)
+		}
+	}
+
+	return results
+}
+
+// removeFromRelationTypeIndex drops a relation from the relation-type index.
+// Caller must hold ms.mu.
+func (ms *MemoryStore) removeFromRelationTypeIndex(relation *MemoryRelation) {
+	indexed := ms.relationTypeIndex[relation.Type]
+	for i, rel := range indexed {
+		if rel == relation {
+			indexed = append(indexed[:i], indexed[i+1:]...)
+			break
+		}
+	}
+
+	if len(indexed) == 0 {
+		delete(ms.relationTypeIndex, relation.Type)
+	} else {
+		ms.relationTypeIndex[relation.Type] = indexed
+	}
+}
+
+// Memory consolidation process with graceful shutdown
+func (ms *MemoryStore) startConsolidationProcess() {
+	ms.mu.RLock()
+	ticker := time.NewTicker(ms.consolidationInterval)
+	ms.mu.RUnlock()
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ms.consolidateMemories()
+		case <-ms.consolidationReset:
+			ms.mu.RLock()
+			interval := ms.consolidationInterval
+			ms.mu.RUnlock()
+			ticker.Reset(interval)
+		case <-ms.ctx.Done():
+			return
+		}
+	}
+}
+
+// Consolidate short-term memories into long-term
+func (ms *MemoryStore) consolidateMemories() {
+	if ms.readOnly.Load() {
+		return
+	}
+
+	ms.mu.Lock()
+	defer ms.unlockAndFlush()
+
+	shortTermMemories := ms.typeIndex[ShortTerm]
+	now := time.Now()
+
+	for id, mem := range shortTermMemories {
+		// Check if memory should be consolidated
+		if ms.accessScore(mem, now) > ms.consolidationAccessThreshold || mem.Importance > ms.consolidationImportanceThreshold {
+			// Leave the memory short_term if the target type is full and rejects
+			if err := ms.makeRoomInType(ms.consolidationTarget); err != nil {
+				continue
+			}
+
+			// Promote to the configured consolidation type
+			mem.Type = ms.consolidationTarget
+			mem.Version++
+			ms.markChanged(mem)
+			delete(ms.typeIndex[ShortTerm], id)
+			ms.typeIndex[ms.consolidationTarget][id] = mem
+			ms.queryCache.invalidate()
+			ms.appendHistory(mem, "promoted", fmt.Sprintf("%s -> %s", ShortTerm, ms.consolidationTarget))
+			snapshot := eventSnapshot(mem)
+			ms.queueEvent(func(l EventListener) { l.OnConsolidate(snapshot, ShortTerm) })
+
+			// Strengthen relations
+			if relations, ok := ms.relations[id]; ok {
+				for _, rel := range relations {
+					rel.Strength *= 1.2
+				}
+			}
+		}
+	}
+}
+
+// recordAccess bumps the raw access count and the time-decayed access score.
+// Caller must hold the ms.mu write lock.
+func (ms *MemoryStore) recordAccess(mem *Memory, now time.Time) {
+	mem.AccessScore = ms.accessScore(mem, now) + 1
+	mem.AccessCount++
+	mem.LastAccess = now
+	ms.recentCache.invalidate(mem.ID)
+
+	if isAccessMilestone(mem.AccessCount) {
+		ms.appendHistory(mem, "accessed", fmt.Sprintf("access count reached %d", mem.AccessCount))
+	}
+}
+
+// GetByID returns a snapshot of a memory, safe to read without the store
+// lock. Repeated reads are served from the recent cache when enabled.
+// Reading by ID does not count as an access.
+func (ms *MemoryStore) GetByID(id string) (*Memory, error) {
+	if snapshot, ok := ms.recentCache.get(id); ok {
+		return snapshot, nil
+	}
+
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	generation := ms.recentCache.currentGeneration()
+	mem, ok := ms.memories[id]
+	if !ok {
+		return nil, errorf(ErrNotFound, "memory with ID %s does not exist", id)
+	}
+	snapshot := eventSnapshot(mem)
+	ms.recentCache.put(&snapshot, generation)
+	return &snapshot, nil
+}
+
+// Touch records an access to a memory without returning its content, so a
+// caller can protect a memory from decay cheaply
+func (ms *MemoryStore) Touch(id string) error {
+	if err := ms.checkWritable(); err != nil {
+		return err
+	}
+
+	ms.mu.Lock()
 	defer ms.mu.Unlock()
 
+	mem, ok := ms.memories[id]
+	if !ok {
+		return errorf(ErrNotFound, "memory with ID %s does not exist", id)
+	}
+	ms.recordAccess(mem, time.Now())
+	return nil
+}
+
+// SetEmbedding replaces a memory's embedding after creation, e.g. once an
+// embedding computed asynchronously is ready, making it similarity-searchable.
+// An empty embedding clears it. A new embedding must match the dimension of
+// the other stored embeddings.
+func (ms *MemoryStore) SetEmbedding(id string, embedding []float32) error {
+	if err := ms.checkWritable(); err != nil {
+		return err
+	}
+	if len(embedding) == 0 {
+		embedding = nil
+	}
+
+	ms.mu.Lock()
+	defer ms.unlockAndFlush()
+
+	mem, ok := ms.memories[id]
+	if !ok {
+		return errorf(ErrNotFound, "memory with ID %s does not exist", id)
+	}
+	if err := ms.checkEmbeddingDimension(id, embedding); err != nil {
+		return err
+	}
+
+	mem.Embedding = embedding
+	mem.Version++
+	ms.markChanged(mem)
+	if embedding != nil {
+		ms.appendHistory(mem, "updated", "embedding set")
+	} else {
+		ms.appendHistory(mem, "updated", "embedding cleared")
+	}
+	ms.indexEmbedding(mem)
+
+	snapshot := eventSnapshot(mem)
+	ms.queueEvent(func(l EventListener) { l.OnStore(snapshot) })
+	return nil
+}
+
+// ChangeType moves a memory to the target type, updating the type index and
+// recording event (promoted or demoted) in its history. A promotion must
+// move to a longer-lived type, later in typesByLifetime, and a demotion to a
+// shorter-lived one. A non-nil decay replaces the memory's
+// decay rate; otherwise a move takes the target type's recommended decay.
+func (ms *MemoryStore) ChangeType(id string, target MemoryType, decay *float32, event string) (*Memory, error) {
+	if err := ms.checkWritable(); err != nil {
+		return nil, err
+	}
+	if !isValidMemoryType(target) {
+		return nil, errorf(ErrValidation, "invalid memory type: %s", target)
+	}
+	if decay != nil && (*decay < 0 || *decay > 1) {
+		return nil, errorf(ErrValidation, "decay must be between 0 and 1")
+	}
+
+	ms.mu.Lock()
+	defer ms.unlockAndFlush()
+
+	mem, ok := ms.memories[id]
+	if !ok {
+		return nil, errorf(ErrNotFound, "memory with ID %s does not exist", id)
+	}
+	if mem.Type == target && decay == nil {
+		return nil, errorf(ErrValidation, "memory %s is already %s", id, target)
+	}
+
+	if mem.Type != target {
+		from, to := slices.Index(typesByLifetime, mem.Type), slices.Index(typesByLifetime, target)
+		if event == "promoted" && to <= from {
+			return nil, errorf(ErrValidation, "cannot promote memory %s from %s to %s, which is not longer-lived", id, mem.Type, target)
+		}
+		if event == "demoted" && to >= from {
+			return nil, errorf(ErrValidation, "cannot demote memory %s from %s to %s, which is not shorter-lived", id, mem.Type, target)
+		}
+		if decay == nil {
+			recommended := memoryTypeGuides[target].decay
+			decay = &recommended
+		}
+		if err := ms.makeRoomInType(target); err != nil {
+			return nil, err
+		}
+		delete(ms.typeIndex[mem.Type], id)
+		ms.typeIndex[target][id] = mem
+		ms.appendHistory(mem, event, fmt.Sprintf("%s -> %s", mem.Type, target))
+		mem.Type = target
+	}
+	if decay != nil {
+		mem.Decay = *decay
+	}
+	mem.Version++
+	ms.markChanged(mem)
+	ms.queryCache.invalidate()
+
+	return mem, nil
+}
+
+// Bulk operations applied by BulkAdjust
+const (
+	BulkSetDecay        = "set_decay"
+	BulkScaleImportance = "scale_importance"
+	BulkPin             = "pin"
+	BulkUnpin           = "unpin"
+)
+
+// BulkFilter selects memories for a bulk operation. Empty fields match
+// every memory; set fields must all match.
+type BulkFilter struct {
+	MemoryType MemoryType
+	Keywords   []string      // any indexed keyword matches
+	OlderThan  time.Duration // by creation time
+}
+
+// BulkAdjust applies op to every memory matching filter in a single pass under
+// the write lock and returns how many memories it changed. set_decay replaces
+// the decay rate with value, scale_importance multiplies importance by value
+// clamped to [0, 1], and pin and unpin exempt memories from decay and eviction
+// or return them to it. Memories the operation leaves unchanged aren't counted.
+func (ms *MemoryStore) BulkAdjust(filter BulkFilter, op string, value float32) (int, error) {
+	if err := ms.checkWritable(); err != nil {
+		return 0, err
+	}
+	if filter.MemoryType != "" && !isValidMemoryType(filter.MemoryType) {
+		return 0, errorf(ErrValidation, "invalid memory type: %s", filter.MemoryType)
+	}
+	if filter.OlderThan < 0 {
+		return 0, errorf(ErrValidation, "older_than cannot be negative")
+	}
+	switch op {
+	case BulkSetDecay:
+		if value < 0 || value > 1 {
+			return 0, errorf(ErrValidation, "decay must be between 0 and 1")
+		}
+	case BulkScaleImportance:
+		if value < 0 {
+			return 0, errorf(ErrValidation, "importance scale cannot be negative")
+		}
+	case BulkPin, BulkUnpin:
+	default:
+		return 0, errorf(ErrValidation, "invalid bulk operation: %s", op)
+	}
+
+	ms.mu.Lock()
+	defer ms.unlockAndFlush()
+
+	candidates := ms.memories
+	if filter.MemoryType != "" {
+		candidates = ms.typeIndex[filter.MemoryType]
+	}
+	cutoff := time.Now().Add(-filter.OlderThan)
+
+	changed := 0
+	for _, mem := range candidates {
+		if filter.OlderThan > 0 && !mem.Timestamp.Before(cutoff) {
+			continue
+		}
+		if len(filter.Keywords) > 0 && !ms.matchesKeywords(mem, filter.Keywords) {
+			continue
+		}
+
+		var detail string
+		switch op {
+		case BulkSetDecay:
+			if mem.Decay == value {
+				continue
+			}
+			mem.Decay = value
+			detail = fmt.Sprintf("decay set to %g", value)
+		case BulkScaleImportance:
+			importance := min(max(mem.Importance*value, 0), 1)
+			if mem.Importance == importance {
+				continue
+			}
+			mem.Importance = importance
+			detail = fmt.Sprintf("importance scaled by %g", value)
+		case BulkPin, BulkUnpin:
+			if mem.Pinned == (op == BulkPin) {
+				continue
+			}
+			mem.Pinned = op == BulkPin
+			detail = op + "ned"
+		}
+		mem.Version++
+		ms.appendHistory(mem, "updated", detail)
+		ms.markChanged(mem)
+
+		snapshot := eventSnapshot(mem)
+		ms.queueEvent(func(l EventListener) { l.OnStore(snapshot) })
+		changed++
+	}
+
+	if changed > 0 {
+		ms.queryCache.invalidate()
+	}
+	return changed, nil
+}
+
+// isAccessMilestone reports whether count is 1 or a power of 10, the access
+// counts worth noting in a memory's history
+func isAccessMilestone(count int) bool {
+	for count >= 10 && count%10 == 0 {
+		count /= 10
+	}
+	return count == 1
+}
+
+// maxHistoryEvents bounds each memory's history, dropping the oldest events
+const maxHistoryEvents = 20
+
+// HistoryEvent is one step in a memory's lifecycle
+type HistoryEvent struct {
+	Event     string    `json:"event"` // created, updated, promoted, demoted, or accessed
+	Timestamp time.Time `json:"timestamp"`
+	Detail    string    `json:"detail,omitempty"`
+}
+
+// markChanged bumps the store version and stamps mem, if any, with it.
+// Caller must hold ms.mu for writing.
+func (ms *MemoryStore) markChanged(mem *Memory) {
+	ms.version++
+	if mem != nil {
+		mem.changed = ms.version
+		ms.recentCache.invalidate(mem.ID)
+	}
+}
+
+// StoreVersion returns the store version, which every mutation increments
+func (ms *MemoryStore) StoreVersion() uint64 {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	return ms.version
+}
+
+// appendHistory records a lifecycle event on the memory
+func (ms *MemoryStore) appendHistory(mem *Memory, event, detail string) {
+	ms.historyMu.Lock()
+	defer ms.historyMu.Unlock()
+
+	mem.history = append(mem.history, HistoryEvent{Event: event, Timestamp: time.Now(), Detail: detail})
+	if len(mem.history) > maxHistoryEvents {
+		mem.history = append([]HistoryEvent(nil), mem.history[len(mem.history)-maxHistoryEvents:]...)
+	}
+}
+
+// MemoryLineage summarizes a memory's journey through the store
+type MemoryLineage struct {
+	ID                string         `json:"id"`
+	Type              MemoryType     `json:"type"`
+	Created           time.Time      `json:"created"`
+	LastAccess        time.Time      `json:"last_access"`
+	AccessCount       int            `json:"access_count"`
+	AccessScore       float32        `json:"access_score"`
+	Importance        float32        `json:"importance"`
+	Decay             float32        `json:"decay"`
+	HoursUntilRemoval *float64       `json:"hours_until_removal,omitempty"` // nil when the memory does not decay
+	History           []HistoryEvent `json:"history"`
+}
+
+// Lineage returns a memory's history and projected decay
+func (ms *MemoryStore) Lineage(memoryID string) (*MemoryLineage, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	mem, ok := ms.memories[memoryID]
+	if !ok {
+		return nil, errorf(ErrNotFound, "memory with ID %s does not exist", memoryID)
+	}
+
+	now := time.Now()
+	lineage := &MemoryLineage{
+		ID:          mem.ID,
+		Type:        mem.Type,
+		Created:     mem.Timestamp,
+		LastAccess:  mem.LastAccess,
+		AccessCount: mem.AccessCount,
+		AccessScore: ms.accessScore(mem, now),
+		Importance:  mem.Importance,
+		Decay:       mem.Decay,
+	}
+	// A floor at or above the removal threshold keeps decay from removing it
+	if floor, ok := ms.decayFloor(mem); mem.Decay > 0 && (!ok || floor < ms.decayRemovalThreshold) {
+		hoursLeft := ms.hoursUntilRemoval(mem, now)
+		lineage.HoursUntilRemoval = &hoursLeft
+	}
+
+	ms.historyMu.Lock()
+	lineage.History = append([]HistoryEvent(nil), mem.history...)
+	ms.historyMu.Unlock()
+
+	return lineage, nil
+}
+
+// accessScore returns the memory's access score decayed to the given time.
+// The score halves every accessHalfLife since the last access; a zero
+// half-life or a memory that was never accessed is left undecayed.
+func (ms *MemoryStore) accessScore(mem *Memory, now time.Time) float32 {
+	if ms.accessHalfLife <= 0 || mem.LastAccess.IsZero() {
+		return mem.AccessScore
+	}
+
+	elapsed := now.Sub(mem.LastAccess)
+	if elapsed <= 0 {
+		return mem.AccessScore
+	}
+
+	halfLives := elapsed.Seconds() / ms.accessHalfLife.Seconds()
+	return mem.AccessScore * float32(math.Pow(0.5, halfLives))
+}
+
+// Memory decay process with graceful shutdown
+func (ms *MemoryStore) startDecayProcess() {
+	ms.mu.RLock()
+	ticker := time.NewTicker(ms.decayInterval)
+	ms.mu.RUnlock()
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ms.applyDecay()
+		case <-ms.decayReset:
+			ms.mu.RLock()
+			interval := ms.decayInterval
+			ms.mu.RUnlock()
+			ticker.Reset(interval)
+		case <-ms.ctx.Done():
+			return
+		}
+	}
+}
+
+// RuntimeSettings holds the store settings that can change without a restart.
+// Zero values leave the current setting unchanged.
+type RuntimeSettings struct {
+	MaxMemories                      int
+	DecayInterval                    time.Duration
+	ConsolidationInterval            time.Duration
+	AccessHalfLife                   time.Duration
+	ConsolidationAccessThreshold     float32
+	ConsolidationImportanceThreshold float32
+}
+
+// Reconfigure applies runtime settings to the running store, restarting the
+// background tickers whose intervals changed, and returns the settings now in effect
+func (ms *MemoryStore) Reconfigure(settings RuntimeSettings) (RuntimeSettings, error) {
+	if settings.MaxMemories < 0 {
+		return RuntimeSettings{}, errorf(ErrValidation, "max memories cannot be negative")
+	}
+	if settings.DecayInterval < 0 || settings.ConsolidationInterval < 0 || settings.AccessHalfLife < 0 {
+		return RuntimeSettings{}, errorf(ErrValidation, "intervals cannot be negative")
+	}
+	if settings.ConsolidationImportanceThreshold < 0 || settings.ConsolidationImportanceThreshold > 1 {
+		return RuntimeSettings{}, errorf(ErrValidation, "consolidation importance threshold must be between 0 and 1")
+	}
+	if settings.ConsolidationAccessThreshold < 0 {
+		return RuntimeSettings{}, errorf(ErrValidation, "consolidation access threshold cannot be negative")
+	}
+
+	ms.mu.Lock()
+	defer ms.unlockAndFlush()
+
+	if settings.MaxMemories > 0 && settings.MaxMemories < len(ms.memories) && ms.rejectWhenFull {
+		return RuntimeSettings{}, errorf(ErrCapacity, "cannot lower max memories to %d below the %d stored without evicting", settings.MaxMemories, len(ms.memories))
+	}
+	if settings.MaxMemories > 0 {
+		ms.maxMemories = settings.MaxMemories
+		for len(ms.memories) > ms.maxMemories {
+			// Pinned memories may keep the store above the new limit
+			if !ms.evictLeastImportant() {
+				break
+			}
+		}
+		ms.updateCapacityWarning()
+	}
+	if settings.DecayInterval > 0 && settings.DecayInterval != ms.decayInterval {
+		ms.decayInterval = settings.DecayInterval
+		signalReset(ms.decayReset)
+	}
+	if settings.ConsolidationInterval > 0 && settings.ConsolidationInterval != ms.consolidationInterval {
+		ms.consolidationInterval = settings.ConsolidationInterval
+		signalReset(ms.consolidationReset)
+	}
+	if settings.AccessHalfLife > 0 {
+		ms.accessHalfLife = settings.AccessHalfLife
+	}
+	if settings.ConsolidationAccessThreshold > 0 {
+		ms.consolidationAccessThreshold = settings.ConsolidationAccessThreshold
+	}
+	if settings.ConsolidationImportanceThreshold > 0 {
+		ms.consolidationImportanceThreshold = settings.ConsolidationImportanceThreshold
+	}
+
+	return RuntimeSettings{
+		MaxMemories:                      ms.maxMemories,
+		DecayInterval:                    ms.decayInterval,
+		ConsolidationInterval:            ms.consolidationInterval,
+		AccessHalfLife:                   ms.accessHalfLife,
+		ConsolidationAccessThreshold:     ms.consolidationAccessThreshold,
+		ConsolidationImportanceThreshold: ms.consolidationImportanceThreshold,
+	}, nil
+}
+
+// signalReset wakes a background process without blocking if a wake-up is already pending
+func signalReset(reset chan struct{}) {
+	select {
+	case reset <- struct{}{}:
+	default:
+	}
+}
+
+// Apply decay to memories
+func (ms *MemoryStore) applyDecay() {
+	if ms.readOnly.Load() {
+		return
+	}
+
+	ms.mu.Lock()
+	defer ms.unlockAndFlush()
+
 	now := time.Now()
 	toRemove := []string{}
 
 	for id, mem := range ms.memories {
-		// Calculate decay based on time since last access
-		timeSinceAccess := now.Sub(mem.LastAccess)
-		decayFactor := float32(timeSinceAccess.Hours()) * mem.Decay
+		if mem.Pinned {
+			continue
+		}
+
+		// Calculate decay based on time since last access, past the grace period
+		decayFactor := float32(ms.decayingHours(mem, now)) * mem.Decay
 
-		// Reduce importance
+		// Reduce importance, stopping at the type's floor
+		floor, hasFloor := ms.decayFloor(mem)
 		mem.Importance -= decayFactor
+		if hasFloor && mem.Importance < floor {
+			mem.Importance = floor
+		}
+
+		// Mark for removal if importance too low
+		if mem.Importance < ms.decayRemovalThreshold {
+			toRemove = append(toRemove, id)
+		}
+	}
+
+	// Decay changed every memory's importance
+	ms.recentCache.clear()
+
+	// Remove decayed memories
+	for _, id := range toRemove {
+		ms.recordRemoval(ms.memories[id], RemovalDecayed)
+		ms.removeMemory(id)
+	}
+	ms.updateCapacityWarning()
+}
+
+// Reasons recorded for removed memories
+const (
+	RemovalEvicted = "eviction"
+	RemovalDecayed = "decay"
+)
+
+// maxRemovalEvents bounds the removal event ring buffer
+const maxRemovalEvents = 100
+
+// RemovalEvent records a memory the store forgot and why
+type RemovalEvent struct {
+	ID         string     `json:"id"`
+	Type       MemoryType `json:"type"`
+	Reason     string     `json:"reason"`
+	Timestamp  time.Time  `json:"timestamp"`
+	Importance float32    `json:"importance"`
+}
+
+// recordRemoval appends a removal event, overwriting the oldest once the
+// buffer is full. Caller must hold ms.mu.
+func (ms *MemoryStore) recordRemoval(mem *Memory, reason string) {
+	event := RemovalEvent{
+		ID:         mem.ID,
+		Type:       mem.Type,
+		Reason:     reason,
+		Timestamp:  time.Now(),
+		Importance: mem.Importance,
+	}
+
+	ms.queueEvent(func(l EventListener) { l.OnEvict(event) })
+
+	if len(ms.removalEvents) < maxRemovalEvents {
+		ms.removalEvents = append(ms.removalEvents, event)
+		return
+	}
+	ms.removalEvents[ms.removalStart] = event
+	ms.removalStart = (ms.removalStart + 1) % maxRemovalEvents
+}
+
+// RemovalEvents returns recent removal events, newest first
+func (ms *MemoryStore) RemovalEvents() []RemovalEvent {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	n := len(ms.removalEvents)
+	events := make([]RemovalEvent, n)
+	for i := 0; i < n; i++ {
+		events[i] = ms.removalEvents[(ms.removalStart+n-1-i)%n]
+	}
+	return events
+}
+
+// AgingEntry describes a memory projected to decay away within a horizon
+type AgingEntry struct {
+	ID                  string     `json:"id"`
+	Type                MemoryType `json:"type"`
+	Content             string     `json:"content"`
+	Importance          float32    `json:"importance"`
+	ProjectedImportance float32    `json:"projected_importance"`
+	HoursUntilRemoval   float64    `json:"hours_until_removal"`
+}
+
+// AgingReport lists memories whose importance, decayed tick by tick as
+// applyDecay would, falls below the removal threshold within horizon.
+// Entries are ordered soonest-to-expire first.
+func (ms *MemoryStore) AgingReport(horizon time.Duration) []AgingEntry {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	now := time.Now()
+	at := now.Add(horizon)
+	report := make([]AgingEntry, 0)
+
+	for _, mem := range ms.memories {
+		if mem.Decay <= 0 || mem.Pinned {
+			continue
+		}
+
+		projected := ms.projectedImportance(mem, now, at)
+		if projected >= ms.decayRemovalThreshold {
+			continue
+		}
+
+		hoursLeft := ms.hoursUntilRemoval(mem, now)
+
+		report = append(report, AgingEntry{
+			ID:                  mem.ID,
+			Type:                mem.Type,
+			Content:             mem.Content,
+			Importance:          mem.Importance,
+			ProjectedImportance: projected,
+			HoursUntilRemoval:   hoursLeft,
+		})
+	}
+
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].HoursUntilRemoval != report[j].HoursUntilRemoval {
+			return report[i].HoursUntilRemoval < report[j].HoursUntilRemoval
+		}
+		return report[i].ID < report[j].ID
+	})
+
+	return report
+}
+
+// decayFloor returns the lowest importance decay can bring a memory to: its
+// type's floor, or its current importance if already below that. ok is false
+// when the type has no floor.
+func (ms *MemoryStore) decayFloor(mem *Memory) (floor float32, ok bool) {
+	floor, ok = ms.importanceFloors[mem.Type]
+	return min(floor, mem.Importance), ok
+}
+
+// decayingHours is how long a memory has been decaying at a given time: the
+// time since its last access, less the grace period
+func (ms *MemoryStore) decayingHours(mem *Memory, at time.Time) float64 {
+	return max(at.Sub(mem.LastAccess)-ms.decayGracePeriod, 0).Hours()
+}
+
+// decayTicks splits the next decay ticks, assumed one interval apart
+// starting one interval from now, into the idle ticks still inside the grace
+// period and the hours decaying at the first tick after them. Tick j past the
+// idle ones subtracts decay times (offset + j*interval) hours, as applyDecay
+// does, so the loss compounds with every tick.
+func (ms *MemoryStore) decayTicks(mem *Memory, now time.Time) (idle int, offset, interval float64) {
+	interval = ms.decayInterval.Hours()
+	offset = (now.Sub(mem.LastAccess) - ms.decayGracePeriod).Hours()
+	if offset < 0 {
+		idle = int(math.Floor(-offset / interval))
+		offset += float64(idle) * interval
+	}
+	return idle, offset, interval
+}
+
+// decayedHours sums the decaying hours applied by the first n decaying ticks
+func decayedHours(n int, offset, interval float64) float64 {
+	m := float64(n)
+	return m*offset + interval*m*(m+1)/2
+}
+
+// projectedImportance projects a memory's importance after the decay ticks
+// until at, stopping at the type's floor
+func (ms *MemoryStore) projectedImportance(mem *Memory, now, at time.Time) float32 {
+	idle, offset, interval := ms.decayTicks(mem, now)
+	ticks := int(at.Sub(now).Hours()/interval) - idle
+	if ticks <= 0 {
+		return mem.Importance
+	}
+
+	projected := mem.Importance - float32(decayedHours(ticks, offset, interval))*mem.Decay
+	if floor, ok := ms.decayFloor(mem); ok && projected < floor {
+		projected = floor
+	}
+	return projected
+}
+
+// hoursUntilRemoval projects the hours from now until the decay tick that
+// takes a memory's importance below the removal threshold, counting any
+// grace period left. The memory's decay must be positive.
+func (ms *MemoryStore) hoursUntilRemoval(mem *Memory, now time.Time) float64 {
+	budget := float64((mem.Importance - ms.decayRemovalThreshold) / mem.Decay)
+	if budget < 0 {
+		return 0
+	}
+
+	// Solve interval/2*n^2 + (offset+interval/2)*n > budget for the fewest ticks
+	idle, offset, interval := ms.decayTicks(mem, now)
+	b := offset + interval/2
+	n := max(int(math.Ceil((math.Sqrt(b*b+2*interval*budget)-b)/interval)), 1)
+	for decayedHours(n, offset, interval) <= budget {
+		n++
+	}
+	for n > 1 && decayedHours(n-1, offset, interval) > budget {
+		n--
+	}
+	return float64(idle+n) * interval
+}
+
+// ExportJSONL writes every memory as one JSON object per line, ordered by ID,
+// so large stores can be exported without building one huge array
+func (ms *MemoryStore) ExportJSONL(w io.Writer) (int, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	ids := make([]string, 0, len(ms.memories))
+	for id := range ms.memories {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	writer := bufio.NewWriter(w)
+	encoder := json.NewEncoder(writer)
+	for i, id := range ids {
+		if err := encoder.Encode(ms.memories[id]); err != nil {
+			return i, fmt.Errorf("export memory %s: %w", id, err)
+		}
+	}
+	return len(ids), writer.Flush()
+}
+
+// maxImportLineBytes bounds a single memory line read by ImportJSONL
+const maxImportLineBytes = 16 * 1024 * 1024
+
+// ImportJSONL stores memories read one JSON object per line, stopping at the
+// first invalid line. Memories imported before the failure are kept.
+func (ms *MemoryStore) ImportJSONL(r io.Reader) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxImportLineBytes)
+
+	count := 0
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var memory Memory
+		if err := json.Unmarshal(scanner.Bytes(), &memory); err != nil {
+			return count, fmt.Errorf("line %d: %w", line, err)
+		}
+		if err := ms.Store(&memory); err != nil {
+			return count, fmt.Errorf("line %d: %w", line, err)
+		}
+		count++
+	}
+	if err := scanner.Err(); err != nil {
+		return count, fmt.Errorf("read import: %w", err)
+	}
+	return count, nil
+}
+
+// KeywordCount is an indexed keyword and the number of memories containing it
+type KeywordCount struct {
+	Keyword string `json:"keyword"`
+	Count   int    `json:"count"`
+}
+
+// Keywords lists indexed keywords starting with prefix, most frequent first
+// unless alphabetical is set. A limit of 0 returns every match.
+func (ms *MemoryStore) Keywords(prefix string, limit int, alphabetical bool) []KeywordCount {
+	prefix = strings.ToLower(prefix)
+
+	ms.keywordIndex.mu.RLock()
+	counts := make([]KeywordCount, 0, len(ms.keywordIndex.index))
+	for keyword, memories := range ms.keywordIndex.index {
+		if strings.HasPrefix(keyword, prefix) && memories.len() > 0 {
+			counts = append(counts, KeywordCount{Keyword: keyword, Count: memories.len()})
+		}
+	}
+	ms.keywordIndex.mu.RUnlock()
+
+	sort.Slice(counts, func(i, j int) bool {
+		if !alphabetical && counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Keyword < counts[j].Keyword
+	})
+
+	if limit > 0 && len(counts) > limit {
+		counts = counts[:limit]
+	}
+	return counts
+}
+
+// CooccurringKeywords lists the keywords that appear in the same memories as
+// keyword, ranked by how many memories they share, then alphabetically. It
+// walks only keyword's postings, counting each memory's cached keywords.
+func (ms *MemoryStore) CooccurringKeywords(keyword string, limit int) []KeywordCount {
+	keyword = strings.ToLower(keyword)
+
+	ms.keywordIndex.mu.RLock()
+	shared := make(map[string]int)
+	if memories, ok := ms.keywordIndex.index[keyword]; ok {
+		memories.each(func(mem *Memory) {
+			for _, other := range mem.keywords {
+				if other != keyword {
+					shared[other]++
+				}
+			}
+		})
+	}
+	ms.keywordIndex.mu.RUnlock()
+
+	counts := make([]KeywordCount, 0, len(shared))
+	for other, count := range shared {
+		counts = append(counts, KeywordCount{Keyword: other, Count: count})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Keyword < counts[j].Keyword
+	})
+
+	if len(counts) > limit {
+		counts = counts[:limit]
+	}
+	return counts
+}
+
+// Weights of each search surface when ranking search results
+const (
+	searchWeightTag      = 2.0
+	searchWeightContent  = 1.0
+	searchWeightMetadata = 0.5
+)
+
+// SearchResult is a memory matched by free-text search with its rank score
+type SearchResult struct {
+	*Memory
+	Score     float32  `json:"score"`
+	MatchedIn []string `json:"matched_in"`
+}
+
+// Search tokenizes free text and matches it against content keywords, metadata
+// values, and tags together. Results are ranked by the weighted count of
+// matching terms, then importance, then ID. It records access to the
+// results, so it holds the write lock.
+func (ms *MemoryStore) Search(text string, limit int) []SearchResult {
+	terms := uniqueKeywords(text, ms.keywordIndex.identifiers)
+	// Tags may be short or multi-word, so also try them verbatim
+	tagTerms := append([]string{strings.ToLower(strings.TrimSpace(text))}, terms...)
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	type match struct {
+		score   float32
+		surface map[string]bool
+	}
+	matches := make(map[string]*match)
+	add := func(index map[string]*postingList, terms []string, surface string, weight float32) {
+		for _, term := range terms {
+			postings, ok := index[term]
+			if !ok {
+				continue
+			}
+			postings.each(func(mem *Memory) {
+				m := matches[mem.ID]
+				if m == nil {
+					m = &match{surface: make(map[string]bool)}
+					matches[mem.ID] = m
+				}
+				m.score += weight
+				m.surface[surface] = true
+			})
+		}
+	}
+
+	ms.keywordIndex.mu.RLock()
+	add(ms.keywordIndex.index, terms, "content", searchWeightContent)
+	add(ms.keywordIndex.metadata, terms, "metadata", searchWeightMetadata)
+	add(ms.keywordIndex.tags, uniqueStrings(tagTerms), "tags", searchWeightTag)
+	ms.keywordIndex.mu.RUnlock()
+
+	results := make([]SearchResult, 0, len(matches))
+	for id, m := range matches {
+		mem, ok := ms.memories[id]
+		if !ok {
+			continue
+		}
+		surfaces := make([]string, 0, len(m.surface))
+		for _, surface := range []string{"content", "metadata", "tags"} {
+			if m.surface[surface] {
+				surfaces = append(surfaces, surface)
+			}
+		}
+		results = append(results, SearchResult{Memory: mem, Score: m.score, MatchedIn: surfaces})
+	}
 
-		// Mark for removal if importance too low
-		if mem.Importance < 0.1 {
-			toRemove = append(toRemove, id)
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		if results[i].Importance != results[j].Importance {
+			return results[i].Importance > results[j].Importance
 		}
+		return results[i].ID < results[j].ID
+	})
+	if len(results) > limit {
+		results = results[:limit]
 	}
 
-	// Remove decayed memories
-	for _, id := range toRemove {
-		ms.removeMemory(id)
+	now := time.Now()
+	for _, result := range results {
+		ms.recordAccess(result.Memory, now)
+	}
+	return results
+}
+
+// uniqueStrings drops empty and repeated strings, keeping first occurrences
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	unique := make([]string, 0, len(values))
+	for _, v := range values {
+		if v != "" && !seen[v] {
+			seen[v] = true
+			unique = append(unique, v)
+		}
 	}
+	return unique
 }
 
 // MCP Tool Implementations
@@ -403,40 +3028,69 @@ func (ms *MemoryStore) applyDecay() {
 func (mcp *MCPServer) StoreMemory(ctx context.Context, args StoreMemoryArgs) (*Memory, error) {
 	// Validate arguments
 	if args.Content == "" {
-		return nil, errors.New("content cannot be empty")
+		return nil, errorf(ErrValidation, "content cannot be empty")
 	}
 	if args.Type == "" {
-		args.Type = ShortTerm // Default to short term
+		args.Type = cmp.Or(mcp.defaults.MemoryType, ShortTerm) // Default to short term
+	}
+	if args.Importance == 0 {
+		args.Importance = mcp.defaults.Importance
+	}
+	if args.Decay < 0 || args.Decay > 1 {
+		return nil, errorf(ErrValidation, "decay must be between 0 and 1")
 	}
-	if args.Importance < 0 || args.Importance > 1 {
-		args.Importance = 0.5 // Default importance
+	if args.Decay == 0 {
+		args.Decay = 0.01 // Default decay rate
 	}
 
 	// Validate memory type
-	validTypes := []MemoryType{ShortTerm, LongTerm, Episodic, Semantic, Procedural}
-	valid := false
-	for _, validType := range validTypes {
-		if args.Type == validType {
-			valid = true
-			break
-		}
+	if !isValidMemoryType(args.Type) {
+		return nil, errorf(ErrValidation, "invalid memory type: %s", args.Type)
+	}
+
+	id := args.ID
+	if id == "" && mcp.store.contentIDs {
+		id = mcp.store.contentID(args.Content)
+	} else if id == "" {
+		id = generateID()
 	}
-	if !valid {
-		return nil, fmt.Errorf("invalid memory type: %s", args.Type)
+
+	// Stamp the session, explicit or the client's, without touching the caller's map
+	metadata := args.Metadata
+	if sessionID := cmp.Or(args.SessionID, mcp.sessionID); sessionID != "" {
+		metadata = maps.Clone(metadata)
+		if metadata == nil {
+			metadata = make(map[string]interface{})
+		}
+		metadata[sessionMetadataKey] = sessionID
 	}
 
 	memory := &Memory{
-		ID:          generateID(),
+		ID:          id,
 		Type:        args.Type,
 		Content:     args.Content,
 		Embedding:   args.Embedding,
-		Metadata:    args.Metadata,
+		Metadata:    metadata,
 		Relations:   args.Relations,
 		Timestamp:   time.Now(),
 		LastAccess:  time.Now(),
 		AccessCount: 0,
 		Importance:  args.Importance,
-		Decay:       0.01, // Default decay rate
+		Decay:       args.Decay,
+	}
+
+	if args.ExpectedVersion != 0 && !args.Upsert {
+		return nil, errorf(ErrValidation, "expected_version requires upsert")
+	}
+
+	if args.Upsert {
+		if err := mcp.store.UpsertVersion(memory, args.ExpectedVersion); err != nil {
+			return nil, err
+		}
+		// Return the stored memory, which keeps its original timestamps on update
+		mcp.store.mu.RLock()
+		defer mcp.store.mu.RUnlock()
+		return mcp.store.memories[memory.ID], nil
 	}
 
 	err := mcp.store.Store(memory)
@@ -445,46 +3099,710 @@ func (mcp *MCPServer) StoreMemory(ctx context.Context, args StoreMemoryArgs) (*M
 
 // Query memories
 func (mcp *MCPServer) QueryMemories(ctx context.Context, args QueryMemoryArgs) ([]*Memory, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return mcp.store.QueryContext(ctx, mcp.queryCriteria(args))
+}
+
+// Count the memories a query matches
+func (mcp *MCPServer) CountMemories(ctx context.Context, args QueryMemoryArgs) (map[string]int, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	count, err := mcp.store.Count(ctx, mcp.queryCriteria(args))
+	if err != nil {
+		return nil, err
+	}
+	return map[string]int{"count": count}, nil
+}
+
+// queryCriteria converts query arguments to store criteria, defaulting
+// session queries to this client's session
+func (mcp *MCPServer) queryCriteria(args QueryMemoryArgs) QueryCriteria {
 	criteria := QueryCriteria{
-		Type:       args.QueryType,
+		Type:         args.QueryType,
+		Keywords:     args.Keywords,
+		MemoryType:   MemoryType(args.MemoryType),
+		Embedding:    args.Embedding,
+		StartTime:    args.StartTime,
+		EndTime:      args.EndTime,
+		MemoryID:     args.MemoryID,
+		Depth:        args.Depth,
+		RelationType: args.RelationType,
+		SessionID:    args.SessionID,
+		Limit:        args.Limit,
+		SinceVersion: args.SinceVersion,
+		Phrase:       args.Phrase,
+		Within:       args.Within,
+
+		ImportanceWeight: args.ImportanceWeight,
+	}
+
+	for _, memoryType := range args.MemoryTypes {
+		criteria.MemoryTypes = append(criteria.MemoryTypes, MemoryType(memoryType))
+	}
+	if criteria.Type == "session" && criteria.SessionID == "" {
+		criteria.SessionID = mcp.sessionID
+	}
+	return criteria
+}
+
+// queryResultsMethod is the notification carrying one chunk of streamed query results
+const queryResultsMethod = "notifications/query_results"
+
+// QueryStream is the response to a query whose results were streamed
+type QueryStream struct {
+	Streamed bool `json:"streamed"`
+	Chunks   int  `json:"chunks"`
+	Total    int  `json:"total"`
+}
+
+// streamQueryResults sends query results as notifications of up to
+// args.ChunkSize each, formatted as the response would be, so a client can
+// process them as they arrive instead of parsing one large response
+func (mcp *MCPServer) streamQueryResults(requestID interface{}, memories []*Memory, args QueryMemoryArgs) (*QueryStream, error) {
+	stream := &QueryStream{Streamed: true, Total: len(memories)}
+	for chunk := range slices.Chunk(memories, args.ChunkSize) {
+		params, err := json.Marshal(map[string]interface{}{
+			"request_id": requestID,
+			"chunk":      stream.Chunks,
+			"results":    mcp.formatQueryResults(chunk, args),
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := mcp.notify(MCPMessage{Jsonrpc: "2.0", Method: queryResultsMethod, Params: params}); err != nil {
+			return nil, fmt.Errorf("stream query results: %w", err)
+		}
+		stream.Chunks++
+	}
+	return stream, nil
+}
+
+// Shape query results for the response: IDs, snippets, or full memories,
+// with outbound relations attached when requested
+func (mcp *MCPServer) formatQueryResults(memories []*Memory, args QueryMemoryArgs) interface{} {
+	if args.IDsOnly {
+		ids := make([]string, len(memories))
+		for i, mem := range memories {
+			ids[i] = mem.ID
+		}
+		return ids
+	}
+
+	var relations map[string][]MemoryRelation
+	if args.IncludeRelations {
+		relations = mcp.store.OutboundRelations(memories)
+	}
+
+	if args.Snippet {
+		snippets := snippetResults(memories, args.Keywords, args.SnippetLength, mcp.store.keywordIndex.identifiers)
+		for i := range snippets {
+			snippets[i].OutboundRelations = relations[snippets[i].ID]
+		}
+		return snippets
+	}
+
+	if !args.IncludeRelations {
+		return memories
+	}
+	results := make([]MemoryWithRelations, len(memories))
+	for i, mem := range memories {
+		results[i] = MemoryWithRelations{Memory: mem, OutboundRelations: relations[mem.ID]}
+	}
+	return results
+}
+
+// Query nearest memories for several embeddings at once
+func (mcp *MCPServer) QuerySimilarBatch(ctx context.Context, args SimilarityBatchArgs) ([][]*Memory, error) {
+	return mcp.store.FindSimilarBatch(args.Embeddings, args.Limit)
+}
+
+// Report memories projected to decay away within the requested horizon
+func (mcp *MCPServer) AgingReport(ctx context.Context, args AgingReportArgs) ([]AgingEntry, error) {
+	if args.HorizonHours < 0 {
+		return nil, errorf(ErrValidation, "horizon_hours cannot be negative")
+	}
+	if args.HorizonHours == 0 {
+		args.HorizonHours = 24 // Default horizon
+	}
+
+	horizon := time.Duration(args.HorizonHours * float64(time.Hour))
+	return mcp.store.AgingReport(horizon), nil
+}
+
+// Export all memories to a JSON Lines file
+func (mcp *MCPServer) ExportMemories(ctx context.Context, args ExportMemoriesArgs) (map[string]interface{}, error) {
+	if args.Path == "" {
+		return nil, errorf(ErrValidation, "path cannot be empty")
+	}
+
+	flag := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if args.Overwrite {
+		flag = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	file, err := mcp.store.openExportFile(args.Path, flag)
+	if errors.Is(err, os.ErrExist) {
+		return nil, errorf(ErrValidation, "%s already exists; pass overwrite to replace it", args.Path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	count, err := mcp.store.ExportJSONL(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{"path": args.Path, "count": count}, nil
+}
+
+// openExportFile opens a file for export_memories or import_memories by a
+// path relative to the export directory. Absolute paths and paths leaving
+// the directory, including through symlinks, are rejected, so clients can
+// only touch files the operator set aside for them.
+func (ms *MemoryStore) openExportFile(name string, flag int) (*os.File, error) {
+	if ms.exportDir == "" {
+		return nil, errorf(ErrValidation, "export and import are disabled; start the server with --export-dir")
+	}
+	if !filepath.IsLocal(name) {
+		return nil, errorf(ErrValidation, "path %q must be relative to the export directory and stay inside it", name)
+	}
+
+	root, err := os.OpenRoot(ms.exportDir)
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+	return root.OpenFile(filepath.Clean(name), flag, 0o644)
+}
+
+// Import memories from a JSON Lines file
+func (mcp *MCPServer) ImportMemories(ctx context.Context, args ImportMemoriesArgs) (map[string]interface{}, error) {
+	if args.Path == "" {
+		return nil, errorf(ErrValidation, "path cannot be empty")
+	}
+
+	file, err := mcp.store.openExportFile(args.Path, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	count, err := mcp.store.ImportJSONL(file)
+	if err != nil {
+		return nil, fmt.Errorf("imported %d memories before failing: %w", count, err)
+	}
+
+	return map[string]interface{}{"path": args.Path, "count": count}, nil
+}
+
+// Write a snapshot to the configured file before a risky operation or disconnect
+func (mcp *MCPServer) Persist(ctx context.Context) (map[string]interface{}, error) {
+	snapshot, size, err := mcp.store.SaveSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"path":          mcp.store.snapshotPath,
+		"bytes":         size,
+		"memories":      len(snapshot.Memories),
+		"relations":     len(snapshot.Relations),
+		"store_version": snapshot.StoreVersion,
+	}, nil
+}
+
+// Snapshot the whole store inline, optionally compressed
+func (mcp *MCPServer) SnapshotStore(ctx context.Context, args SnapshotArgs) (*SnapshotResult, error) {
+	snapshot := mcp.store.Snapshot()
+	result := &SnapshotResult{
+		Format:       "json",
+		Memories:     len(snapshot.Memories),
+		Relations:    len(snapshot.Relations),
+		StoreVersion: snapshot.StoreVersion,
+	}
+	if !args.Compress {
+		result.Snapshot = snapshot
+		return result, nil
+	}
+
+	data, err := encodeSnapshot(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	result.Format = "gzip+base64"
+	result.Data = data
+	return result, nil
+}
+
+// Replace the store's contents with a snapshot
+func (mcp *MCPServer) RestoreSnapshot(ctx context.Context, args RestoreSnapshotArgs) (map[string]interface{}, error) {
+	if (args.Snapshot == nil) == (args.Data == "") {
+		return nil, errorf(ErrValidation, "pass exactly one of snapshot or data")
+	}
+
+	snapshot := args.Snapshot
+	if args.Data != "" {
+		var err error
+		if snapshot, err = decodeSnapshot(args.Data); err != nil {
+			return nil, err
+		}
+	}
+	if err := mcp.store.Restore(snapshot); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"memories":  len(snapshot.Memories),
+		"relations": len(snapshot.Relations),
+		"taken_at":  snapshot.CreatedAt,
+	}, nil
+}
+
+// Report a memory's lifecycle history and projected decay
+func (mcp *MCPServer) MemoryLineage(ctx context.Context, args MemoryLineageArgs) (*MemoryLineage, error) {
+	if args.MemoryID == "" {
+		return nil, errorf(ErrValidation, "memory_id cannot be empty")
+	}
+	return mcp.store.Lineage(args.MemoryID)
+}
+
+// Promote a memory to a longer-lived type, the consolidation target by default
+func (mcp *MCPServer) PromoteMemory(ctx context.Context, args ChangeTypeArgs) (*Memory, error) {
+	if args.MemoryID == "" {
+		return nil, errorf(ErrValidation, "memory_id cannot be empty")
+	}
+	if args.TargetType == "" {
+		args.TargetType = mcp.store.consolidationTarget
+	}
+	return mcp.store.ChangeType(args.MemoryID, args.TargetType, args.Decay, "promoted")
+}
+
+// Demote a memory to a shorter-lived type, short_term by default
+func (mcp *MCPServer) DemoteMemory(ctx context.Context, args ChangeTypeArgs) (*Memory, error) {
+	if args.MemoryID == "" {
+		return nil, errorf(ErrValidation, "memory_id cannot be empty")
+	}
+	if args.TargetType == "" {
+		args.TargetType = ShortTerm
+	}
+	return mcp.store.ChangeType(args.MemoryID, args.TargetType, args.Decay, "demoted")
+}
+
+// Apply a bulk operation to every memory matching a filter
+func (mcp *MCPServer) BulkAdjust(ctx context.Context, args BulkAdjustArgs) (map[string]interface{}, error) {
+	if args.Operation == "" {
+		return nil, errorf(ErrValidation, "operation is required")
+	}
+	if args.OlderThanHours < 0 {
+		return nil, errorf(ErrValidation, "older_than_hours cannot be negative")
+	}
+	var value float32
+	if args.Value != nil {
+		value = *args.Value
+	} else if args.Operation == BulkSetDecay || args.Operation == BulkScaleImportance {
+		return nil, errorf(ErrValidation, "value is required for %s", args.Operation)
+	}
+
+	filter := BulkFilter{
+		MemoryType: args.MemoryType,
 		Keywords:   args.Keywords,
-		MemoryType: MemoryType(args.MemoryType),
-		Embedding:  args.Embedding,
-		StartTime:  args.StartTime,
-		EndTime:    args.EndTime,
-		MemoryID:   args.MemoryID,
-		Depth:      args.Depth,
-		Limit:      args.Limit,
+		OlderThan:  time.Duration(args.OlderThanHours * float64(time.Hour)),
+	}
+	count, err := mcp.store.BulkAdjust(filter, args.Operation, value)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"operation": args.Operation, "count": count}, nil
+}
+
+// setDefaults validates and replaces this client's store_memory defaults
+func (mcp *MCPServer) setDefaults(defaults StoreDefaults) error {
+	if defaults.MemoryType != "" && !isValidMemoryType(defaults.MemoryType) {
+		return errorf(ErrValidation, "invalid memory type: %s", defaults.MemoryType)
 	}
+	if defaults.Importance < 0 || defaults.Importance > 1 {
+		return errorf(ErrValidation, "default importance must be between 0 and 1")
+	}
+	mcp.defaults = defaults
+	return nil
+}
+
+// Set the memory type and importance this client's stores default to
+func (mcp *MCPServer) SetClientDefaults(ctx context.Context, args StoreDefaults) (StoreDefaults, error) {
+	if err := mcp.setDefaults(args); err != nil {
+		return StoreDefaults{}, err
+	}
+	return mcp.defaults, nil
+}
+
+// Mark a memory as recently accessed without retrieving it
+func (mcp *MCPServer) TouchMemory(ctx context.Context, args TouchMemoryArgs) (map[string]interface{}, error) {
+	if args.MemoryID == "" {
+		return nil, errorf(ErrValidation, "memory_id cannot be empty")
+	}
+	if err := mcp.store.Touch(args.MemoryID); err != nil {
+		return nil, err
+	}
+
+	mcp.store.mu.RLock()
+	defer mcp.store.mu.RUnlock()
+	mem, ok := mcp.store.memories[args.MemoryID]
+	if !ok {
+		return nil, errorf(ErrNotFound, "memory with ID %s does not exist", args.MemoryID)
+	}
+	return map[string]interface{}{
+		"memory_id":    mem.ID,
+		"access_count": mem.AccessCount,
+		"last_access":  mem.LastAccess,
+	}, nil
+}
+
+// Set or clear a memory's embedding
+func (mcp *MCPServer) SetEmbedding(ctx context.Context, args SetEmbeddingArgs) (map[string]interface{}, error) {
+	if args.MemoryID == "" {
+		return nil, errorf(ErrValidation, "memory_id cannot be empty")
+	}
+	if args.Embedding == nil {
+		return nil, errorf(ErrValidation, "embedding is required; pass an empty array to clear it")
+	}
+	if err := mcp.store.SetEmbedding(args.MemoryID, args.Embedding); err != nil {
+		return nil, err
+	}
+
+	mcp.store.mu.RLock()
+	defer mcp.store.mu.RUnlock()
+	mem, ok := mcp.store.memories[args.MemoryID]
+	if !ok {
+		return nil, errorf(ErrNotFound, "memory with ID %s does not exist", args.MemoryID)
+	}
+	return map[string]interface{}{
+		"memory_id": mem.ID,
+		"dimension": len(mem.Embedding),
+		"version":   mem.Version,
+	}, nil
+}
+
+// Search content, metadata, and tags with free text
+func (mcp *MCPServer) Search(ctx context.Context, args SearchArgs) ([]SearchResult, error) {
+	if strings.TrimSpace(args.Query) == "" {
+		return nil, errorf(ErrValidation, "query cannot be empty")
+	}
+	if args.Limit < 0 {
+		return nil, errorf(ErrValidation, "limit cannot be negative")
+	}
+	if args.Limit == 0 {
+		args.Limit = 10 // Default limit
+	}
+	if args.Limit > 1000 {
+		return nil, errorf(ErrValidation, "limit cannot exceed 1000")
+	}
+
+	return mcp.store.Search(args.Query, args.Limit), nil
+}
+
+// Summarize the cluster of memories connected to a seed memory
+func (mcp *MCPServer) MemoryCluster(ctx context.Context, args MemoryClusterArgs) (*ClusterSummary, error) {
+	if args.MemoryID == "" {
+		return nil, errorf(ErrValidation, "memory_id cannot be empty")
+	}
+	if args.Depth < 0 {
+		return nil, errorf(ErrValidation, "depth cannot be negative")
+	}
+	if args.Depth == 0 {
+		args.Depth = 2 // Default depth
+	}
+
+	return mcp.store.Cluster(args.MemoryID, args.Depth)
+}
+
+// List indexed keywords with their document frequencies
+func (mcp *MCPServer) ListKeywords(ctx context.Context, args ListKeywordsArgs) ([]KeywordCount, error) {
+	if args.Limit < 0 {
+		return nil, errorf(ErrValidation, "limit cannot be negative")
+	}
+	alphabetical := false
+	switch args.Sort {
+	case "", "frequency":
+	case "alphabetical":
+		alphabetical = true
+	default:
+		return nil, errorf(ErrValidation, "invalid sort %q: must be frequency or alphabetical", args.Sort)
+	}
+
+	return mcp.store.Keywords(args.Prefix, args.Limit, alphabetical), nil
+}
+
+// List keywords that appear alongside a keyword
+func (mcp *MCPServer) KeywordCooccurrence(ctx context.Context, args KeywordCooccurrenceArgs) ([]KeywordCount, error) {
+	if args.Keyword == "" {
+		return nil, errorf(ErrValidation, "keyword is required")
+	}
+	if args.Limit < 0 {
+		return nil, errorf(ErrValidation, "limit cannot be negative")
+	}
+	if args.Limit == 0 {
+		args.Limit = 10
+	}
+	if args.Limit > 100 {
+		return nil, errorf(ErrValidation, "limit cannot exceed 100")
+	}
+
+	return mcp.store.CooccurringKeywords(args.Keyword, args.Limit), nil
+}
+
+// OrphanReport lists memories without relations
+type OrphanReport struct {
+	Orphans []*Memory `json:"orphans"`
+	Total   int       `json:"total"` // orphans before the limit was applied
+}
+
+// Find memories with no inbound or outbound relations
+func (mcp *MCPServer) FindOrphans(ctx context.Context, args FindOrphansArgs) (*OrphanReport, error) {
+	if args.Limit < 0 {
+		return nil, errorf(ErrValidation, "limit cannot be negative")
+	}
+
+	orphans, total := mcp.store.Orphans(args.Limit)
+	return &OrphanReport{Orphans: orphans, Total: total}, nil
+}
+
+// List the memory types with usage guidance
+func (mcp *MCPServer) ListMemoryTypes(ctx context.Context) ([]MemoryTypeInfo, error) {
+	return mcp.store.MemoryTypes(), nil
+}
+
+// Find the most connected memories
+func (mcp *MCPServer) FindHubs(ctx context.Context, args FindHubsArgs) ([]HubEntry, error) {
+	if args.Limit < 0 {
+		return nil, errorf(ErrValidation, "limit cannot be negative")
+	}
+	if args.Limit == 0 {
+		args.Limit = 10
+	}
+
+	return mcp.store.Hubs(args.Limit), nil
+}
+
+// MemoryComparison is the similarity between two memories
+type MemoryComparison struct {
+	IDA        string  `json:"id_a"`
+	IDB        string  `json:"id_b"`
+	Similarity float32 `json:"similarity"`
+}
 
-	return mcp.store.Query(criteria)
+// Compare two memories by embedding
+func (mcp *MCPServer) CompareMemories(ctx context.Context, args CompareMemoriesArgs) (*MemoryComparison, error) {
+	if args.IDA == "" || args.IDB == "" {
+		return nil, errorf(ErrValidation, "id_a and id_b are required")
+	}
+
+	similarity, err := mcp.store.Compare(args.IDA, args.IDB)
+	if err != nil {
+		return nil, err
+	}
+	return &MemoryComparison{IDA: args.IDA, IDB: args.IDB, Similarity: similarity}, nil
+}
+
+// Suggest relations to a memory's nearest neighbors
+func (mcp *MCPServer) SuggestRelations(ctx context.Context, args SuggestRelationsArgs) ([]RelationSuggestion, error) {
+	if args.MemoryID == "" {
+		return nil, errorf(ErrValidation, "memory_id is required")
+	}
+	threshold := float32(0.8)
+	if args.Threshold != nil {
+		threshold = *args.Threshold
+	}
+	if threshold < -1 || threshold > 1 {
+		return nil, errorf(ErrValidation, "threshold must be between -1 and 1")
+	}
+	if args.Limit < 0 {
+		return nil, errorf(ErrValidation, "limit cannot be negative")
+	}
+	if args.Limit == 0 {
+		args.Limit = 5
+	}
+
+	return mcp.store.SuggestRelations(args.MemoryID, threshold, args.Limit)
+}
+
+// Apply new runtime settings to the running store
+func (mcp *MCPServer) ReloadConfig(ctx context.Context, args ReloadConfigArgs) (map[string]interface{}, error) {
+	settings := RuntimeSettings{
+		MaxMemories:                      args.MaxMemories,
+		ConsolidationAccessThreshold:     args.ConsolidationAccessThreshold,
+		ConsolidationImportanceThreshold: args.ConsolidationImportanceThreshold,
+	}
+
+	durations := []struct {
+		name  string
+		value string
+		dest  *time.Duration
+	}{
+		{"decay_interval", args.DecayInterval, &settings.DecayInterval},
+		{"consolidation_interval", args.ConsolidationInterval, &settings.ConsolidationInterval},
+		{"access_half_life", args.AccessHalfLife, &settings.AccessHalfLife},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(d.value)
+		if err != nil {
+			return nil, errorf(ErrValidation, "invalid %s: %w", d.name, err)
+		}
+		*d.dest = parsed
+	}
+
+	applied, err := mcp.store.Reconfigure(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"max_memories":                       applied.MaxMemories,
+		"decay_interval":                     applied.DecayInterval.String(),
+		"consolidation_interval":             applied.ConsolidationInterval.String(),
+		"access_half_life":                   applied.AccessHalfLife.String(),
+		"consolidation_access_threshold":     applied.ConsolidationAccessThreshold,
+		"consolidation_importance_threshold": applied.ConsolidationImportanceThreshold,
+	}, nil
+}
+
+// IndexRebuildReport summarizes the indexes after a rebuild
+type IndexRebuildReport struct {
+	Memories    int `json:"memories"`
+	Keywords    int `json:"keywords"`
+	TimeBuckets int `json:"time_buckets"`
+	Embeddings  int `json:"embeddings"`
+}
+
+// RebuildIndexes discards the type, time, keyword, content, and embedding
+// indexes and repopulates them from the primary map, recovering from any
+// drift between the two. It holds the write lock for the whole rebuild.
+func (ms *MemoryStore) RebuildIndexes() IndexRebuildReport {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.rebuildIndexes()
+	return IndexRebuildReport{
+		Memories:    len(ms.memories),
+		Keywords:    len(ms.keywordIndex.index),
+		TimeBuckets: len(ms.timeIndex.buckets),
+		Embeddings:  len(ms.embeddingIndex.embeddings) + len(ms.embeddingIndex.quantized),
+	}
+}
+
+// rebuildIndexes repopulates the secondary indexes from the primary map.
+// Caller must hold ms.mu.
+func (ms *MemoryStore) rebuildIndexes() {
+	for _, t := range allMemoryTypes {
+		ms.typeIndex[t] = make(map[string]*Memory)
+	}
+
+	ms.timeIndex.mu.Lock()
+	ms.timeIndex.buckets = make(map[string][]*Memory)
+	ms.timeIndex.mu.Unlock()
+
+	ms.keywordIndex.mu.Lock()
+	ms.keywordIndex.index = make(map[string]*postingList)
+	ms.keywordIndex.metadata = make(map[string]*postingList)
+	ms.keywordIndex.tags = make(map[string]*postingList)
+	ms.keywordIndex.positions = make(map[string]map[string][]int)
+	ms.keywordIndex.mu.Unlock()
+
+	if ms.contentIndex != nil {
+		clear(ms.contentIndex)
+	}
+
+	ms.embeddingIndex.mu.Lock()
+	ms.embeddingIndex.embeddings = make(map[string][]float32)
+	ms.embeddingIndex.quantized = make(map[string]QuantizedVector)
+	clear(ms.embeddingIndex.pending)
+	ms.embeddingIndex.mu.Unlock()
+
+	// Insert oldest first so each time bucket stays in chronological order
+	memories := make([]*Memory, 0, len(ms.memories))
+	for _, mem := range ms.memories {
+		memories = append(memories, mem)
+	}
+	sort.Slice(memories, func(i, j int) bool {
+		if !memories[i].Timestamp.Equal(memories[j].Timestamp) {
+			return memories[i].Timestamp.Before(memories[j].Timestamp)
+		}
+		return memories[i].ID < memories[j].ID
+	})
+
+	for _, mem := range memories {
+		if ms.typeIndex[mem.Type] == nil {
+			ms.typeIndex[mem.Type] = make(map[string]*Memory)
+		}
+		ms.typeIndex[mem.Type][mem.ID] = mem
+		ms.addToTimeIndex(mem)
+		ms.addToKeywordIndex(mem)
+		ms.addToContentIndex(mem)
+		// Synchronously, so the report counts every embedding
+		ms.embeddingIndex.put(mem.ID, mem.Embedding)
+	}
+	ms.queryCache.invalidate()
+}
+
+// RebuildIndexes is the admin tool entry point for rebuilding every index
+func (mcp *MCPServer) RebuildIndexes(ctx context.Context) (IndexRebuildReport, error) {
+	return mcp.store.RebuildIndexes(), nil
+}
+
+// Create relation between memories with validation
+func (mcp *MCPServer) CreateRelation(ctx context.Context, args CreateRelationArgs) error {
+	mcp.store.mu.Lock()
+	defer mcp.store.mu.Unlock()
+
+	return mcp.store.addRelation(args)
 }
 
-// Create relation between memories with validation
-func (mcp *MCPServer) CreateRelation(ctx context.Context, args CreateRelationArgs) error {
+// Create many relations under one write lock, returning one error (or nil) per edge
+func (mcp *MCPServer) CreateRelations(ctx context.Context, args []CreateRelationArgs) []error {
+	mcp.store.mu.Lock()
+	defer mcp.store.mu.Unlock()
+
+	errs := make([]error, len(args))
+	for i, relation := range args {
+		errs[i] = mcp.store.addRelation(relation)
+	}
+	return errs
+}
+
+// addRelation validates and inserts one relation. Caller must hold ms.mu.
+func (ms *MemoryStore) addRelation(args CreateRelationArgs) error {
+	if err := ms.checkWritable(); err != nil {
+		return err
+	}
+
 	// Validate arguments
 	if args.FromID == "" {
-		return errors.New("from_id cannot be empty")
+		return errorf(ErrValidation, "from_id cannot be empty")
 	}
 	if args.ToID == "" {
-		return errors.New("to_id cannot be empty")
+		return errorf(ErrValidation, "to_id cannot be empty")
 	}
 	if args.RelationType == "" {
-		return errors.New("relation_type cannot be empty")
+		return errorf(ErrValidation, "relation_type cannot be empty")
+	}
+	if args.FromID == args.ToID && !ms.allowSelfRelations {
+		return errorf(ErrValidation, "memory %s cannot be related to itself", args.FromID)
 	}
 	if args.Strength < 0 || args.Strength > 1 {
 		args.Strength = 0.5 // Default strength
 	}
 
-	mcp.store.mu.Lock()
-	defer mcp.store.mu.Unlock()
-
 	// Check that both memories exist
-	if _, exists := mcp.store.memories[args.FromID]; !exists {
-		return fmt.Errorf("memory with ID %s does not exist", args.FromID)
+	if _, exists := ms.memories[args.FromID]; !exists {
+		return errorf(ErrNotFound, "memory with ID %s does not exist", args.FromID)
 	}
-	if _, exists := mcp.store.memories[args.ToID]; !exists {
-		return fmt.Errorf("memory with ID %s does not exist", args.ToID)
+	if _, exists := ms.memories[args.ToID]; !exists {
+		return errorf(ErrNotFound, "memory with ID %s does not exist", args.ToID)
 	}
 
 	relation := &MemoryRelation{
@@ -494,7 +3812,54 @@ func (mcp *MCPServer) CreateRelation(ctx context.Context, args CreateRelationArg
 		Strength: args.Strength,
 	}
 
-	mcp.store.relations[args.FromID] = append(mcp.store.relations[args.FromID], relation)
+	ms.relations[args.FromID] = append(ms.relations[args.FromID], relation)
+	ms.relationTypeIndex[args.RelationType] = append(ms.relationTypeIndex[args.RelationType], relation)
+	ms.markChanged(ms.memories[args.FromID])
+	ms.queryCache.invalidate()
+
+	return nil
+}
+
+// Delete relations between two memories, optionally limited to one relation type
+func (mcp *MCPServer) DeleteRelation(ctx context.Context, args DeleteRelationArgs) error {
+	if err := mcp.store.checkWritable(); err != nil {
+		return err
+	}
+
+	// Validate arguments
+	if args.FromID == "" {
+		return errorf(ErrValidation, "from_id cannot be empty")
+	}
+	if args.ToID == "" {
+		return errorf(ErrValidation, "to_id cannot be empty")
+	}
+
+	mcp.store.mu.Lock()
+	defer mcp.store.mu.Unlock()
+
+	relations := mcp.store.relations[args.FromID]
+	kept := relations[:0]
+	removed := 0
+	for _, rel := range relations {
+		if rel.To == args.ToID && (args.RelationType == "" || rel.Type == args.RelationType) {
+			mcp.store.removeFromRelationTypeIndex(rel)
+			removed++
+			continue
+		}
+		kept = append(kept, rel)
+	}
+
+	if removed == 0 {
+		return errorf(ErrNotFound, "no relation from %s to %s", args.FromID, args.ToID)
+	}
+
+	if len(kept) == 0 {
+		delete(mcp.store.relations, args.FromID)
+	} else {
+		mcp.store.relations[args.FromID] = kept
+	}
+	mcp.store.markChanged(mcp.store.memories[args.FromID])
+	mcp.store.queryCache.invalidate()
 
 	return nil
 }
@@ -506,6 +3871,7 @@ func (mcp *MCPServer) GetStats(ctx context.Context) (map[string]interface{}, err
 
 	stats := map[string]interface{}{
 		"total_memories": len(mcp.store.memories),
+		"store_version":  mcp.store.version,
 		"by_type": map[string]int{
 			"short_term": len(mcp.store.typeIndex[ShortTerm]),
 			"long_term":  len(mcp.store.typeIndex[LongTerm]),
@@ -515,17 +3881,107 @@ func (mcp *MCPServer) GetStats(ctx context.Context) (map[string]interface{}, err
 		},
 		"total_relations": len(mcp.store.relations),
 		"capacity_used":   float32(len(mcp.store.memories)) / float32(mcp.store.maxMemories),
+		"read_only":       mcp.store.readOnly.Load(),
+	}
+	if mcp.store.queryCache != nil {
+		stats["query_cache"] = mcp.store.queryCache.stats()
+	}
+	if mcp.store.recentCache != nil {
+		stats["recent_cache"] = mcp.store.recentCache.stats()
+	}
+	if mcp.store.queryLimiter != nil {
+		stats["query_limiter"] = mcp.store.queryLimiter.stats()
+	}
+	if mcp.store.embeddingIndex.queue != nil {
+		mcp.store.embeddingIndex.mu.RLock()
+		stats["pending_embeddings"] = mcp.store.embeddingIndex.queued
+		mcp.store.embeddingIndex.mu.RUnlock()
+	}
+	if mcp.store.capacityWarningThreshold > 0 {
+		stats["capacity_warning"] = map[string]interface{}{
+			"threshold": mcp.store.capacityWarningThreshold,
+			"active":    mcp.store.capacityWarningActive,
+			"warnings":  mcp.store.capacityWarnings,
+		}
 	}
 
 	return stats, nil
 }
 
+// HealthStatus separates liveness (the process answers) from readiness (the
+// store accepts work)
+type HealthStatus struct {
+	Live         bool     `json:"live"`
+	Ready        bool     `json:"ready"`
+	ShuttingDown bool     `json:"shutting_down"`
+	MemoryCount  int      `json:"memory_count"`
+	MaxMemories  int      `json:"max_memories"`
+	HeapMB       float64  `json:"heap_mb"`
+	Reasons      []string `json:"reasons,omitempty"` // why the store is not ready
+}
+
+// Health reports readiness without draining or blocking on long requests:
+// it holds the store lock only long enough to read the memory count
+func (ms *MemoryStore) Health() HealthStatus {
+	ms.lifecycleMu.Lock()
+	closing := ms.closing
+	ms.lifecycleMu.Unlock()
+
+	ms.mu.RLock()
+	count := len(ms.memories)
+	maxMemories := ms.maxMemories
+	rejectWhenFull := ms.rejectWhenFull
+	ms.mu.RUnlock()
+
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(sample)
+	var heapBytes uint64
+	if sample[0].Value.Kind() == metrics.KindUint64 {
+		heapBytes = sample[0].Value.Uint64()
+	}
+
+	status := HealthStatus{
+		Live:         true,
+		ShuttingDown: closing,
+		MemoryCount:  count,
+		MaxMemories:  maxMemories,
+		HeapMB:       float64(heapBytes) / (1024 * 1024),
+	}
+	if closing {
+		status.Reasons = append(status.Reasons, "store is shutting down")
+	}
+	// An evicting store keeps accepting writes when full, so only a
+	// rejecting one is unusable at capacity
+	if rejectWhenFull && count >= maxMemories {
+		status.Reasons = append(status.Reasons, "store is at capacity")
+	}
+	if ms.memoryLimitBytes > 0 && heapBytes > ms.memoryLimitBytes {
+		status.Reasons = append(status.Reasons, "heap exceeds memory limit")
+	}
+	status.Ready = len(status.Reasons) == 0
+
+	return status
+}
+
+// Health reports liveness and readiness for orchestration probes
+func (mcp *MCPServer) Health(ctx context.Context) (HealthStatus, error) {
+	return mcp.store.Health(), nil
+}
+
 // Helper functions
 
 func generateID() string {
 	return fmt.Sprintf("mem_%d", time.Now().UnixNano())
 }
 
+// sessionCounter keeps session IDs unique when clients connect in the same instant
+var sessionCounter atomic.Uint64
+
+// newSessionID names a client session
+func newSessionID() string {
+	return fmt.Sprintf("session_%d_%d", time.Now().UnixNano(), sessionCounter.Add(1))
+}
+
 func cosineSimilarity(a, b []float32) float32 {
 	var dot, normA, normB float32
 	for i := range a {
@@ -545,16 +4001,14 @@ func (ms *MemoryStore) addToKeywordIndex(memory *Memory) {
 	ms.keywordIndex.mu.Lock()
 	defer ms.keywordIndex.mu.Unlock()
 
-	// Extract and normalize words
-	words := extractWords(memory.Content)
-	for _, word := range words {
-		if len(word) >= 3 { // Only index words with 3+ characters
-			lowerWord := strings.ToLower(word)
-			if ms.keywordIndex.index[lowerWord] == nil {
-				ms.keywordIndex.index[lowerWord] = make(map[string]*Memory)
-			}
-			ms.keywordIndex.index[lowerWord][memory.ID] = memory
-		}
+	// Cache the unique term sets so removal undoes exactly what was added
+	memory.keywords = uniqueKeywords(memory.Content, ms.keywordIndex.identifiers)
+	memory.metadataKeywords, memory.tags = metadataTerms(memory.Metadata, ms.keywordIndex.identifiers)
+	addPostings(ms.keywordIndex.index, memory.keywords, memory)
+	addPostings(ms.keywordIndex.metadata, memory.metadataKeywords, memory)
+	addPostings(ms.keywordIndex.tags, memory.tags, memory)
+	if ms.keywordIndex.positional {
+		addPositions(ms.keywordIndex.positions, memory, ms.keywordIndex.identifiers)
 	}
 }
 
@@ -563,41 +4017,366 @@ func (ms *MemoryStore) removeFromKeywordIndex(memory *Memory) {
 	ms.keywordIndex.mu.Lock()
 	defer ms.keywordIndex.mu.Unlock()
 
-	words := extractWords(memory.Content)
-	for _, word := range words {
+	words := memory.keywords
+	metadataWords, tags := memory.metadataKeywords, memory.tags
+	if words == nil {
+		words = uniqueKeywords(memory.Content, ms.keywordIndex.identifiers)
+		metadataWords, tags = metadataTerms(memory.Metadata, ms.keywordIndex.identifiers)
+	}
+
+	removePostings(ms.keywordIndex.index, words, memory)
+	removePostings(ms.keywordIndex.metadata, metadataWords, memory)
+	removePostings(ms.keywordIndex.tags, tags, memory)
+	if ms.keywordIndex.positional {
+		removePositions(ms.keywordIndex.positions, words, memory.ID)
+	}
+	memory.keywords, memory.metadataKeywords, memory.tags = nil, nil, nil
+}
+
+// addPostings links each term to the memory
+func addPostings(index map[string]*postingList, terms []string, memory *Memory) {
+	for _, term := range terms {
+		if index[term] == nil {
+			index[term] = &postingList{}
+		}
+		index[term].add(memory)
+	}
+}
+
+// removePostings unlinks each term from the memory, dropping emptied terms
+func removePostings(index map[string]*postingList, terms []string, memory *Memory) {
+	for _, term := range terms {
+		if memories, exists := index[term]; exists {
+			memories.remove(memory.ID)
+			// Clean up empty entries
+			if memories.len() == 0 {
+				delete(index, term)
+			}
+		}
+	}
+}
+
+// wordPosition is an indexable word and its offset among all of a text's words
+type wordPosition struct {
+	word     string
+	position int
+}
+
+// wordPositions returns the lowercase indexable words of text in order with
+// their offsets. Short words are not indexed but still count toward offsets,
+// so "Paris is in France" puts france three words after paris.
+func wordPositions(text string, identifiers bool) []wordPosition {
+	var words []string
+	if identifiers {
+		words = extractIdentifierWords(text)
+	} else {
+		words = extractWords(text)
+	}
+
+	positions := make([]wordPosition, 0, len(words))
+	for i, word := range words {
 		if len(word) >= 3 {
-			lowerWord := strings.ToLower(word)
-			if memories, exists := ms.keywordIndex.index[lowerWord]; exists {
-				delete(memories, memory.ID)
-				// Clean up empty entries
-				if len(memories) == 0 {
-					delete(ms.keywordIndex.index, lowerWord)
-				}
+			positions = append(positions, wordPosition{word: strings.ToLower(word), position: i})
+		}
+	}
+	return positions
+}
+
+// addPositions records where each word occurs in the memory's content
+func addPositions(index map[string]map[string][]int, memory *Memory, identifiers bool) {
+	for _, wp := range wordPositions(memory.Content, identifiers) {
+		if index[wp.word] == nil {
+			index[wp.word] = make(map[string][]int)
+		}
+		index[wp.word][memory.ID] = append(index[wp.word][memory.ID], wp.position)
+	}
+}
+
+// removePositions drops the memory's offsets for each word, dropping emptied words
+func removePositions(index map[string]map[string][]int, words []string, id string) {
+	for _, word := range words {
+		if memories, exists := index[word]; exists {
+			delete(memories, id)
+			if len(memories) == 0 {
+				delete(index, word)
+			}
+		}
+	}
+}
+
+// metadataTerms returns the indexable words of string metadata values and the
+// lowercase tags listed under metadata["tags"]
+func metadataTerms(metadata map[string]interface{}, identifiers bool) (words []string, tags []string) {
+	var text []string
+	for key, value := range metadata {
+		if key == "tags" {
+			continue
+		}
+		if s, ok := value.(string); ok {
+			text = append(text, s)
+		}
+	}
+	words = uniqueKeywords(strings.Join(text, " "), identifiers)
+
+	var rawTags []string
+	switch v := metadata["tags"].(type) {
+	case []string:
+		rawTags = v
+	case []interface{}:
+		for _, tag := range v {
+			if s, ok := tag.(string); ok {
+				rawTags = append(rawTags, s)
 			}
 		}
 	}
+
+	seen := make(map[string]bool, len(rawTags))
+	for _, tag := range rawTags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag != "" && !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	return words, tags
+}
+
+// uniqueKeywords returns the distinct lowercase indexable words in text
+func uniqueKeywords(text string, identifiers bool) []string {
+	var words []string
+	if identifiers {
+		words = extractIdentifierWords(text)
+	} else {
+		words = extractWords(text)
+	}
+	seen := make(map[string]struct{}, len(words))
+	keywords := make([]string, 0, len(words))
+
+	for _, word := range words {
+		if len(word) < 3 { // Only index words with 3+ characters
+			continue
+		}
+		lowerWord := strings.ToLower(word)
+		if _, dup := seen[lowerWord]; dup {
+			continue
+		}
+		seen[lowerWord] = struct{}{}
+		keywords = append(keywords, lowerWord)
+	}
+	return keywords
+}
+
+// matchesKeywords reports whether the keyword index links any keyword to the memory
+func (ms *MemoryStore) matchesKeywords(memory *Memory, keywords []string) bool {
+	ms.keywordIndex.mu.RLock()
+	defer ms.keywordIndex.mu.RUnlock()
+
+	for _, keyword := range keywords {
+		if memories, exists := ms.keywordIndex.index[strings.ToLower(keyword)]; exists && memories.contains(memory.ID) {
+			return true
+		}
+	}
+	return false
 }
 
 // extractWords splits text into indexable words
 func extractWords(text string) []string {
 	// Simple word extraction - split on whitespace and punctuation
 	words := strings.FieldsFunc(text, func(c rune) bool {
-		return !((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9'))
+		return !isWordRune(c)
 	})
 	return words
 }
 
-// normalizeVector normalizes a vector to unit length
+// isWordRune reports whether c can be part of an indexable word
+func isWordRune(c rune) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// isIdentifierJoiner reports whether c joins word characters into one
+// identifier, as in user_id, config.yaml, or v1.2.3
+func isIdentifierJoiner(c rune) bool {
+	return c == '_' || c == '.' || c == '-'
+}
+
+// wordSpans returns the [start, end) rune offsets of the words in runes. With
+// identifiers set, a joiner between two word characters stays inside the
+// word, while leading, trailing, and repeated joiners still split, so a
+// sentence-ending period is not indexed.
+func wordSpans(runes []rune, identifiers bool) [][2]int {
+	var spans [][2]int
+	for start := 0; start < len(runes); {
+		if !isWordRune(runes[start]) {
+			start++
+			continue
+		}
+		end := start
+		for end < len(runes) {
+			if isWordRune(runes[end]) {
+				end++
+			} else if identifiers && isIdentifierJoiner(runes[end]) && end+1 < len(runes) && isWordRune(runes[end+1]) {
+				end += 2
+			} else {
+				break
+			}
+		}
+		spans = append(spans, [2]int{start, end})
+		start = end
+	}
+	return spans
+}
+
+// extractIdentifierWords splits text into words, keeping identifiers whole
+func extractIdentifierWords(text string) []string {
+	runes := []rune(text)
+	spans := wordSpans(runes, true)
+	words := make([]string, len(spans))
+	for i, span := range spans {
+		words[i] = string(runes[span[0]:span[1]])
+	}
+	return words
+}
+
+// makeSnippet returns an excerpt of at most maxLen content characters around
+// the densest cluster of keyword matches, with matches wrapped in ** markers
+// and elided ends shown as "...". Without matches the excerpt starts at the
+// beginning of the content. identifiers must match the index's tokenization
+// so identifier keywords are found.
+func makeSnippet(content string, keywords []string, maxLen int, identifiers bool) string {
+	runes := []rune(content)
+	if maxLen <= 0 {
+		maxLen = defaultSnippetLength
+	}
+
+	wanted := make(map[string]bool, len(keywords))
+	for _, keyword := range keywords {
+		wanted[strings.ToLower(keyword)] = true
+	}
+
+	// Find word spans matching any keyword
+	var matches [][2]int
+	for _, span := range wordSpans(runes, identifiers) {
+		if wanted[strings.ToLower(string(runes[span[0]:span[1]]))] {
+			matches = append(matches, span)
+		}
+	}
+
+	// Pick the window start covering the most matches, earliest on ties
+	first, last := 0, -1
+	for i := range matches {
+		j := i
+		for j+1 < len(matches) && matches[j+1][1]-matches[i][0] <= maxLen {
+			j++
+		}
+		if matches[i][1]-matches[i][0] <= maxLen && j-i > last-first {
+			first, last = i, j
+		}
+	}
+
+	windowStart := 0
+	if last >= first {
+		// Center the matched cluster in the window
+		clusterLen := matches[last][1] - matches[first][0]
+		windowStart = matches[first][0] - (maxLen-clusterLen)/2
+	}
+	windowEnd := windowStart + maxLen
+	if windowEnd > len(runes) {
+		windowEnd = len(runes)
+		windowStart = windowEnd - maxLen
+	}
+	if windowStart < 0 {
+		windowStart = 0
+	}
+
+	var b strings.Builder
+	if windowStart > 0 {
+		b.WriteString("...")
+	}
+	pos := windowStart
+	for _, m := range matches {
+		if m[0] < windowStart || m[1] > windowEnd {
+			continue
+		}
+		b.WriteString(string(runes[pos:m[0]]))
+		b.WriteString("**")
+		b.WriteString(string(runes[m[0]:m[1]]))
+		b.WriteString("**")
+		pos = m[1]
+	}
+	b.WriteString(string(runes[pos:windowEnd]))
+	if windowEnd < len(runes) {
+		b.WriteString("...")
+	}
+	return b.String()
+}
+
+// defaultSnippetLength is the excerpt size used when none is requested
+const defaultSnippetLength = 160
+
+// MemorySnippet is a compact query result carrying an excerpt instead of full content
+type MemorySnippet struct {
+	ID         string     `json:"id"`
+	Type       MemoryType `json:"type"`
+	Snippet    string     `json:"snippet"`
+	Importance float32    `json:"importance"`
+	Timestamp  time.Time  `json:"timestamp"`
+
+	OutboundRelations []MemoryRelation `json:"outbound_relations,omitempty"`
+}
+
+// MemoryWithRelations is a full query result carrying its outbound relations
+type MemoryWithRelations struct {
+	*Memory
+	OutboundRelations []MemoryRelation `json:"outbound_relations"`
+}
+
+// OutboundRelations copies the outbound relations of each memory, keyed by memory ID
+func (ms *MemoryStore) OutboundRelations(memories []*Memory) map[string][]MemoryRelation {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	relations := make(map[string][]MemoryRelation, len(memories))
+	for _, mem := range memories {
+		edges := make([]MemoryRelation, 0, len(ms.relations[mem.ID]))
+		for _, rel := range ms.relations[mem.ID] {
+			edges = append(edges, *rel)
+		}
+		relations[mem.ID] = edges
+	}
+	return relations
+}
+
+// snippetResults converts query results to snippets around the given keywords
+func snippetResults(memories []*Memory, keywords []string, maxLen int, identifiers bool) []MemorySnippet {
+	snippets := make([]MemorySnippet, 0, len(memories))
+	for _, mem := range memories {
+		snippets = append(snippets, MemorySnippet{
+			ID:         mem.ID,
+			Type:       mem.Type,
+			Snippet:    makeSnippet(mem.Content, keywords, maxLen, identifiers),
+			Importance: mem.Importance,
+			Timestamp:  mem.Timestamp,
+		})
+	}
+	return snippets
+}
+
+// unitNormTolerance is how far a squared norm may be from 1 for a vector to
+// count as already normalized
+const unitNormTolerance = 1e-5
+
+// normalizeVector returns a unit-length copy of a vector. Zero and already
+// normalized vectors are copied unchanged rather than divided again; the
+// result never shares the caller's backing array.
 func normalizeVector(v []float32) []float32 {
 	var norm float32
 	for _, val := range v {
 		norm += val * val
 	}
-	norm = sqrt(norm)
-
-	if norm == 0 {
-		return v
+	if norm == 0 || math.Abs(float64(norm)-1) <= unitNormTolerance {
+		return slices.Clone(v)
 	}
+	norm = sqrt(norm)
 
 	normalized := make([]float32, len(v))
 	for i, val := range v {
@@ -606,6 +4385,46 @@ func normalizeVector(v []float32) []float32 {
 	return normalized
 }
 
+// quantizeVector encodes a vector as int8 values scaled by its largest magnitude
+func quantizeVector(v []float32) QuantizedVector {
+	var maxAbs float32
+	for _, val := range v {
+		if abs := float32(math.Abs(float64(val))); abs > maxAbs {
+			maxAbs = abs
+		}
+	}
+
+	q := QuantizedVector{Values: make([]int8, len(v))}
+	if maxAbs == 0 {
+		return q
+	}
+
+	q.Scale = maxAbs / 127
+	for i, val := range v {
+		q.Values[i] = int8(math.Round(float64(val / q.Scale)))
+	}
+	return q
+}
+
+// dot computes the dot product with a full-precision vector, dequantizing on the fly
+func (q QuantizedVector) dot(v []float32) float32 {
+	var sum float32
+	for i := range q.Values {
+		sum += float32(q.Values[i]) * v[i]
+	}
+	return sum * q.Scale
+}
+
+// distance computes the euclidean distance to a full-precision vector, dequantizing on the fly
+func (q QuantizedVector) distance(v []float32) float32 {
+	var sum float32
+	for i := range q.Values {
+		d := float32(q.Values[i])*q.Scale - v[i]
+		sum += d * d
+	}
+	return sqrt(sum)
+}
+
 // dotProduct computes dot product of two vectors
 func dotProduct(a, b []float32) float32 {
 	var sum float32
@@ -615,54 +4434,266 @@ func dotProduct(a, b []float32) float32 {
 	return sum
 }
 
-// cleanupTimeBuckets removes old time buckets to prevent memory leaks
+// euclideanDistance computes the straight-line distance between two vectors
+func euclideanDistance(a, b []float32) float32 {
+	var sum float32
+	for i := range a {
+		d := a[i] - b[i]
+		sum += d * d
+	}
+	return sqrt(sum)
+}
+
+// cleanupTimeBuckets compacts time buckets older than the retention window,
+// dropping entries for memories that no longer exist. Buckets holding live
+// memories are kept so temporal queries still find old-but-present memories.
+// Caller must hold ms.mu.
 func (ms *MemoryStore) cleanupTimeBuckets() {
 	ms.timeIndex.mu.Lock()
 	defer ms.timeIndex.mu.Unlock()
 
-	cutoff := time.Now().Add(-24 * time.Hour * 7) // Keep only last 7 days
-	cutoffStr := cutoff.Format("2006-01-02-15")
+	cutoff := time.Now().Add(-ms.timeIndex.retention)
+	cutoffStr := cutoff.UTC().Format(ms.timeIndex.format)
+
+	for bucket, memories := range ms.timeIndex.buckets {
+		if bucket >= cutoffStr {
+			continue
+		}
+
+		live := memories[:0]
+		for _, mem := range memories {
+			if current, ok := ms.memories[mem.ID]; ok && current == mem {
+				live = append(live, mem)
+			}
+		}
 
-	for bucket := range ms.timeIndex.buckets {
-		if bucket < cutoffStr {
+		if len(live) == 0 {
 			delete(ms.timeIndex.buckets, bucket)
+		} else {
+			ms.timeIndex.buckets[bucket] = live
 		}
 	}
 }
 
+// removeFromTimeIndex drops a memory from its time bucket
+func (ms *MemoryStore) removeFromTimeIndex(memory *Memory) {
+	ms.timeIndex.mu.Lock()
+	defer ms.timeIndex.mu.Unlock()
+
+	bucket := memory.Timestamp.UTC().Format(ms.timeIndex.format)
+	memories := ms.timeIndex.buckets[bucket]
+	for i, mem := range memories {
+		if mem == memory {
+			memories = append(memories[:i], memories[i+1:]...)
+			break
+		}
+	}
+
+	if len(memories) == 0 {
+		delete(ms.timeIndex.buckets, bucket)
+	} else {
+		ms.timeIndex.buckets[bucket] = memories
+	}
+}
+
 // Additional helper types
 
 type QueryCriteria struct {
-	Type       string
-	Keywords   []string
-	MemoryType MemoryType
-	Embedding  []float32
-	StartTime  time.Time
-	EndTime    time.Time
-	MemoryID   string
-	Depth      int
-	Limit      int
+	Type         string
+	Keywords     []string
+	MemoryType   MemoryType
+	MemoryTypes  []MemoryType // type queries union these with MemoryType
+	Embedding    []float32
+	StartTime    time.Time
+	EndTime      time.Time
+	MemoryID     string
+	Depth        int
+	RelationType string
+	SessionID    string
+	Limit        int
+	SinceVersion uint64 // only memories changed after this store version
+	Phrase       string
+	Within       int // phrase words may be this many apart in any order; 0 needs them adjacent
+
+	ImportanceWeight float32
 }
 
 type StoreMemoryArgs struct {
+	ID         string                 `json:"id,omitempty"`
+	Upsert     bool                   `json:"upsert,omitempty"`
 	Type       MemoryType             `json:"type"`
 	Content    string                 `json:"content"`
 	Embedding  []float32              `json:"embedding,omitempty"`
 	Metadata   map[string]interface{} `json:"metadata"`
 	Relations  []string               `json:"relations"`
 	Importance float32                `json:"importance"`
+	Decay      float32                `json:"decay,omitempty"`
+
+	ExpectedVersion int    `json:"expected_version,omitempty"` // with upsert, fail unless the stored version matches
+	SessionID       string `json:"session_id,omitempty"`       // overrides the client's session
 }
 
 type QueryMemoryArgs struct {
-	QueryType  string    `json:"query_type"`
-	Keywords   []string  `json:"keywords,omitempty"`
-	MemoryType string    `json:"memory_type,omitempty"`
-	Embedding  []float32 `json:"embedding,omitempty"`
-	StartTime  time.Time `json:"start_time,omitempty"`
-	EndTime    time.Time `json:"end_time,omitempty"`
-	MemoryID   string    `json:"memory_id,omitempty"`
-	Depth      int       `json:"depth,omitempty"`
-	Limit      int       `json:"limit,omitempty"`
+	QueryType     string    `json:"query_type"`
+	Keywords      []string  `json:"keywords,omitempty"`
+	MemoryType    string    `json:"memory_type,omitempty"`
+	MemoryTypes   []string  `json:"memory_types,omitempty"`
+	Embedding     []float32 `json:"embedding,omitempty"`
+	StartTime     time.Time `json:"start_time,omitempty"`
+	EndTime       time.Time `json:"end_time,omitempty"`
+	MemoryID      string    `json:"memory_id,omitempty"`
+	Depth         int       `json:"depth,omitempty"`
+	RelationType  string    `json:"relation_type,omitempty"`
+	SessionID     string    `json:"session_id,omitempty"` // for session queries, defaults to the client's session
+	Phrase        string    `json:"phrase,omitempty"`
+	Within        int       `json:"within,omitempty"`
+	Limit         int       `json:"limit,omitempty"`
+	Snippet       bool      `json:"snippet,omitempty"`
+	SnippetLength int       `json:"snippet_length,omitempty"`
+
+	IncludeRelations bool    `json:"include_relations,omitempty"`
+	ImportanceWeight float32 `json:"importance_weight,omitempty"`
+	IDsOnly          bool    `json:"ids_only,omitempty"`   // return only matching IDs; overrides snippet and include_relations
+	CountOnly        bool    `json:"count_only,omitempty"` // return only the number of matches
+	ChunkSize        int     `json:"chunk_size,omitempty"` // stream results in chunks of this many where supported
+	SinceVersion     uint64  `json:"since_version,omitempty"`
+}
+
+type ExportMemoriesArgs struct {
+	Path      string `json:"path"`
+	Overwrite bool   `json:"overwrite,omitempty"` // replace an existing file
+}
+
+type ImportMemoriesArgs struct {
+	Path string `json:"path"`
+}
+
+type SnapshotArgs struct {
+	Compress bool `json:"compress,omitempty"`
+}
+
+// SnapshotResult carries a snapshot as JSON, or compressed in Data
+type SnapshotResult struct {
+	Format       string         `json:"format"` // json or gzip+base64
+	Memories     int            `json:"memories"`
+	Relations    int            `json:"relations"`
+	StoreVersion uint64         `json:"store_version"`
+	Snapshot     *StoreSnapshot `json:"snapshot,omitempty"`
+	Data         string         `json:"data,omitempty"`
+}
+
+type RestoreSnapshotArgs struct {
+	Snapshot *StoreSnapshot `json:"snapshot,omitempty"`
+	Data     string         `json:"data,omitempty"`
+}
+
+type MemoryLineageArgs struct {
+	MemoryID string `json:"memory_id"`
+}
+
+// StoreDefaults fill in store_memory's type and importance when a call
+// omits them; zero values fall back to the global defaults
+type StoreDefaults struct {
+	MemoryType MemoryType `json:"memory_type,omitempty"`
+	Importance float32    `json:"importance,omitempty"`
+}
+
+type TouchMemoryArgs struct {
+	MemoryID string `json:"memory_id"`
+}
+
+type SetEmbeddingArgs struct {
+	MemoryID  string    `json:"memory_id"`
+	Embedding []float32 `json:"embedding"` // empty clears the embedding
+}
+
+type ChangeTypeArgs struct {
+	MemoryID   string     `json:"memory_id"`
+	TargetType MemoryType `json:"target_type,omitempty"`
+	Decay      *float32   `json:"decay,omitempty"` // nil takes the target type's recommended rate
+}
+
+type BulkAdjustArgs struct {
+	Operation      string     `json:"operation"`       // set_decay, scale_importance, pin, or unpin
+	Value          *float32   `json:"value,omitempty"` // required by set_decay and scale_importance
+	MemoryType     MemoryType `json:"memory_type,omitempty"`
+	Keywords       []string   `json:"keywords,omitempty"`
+	OlderThanHours float64    `json:"older_than_hours,omitempty"`
+}
+
+type SearchArgs struct {
+	Query string `json:"query"`
+	Limit int    `json:"limit,omitempty"`
+}
+
+type MemoryClusterArgs struct {
+	MemoryID string `json:"memory_id"`
+	Depth    int    `json:"depth,omitempty"`
+}
+
+type KeywordCooccurrenceArgs struct {
+	Keyword string `json:"keyword"`
+	Limit   int    `json:"limit,omitempty"`
+}
+
+type ListKeywordsArgs struct {
+	Prefix string `json:"prefix,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+	Sort   string `json:"sort,omitempty"`
+}
+
+type ReloadConfigArgs struct {
+	MaxMemories                      int     `json:"max_memories,omitempty"`
+	DecayInterval                    string  `json:"decay_interval,omitempty"`
+	ConsolidationInterval            string  `json:"consolidation_interval,omitempty"`
+	AccessHalfLife                   string  `json:"access_half_life,omitempty"`
+	ConsolidationAccessThreshold     float32 `json:"consolidation_access_threshold,omitempty"`
+	ConsolidationImportanceThreshold float32 `json:"consolidation_importance_threshold,omitempty"`
+}
+
+type FindOrphansArgs struct {
+	Limit int `json:"limit,omitempty"`
+}
+
+type FindHubsArgs struct {
+	Limit int `json:"limit,omitempty"`
+}
+
+type CompareMemoriesArgs struct {
+	IDA string `json:"id_a"`
+	IDB string `json:"id_b"`
+}
+
+type SuggestRelationsArgs struct {
+	MemoryID  string   `json:"memory_id"`
+	Threshold *float32 `json:"threshold,omitempty"` // nil takes 0.8; 0 is a real threshold
+	Limit     int      `json:"limit,omitempty"`
+}
+
+type AgingReportArgs struct {
+	HorizonHours float64 `json:"horizon_hours,omitempty"`
+}
+
+type DeleteRelationArgs struct {
+	FromID       string `json:"from_id"`
+	ToID         string `json:"to_id"`
+	RelationType string `json:"relation_type,omitempty"`
+}
+
+type SimilarityBatchArgs struct {
+	Embeddings [][]float32 `json:"embeddings"`
+	Limit      int         `json:"limit,omitempty"`
+}
+
+type CreateRelationsArgs struct {
+	Relations []CreateRelationArgs `json:"relations"`
+}
+
+// RelationResult reports the outcome of one edge in a bulk create
+type RelationResult struct {
+	Index  int    `json:"index"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
 }
 
 type CreateRelationArgs struct {
@@ -1,11 +1,19 @@
 package main
 
 import (
+	"bytes"
 	"container/heap"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"math"
+	"math/rand"
 	"reflect"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -137,6 +145,467 @@ func TestStoreValidation(t *testing.T) {
 	}
 }
 
+// Test each importance overflow mode with an out-of-range importance
+func TestImportanceOverflow(t *testing.T) {
+	tests := []struct {
+		mode    string
+		want    float32
+		wantErr bool
+	}{
+		{mode: "clamp", want: 1},
+		{mode: "default", want: 0.5},
+		{mode: "reject", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			config := DefaultConfig()
+			config.MaxMemories = 10
+			config.ImportanceOverflow = tt.mode
+			store := NewMemoryStoreWithConfig(config)
+			defer store.Shutdown()
+			server := &MCPServer{store: store}
+
+			memory := &Memory{ID: "direct", Type: ShortTerm, Content: "Direct store", Importance: 1.5}
+			err := store.Store(memory)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Store() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && memory.Importance != tt.want {
+				t.Errorf("Store() importance = %f, want %f", memory.Importance, tt.want)
+			}
+
+			stored, err := server.StoreMemory(context.Background(), StoreMemoryArgs{Type: ShortTerm, Content: "Tool store", Importance: 1.5})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("StoreMemory() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && stored.Importance != tt.want {
+				t.Errorf("StoreMemory() importance = %f, want %f", stored.Importance, tt.want)
+			}
+		})
+	}
+}
+
+// Test that evictions are recorded in the removal event buffer
+func TestRemovalEvents(t *testing.T) {
+	store := NewMemoryStore(2)
+	defer store.Shutdown()
+
+	store.Store(&Memory{ID: "weak", Type: ShortTerm, Content: "Weak memory", Importance: 0.2})
+	store.Store(&Memory{ID: "strong", Type: ShortTerm, Content: "Strong memory", Importance: 0.9})
+	store.Store(&Memory{ID: "new", Type: ShortTerm, Content: "New memory", Importance: 0.5})
+
+	events := store.RemovalEvents()
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 removal event, got %d", len(events))
+	}
+	if events[0].ID != "weak" || events[0].Reason != RemovalEvicted || events[0].Importance != 0.2 {
+		t.Errorf("Unexpected removal event: %+v", events[0])
+	}
+
+	// The buffer keeps only the most recent events, newest first
+	for i := 0; i < maxRemovalEvents+5; i++ {
+		store.Store(&Memory{ID: fmt.Sprintf("filler-%d", i), Type: ShortTerm, Content: "Filler", Importance: 0.1})
+	}
+	events = store.RemovalEvents()
+	if len(events) != maxRemovalEvents {
+		t.Fatalf("Expected %d events, got %d", maxRemovalEvents, len(events))
+	}
+	// Each filler evicts the previous one, so the newest event is the second-to-last filler
+	if want := fmt.Sprintf("filler-%d", maxRemovalEvents+3); events[0].ID != want {
+		t.Errorf("Expected newest event for %s, got %s", want, events[0].ID)
+	}
+	if events[len(events)-1].ID == "weak" {
+		t.Error("Oldest event should have been overwritten")
+	}
+}
+
+// Test evict and reject behavior when storing into a full store
+func TestOnFull(t *testing.T) {
+	for _, mode := range []string{"evict", "reject"} {
+		t.Run(mode, func(t *testing.T) {
+			config := DefaultConfig()
+			config.MaxMemories = 2
+			config.OnFull = mode
+			store := NewMemoryStoreWithConfig(config)
+			defer store.Shutdown()
+
+			store.Store(&Memory{ID: "a", Type: ShortTerm, Content: "First", Importance: 0.3})
+			store.Store(&Memory{ID: "b", Type: ShortTerm, Content: "Second", Importance: 0.6})
+
+			err := store.Store(&Memory{ID: "c", Type: ShortTerm, Content: "Third", Importance: 0.9})
+			_, storedA := store.memories["a"]
+			_, storedC := store.memories["c"]
+
+			if mode == "reject" {
+				if !errors.Is(err, ErrStoreFull) {
+					t.Errorf("Expected ErrStoreFull, got %v", err)
+				}
+				if !storedA || storedC {
+					t.Error("Expected existing memories kept and new memory rejected")
+				}
+				if _, err := store.Reconfigure(RuntimeSettings{MaxMemories: 1}); err == nil {
+					t.Error("Expected error lowering capacity below stored count")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Errorf("Expected eviction to make room, got %v", err)
+			}
+			if storedA || !storedC {
+				t.Error("Expected least important memory evicted and new memory stored")
+			}
+		})
+	}
+}
+
+// Test that the capacity warning fires once per crossing of the threshold
+func TestCapacityWarning(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxMemories = 10
+	config.CapacityWarning = 0.5
+	store := NewMemoryStoreWithConfig(config)
+	defer store.Shutdown()
+
+	storeN := func(prefix string, n int) {
+		for i := 0; i < n; i++ {
+			mem := &Memory{ID: fmt.Sprintf("%s-%d", prefix, i), Type: ShortTerm, Content: "Filler memory", Importance: 0.5}
+			if err := store.Store(mem); err != nil {
+				t.Fatalf("Failed to store memory: %v", err)
+			}
+		}
+	}
+
+	storeN("below", 4)
+	if store.capacityWarnings != 0 {
+		t.Fatalf("Expected no warning below the threshold, got %d", store.capacityWarnings)
+	}
+
+	storeN("above", 6) // crosses at 5 of 10 and stays above, including evictions at capacity
+	storeN("evict", 3)
+	if store.capacityWarnings != 1 || !store.capacityWarningActive {
+		t.Fatalf("Expected exactly one active warning, got %d (active %v)", store.capacityWarnings, store.capacityWarningActive)
+	}
+
+	// Raising capacity drops usage below the threshold and re-arms the warning
+	if _, err := store.Reconfigure(RuntimeSettings{MaxMemories: 40}); err != nil {
+		t.Fatalf("Reconfigure failed: %v", err)
+	}
+	if store.capacityWarningActive {
+		t.Error("Expected the warning to clear below the threshold")
+	}
+
+	storeN("again", 10)
+	if store.capacityWarnings != 2 {
+		t.Errorf("Expected a second warning after re-crossing, got %d", store.capacityWarnings)
+	}
+}
+
+// Test that a per-type cap evicts only within that type
+func TestTypeCapacity(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxMemories = 100
+	if err := parseTypeCapacities("short_term=3", config); err != nil {
+		t.Fatalf("Failed to parse type capacity: %v", err)
+	}
+	store := NewMemoryStoreWithConfig(config)
+	defer store.Shutdown()
+
+	for i := 0; i < 3; i++ {
+		mem := &Memory{ID: fmt.Sprintf("long-%d", i), Type: LongTerm, Content: "Durable knowledge", Importance: 0.1}
+		if err := store.Store(mem); err != nil {
+			t.Fatalf("Failed to store memory: %v", err)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		mem := &Memory{ID: fmt.Sprintf("short-%d", i), Type: ShortTerm, Content: "Chatter", Importance: 0.2 + float32(i)*0.1}
+		if err := store.Store(mem); err != nil {
+			t.Fatalf("Failed to store memory: %v", err)
+		}
+	}
+
+	if n := len(store.typeIndex[ShortTerm]); n != 3 {
+		t.Errorf("Expected short_term capped at 3, got %d", n)
+	}
+	// The long-term memories are the least important overall but another type's cap must not touch them
+	if n := len(store.typeIndex[LongTerm]); n != 3 {
+		t.Errorf("Expected all 3 long_term memories kept, got %d", n)
+	}
+	for _, id := range []string{"short-0", "short-1"} {
+		if _, ok := store.memories[id]; ok {
+			t.Errorf("Expected least important short_term memory %s evicted", id)
+		}
+	}
+
+	config = DefaultConfig()
+	if err := parseTypeCapacities("forever=3", config); err != nil {
+		t.Fatalf("Failed to parse type capacity: %v", err)
+	}
+	if err := config.Validate(); err == nil {
+		t.Error("Expected an unknown memory type cap to fail validation")
+	}
+	if err := parseTypeCapacities("short_term", config); err == nil {
+		t.Error("Expected a cap without a limit to fail parsing")
+	}
+}
+
+// Test that a reject-policy type refuses writes at its cap and is never evicted, while other types evict
+func TestTypePolicy(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxMemories = 6
+	config.OnFull = "reject"
+	if err := parseTypeCapacities("semantic=2,short_term=2", config); err != nil {
+		t.Fatalf("Failed to parse type capacity: %v", err)
+	}
+	if err := parseTypePolicies("semantic=reject,short_term=evict", config); err != nil {
+		t.Fatalf("Failed to parse type policy: %v", err)
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Expected a valid configuration, got %v", err)
+	}
+	store := NewMemoryStoreWithConfig(config)
+	defer store.Shutdown()
+
+	for i := 0; i < 2; i++ {
+		if err := store.Store(&Memory{ID: fmt.Sprintf("fact-%d", i), Type: Semantic, Content: fmt.Sprintf("Curated fact %d", i), Importance: 0.1}); err != nil {
+			t.Fatalf("Failed to store memory: %v", err)
+		}
+	}
+	err := store.Store(&Memory{ID: "fact-2", Type: Semantic, Content: "One fact too many", Importance: 0.9})
+	if !errors.Is(err, ErrCapacity) {
+		t.Errorf("Expected a capacity error for a full reject-policy type, got %v", err)
+	}
+
+	// short_term evicts within itself despite --on-full reject
+	for i := 0; i < 4; i++ {
+		if err := store.Store(&Memory{ID: fmt.Sprintf("note-%d", i), Type: ShortTerm, Content: fmt.Sprintf("Note %d", i), Importance: 0.5}); err != nil {
+			t.Fatalf("Expected short_term to evict at its cap, got %v", err)
+		}
+	}
+	if n := len(store.typeIndex[ShortTerm]); n != 2 {
+		t.Errorf("Expected short_term capped at 2, got %d", n)
+	}
+
+	// Global eviction skips the curated facts even though they are the least important
+	store.mu.Lock()
+	store.rejectWhenFull = false
+	store.mu.Unlock()
+	for i := 0; i < 3; i++ {
+		if err := store.Store(&Memory{ID: fmt.Sprintf("event-%d", i), Type: Episodic, Content: fmt.Sprintf("Event %d", i), Importance: 0.5}); err != nil {
+			t.Fatalf("Failed to store memory: %v", err)
+		}
+	}
+	for _, id := range []string{"fact-0", "fact-1"} {
+		if _, ok := store.memories[id]; !ok {
+			t.Errorf("Expected reject-policy memory %s never evicted", id)
+		}
+	}
+
+	config = DefaultConfig()
+	if err := parseTypePolicies("semantic=keep", config); err != nil {
+		t.Fatalf("Failed to parse type policy: %v", err)
+	}
+	if err := config.Validate(); err == nil {
+		t.Error("Expected an unknown policy to fail validation")
+	}
+}
+
+// Test that eviction among equally important memories is deterministic
+func TestEvictionTieBreak(t *testing.T) {
+	store := NewMemoryStore(4)
+	defer store.Shutdown()
+
+	now := time.Now()
+	memories := []*Memory{
+		{ID: "recent", LastAccess: now, AccessCount: 1},
+		{ID: "old-busy", LastAccess: now.Add(-time.Hour), AccessCount: 5},
+		{ID: "old-b", LastAccess: now.Add(-time.Hour), AccessCount: 2},
+		{ID: "old-a", LastAccess: now.Add(-time.Hour), AccessCount: 2},
+	}
+	for _, m := range memories {
+		m.Type = ShortTerm
+		m.Content = "Equal memory " + m.ID
+		m.Importance = 0.5
+		store.Store(m)
+	}
+
+	// Oldest access, then fewest accesses, then lowest ID
+	for _, want := range []string{"old-a", "old-b", "old-busy", "recent"} {
+		store.mu.Lock()
+		store.evictLeastImportant()
+		_, exists := store.memories[want]
+		store.mu.Unlock()
+		if exists {
+			t.Fatalf("Expected %s to be evicted next", want)
+		}
+	}
+}
+
+// Test that importance weighting can reorder close similarity results
+func TestImportanceWeightedSimilarity(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+
+	store.Store(&Memory{ID: "trivial", Type: ShortTerm, Content: "Closest match", Embedding: []float32{1, 0.1, 0}, Importance: 0.1})
+	store.Store(&Memory{ID: "critical", Type: ShortTerm, Content: "Near match", Embedding: []float32{1, 0.3, 0}, Importance: 0.9})
+
+	query := []float32{1, 0, 0}
+	pure, err := store.Query(QueryCriteria{Type: "similarity", Embedding: query, Limit: 2})
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if pure[0].ID != "trivial" {
+		t.Errorf("Expected pure similarity to rank trivial first, got %s", pure[0].ID)
+	}
+
+	weighted, err := store.Query(QueryCriteria{Type: "similarity", Embedding: query, Limit: 2, ImportanceWeight: 0.3})
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if weighted[0].ID != "critical" {
+		t.Errorf("Expected importance weighting to rank critical first, got %s", weighted[0].ID)
+	}
+
+	if _, err := store.Query(QueryCriteria{Type: "similarity", Embedding: query, ImportanceWeight: 1.5}); err == nil {
+		t.Error("Expected error for importance weight above 1")
+	}
+
+	// Dot and euclidean scores are not on importance's scale
+	for _, metric := range []SimilarityMetric{MetricDot, MetricEuclidean} {
+		config := DefaultConfig()
+		config.MaxMemories = 10
+		config.SimilarityMetric = string(metric)
+		other := NewMemoryStoreWithConfig(config)
+		other.Store(&Memory{ID: "m", Type: ShortTerm, Content: "Vector", Embedding: []float32{1, 0, 0}, Importance: 0.5})
+		if _, err := other.Query(QueryCriteria{Type: "similarity", Embedding: query, ImportanceWeight: 0.3}); !errors.Is(err, ErrValidation) {
+			t.Errorf("Expected a validation error weighting %s scores, got %v", metric, err)
+		}
+		if results, err := other.Query(QueryCriteria{Type: "similarity", Embedding: query}); err != nil || len(results) != 1 {
+			t.Errorf("Expected unweighted %s queries to work, got %d results and %v", metric, len(results), err)
+		}
+		other.Shutdown()
+	}
+}
+
+// Test that only notable access counts are recorded in history
+func TestIsAccessMilestone(t *testing.T) {
+	for count, want := range map[int]bool{1: true, 2: false, 10: true, 11: false, 100: true, 110: false, 1000: true, 0: false} {
+		if got := isAccessMilestone(count); got != want {
+			t.Errorf("isAccessMilestone(%d) = %v, want %v", count, got, want)
+		}
+	}
+}
+
+// Test round-tripping a large store through JSON Lines export and import
+func TestJSONLRoundTrip(t *testing.T) {
+	const count = 10000
+	source := NewMemoryStore(count)
+	defer source.Shutdown()
+
+	for i := 0; i < count; i++ {
+		source.Store(&Memory{
+			ID:         fmt.Sprintf("mem-%05d", i),
+			Type:       Semantic,
+			Content:    fmt.Sprintf("Fact number %d", i),
+			Embedding:  []float32{float32(i), 1},
+			Metadata:   map[string]interface{}{"tags": []string{"bulk"}},
+			Importance: 0.5,
+		})
+	}
+
+	var buf bytes.Buffer
+	exported, err := source.ExportJSONL(&buf)
+	if err != nil || exported != count {
+		t.Fatalf("ExportJSONL = %d, %v; want %d", exported, err, count)
+	}
+	if lines := bytes.Count(buf.Bytes(), []byte("\n")); lines != count {
+		t.Fatalf("Expected %d lines, got %d", count, lines)
+	}
+
+	target := NewMemoryStore(count)
+	defer target.Shutdown()
+	imported, err := target.ImportJSONL(&buf)
+	if err != nil || imported != count {
+		t.Fatalf("ImportJSONL = %d, %v; want %d", imported, err, count)
+	}
+
+	mem := target.memories["mem-01234"]
+	if mem == nil || mem.Content != "Fact number 1234" || len(mem.Embedding) != 2 {
+		t.Fatalf("Round-tripped memory mismatch: %+v", mem)
+	}
+	if results := target.Search("bulk", 5); len(results) != 5 {
+		t.Errorf("Expected imported memories to be indexed, got %d search results", len(results))
+	}
+
+	// Import stops at the first bad line, keeping what came before
+	bad := strings.NewReader(`{"id":"ok","type":"semantic","content":"Fine","importance":0.5}` + "\nnot json\n")
+	partial := NewMemoryStore(10)
+	defer partial.Shutdown()
+	if n, err := partial.ImportJSONL(bad); err == nil || n != 1 {
+		t.Errorf("Expected 1 import before a line 2 error, got %d, %v", n, err)
+	}
+
+	// A missing or unknown type is a validation error, not a crash
+	for _, line := range []string{
+		`{"id":"untyped","content":"No type","importance":0.5}`,
+		`{"id":"mistyped","type":"forever","content":"Unknown type","importance":0.5}`,
+	} {
+		if n, err := partial.ImportJSONL(strings.NewReader(line)); !errors.Is(err, ErrValidation) || n != 0 {
+			t.Errorf("Expected a validation error importing %s, got %d, %v", line, n, err)
+		}
+	}
+}
+
+// cancelAfterContext reports cancellation once Err has been checked a set number of times
+type cancelAfterContext struct {
+	context.Context
+	checks int
+}
+
+func (c *cancelAfterContext) Err() error {
+	c.checks--
+	if c.checks < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+// Test that a similarity scan stops when its context is cancelled mid-scan
+func TestSimilarityScanCancellation(t *testing.T) {
+	const count = 5 * similarityCancelCheckInterval
+	store := NewMemoryStore(count)
+	defer store.Shutdown()
+
+	for i := 0; i < count; i++ {
+		store.Store(&Memory{
+			ID:         fmt.Sprintf("vec-%d", i),
+			Type:       ShortTerm,
+			Content:    fmt.Sprintf("Memory %d", i),
+			Embedding:  []float32{rand.Float32(), rand.Float32(), rand.Float32()},
+			Importance: 0.5,
+		})
+	}
+	query := []float32{1, 0, 0}
+
+	// Cancelled after two checks, i.e. partway through the scan
+	ctx := &cancelAfterContext{Context: context.Background(), checks: 2}
+	results, err := store.findSimilarContext(ctx, query, 10)
+	if !errors.Is(err, context.Canceled) || results != nil {
+		t.Errorf("Expected cancellation with no results, got %d results and %v", len(results), err)
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := store.QueryContext(cancelled, QueryCriteria{Type: "similarity", Embedding: query}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected QueryContext to report cancellation, got %v", err)
+	}
+
+	if results, err := store.findSimilarContext(context.Background(), query, 10); err != nil || len(results) != 10 {
+		t.Errorf("Expected 10 results without cancellation, got %d and %v", len(results), err)
+	}
+}
+
 // Test duplicate ID handling
 func TestStoreDuplicateID(t *testing.T) {
 	store := NewMemoryStore(10)
@@ -275,6 +744,31 @@ func TestKeywordSearchCaseInsensitive(t *testing.T) {
 	}
 }
 
+// Test that keyword removal uses the indexed word set even if content changed
+func TestKeywordIndexSymmetricRemoval(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+
+	memory := &Memory{ID: "kw", Type: ShortTerm, Content: "Alpha beta alpha ALPHA gamma", Importance: 0.5}
+	if err := store.Store(memory); err != nil {
+		t.Fatalf("Failed to store memory: %v", err)
+	}
+
+	if !reflect.DeepEqual(memory.keywords, []string{"alpha", "beta", "gamma"}) {
+		t.Errorf("Expected deduplicated keywords, got %v", memory.keywords)
+	}
+
+	// Content mutated behind the index's back must not leave stale keys
+	memory.Content = "Completely different text"
+	store.removeFromKeywordIndex(memory)
+
+	store.keywordIndex.mu.RLock()
+	defer store.keywordIndex.mu.RUnlock()
+	if len(store.keywordIndex.index) != 0 {
+		t.Errorf("Expected empty keyword index, got %d keys", len(store.keywordIndex.index))
+	}
+}
+
 // Test memory removal and index cleanup
 func TestMemoryRemoval(t *testing.T) {
 	store := NewMemoryStore(10)
@@ -466,6 +960,75 @@ func TestTimeIndexing(t *testing.T) {
 	}
 }
 
+// Test that memories exactly on a temporal query's bounds are included
+func TestTemporalBoundariesInclusive(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	end := start.Add(30 * time.Minute)
+	for id, timestamp := range map[string]time.Time{
+		"at-start": start,
+		"inside":   start.Add(time.Minute),
+		"at-end":   end,
+		"before":   start.Add(-time.Nanosecond),
+		"after":    end.Add(time.Nanosecond),
+	} {
+		store.Store(&Memory{ID: id, Type: Episodic, Content: "Event " + id, Importance: 0.5, Timestamp: timestamp, LastAccess: timestamp})
+	}
+
+	results, err := store.Query(QueryCriteria{Type: "temporal", StartTime: start, EndTime: end, Limit: 10})
+	if err != nil {
+		t.Fatalf("Temporal query failed: %v", err)
+	}
+	ids := make([]string, len(results))
+	for i, mem := range results {
+		ids[i] = mem.ID
+	}
+	slices.Sort(ids)
+	if !slices.Equal(ids, []string{"at-end", "at-start", "inside"}) {
+		t.Errorf("Expected memories on and between the bounds, got %v", ids)
+	}
+
+	// A range of a single instant still finds the memory stored at it
+	if results := store.findTemporal(start, start); len(results) != 1 || results[0].ID != "at-start" {
+		t.Errorf("Expected at-start for an empty range at its timestamp, got %v", results)
+	}
+}
+
+// Test that temporal queries find memories whatever time zones timestamps and bounds carry
+func TestTemporalTimeZones(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+
+	newYork := time.FixedZone("EST", -5*60*60)
+	tokyo := time.FixedZone("JST", 9*60*60)
+	stored := time.Now().Add(-2 * time.Hour).Truncate(time.Second).In(newYork)
+	store.Store(&Memory{ID: "local", Type: Episodic, Content: "Stored with a local time", Importance: 0.5, Timestamp: stored, LastAccess: stored})
+
+	for name, zone := range map[string]*time.Location{"UTC": time.UTC, "JST": tokyo, "EST": newYork} {
+		start, end := stored.Add(-time.Minute).In(zone), stored.Add(time.Minute).In(zone)
+		results, err := store.Query(QueryCriteria{Type: "temporal", StartTime: start, EndTime: end})
+		if err != nil {
+			t.Fatalf("Temporal query failed: %v", err)
+		}
+		if len(results) != 1 || results[0].ID != "local" {
+			t.Errorf("Expected the memory for %s bounds, got %d results", name, len(results))
+		}
+	}
+
+	store.mu.Lock()
+	store.removeMemory("local")
+	store.mu.Unlock()
+	store.timeIndex.mu.RLock()
+	defer store.timeIndex.mu.RUnlock()
+	for bucket, memories := range store.timeIndex.buckets {
+		if len(memories) > 0 {
+			t.Errorf("Expected removal to clear the memory's UTC bucket, %s still holds %d", bucket, len(memories))
+		}
+	}
+}
+
 // Test memory type filtering
 func TestMemoryTypeFiltering(t *testing.T) {
 	store := NewMemoryStore(10)
@@ -498,6 +1061,47 @@ func TestMemoryTypeFiltering(t *testing.T) {
 	}
 }
 
+// Test that memory_types unions several type buckets under one limit
+func TestQueryMultipleTypes(t *testing.T) {
+	store := NewMemoryStore(20)
+	defer store.Shutdown()
+
+	types := []MemoryType{Semantic, Procedural, Episodic}
+	for i := 0; i < 9; i++ {
+		memory := &Memory{
+			ID:         fmt.Sprintf("multi-%d", i),
+			Type:       types[i%len(types)],
+			Content:    fmt.Sprintf("Memory %d", i),
+			Importance: float32(i+1) / 10,
+		}
+		if err := store.Store(memory); err != nil {
+			t.Fatalf("Failed to store memory: %v", err)
+		}
+	}
+
+	results, err := store.Query(QueryCriteria{
+		Type:        "type",
+		MemoryTypes: []MemoryType{Semantic, Procedural, Semantic},
+		Limit:       4,
+	})
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	ids := make([]string, len(results))
+	for i, mem := range results {
+		ids[i] = mem.ID
+	}
+	// Semantic holds 0,3,6 and procedural 1,4,7; importance rises with the index
+	expected := []string{"multi-7", "multi-6", "multi-4", "multi-3"}
+	if !reflect.DeepEqual(ids, expected) {
+		t.Errorf("Expected %v, got %v", expected, ids)
+	}
+
+	if _, err := store.Query(QueryCriteria{Type: "type", MemoryTypes: []MemoryType{"bogus"}}); !errors.Is(err, ErrValidation) {
+		t.Errorf("Expected validation error for unknown type, got %v", err)
+	}
+}
+
 // Test extractWords function
 func TestExtractWords(t *testing.T) {
 	tests := []struct {
@@ -536,19 +1140,58 @@ func TestExtractWords(t *testing.T) {
 	}
 }
 
-// Test vector normalization
-func TestNormalizeVector(t *testing.T) {
-	tests := []struct {
-		name     string
-		input    []float32
-		expected []float32
-	}{
-		{
-			name:     "unit vector",
-			input:    []float32{1, 0, 0},
-			expected: []float32{1, 0, 0},
-		},
-		{
+// Test that identifier mode keeps dotted and underscored names whole
+func TestIdentifierTokens(t *testing.T) {
+	words := extractIdentifierWords("Set user_id in config.yaml for v1.2.3. Then -restart_ the end-to-end run...")
+	expected := []string{"Set", "user_id", "in", "config.yaml", "for", "v1.2.3", "Then", "restart", "the", "end-to-end", "run"}
+	if !reflect.DeepEqual(words, expected) {
+		t.Errorf("extractIdentifierWords() = %v, want %v", words, expected)
+	}
+
+	config := DefaultConfig()
+	config.IdentifierTokens = true
+	store := NewMemoryStoreWithConfig(config)
+	defer store.Shutdown()
+
+	if err := store.Store(&Memory{ID: "cfg", Type: Semantic, Content: "The user_id column is set in config.yaml", Importance: 0.5}); err != nil {
+		t.Fatalf("Failed to store memory: %v", err)
+	}
+
+	for _, keyword := range []string{"user_id", "config.yaml"} {
+		results, err := store.Query(QueryCriteria{Type: "keywords", Keywords: []string{keyword}})
+		if err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+		if len(results) != 1 {
+			t.Errorf("Expected %q to find the memory, got %d results", keyword, len(results))
+		}
+	}
+
+	// The parts are no longer separate keywords
+	results, _ := store.Query(QueryCriteria{Type: "keywords", Keywords: []string{"yaml"}})
+	if len(results) != 0 {
+		t.Errorf("Expected yaml alone not to match in identifier mode, got %d results", len(results))
+	}
+
+	snippet := makeSnippet("The user_id column", []string{"user_id"}, 100, true)
+	if !strings.Contains(snippet, "**user_id**") {
+		t.Errorf("Expected snippet to highlight the identifier, got %q", snippet)
+	}
+}
+
+// Test vector normalization
+func TestNormalizeVector(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    []float32
+		expected []float32
+	}{
+		{
+			name:     "unit vector",
+			input:    []float32{1, 0, 0},
+			expected: []float32{1, 0, 0},
+		},
+		{
 			name:     "non-unit vector",
 			input:    []float32{3, 4, 0},
 			expected: []float32{0.6, 0.8, 0},
@@ -572,6 +1215,39 @@ func TestNormalizeVector(t *testing.T) {
 	}
 }
 
+// Test that normalization copies vectors that are already unit length
+// without dividing them again, and that a batch scores repeated queries once
+func TestNormalizationNotRepeated(t *testing.T) {
+	unit := normalizeVector([]float32{3, 4, 0})
+	again := normalizeVector(unit)
+	if !slices.Equal(again, unit) {
+		t.Errorf("Expected an already normalized vector unchanged, got %v", again)
+	}
+	again[0] = 0
+	if unit[0] == 0 {
+		t.Error("Expected a copy that doesn't share the caller's vector")
+	}
+	allocs := testing.AllocsPerRun(100, func() { normalizeVector(unit) })
+	if allocs != 1 {
+		t.Errorf("Expected only the copy's allocation normalizing a unit vector, got %v", allocs)
+	}
+
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+	for i, emb := range [][]float32{{1, 0}, {0, 1}, {0.7, 0.7}} {
+		store.Store(&Memory{ID: fmt.Sprintf("v%d", i), Type: Semantic, Content: "Vector", Embedding: emb, Importance: 0.5})
+	}
+
+	query := []float32{1, 0.1}
+	results := store.findSimilarBatch([][]float32{query, {0, 1}, query}, 2)
+	if !reflect.DeepEqual(results[0], results[2]) {
+		t.Errorf("Expected repeated queries to get the same results, got %v and %v", results[0], results[2])
+	}
+	if &results[0][0] == &results[2][0] {
+		t.Error("Expected repeated queries to get separate result slices")
+	}
+}
+
 // Helper function for float comparison
 func floatEquals(a, b, epsilon float32) bool {
 	diff := a - b
@@ -609,6 +1285,104 @@ func TestGracefulShutdown(t *testing.T) {
 	}
 }
 
+// Test that calling Shutdown more than once is a safe no-op
+func TestShutdownTwice(t *testing.T) {
+	store := NewMemoryStore(10)
+
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Second Shutdown panicked: %v", r)
+		}
+	}()
+
+	store.Shutdown()
+	store.Shutdown()
+
+	if err := store.ShutdownWithTimeout(time.Second); err != nil {
+		t.Errorf("Repeated shutdown returned error: %v", err)
+	}
+}
+
+// Test that shutdown waits for in-flight requests and rejects new ones
+func TestShutdownDrainsInFlightRequests(t *testing.T) {
+	store := NewMemoryStore(10)
+	server := &MCPServer{store: store}
+
+	if err := store.beginRequest(); err != nil {
+		t.Fatalf("beginRequest failed: %v", err)
+	}
+
+	const handlerDuration = 100 * time.Millisecond
+	handlerDone := make(chan struct{})
+	go func() {
+		time.Sleep(handlerDuration)
+		close(handlerDone)
+		store.endRequest()
+	}()
+
+	start := time.Now()
+	if err := store.ShutdownWithTimeout(2 * time.Second); err != nil {
+		t.Fatalf("Shutdown returned error: %v", err)
+	}
+
+	select {
+	case <-handlerDone:
+	default:
+		t.Fatal("Shutdown returned before the in-flight handler finished")
+	}
+	if elapsed := time.Since(start); elapsed < handlerDuration/2 {
+		t.Errorf("Shutdown did not wait for handler, took %v", elapsed)
+	}
+
+	params := json.RawMessage(`{"name": "get_stats", "arguments": {}}`)
+	response := server.handleMessage(MCPMessage{Jsonrpc: "2.0", ID: 1, Method: "tools/call", Params: params})
+	if response.Error == nil || response.Error.Message != ErrShuttingDown.Error() {
+		t.Errorf("Expected shutting down error, got %+v", response.Error)
+	}
+}
+
+// Test that health reports ready on a fresh store and not ready after shutdown
+func TestHealth(t *testing.T) {
+	store := NewMemoryStore(10)
+	server := &MCPServer{store: store}
+
+	health := store.Health()
+	if !health.Live || !health.Ready || health.ShuttingDown {
+		t.Fatalf("Expected a fresh store to be live and ready, got %+v", health)
+	}
+
+	store.Shutdown()
+
+	health = store.Health()
+	if !health.Live {
+		t.Error("Expected the store to stay live after shutdown")
+	}
+	if health.Ready || !health.ShuttingDown {
+		t.Errorf("Expected a shut down store to be not ready, got %+v", health)
+	}
+
+	// The tool must still answer once other calls are refused
+	params := json.RawMessage(`{"name": "health", "arguments": {}}`)
+	response := server.handleMessage(MCPMessage{Jsonrpc: "2.0", ID: 1, Method: "tools/call", Params: params})
+	if response.Error != nil {
+		t.Fatalf("Expected health to answer during shutdown, got %+v", response.Error)
+	}
+	text := response.Result.(map[string]interface{})["content"].([]map[string]interface{})[0]["text"].(string)
+	if !strings.Contains(text, `"ready": false`) {
+		t.Errorf("Expected health result to report not ready, got %s", text)
+	}
+
+	config := DefaultConfig()
+	config.MaxMemories = 1
+	config.OnFull = "reject"
+	full := NewMemoryStoreWithConfig(config)
+	defer full.Shutdown()
+	full.Store(&Memory{ID: "only", Type: ShortTerm, Content: "fills the store", Importance: 0.5})
+	if health := full.Health(); health.Ready {
+		t.Errorf("Expected a full rejecting store to be not ready, got %+v", health)
+	}
+}
+
 // Test memory access count updates
 func TestAccessCountUpdate(t *testing.T) {
 	store := NewMemoryStore(10)
@@ -648,6 +1422,294 @@ func TestAccessCountUpdate(t *testing.T) {
 	}
 }
 
+// Test that touching a memory records an access without a query
+func TestTouch(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+
+	past := time.Now().Add(-time.Hour)
+	memory := &Memory{ID: "touched", Type: ShortTerm, Content: "Keep me around", Importance: 0.5, LastAccess: past}
+	if err := store.Store(memory); err != nil {
+		t.Fatalf("Failed to store memory: %v", err)
+	}
+
+	if err := store.Touch("touched"); err != nil {
+		t.Fatalf("Touch failed: %v", err)
+	}
+	if memory.AccessCount != 1 {
+		t.Errorf("Expected access count 1, got %d", memory.AccessCount)
+	}
+	if !memory.LastAccess.After(past) {
+		t.Errorf("Expected last access to move forward from %v, got %v", past, memory.LastAccess)
+	}
+
+	if err := store.Touch("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected not found error for unknown ID, got %v", err)
+	}
+}
+
+// Test that read-only mode rejects writes while queries keep working
+func TestReadOnlyMode(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+	server := &MCPServer{store: store}
+
+	old := time.Now().Add(-24 * time.Hour)
+	store.Store(&Memory{ID: "frozen", Type: ShortTerm, Content: "Snapshot of the deploy plan", Importance: 0.5, Decay: 0.1, LastAccess: old})
+	store.Store(&Memory{ID: "other", Type: Semantic, Content: "Deploys happen on Tuesday", Importance: 0.5})
+	server.CreateRelation(context.Background(), CreateRelationArgs{FromID: "frozen", ToID: "other", RelationType: "relates_to", Strength: 0.5})
+	store.SetReadOnly(true)
+
+	for name, err := range map[string]error{
+		"store":           store.Store(&Memory{ID: "new", Type: Semantic, Content: "Rejected", Importance: 0.5}),
+		"upsert":          store.Upsert(&Memory{ID: "frozen", Type: ShortTerm, Content: "Changed", Importance: 0.5}),
+		"touch":           store.Touch("frozen"),
+		"set_embedding":   store.SetEmbedding("frozen", []float32{1, 0}),
+		"create_relation": server.CreateRelation(context.Background(), CreateRelationArgs{FromID: "other", ToID: "frozen", RelationType: "relates_to"}),
+		"delete_relation": server.DeleteRelation(context.Background(), DeleteRelationArgs{FromID: "frozen", ToID: "other"}),
+	} {
+		if !errors.Is(err, ErrReadOnly) {
+			t.Errorf("Expected %s to be rejected as read-only, got %v", name, err)
+		}
+	}
+	if _, err := store.ChangeType("frozen", LongTerm, nil, "promoted"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expected change type to be rejected as read-only, got %v", err)
+	}
+
+	response := server.handleMessage(MCPMessage{Jsonrpc: "2.0", ID: 1, Method: "tools/call",
+		Params: json.RawMessage(`{"name": "store_memory", "arguments": {"content": "Rejected over MCP", "type": "semantic"}}`)})
+	if response.Error == nil || response.Error.Code != errCodeReadOnly {
+		t.Errorf("Expected read-only error code over MCP, got %+v", response.Error)
+	}
+
+	// Background processes leave the snapshot alone
+	store.applyDecay()
+	store.consolidateMemories()
+	if mem := store.memories["frozen"]; mem == nil || mem.Importance != 0.5 || mem.Type != ShortTerm {
+		t.Errorf("Expected the frozen memory to be untouched by decay and consolidation, got %+v", mem)
+	}
+
+	results, err := store.Query(QueryCriteria{Type: "keyword", Keywords: []string{"deploy"}, Limit: 10})
+	if err != nil || len(results) != 1 || results[0].ID != "frozen" {
+		t.Errorf("Expected queries to work in read-only mode, got %v, %v", results, err)
+	}
+	if relations := store.relations["frozen"]; len(relations) != 1 {
+		t.Errorf("Expected the relation to survive, got %v", relations)
+	}
+	if stats, _ := server.GetStats(context.Background()); stats["read_only"] != true || stats["total_memories"] != 2 {
+		t.Errorf("Expected stats for a read-only store of 2 memories, got %v", stats)
+	}
+
+	config := DefaultConfig()
+	config.ReadOnly = true
+	configured := NewMemoryStoreWithConfig(config)
+	defer configured.Shutdown()
+	if err := configured.Store(&Memory{ID: "new", Type: Semantic, Content: "Rejected", Importance: 0.5}); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expected a store configured read-only to reject writes, got %v", err)
+	}
+}
+
+// Test attaching an embedding after creation, then clearing it
+func TestSetEmbedding(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+	server := &MCPServer{store: store}
+
+	store.Store(&Memory{ID: "embedded", Type: Semantic, Content: "Has an embedding", Importance: 0.5, Embedding: []float32{0, 1}})
+	store.Store(&Memory{ID: "late", Type: Semantic, Content: "Embedded later", Importance: 0.5})
+
+	similar := func() []*Memory {
+		results, err := store.Query(QueryCriteria{Type: "similarity", Embedding: []float32{1, 0}, Limit: 5})
+		if err != nil {
+			t.Fatalf("Similarity query failed: %v", err)
+		}
+		return results
+	}
+	if results := similar(); len(results) != 1 || results[0].ID != "embedded" {
+		t.Fatalf("Expected only the embedded memory before set_embedding, got %v", results)
+	}
+
+	if err := store.SetEmbedding("late", []float32{1, 0, 0}); !errors.Is(err, ErrValidation) {
+		t.Errorf("Expected a validation error for a mismatched dimension, got %v", err)
+	}
+	if err := store.SetEmbedding("missing", []float32{1, 0}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected a not found error, got %v", err)
+	}
+	if _, err := server.SetEmbedding(context.Background(), SetEmbeddingArgs{MemoryID: "late"}); !errors.Is(err, ErrValidation) {
+		t.Errorf("Expected an omitted embedding to be rejected, got %v", err)
+	}
+
+	result, err := server.SetEmbedding(context.Background(), SetEmbeddingArgs{MemoryID: "late", Embedding: []float32{2, 0}})
+	if err != nil {
+		t.Fatalf("SetEmbedding failed: %v", err)
+	}
+	if result["dimension"] != 2 || result["version"] != 2 {
+		t.Errorf("Expected dimension 2 at version 2, got %v", result)
+	}
+	if results := similar(); len(results) != 2 || results[0].ID != "late" {
+		t.Errorf("Expected late to rank first once embedded, got %v", results)
+	}
+
+	if _, err := server.SetEmbedding(context.Background(), SetEmbeddingArgs{MemoryID: "late", Embedding: []float32{}}); err != nil {
+		t.Fatalf("Clearing the embedding failed: %v", err)
+	}
+	if results := similar(); len(results) != 1 || results[0].ID != "embedded" {
+		t.Errorf("Expected late to drop out of similarity results once cleared, got %v", results)
+	}
+}
+
+// recordingListener collects the events a store delivers
+type recordingListener struct {
+	store           *MemoryStore
+	stored          []string
+	queried         [][]string
+	evicted         []RemovalEvent
+	consolidated    []string
+	removalsOnEvict int
+	metadata        map[string]interface{}
+}
+
+func (l *recordingListener) OnStore(memory Memory) {
+	l.stored = append(l.stored, memory.ID)
+	if memory.Metadata != nil {
+		l.metadata = memory.Metadata
+	}
+}
+
+func (l *recordingListener) OnQuery(criteria QueryCriteria, ids []string) {
+	l.queried = append(l.queried, ids)
+}
+
+func (l *recordingListener) OnEvict(event RemovalEvent) {
+	l.evicted = append(l.evicted, event)
+	// Calling back into the store would deadlock if the lock were still held
+	l.removalsOnEvict = len(l.store.RemovalEvents())
+}
+
+func (l *recordingListener) OnConsolidate(memory Memory, from MemoryType) {
+	l.consolidated = append(l.consolidated, memory.ID+":"+string(from)+"->"+string(memory.Type))
+}
+
+// Test that registered listeners see store, query, evict, and consolidate events
+func TestEventListener(t *testing.T) {
+	store := NewMemoryStore(2)
+	defer store.Shutdown()
+	listener := &recordingListener{store: store}
+	store.AddEventListener(listener)
+
+	weak := &Memory{ID: "weak", Type: ShortTerm, Content: "weak event memory", Importance: 0.2,
+		Metadata: map[string]interface{}{"tags": []interface{}{"event"}}}
+	for _, m := range []*Memory{
+		weak,
+		{ID: "strong", Type: ShortTerm, Content: "strong event memory", Importance: 0.9},
+	} {
+		if err := store.Store(m); err != nil {
+			t.Fatalf("Failed to store memory: %v", err)
+		}
+	}
+	if !slices.Equal(listener.stored, []string{"weak", "strong"}) {
+		t.Errorf("Expected store events for weak and strong, got %v", listener.stored)
+	}
+
+	// The delivered memory is a deep copy, unaffected by later changes
+	weak.Metadata["tags"].([]interface{})[0] = "changed"
+	if tags := listener.metadata["tags"].([]interface{}); tags[0] != "event" {
+		t.Errorf("Expected the event snapshot to keep its own metadata, got %v", tags)
+	}
+
+	if _, err := store.Query(QueryCriteria{Type: "keyword", Keywords: []string{"strong"}}); err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if len(listener.queried) != 1 || !slices.Equal(listener.queried[0], []string{"strong"}) {
+		t.Errorf("Expected one query event returning strong, got %v", listener.queried)
+	}
+
+	// A third memory evicts the least important one
+	if err := store.Store(&Memory{ID: "third", Type: LongTerm, Content: "third event memory", Importance: 0.5}); err != nil {
+		t.Fatalf("Failed to store memory: %v", err)
+	}
+	if len(listener.evicted) != 1 || listener.evicted[0].ID != "weak" || listener.evicted[0].Reason != RemovalEvicted {
+		t.Errorf("Expected eviction of weak, got %+v", listener.evicted)
+	}
+	if listener.removalsOnEvict != 1 {
+		t.Errorf("Expected the listener to read 1 removal event, got %d", listener.removalsOnEvict)
+	}
+
+	store.consolidateMemories()
+	if !slices.Equal(listener.consolidated, []string{"strong:short_term->long_term"}) {
+		t.Errorf("Expected strong to be consolidated, got %v", listener.consolidated)
+	}
+}
+
+// Test promoting a memory to long_term and demoting it back
+func TestPromoteDemoteMemory(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+	server := &MCPServer{store: store}
+
+	memory := &Memory{ID: "fact", Type: ShortTerm, Content: "Production database is Postgres", Importance: 0.5, Decay: 0.01}
+	if err := store.Store(memory); err != nil {
+		t.Fatalf("Failed to store memory: %v", err)
+	}
+
+	slower := float32(0.001)
+	promoted, err := server.PromoteMemory(context.Background(), ChangeTypeArgs{MemoryID: "fact", Decay: &slower})
+	if err != nil {
+		t.Fatalf("Promote failed: %v", err)
+	}
+	if promoted.Type != LongTerm || promoted.Decay != slower {
+		t.Errorf("Expected long_term with decay %v, got %s with decay %v", slower, promoted.Type, promoted.Decay)
+	}
+	if _, ok := store.typeIndex[LongTerm]["fact"]; !ok {
+		t.Error("Expected the memory in the long_term index")
+	}
+	if _, ok := store.typeIndex[ShortTerm]["fact"]; ok {
+		t.Error("Expected the memory removed from the short_term index")
+	}
+
+	demoted, err := server.DemoteMemory(context.Background(), ChangeTypeArgs{MemoryID: "fact"})
+	if err != nil {
+		t.Fatalf("Demote failed: %v", err)
+	}
+	if want := memoryTypeGuides[ShortTerm].decay; demoted.Type != ShortTerm || demoted.Decay != want {
+		t.Errorf("Expected short_term with its recommended decay %v, got %s with decay %v", want, demoted.Type, demoted.Decay)
+	}
+	results, _ := store.Query(QueryCriteria{Type: "type", MemoryType: ShortTerm})
+	if len(results) != 1 || results[0].ID != "fact" {
+		t.Errorf("Expected a type query to find the demoted memory, got %d results", len(results))
+	}
+
+	if _, err := server.PromoteMemory(context.Background(), ChangeTypeArgs{MemoryID: "fact", TargetType: "forever"}); !errors.Is(err, ErrValidation) {
+		t.Errorf("Expected validation error for an invalid type, got %v", err)
+	}
+	if _, err := server.DemoteMemory(context.Background(), ChangeTypeArgs{MemoryID: "fact"}); !errors.Is(err, ErrValidation) {
+		t.Errorf("Expected validation error when already the target type, got %v", err)
+	}
+	// Moves must go the way their name says
+	if _, err := server.DemoteMemory(context.Background(), ChangeTypeArgs{MemoryID: "fact", TargetType: LongTerm}); !errors.Is(err, ErrValidation) {
+		t.Errorf("Expected validation error demoting to a longer-lived type, got %v", err)
+	}
+	if _, err := server.PromoteMemory(context.Background(), ChangeTypeArgs{MemoryID: "fact", TargetType: Episodic}); err != nil {
+		t.Fatalf("Promote to episodic failed: %v", err)
+	}
+	if _, err := server.PromoteMemory(context.Background(), ChangeTypeArgs{MemoryID: "fact", TargetType: ShortTerm}); !errors.Is(err, ErrValidation) {
+		t.Errorf("Expected validation error promoting to a shorter-lived type, got %v", err)
+	}
+	if promoted, err := server.PromoteMemory(context.Background(), ChangeTypeArgs{MemoryID: "fact", TargetType: Semantic}); err != nil || promoted.Decay != memoryTypeGuides[Semantic].decay {
+		t.Errorf("Expected promotion to semantic with its recommended decay, got %v", err)
+	}
+	// long_term and semantic share a recommended decay but are still ordered
+	if _, err := server.DemoteMemory(context.Background(), ChangeTypeArgs{MemoryID: "fact", TargetType: LongTerm}); err != nil {
+		t.Errorf("Demote from semantic to long_term failed: %v", err)
+	}
+	if promoted, err := server.PromoteMemory(context.Background(), ChangeTypeArgs{MemoryID: "fact", TargetType: Semantic}); err != nil || promoted.Type != Semantic {
+		t.Errorf("Expected promotion from long_term to semantic, got %v", err)
+	}
+	if _, err := server.PromoteMemory(context.Background(), ChangeTypeArgs{MemoryID: "missing"}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected not found error, got %v", err)
+	}
+}
+
 // Test heap-based similarity search
 func TestSimilaritySearch(t *testing.T) {
 	store := NewMemoryStore(10)
@@ -703,58 +1765,266 @@ func TestSimilaritySearch(t *testing.T) {
 	}
 }
 
-// Test ScoredMemoryHeap implementation
-func TestScoredMemoryHeap(t *testing.T) {
-	h := &ScoredMemoryHeap{}
-	heap.Init(h)
-	
-	// Push items with different scores
-	items := []*ScoredMemory{
-		{Memory: &Memory{ID: "1"}, Score: 0.5},
-		{Memory: &Memory{ID: "2"}, Score: 0.8},
-		{Memory: &Memory{ID: "3"}, Score: 0.3},
-		{Memory: &Memory{ID: "4"}, Score: 0.9},
-		{Memory: &Memory{ID: "5"}, Score: 0.1},
+// Test finding neighbors of a stored memory by its ID
+func TestSimilarToID(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+
+	for _, mem := range []*Memory{
+		{ID: "seed", Type: Semantic, Content: "Seed", Embedding: []float32{1, 0, 0}, Importance: 0.5},
+		{ID: "near", Type: Semantic, Content: "Near", Embedding: []float32{0.9, 0.1, 0}, Importance: 0.5},
+		{ID: "middle", Type: Semantic, Content: "Middle", Embedding: []float32{0.5, 0.5, 0}, Importance: 0.5},
+		{ID: "far", Type: Semantic, Content: "Far", Embedding: []float32{0, 0, 1}, Importance: 0.5},
+		{ID: "plain", Type: Semantic, Content: "No embedding", Importance: 0.5},
+	} {
+		if err := store.Store(mem); err != nil {
+			t.Fatalf("Failed to store memory: %v", err)
+		}
 	}
-	
-	for _, item := range items {
-		heap.Push(h, item)
+
+	results, err := store.Query(QueryCriteria{Type: "similar_to_id", MemoryID: "seed", Limit: 2})
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
 	}
-	
-	// Test that we get items in ascending order (min-heap)
-	expectedOrder := []float32{0.1, 0.3, 0.5, 0.8, 0.9}
-	for _, expectedScore := range expectedOrder {
-		if h.Len() == 0 {
-			t.Fatal("Heap empty too early")
-		}
-		
-		item := heap.Pop(h).(*ScoredMemory)
-		if !floatEquals(item.Score, expectedScore, 0.0001) {
-			t.Errorf("Expected score %f, got %f", expectedScore, item.Score)
-		}
+	ids := make([]string, len(results))
+	for i, mem := range results {
+		ids[i] = mem.ID
 	}
-	
-	if h.Len() != 0 {
-		t.Errorf("Heap should be empty, but has %d items", h.Len())
+	if !reflect.DeepEqual(ids, []string{"near", "middle"}) {
+		t.Errorf("Expected neighbors [near middle] without the seed, got %v", ids)
+	}
+
+	if _, err := store.Query(QueryCriteria{Type: "similar_to_id", MemoryID: "plain"}); !errors.Is(err, ErrValidation) {
+		t.Errorf("Expected validation error for a seed without embedding, got %v", err)
+	}
+	if _, err := store.Query(QueryCriteria{Type: "similar_to_id", MemoryID: "missing"}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected not found error for an unknown seed, got %v", err)
 	}
 }
 
-// Test top-K selection with heap
-func TestTopKSelection(t *testing.T) {
+// Test that similarity queries with keyword or type filters rank only the candidates
+func TestSimilarityOverCandidates(t *testing.T) {
 	store := NewMemoryStore(20)
 	defer store.Shutdown()
-	
-	// Create many memories with embeddings
-	for i := 0; i < 20; i++ {
-		angle := float64(i) * math.Pi / 10.0
-		memory := &Memory{
-			ID:         fmt.Sprintf("vec-%d", i),
-			Type:       ShortTerm,
-			Content:    fmt.Sprintf("Memory %d", i),
-			Embedding:  []float32{float32(math.Cos(angle)), float32(math.Sin(angle)), 0},
-			Importance: 0.5,
-		}
-		if err := store.Store(memory); err != nil {
+
+	for _, mem := range []*Memory{
+		{ID: "go-near", Type: Semantic, Content: "Golang channels", Embedding: []float32{1, 0.1}},
+		{ID: "go-far", Type: Semantic, Content: "Golang modules", Embedding: []float32{0.2, 1}},
+		{ID: "go-episode", Type: Episodic, Content: "Debugged Golang code", Embedding: []float32{1, 0.2}},
+		{ID: "rust-nearest", Type: Semantic, Content: "Rust ownership", Embedding: []float32{1, 0}},
+		{ID: "go-unembedded", Type: Semantic, Content: "Golang generics"},
+	} {
+		mem.Importance = 0.5
+		if err := store.Store(mem); err != nil {
+			t.Fatalf("Failed to store memory: %v", err)
+		}
+	}
+
+	ids := func(criteria QueryCriteria) []string {
+		t.Helper()
+		results, err := store.Query(criteria)
+		if err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+		ids := make([]string, len(results))
+		for i, mem := range results {
+			ids[i] = mem.ID
+		}
+		return ids
+	}
+
+	query := []float32{1, 0}
+	if got := ids(QueryCriteria{Type: "similarity", Embedding: query}); len(got) != 4 || got[0] != "rust-nearest" {
+		t.Errorf("Expected an unfiltered query to rank every embedding, got %v", got)
+	}
+	if got := ids(QueryCriteria{Type: "similarity", Embedding: query, Keywords: []string{"golang"}}); !slices.Equal(got, []string{"go-near", "go-episode", "go-far"}) {
+		t.Errorf("Expected only Go memories ranked by similarity, got %v", got)
+	}
+	if got := ids(QueryCriteria{Type: "similarity", Embedding: query, Keywords: []string{"golang"}, MemoryType: Semantic}); !slices.Equal(got, []string{"go-near", "go-far"}) {
+		t.Errorf("Expected only semantic Go memories, got %v", got)
+	}
+	if got := ids(QueryCriteria{Type: "similarity", Embedding: query, MemoryType: Episodic}); !slices.Equal(got, []string{"go-episode"}) {
+		t.Errorf("Expected only the episodic memory, got %v", got)
+	}
+	if got := ids(QueryCriteria{Type: "similar_to_id", MemoryID: "go-near", Keywords: []string{"golang"}}); !slices.Equal(got, []string{"go-episode", "go-far"}) {
+		t.Errorf("Expected Go neighbors of go-near without the seed, got %v", got)
+	}
+}
+
+// Test that embeddings stored in a burst become searchable once indexing drains
+func TestBackgroundEmbeddingIndexing(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxMemories = 500
+	config.IndexWorkers = 4
+	config.IndexQueueSize = 8 // smaller than the burst, so stores hit backpressure
+	store := NewMemoryStoreWithConfig(config)
+	defer store.Shutdown()
+
+	const count = 200
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < count; i += 4 {
+				embedding := make([]float32, count)
+				embedding[i] = 1
+				mem := &Memory{ID: fmt.Sprintf("m%d", i), Type: Semantic, Content: "burst memory", Importance: 0.5, Embedding: embedding}
+				if err := store.Store(mem); err != nil {
+					t.Errorf("Failed to store memory: %v", err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	store.DrainIndexing()
+
+	store.embeddingIndex.mu.RLock()
+	indexed := len(store.embeddingIndex.embeddings)
+	store.embeddingIndex.mu.RUnlock()
+	if indexed != count {
+		t.Fatalf("Expected %d indexed embeddings after drain, got %d", count, indexed)
+	}
+
+	for i := 0; i < count; i += 37 {
+		query := make([]float32, count)
+		query[i] = 1
+		results, err := store.Query(QueryCriteria{Type: "similarity", Embedding: query, Limit: 1})
+		if err != nil {
+			t.Fatalf("Similarity query failed: %v", err)
+		}
+		if want := fmt.Sprintf("m%d", i); len(results) != 1 || results[0].ID != want {
+			t.Errorf("Expected %s to be searchable, got %v", want, results)
+		}
+	}
+
+	// An update supersedes any queued embedding for the same memory
+	updated := make([]float32, count)
+	updated[1] = 3
+	if err := store.Upsert(&Memory{ID: "m0", Type: Semantic, Content: "burst memory", Importance: 0.5, Embedding: updated}); err != nil {
+		t.Fatalf("Upsert failed: %v", err)
+	}
+	store.DrainIndexing()
+	store.embeddingIndex.mu.RLock()
+	vector := store.embeddingIndex.embeddings["m0"]
+	store.embeddingIndex.mu.RUnlock()
+	if len(vector) != count || vector[1] != 1 || vector[0] != 0 {
+		t.Errorf("Expected m0 to be indexed with its normalized updated embedding")
+	}
+}
+
+// Test ScoredMemoryHeap implementation
+func TestScoredMemoryHeap(t *testing.T) {
+	h := &ScoredMemoryHeap{}
+	heap.Init(h)
+	
+	// Push items with different scores
+	items := []*ScoredMemory{
+		{Memory: &Memory{ID: "1"}, Score: 0.5},
+		{Memory: &Memory{ID: "2"}, Score: 0.8},
+		{Memory: &Memory{ID: "3"}, Score: 0.3},
+		{Memory: &Memory{ID: "4"}, Score: 0.9},
+		{Memory: &Memory{ID: "5"}, Score: 0.1},
+	}
+	
+	for _, item := range items {
+		heap.Push(h, item)
+	}
+	
+	// Test that we get items in ascending order (min-heap)
+	expectedOrder := []float32{0.1, 0.3, 0.5, 0.8, 0.9}
+	for _, expectedScore := range expectedOrder {
+		if h.Len() == 0 {
+			t.Fatal("Heap empty too early")
+		}
+		
+		item := heap.Pop(h).(*ScoredMemory)
+		if !floatEquals(item.Score, expectedScore, 0.0001) {
+			t.Errorf("Expected score %f, got %f", expectedScore, item.Score)
+		}
+	}
+	
+	if h.Len() != 0 {
+		t.Errorf("Heap should be empty, but has %d items", h.Len())
+	}
+}
+
+// Test that the heap and quickselect top-K paths return the same results
+func TestTopKSelectMatchesHeap(t *testing.T) {
+	rng := rand.New(rand.NewSource(7))
+	snapshot := make([]embeddingEntry, 2000)
+	for i := range snapshot {
+		embedding := make([]float32, 16)
+		for j := range embedding {
+			embedding[j] = rng.Float32()*2 - 1
+		}
+		snapshot[i] = embeddingEntry{
+			memory:     &Memory{ID: fmt.Sprintf("vec-%d", i)},
+			importance: rng.Float32(),
+			vector:     MetricCosine.prepare(embedding),
+		}
+	}
+	query := make([]float32, 16)
+	for i := range query {
+		query[i] = rng.Float32()*2 - 1
+	}
+
+	heapIndex := &EmbeddingIndex{metric: MetricCosine}
+	selectIndex := &EmbeddingIndex{metric: MetricCosine, selectRatio: 1e-9}
+	// Equal scores may come back in either order, so compare ID sets
+	ids := func(memories []*Memory) []string {
+		result := make([]string, len(memories))
+		for i, mem := range memories {
+			result[i] = mem.ID
+		}
+		slices.Sort(result)
+		return result
+	}
+
+	for _, limit := range []int{1, 10, 100, 500, 1999, 2000, 3000} {
+		for _, weight := range []float32{0, 0.3} {
+			fromHeap, _ := scoreSimilar(context.Background(), snapshot, heapIndex, query, limit, weight)
+			fromSelect, _ := scoreSimilar(context.Background(), snapshot, selectIndex, query, limit, weight)
+			if !slices.Equal(ids(fromHeap), ids(fromSelect)) {
+				t.Errorf("Limit %d, weight %v: heap and quickselect top-K sets differ", limit, weight)
+			}
+		}
+	}
+
+	// Equal scores must not stall the partition
+	tied := make([]ScoredMemory, 1000)
+	for i := range tied {
+		tied[i] = ScoredMemory{Memory: &Memory{ID: fmt.Sprintf("tie-%d", i)}, Score: float32(i % 3)}
+	}
+	results := selectTopK(tied, 500)
+	if len(results) != 500 {
+		t.Fatalf("Expected 500 tied results, got %d", len(results))
+	}
+	counts := make(map[float32]int)
+	for _, entry := range tied[:500] {
+		counts[entry.Score]++
+	}
+	if counts[2] != 333 || counts[1] != 167 || counts[0] != 0 {
+		t.Errorf("Expected all 2s then 1s in the top 500, got %v", counts)
+	}
+}
+
+// Test top-K selection with heap
+func TestTopKSelection(t *testing.T) {
+	store := NewMemoryStore(20)
+	defer store.Shutdown()
+	
+	// Create many memories with embeddings
+	for i := 0; i < 20; i++ {
+		angle := float64(i) * math.Pi / 10.0
+		memory := &Memory{
+			ID:         fmt.Sprintf("vec-%d", i),
+			Type:       ShortTerm,
+			Content:    fmt.Sprintf("Memory %d", i),
+			Embedding:  []float32{float32(math.Cos(angle)), float32(math.Sin(angle)), 0},
+			Importance: 0.5,
+		}
+		if err := store.Store(memory); err != nil {
 			t.Fatalf("Failed to store memory: %v", err)
 		}
 	}
@@ -854,30 +2124,1603 @@ func TestMemoryConsolidation(t *testing.T) {
 	}
 }
 
-// Test time bucket cleanup
-func TestTimeBucketCleanup(t *testing.T) {
+// Test consolidation into a configured target type
+func TestConsolidationTarget(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxMemories = 10
+	config.ConsolidationTarget = string(Semantic)
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	store := NewMemoryStoreWithConfig(config)
+	defer store.Shutdown()
+
+	memory := &Memory{ID: "fact", Type: ShortTerm, Content: "User prefers tabs", Importance: 0.8}
+	if err := store.Store(memory); err != nil {
+		t.Fatalf("Failed to store memory: %v", err)
+	}
+
+	store.consolidateMemories()
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	if memory.Type != Semantic {
+		t.Errorf("Expected promotion to semantic, got %s", memory.Type)
+	}
+	if _, ok := store.typeIndex[Semantic]["fact"]; !ok {
+		t.Error("Memory missing from semantic type index")
+	}
+	if _, ok := store.typeIndex[ShortTerm]["fact"]; ok {
+		t.Error("Memory still in short_term type index")
+	}
+	if _, ok := store.typeIndex[LongTerm]["fact"]; ok {
+		t.Error("Memory should not be promoted to long_term")
+	}
+
+	config.ConsolidationTarget = "short_term"
+	if err := config.Validate(); err == nil {
+		t.Error("Expected validation error for short_term target")
+	}
+}
+
+// Test changing the decay interval on a running store
+func TestReconfigureDecayInterval(t *testing.T) {
 	store := NewMemoryStore(10)
 	defer store.Shutdown()
-	
-	// Add old memories directly to time index
-	oldTime := time.Now().Add(-10 * 24 * time.Hour) // 10 days ago
-	oldBucket := oldTime.Format("2006-01-02-15")
-	
-	store.timeIndex.mu.Lock()
-	store.timeIndex.buckets[oldBucket] = []*Memory{
-		{ID: "old-memory", Content: "Old memory"},
+
+	memory := &Memory{ID: "stale", Type: ShortTerm, Content: "Stale memory", Importance: 0.5, Decay: 0.5}
+	if err := store.Store(memory); err != nil {
+		t.Fatalf("Failed to store memory: %v", err)
 	}
-	store.timeIndex.mu.Unlock()
-	
-	// Run cleanup
-	store.cleanupTimeBuckets()
-	
-	// Check that old bucket was removed
-	store.timeIndex.mu.RLock()
-	_, exists := store.timeIndex.buckets[oldBucket]
-	store.timeIndex.mu.RUnlock()
-	
-	if exists {
-		t.Error("Old time bucket should have been cleaned up")
+	store.mu.Lock()
+	memory.LastAccess = time.Now().Add(-2 * time.Hour)
+	store.mu.Unlock()
+
+	applied, err := store.Reconfigure(RuntimeSettings{DecayInterval: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Reconfigure failed: %v", err)
+	}
+	if applied.DecayInterval != 20*time.Millisecond {
+		t.Errorf("Expected decay interval 20ms, got %v", applied.DecayInterval)
+	}
+	if applied.MaxMemories != 10 {
+		t.Errorf("Expected unchanged max memories 10, got %d", applied.MaxMemories)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		store.mu.RLock()
+		_, exists := store.memories["stale"]
+		store.mu.RUnlock()
+		if !exists {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected decay to run on the new interval")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := store.Reconfigure(RuntimeSettings{ConsolidationImportanceThreshold: 2}); err == nil {
+		t.Error("Expected error for importance threshold above 1")
+	}
+
+	// Startup configuration rejects the same thresholds
+	config := DefaultConfig()
+	config.ConsolidationImportanceThreshold = 2
+	if err := config.Validate(); err == nil {
+		t.Error("Expected a consolidation importance threshold above 1 to fail validation")
+	}
+	config = DefaultConfig()
+	config.ConsolidationAccessThreshold = -1
+	if err := config.Validate(); err == nil {
+		t.Error("Expected a negative consolidation access threshold to fail validation")
+	}
+}
+
+// Test that a lower decay removal threshold keeps faded memories
+func TestDecayRemovalThreshold(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxMemories = 10
+	config.DecayRemovalThreshold = 0.01
+	config.DecayGracePeriod = 0
+	store := NewMemoryStoreWithConfig(config)
+	defer store.Shutdown()
+
+	// 0.15 - 0.05*2h = 0.05, below the default 0.1 but above 0.01
+	mem := &Memory{ID: "faded", Type: ShortTerm, Content: "Faded memory", Importance: 0.15, Decay: 0.05,
+		LastAccess: time.Now().Add(-2 * time.Hour)}
+	if err := store.Store(mem); err != nil {
+		t.Fatalf("Failed to store memory: %v", err)
+	}
+
+	store.applyDecay()
+
+	store.mu.RLock()
+	_, exists := store.memories["faded"]
+	importance := mem.Importance
+	store.mu.RUnlock()
+	if !exists {
+		t.Errorf("Expected memory with importance %f to survive a 0.01 threshold", importance)
+	}
+
+	config.DecayRemovalThreshold = 1
+	if err := config.Validate(); err == nil {
+		t.Error("Expected a threshold of 1 to fail validation")
+	}
+}
+
+// Test that a type's importance floor stops decay while other types still fade away
+func TestImportanceFloor(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxMemories = 10
+	config.DecayGracePeriod = 0
+	if err := parseImportanceFloors("semantic=0.3", config); err != nil {
+		t.Fatalf("Failed to parse floors: %v", err)
+	}
+	store := NewMemoryStoreWithConfig(config)
+	defer store.Shutdown()
+
+	lastAccess := time.Now().Add(-10 * time.Hour)
+	fact := &Memory{ID: "fact", Type: Semantic, Content: "Core knowledge", Importance: 0.8, Decay: 0.05, LastAccess: lastAccess}
+	chatter := &Memory{ID: "chatter", Type: ShortTerm, Content: "Small talk", Importance: 0.8, Decay: 0.05, LastAccess: lastAccess}
+	for _, mem := range []*Memory{fact, chatter} {
+		if err := store.Store(mem); err != nil {
+			t.Fatalf("Failed to store memory: %v", err)
+		}
+	}
+
+	if report := store.AgingReport(24 * time.Hour); len(report) != 1 || report[0].ID != "chatter" {
+		t.Errorf("Expected only chatter to be projected for removal, got %+v", report)
+	}
+	if lineage, _ := store.Lineage("fact"); lineage.HoursUntilRemoval != nil {
+		t.Errorf("Expected no removal projection for a floored memory, got %v", *lineage.HoursUntilRemoval)
+	}
+
+	// 0.8 - 0.05*10h = 0.3 after one pass, then the floor holds it
+	for range 3 {
+		store.applyDecay()
+	}
+
+	store.mu.RLock()
+	_, chatterExists := store.memories["chatter"]
+	_, factExists := store.memories["fact"]
+	importance := fact.Importance
+	store.mu.RUnlock()
+	if chatterExists {
+		t.Error("Expected the short-term memory to decay to removal")
+	}
+	if !factExists || importance != 0.3 {
+		t.Errorf("Expected the semantic memory to stop at its 0.3 floor, got %v (exists %v)", importance, factExists)
+	}
+
+	if err := parseImportanceFloors("episodic", config); err == nil {
+		t.Error("Expected a floor without a value to fail parsing")
+	}
+	config.ImportanceFloors[Semantic] = 1.5
+	if err := config.Validate(); err == nil {
+		t.Error("Expected a floor above 1 to fail validation")
+	}
+}
+
+// Test that a recently accessed memory loses no importance within the grace period
+func TestDecayGracePeriod(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxMemories = 10
+	config.DecayGracePeriod = time.Hour
+	store := NewMemoryStoreWithConfig(config)
+	defer store.Shutdown()
+
+	now := time.Now()
+	fresh := &Memory{ID: "fresh", Type: ShortTerm, Content: "Just touched", Importance: 0.5, Decay: 0.5, LastAccess: now.Add(-50 * time.Minute)}
+	stale := &Memory{ID: "stale", Type: ShortTerm, Content: "Touched a while ago", Importance: 0.5, Decay: 0.1, LastAccess: now.Add(-3 * time.Hour)}
+	for _, mem := range []*Memory{fresh, stale} {
+		if err := store.Store(mem); err != nil {
+			t.Fatalf("Failed to store memory: %v", err)
+		}
+	}
+
+	store.applyDecay()
+
+	store.mu.RLock()
+	freshImportance, staleImportance := fresh.Importance, stale.Importance
+	store.mu.RUnlock()
+	if freshImportance != 0.5 {
+		t.Errorf("Expected no decay within the grace period, got importance %v", freshImportance)
+	}
+	// Only the 2 hours past the grace period count: 0.5 - 0.1*2h = 0.3
+	if math.Abs(float64(staleImportance-0.3)) > 0.001 {
+		t.Errorf("Expected decay past the grace period only, got importance %v", staleImportance)
+	}
+
+	// The removal projection counts the grace period left: two idle 5m ticks,
+	// then ticks decaying 5, 10, 15, and 20 minutes' worth, 0.83h in all
+	if lineage, _ := store.Lineage("fresh"); lineage.HoursUntilRemoval == nil || math.Abs(*lineage.HoursUntilRemoval-0.5) > 0.01 {
+		t.Errorf("Expected about 0.5 hours until removal, got %v", lineage.HoursUntilRemoval)
+	}
+}
+
+// Test that decay projections for a memory part way through its life match
+// what applyDecay does tick by tick
+func TestDecayProjection(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxMemories = 10
+	store := NewMemoryStoreWithConfig(config)
+	defer store.Shutdown()
+
+	now := time.Now()
+	mem := &Memory{ID: "midlife", Type: ShortTerm, Content: "Half forgotten", Importance: 0.8, Decay: 0.01, LastAccess: now.Add(-3 * time.Hour)}
+	if err := store.Store(mem); err != nil {
+		t.Fatalf("Failed to store memory: %v", err)
+	}
+	lineage, _ := store.Lineage("midlife")
+	if lineage.HoursUntilRemoval == nil {
+		t.Fatal("Expected a removal projection")
+	}
+	store.mu.RLock()
+	projected := store.projectedImportance(mem, now, now.Add(time.Hour))
+	store.mu.RUnlock()
+
+	// Run decay ticks, aging the last access by one interval before each
+	ticks := 0
+	for exists := true; exists && ticks < 1000; ticks++ {
+		store.mu.Lock()
+		mem.LastAccess = mem.LastAccess.Add(-config.DecayInterval)
+		store.mu.Unlock()
+		store.applyDecay()
+
+		store.mu.RLock()
+		_, exists = store.memories["midlife"]
+		importance := mem.Importance
+		store.mu.RUnlock()
+		if ticks+1 == int(time.Hour/config.DecayInterval) && math.Abs(float64(importance-projected)) > 0.001 {
+			t.Errorf("Expected importance %v after an hour of ticks, got %v", projected, importance)
+		}
+	}
+
+	if hours := float64(ticks) * config.DecayInterval.Hours(); math.Abs(*lineage.HoursUntilRemoval-hours) > 0.001 {
+		t.Errorf("Expected removal projected after %v hours, got %v", hours, *lineage.HoursUntilRemoval)
+	}
+}
+
+// Test that repeated keyword queries are cached until the store changes
+func TestQueryCache(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxMemories = 10
+	config.QueryCacheSize = 4
+	store := NewMemoryStoreWithConfig(config)
+	defer store.Shutdown()
+
+	store.Store(&Memory{ID: "deploy-1", Type: ShortTerm, Content: "Deploy the API", Importance: 0.5})
+
+	criteria := QueryCriteria{Type: "keywords", Keywords: []string{"deploy"}, Limit: 10}
+	if results, _ := store.Query(criteria); len(results) != 1 {
+		t.Fatalf("Expected 1 result, got %d", len(results))
+	}
+
+	// Same query with different keyword case hits the cache
+	criteria.Keywords = []string{"DEPLOY"}
+	if results, _ := store.Query(criteria); len(results) != 1 {
+		t.Fatalf("Expected 1 cached result, got %d", len(results))
+	}
+	if store.queryCache.hits != 1 || store.queryCache.misses != 1 {
+		t.Errorf("Expected 1 hit and 1 miss, got %d hits and %d misses", store.queryCache.hits, store.queryCache.misses)
+	}
+
+	// A write invalidates cached results
+	store.Store(&Memory{ID: "deploy-2", Type: ShortTerm, Content: "Deploy the worker", Importance: 0.5})
+	if results, _ := store.Query(criteria); len(results) != 2 {
+		t.Errorf("Expected 2 results after invalidation, got %d", len(results))
+	}
+	if store.queryCache.hits != 1 || store.queryCache.misses != 2 {
+		t.Errorf("Expected query after write to miss, got %d hits and %d misses", store.queryCache.hits, store.queryCache.misses)
+	}
+}
+
+// Test that heavy queries beyond the concurrency cap wait for a slot
+func TestQueryLimiter(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxConcurrentQueries = 2
+	store := NewMemoryStoreWithConfig(config)
+	defer store.Shutdown()
+
+	for i := 0; i < 20; i++ {
+		store.Store(&Memory{
+			ID:         fmt.Sprintf("limit-%d", i),
+			Type:       Semantic,
+			Content:    "golang scheduling notes",
+			Embedding:  []float32{float32(i), 1, 0},
+			Importance: 0.5,
+		})
+	}
+
+	// Hold every slot so queries queue behind them
+	limiter := store.queryLimiter
+	for i := 0; i < 2; i++ {
+		if err := limiter.acquire(context.Background()); err != nil {
+			t.Fatalf("Failed to acquire slot: %v", err)
+		}
 	}
-}
\ No newline at end of file
+
+	const queries = 8
+	var done, returned atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < queries; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			criteria := QueryCriteria{Type: "keywords", Keywords: []string{"golang"}}
+			if i%2 == 0 {
+				criteria = QueryCriteria{Type: "similarity", Embedding: []float32{1, 0, 0}}
+			}
+			results, err := store.Query(criteria)
+			if err != nil {
+				t.Errorf("Query failed: %v", err)
+			}
+			returned.Add(int32(len(results)))
+			done.Add(1)
+		}(i)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for limiter.waiting.Load() < queries && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if waiting := limiter.waiting.Load(); waiting != queries || done.Load() != 0 {
+		t.Fatalf("Expected all %d queries waiting, got %d waiting and %d done", queries, waiting, done.Load())
+	}
+
+	// Index lookups are not limited
+	results, err := store.Query(QueryCriteria{Type: "type", MemoryType: Semantic})
+	if err != nil {
+		t.Errorf("Expected a type query to bypass the limiter, got %v", err)
+	}
+	returned.Add(int32(len(results)))
+
+	// A waiting query gives up when its context is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := store.QueryContext(ctx, QueryCriteria{Type: "keywords", Keywords: []string{"golang"}}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected a cancelled query to fail, got %v", err)
+	}
+
+	// Sample the running count while the queue drains
+	stop := make(chan struct{})
+	sampled := make(chan int)
+	go func() {
+		peak := 0
+		for {
+			select {
+			case <-stop:
+				sampled <- peak
+				return
+			default:
+				peak = max(peak, len(limiter.slots))
+			}
+		}
+	}()
+	limiter.release()
+	limiter.release()
+	wg.Wait()
+	close(stop)
+
+	if peak := <-sampled; peak > 2 {
+		t.Errorf("Expected at most 2 queries running at once, saw %d", peak)
+	}
+	if done.Load() != queries || len(limiter.slots) != 0 || limiter.waiting.Load() != 0 {
+		t.Errorf("Expected all queries done and slots free, got %d done, %d running, %d waiting",
+			done.Load(), len(limiter.slots), limiter.waiting.Load())
+	}
+
+	// Queries running at once record every access
+	store.mu.RLock()
+	accesses := 0
+	for _, mem := range store.memories {
+		accesses += mem.AccessCount
+	}
+	store.mu.RUnlock()
+	if accesses != int(returned.Load()) {
+		t.Errorf("Expected %d recorded accesses, got %d", returned.Load(), accesses)
+	}
+}
+
+// Test time bucket cleanup
+func TestTimeBucketCleanup(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+	
+	// Add old memories directly to time index
+	oldTime := time.Now().Add(-10 * 24 * time.Hour) // 10 days ago
+	oldBucket := oldTime.Format("2006-01-02-15")
+	
+	store.timeIndex.mu.Lock()
+	store.timeIndex.buckets[oldBucket] = []*Memory{
+		{ID: "old-memory", Content: "Old memory"},
+	}
+	store.timeIndex.mu.Unlock()
+	
+	// Run cleanup
+	store.cleanupTimeBuckets()
+	
+	// Check that old bucket was removed
+	store.timeIndex.mu.RLock()
+	_, exists := store.timeIndex.buckets[oldBucket]
+	store.timeIndex.mu.RUnlock()
+	
+	if exists {
+		t.Error("Old time bucket should have been cleaned up")
+	}
+}
+
+// Test that the access score decays so old activity loses to recent activity
+func TestAccessScoreHalfLife(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxMemories = 10
+	config.AccessHalfLife = 24 * time.Hour
+	store := NewMemoryStoreWithConfig(config)
+	defer store.Shutdown()
+
+	now := time.Now()
+	old := &Memory{
+		ID:          "old-hot",
+		Type:        ShortTerm,
+		Content:     "Heavily accessed long ago",
+		Importance:  0.5,
+		AccessCount: 10,
+		AccessScore: 10,
+		LastAccess:  now.Add(-10 * 24 * time.Hour),
+	}
+	recent := &Memory{
+		ID:          "recent-hot",
+		Type:        ShortTerm,
+		Content:     "Accessed a few times just now",
+		Importance:  0.5,
+		AccessCount: 4,
+		AccessScore: 4,
+		LastAccess:  now,
+	}
+
+	for _, m := range []*Memory{old, recent} {
+		if err := store.Store(m); err != nil {
+			t.Fatalf("Failed to store memory %s: %v", m.ID, err)
+		}
+	}
+
+	oldScore := store.accessScore(old, now)
+	recentScore := store.accessScore(recent, now)
+	if oldScore >= recentScore {
+		t.Errorf("Expected old score %f to be lower than recent score %f", oldScore, recentScore)
+	}
+
+	store.consolidateMemories()
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	if old.Type != ShortTerm {
+		t.Errorf("Expected stale memory to stay short_term, got %s", old.Type)
+	}
+	if recent.Type != LongTerm {
+		t.Errorf("Expected recently accessed memory to be consolidated, got %s", recent.Type)
+	}
+	if old.AccessCount != 10 {
+		t.Errorf("Expected raw access count to be preserved, got %d", old.AccessCount)
+	}
+}
+
+// Test related traversal filtered by keywords
+func TestRelatedKeywordsQuery(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+	server := &MCPServer{store: store}
+
+	memories := []*Memory{
+		{ID: "seed", Type: Semantic, Content: "Project Apollo overview", Importance: 0.5},
+		{ID: "deploy", Type: Semantic, Content: "Apollo deploys with Kubernetes", Importance: 0.5},
+		{ID: "budget", Type: Semantic, Content: "Apollo budget review", Importance: 0.5},
+		{ID: "cluster", Type: Semantic, Content: "Kubernetes cluster sizing", Importance: 0.5},
+		{ID: "unrelated", Type: Semantic, Content: "Kubernetes upgrade notes", Importance: 0.5},
+	}
+	for _, m := range memories {
+		if err := store.Store(m); err != nil {
+			t.Fatalf("Failed to store memory %s: %v", m.ID, err)
+		}
+	}
+
+	relations := []CreateRelationArgs{
+		{FromID: "seed", ToID: "deploy", RelationType: "part_of"},
+		{FromID: "seed", ToID: "budget", RelationType: "part_of"},
+		{FromID: "deploy", ToID: "cluster", RelationType: "leads_to"},
+	}
+	for _, rel := range relations {
+		if err := server.CreateRelation(nil, rel); err != nil {
+			t.Fatalf("Failed to create relation: %v", err)
+		}
+	}
+
+	results, err := store.Query(QueryCriteria{
+		Type:     "related_keywords",
+		MemoryID: "seed",
+		Depth:    3,
+		Keywords: []string{"kubernetes"},
+	})
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+
+	found := make(map[string]bool)
+	for _, mem := range results {
+		found[mem.ID] = true
+	}
+	if len(results) != 2 || !found["deploy"] || !found["cluster"] {
+		t.Errorf("Expected deploy and cluster, got %v", found)
+	}
+
+	if _, err := store.Query(QueryCriteria{Type: "related_keywords", MemoryID: "seed", Depth: 3}); !errors.Is(err, ErrValidation) {
+		t.Errorf("Expected a validation error without keywords, got %v", err)
+	}
+}
+
+// Test that related results are ordered by strength then ID on every call
+func TestFindRelatedDeterministicOrder(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+	server := &MCPServer{store: store}
+
+	for _, id := range []string{"root", "a", "b", "c", "d", "e"} {
+		mem := &Memory{ID: id, Type: Semantic, Content: "Node " + id, Importance: 0.5}
+		if err := store.Store(mem); err != nil {
+			t.Fatalf("Failed to store memory %s: %v", id, err)
+		}
+	}
+
+	relations := []CreateRelationArgs{
+		{FromID: "root", ToID: "c", RelationType: "related_to", Strength: 0.3},
+		{FromID: "root", ToID: "b", RelationType: "related_to", Strength: 0.9},
+		{FromID: "root", ToID: "a", RelationType: "related_to", Strength: 0.3},
+		{FromID: "a", ToID: "e", RelationType: "related_to", Strength: 0.4},
+		{FromID: "b", ToID: "d", RelationType: "related_to", Strength: 0.4},
+	}
+	for _, rel := range relations {
+		if err := server.CreateRelation(nil, rel); err != nil {
+			t.Fatalf("Failed to create relation: %v", err)
+		}
+	}
+
+	expected := []string{"b", "a", "c", "d", "e"}
+	for i := 0; i < 5; i++ {
+		store.mu.RLock()
+		results := store.findRelated("root", 3)
+		store.mu.RUnlock()
+
+		ids := make([]string, len(results))
+		for j, mem := range results {
+			ids[j] = mem.ID
+		}
+		if !reflect.DeepEqual(ids, expected) {
+			t.Fatalf("Call %d: expected order %v, got %v", i, expected, ids)
+		}
+	}
+}
+
+// Test that a densely connected graph returns each reachable memory once
+func TestFindRelatedDenseGraphNoDuplicates(t *testing.T) {
+	store := NewMemoryStore(20)
+	defer store.Shutdown()
+
+	ids := []string{"root", "a", "b", "c", "d", "e"}
+	for _, id := range ids {
+		if err := store.Store(&Memory{ID: id, Type: Semantic, Content: "Node " + id, Importance: 0.5}); err != nil {
+			t.Fatalf("Failed to store memory %s: %v", id, err)
+		}
+	}
+
+	// Connect every pair in both directions, twice, with different types
+	store.mu.Lock()
+	for _, from := range ids {
+		for _, to := range ids {
+			if from == to {
+				continue
+			}
+			for _, relType := range []string{"related_to", "depends_on"} {
+				if err := store.addRelation(CreateRelationArgs{FromID: from, ToID: to, RelationType: relType, Strength: 0.5}); err != nil {
+					t.Fatalf("Failed to create relation: %v", err)
+				}
+			}
+		}
+	}
+	store.mu.Unlock()
+
+	store.mu.RLock()
+	results := store.findRelated("root", 4)
+	store.mu.RUnlock()
+
+	if len(results) != len(ids)-1 {
+		t.Fatalf("Expected %d related memories, got %d", len(ids)-1, len(results))
+	}
+	seen := make(map[string]bool)
+	for _, mem := range results {
+		if seen[mem.ID] {
+			t.Errorf("Memory %s returned more than once", mem.ID)
+		}
+		if mem.ID == "root" {
+			t.Error("Seed memory returned as related")
+		}
+		seen[mem.ID] = true
+	}
+}
+
+// Test that related query depth is clamped to the configured maximum
+func TestMaxRelatedDepth(t *testing.T) {
+	// A chain node-0 -> node-1 -> ... -> node-9
+	newChain := func(maxDepth int) *MemoryStore {
+		config := DefaultConfig()
+		config.MaxRelatedDepth = maxDepth
+		store := NewMemoryStoreWithConfig(config)
+		for i := 0; i < 10; i++ {
+			store.Store(&Memory{ID: fmt.Sprintf("node-%d", i), Type: Semantic, Content: "Chain node", Importance: 0.5})
+		}
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		for i := 1; i < 10; i++ {
+			if err := store.addRelation(CreateRelationArgs{FromID: fmt.Sprintf("node-%d", i-1), ToID: fmt.Sprintf("node-%d", i), RelationType: "leads_to", Strength: 0.5}); err != nil {
+				t.Fatalf("Failed to create relation: %v", err)
+			}
+		}
+		return store
+	}
+
+	store := newChain(3)
+	defer store.Shutdown()
+	clamped, err := store.Query(QueryCriteria{Type: "related", MemoryID: "node-0", Depth: 1000000, Limit: 100})
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	atMax, _ := store.Query(QueryCriteria{Type: "related", MemoryID: "node-0", Depth: 3, Limit: 100})
+	if len(clamped) != len(atMax) || len(clamped) >= 9 {
+		t.Errorf("Expected an excessive depth to return the same %d memories as depth 3, got %d", len(atMax), len(clamped))
+	}
+
+	// With no cap the whole chain is reachable
+	unlimited := newChain(0)
+	defer unlimited.Shutdown()
+	results, _ := unlimited.Query(QueryCriteria{Type: "related", MemoryID: "node-0", Depth: 1000000, Limit: 100})
+	if len(results) != 9 {
+		t.Errorf("Expected all 9 chained memories without a cap, got %d", len(results))
+	}
+}
+
+// Test that a memory reached by two relation paths is returned and accessed once
+func TestQueryDeduplicatesAcrossPaths(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+
+	for _, id := range []string{"root", "left", "right", "shared"} {
+		store.Store(&Memory{ID: id, Type: Semantic, Content: "diamond node " + id, Importance: 0.5})
+	}
+	for _, rel := range [][2]string{{"root", "left"}, {"root", "right"}, {"left", "shared"}, {"right", "shared"}} {
+		if err := store.addRelation(CreateRelationArgs{FromID: rel[0], ToID: rel[1], RelationType: "leads_to", Strength: 0.5}); err != nil {
+			t.Fatalf("Failed to add relation: %v", err)
+		}
+	}
+
+	for _, queryType := range []string{"related", "related_keywords"} {
+		results, err := store.Query(QueryCriteria{Type: queryType, MemoryID: "root", Depth: 3, Keywords: []string{"diamond"}})
+		if err != nil {
+			t.Fatalf("%s query failed: %v", queryType, err)
+		}
+		shared := 0
+		for _, mem := range results {
+			if mem.ID == "shared" {
+				shared++
+			}
+		}
+		if shared != 1 || len(results) != 3 {
+			t.Errorf("%s: expected left, right, and shared once each, got %d results with shared %d times", queryType, len(results), shared)
+		}
+	}
+
+	// The duplicate step itself keeps the first occurrence
+	mem := store.memories["shared"]
+	before := mem.AccessCount
+	results := store.finishQuery([]*Memory{mem, store.memories["left"], mem}, time.Now())
+	if len(results) != 2 || results[0].ID != "shared" || results[1].ID != "left" {
+		t.Errorf("Expected [shared left], got %v", results)
+	}
+	if mem.AccessCount != before+1 {
+		t.Errorf("Expected one access recorded for the repeated memory, got %d", mem.AccessCount-before)
+	}
+}
+
+// Test that int8-quantized similarity closely matches full precision ordering
+func TestQuantizedSimilarityRecall(t *testing.T) {
+	const (
+		count     = 200
+		dimension = 64
+		topK      = 10
+	)
+
+	rng := rand.New(rand.NewSource(42))
+	vectors := make([][]float32, count)
+	for i := range vectors {
+		vectors[i] = make([]float32, dimension)
+		for j := range vectors[i] {
+			vectors[i][j] = float32(rng.NormFloat64())
+		}
+	}
+
+	fullConfig := DefaultConfig()
+	fullConfig.MaxMemories = count
+	full := NewMemoryStoreWithConfig(fullConfig)
+	defer full.Shutdown()
+
+	quantConfig := DefaultConfig()
+	quantConfig.MaxMemories = count
+	quantConfig.QuantizeEmbeddings = true
+	quantized := NewMemoryStoreWithConfig(quantConfig)
+	defer quantized.Shutdown()
+
+	for i, vec := range vectors {
+		for _, store := range []*MemoryStore{full, quantized} {
+			mem := &Memory{
+				ID:         fmt.Sprintf("vec-%d", i),
+				Type:       Semantic,
+				Content:    fmt.Sprintf("Vector %d", i),
+				Embedding:  vec,
+				Importance: 0.5,
+			}
+			if err := store.Store(mem); err != nil {
+				t.Fatalf("Failed to store memory: %v", err)
+			}
+		}
+	}
+
+	if len(quantized.embeddingIndex.embeddings) != 0 || len(quantized.embeddingIndex.quantized) != count {
+		t.Fatal("Quantized store should only hold int8 embeddings")
+	}
+
+	var hits, total int
+	for q := 0; q < 20; q++ {
+		query := vectors[rng.Intn(count)]
+		expected := make(map[string]bool)
+		for _, mem := range full.findSimilar(query, topK) {
+			expected[mem.ID] = true
+		}
+
+		results := quantized.findSimilar(query, topK)
+		if results[0].ID != full.findSimilar(query, 1)[0].ID {
+			t.Errorf("Query %d: quantized top result differs from full precision", q)
+		}
+		for _, mem := range results {
+			if expected[mem.ID] {
+				hits++
+			}
+		}
+		total += topK
+	}
+
+	recall := float64(hits) / float64(total)
+	t.Logf("Quantized recall@%d: %.3f", topK, recall)
+	if recall < 0.9 {
+		t.Errorf("Expected recall of at least 0.9, got %.3f", recall)
+	}
+}
+
+// Test that a query of the wrong dimension is rejected rather than indexing
+// past the end of a quantized query vector
+func TestQuantizedDimensionMismatch(t *testing.T) {
+	config := DefaultConfig()
+	config.QuantizeEmbeddings = true
+	store := NewMemoryStoreWithConfig(config)
+	defer store.Shutdown()
+
+	mem := &Memory{ID: "wide", Type: Semantic, Content: "Wide vector", Embedding: []float32{1, 0, 0, 0}, Importance: 0.5}
+	if err := store.Store(mem); err != nil {
+		t.Fatalf("Failed to store memory: %v", err)
+	}
+
+	short := []float32{1, 0}
+	if _, err := store.Query(QueryCriteria{Type: "similarity", Embedding: short}); !errors.Is(err, ErrValidation) {
+		t.Errorf("Expected validation error for a short query, got %v", err)
+	}
+	if _, err := store.Query(QueryCriteria{Type: "similarity", Embedding: short, ImportanceWeight: 0.5}); !errors.Is(err, ErrValidation) {
+		t.Errorf("Expected validation error for a short weighted query, got %v", err)
+	}
+	if _, err := store.FindSimilarBatch([][]float32{{1, 0, 0, 0}, short}, 5); !errors.Is(err, ErrValidation) {
+		t.Errorf("Expected validation error for a short batch query, got %v", err)
+	}
+
+	narrow := &Memory{ID: "narrow", Type: Semantic, Content: "Narrow vector", Embedding: short, Importance: 0.5}
+	if err := store.Store(narrow); !errors.Is(err, ErrValidation) {
+		t.Errorf("Expected validation error storing a mismatched embedding, got %v", err)
+	}
+	if err := store.Upsert(&Memory{ID: "wide", Type: Semantic, Content: "Wide vector", Embedding: short, Importance: 0.5}); err != nil {
+		t.Errorf("Expected the only embedding to be replaceable with another dimension, got %v", err)
+	}
+
+	if results, err := store.Query(QueryCriteria{Type: "similarity", Embedding: short}); err != nil || len(results) != 1 {
+		t.Errorf("Expected the matching query to find the memory, got %v, %v", results, err)
+	}
+}
+
+// Test that the similarity metric changes ranking: dot favors large vectors,
+// cosine favors direction, and euclidean favors nearby points
+func TestSimilarityMetrics(t *testing.T) {
+	tests := []struct {
+		metric SimilarityMetric
+		want   []string
+	}{
+		{MetricCosine, []string{"aligned", "close", "large"}},
+		{MetricDot, []string{"large", "aligned", "close"}},
+		{MetricEuclidean, []string{"aligned", "close", "large"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.metric), func(t *testing.T) {
+			config := DefaultConfig()
+			config.SimilarityMetric = string(tt.metric)
+			store := NewMemoryStoreWithConfig(config)
+			defer store.Shutdown()
+
+			for _, mem := range []*Memory{
+				{ID: "aligned", Type: Semantic, Content: "Aligned", Embedding: []float32{1, 0}, Importance: 0.5},
+				{ID: "large", Type: Semantic, Content: "Large", Embedding: []float32{10, 10}, Importance: 0.5},
+				{ID: "close", Type: Semantic, Content: "Close", Embedding: []float32{0.5, 0.1}, Importance: 0.5},
+			} {
+				if err := store.Store(mem); err != nil {
+					t.Fatalf("Failed to store memory: %v", err)
+				}
+			}
+
+			results, err := store.Query(QueryCriteria{Type: "similarity", Embedding: []float32{1, 0}, Limit: 3})
+			if err != nil {
+				t.Fatalf("Query failed: %v", err)
+			}
+			got := make([]string, len(results))
+			for i, mem := range results {
+				got[i] = mem.ID
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Expected order %v, got %v", tt.want, got)
+			}
+		})
+	}
+
+	config := DefaultConfig()
+	config.SimilarityMetric = "manhattan"
+	if err := config.Validate(); err == nil {
+		t.Error("Expected an unknown similarity metric to fail validation")
+	}
+}
+
+// Test that rebuilding restores every index after they are corrupted
+func TestRebuildIndexes(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+
+	for _, mem := range []*Memory{
+		{ID: "deploy", Type: Procedural, Content: "Deploy with the release script", Embedding: []float32{1, 0}, Importance: 0.5, Timestamp: time.Now()},
+		{ID: "user", Type: Semantic, Content: "User prefers tabs", Embedding: []float32{0, 1}, Importance: 0.5, Timestamp: time.Now()},
+	} {
+		if err := store.Store(mem); err != nil {
+			t.Fatalf("Failed to store memory: %v", err)
+		}
+	}
+
+	queries := []QueryCriteria{
+		{Type: "keywords", Keywords: []string{"release"}},
+		{Type: "type", MemoryType: Procedural},
+		{Type: "temporal", StartTime: time.Now().Add(-time.Hour), EndTime: time.Now().Add(time.Hour)},
+		{Type: "similarity", Embedding: []float32{1, 0}, Limit: 1},
+	}
+	assertDeployFound := func(stage string) {
+		t.Helper()
+		for _, criteria := range queries {
+			results, err := store.Query(criteria)
+			if err != nil {
+				t.Fatalf("%s: %s query failed: %v", stage, criteria.Type, err)
+			}
+			found := false
+			for _, mem := range results {
+				found = found || mem.ID == "deploy"
+			}
+			if !found {
+				t.Errorf("%s: expected %s query to find deploy, got %d results", stage, criteria.Type, len(results))
+			}
+		}
+	}
+	assertDeployFound("before corruption")
+
+	// Corrupt every index so none of the queries can find the memory
+	store.mu.Lock()
+	store.typeIndex[Procedural] = make(map[string]*Memory)
+	store.timeIndex.buckets = make(map[string][]*Memory)
+	delete(store.keywordIndex.index, "release")
+	delete(store.embeddingIndex.embeddings, "deploy")
+	store.mu.Unlock()
+
+	report := store.RebuildIndexes()
+	if report.Memories != 2 || report.Embeddings != 2 || report.TimeBuckets == 0 || report.Keywords == 0 {
+		t.Errorf("Unexpected rebuild report %+v", report)
+	}
+	assertDeployFound("after rebuild")
+
+	if n := len(store.typeIndex[Semantic]); n != 1 {
+		t.Errorf("Expected 1 semantic memory after rebuild, got %d", n)
+	}
+}
+
+// Test that batch similarity matches individual similarity searches
+func TestFindSimilarBatch(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+
+	memories := []*Memory{
+		{ID: "x", Type: Semantic, Content: "X axis", Embedding: []float32{1, 0, 0}, Importance: 0.5},
+		{ID: "xy", Type: Semantic, Content: "XY diagonal", Embedding: []float32{0.7, 0.7, 0}, Importance: 0.5},
+		{ID: "y", Type: Semantic, Content: "Y axis", Embedding: []float32{0, 1, 0}, Importance: 0.5},
+		{ID: "z", Type: Semantic, Content: "Z axis", Embedding: []float32{0, 0, 1}, Importance: 0.5},
+	}
+	for _, m := range memories {
+		if err := store.Store(m); err != nil {
+			t.Fatalf("Failed to store memory: %v", err)
+		}
+	}
+
+	queries := [][]float32{{1, 0, 0}, {0, 1, 0}, {0, 0.1, 1}}
+	results, err := store.FindSimilarBatch(queries, 2)
+	if err != nil {
+		t.Fatalf("FindSimilarBatch failed: %v", err)
+	}
+	if len(results) != len(queries) {
+		t.Fatalf("Expected %d result sets, got %d", len(queries), len(results))
+	}
+
+	for i, query := range queries {
+		expected := store.findSimilar(query, 2)
+		if len(results[i]) != len(expected) {
+			t.Fatalf("Query %d: expected %d results, got %d", i, len(expected), len(results[i]))
+		}
+		for j := range expected {
+			if results[i][j].ID != expected[j].ID {
+				t.Errorf("Query %d result %d: expected %s, got %s", i, j, expected[j].ID, results[i][j].ID)
+			}
+		}
+	}
+
+	if _, err := store.FindSimilarBatch(nil, 2); err == nil {
+		t.Error("Expected error for empty query batch")
+	}
+}
+
+// Test that upserting an existing ID updates it in place and re-indexes content
+func TestUpsert(t *testing.T) {
+	store := NewMemoryStore(10)
+	defer store.Shutdown()
+
+	first := &Memory{ID: "event-1", Type: ShortTerm, Content: "Deployment started", Importance: 0.5}
+	if err := store.Upsert(first); err != nil {
+		t.Fatalf("First upsert failed: %v", err)
+	}
+
+	second := &Memory{ID: "event-1", Type: Episodic, Content: "Rollback finished", Importance: 0.7}
+	if err := store.Upsert(second); err != nil {
+		t.Fatalf("Second upsert failed: %v", err)
+	}
+
+	if err := store.Store(&Memory{ID: "event-1", Type: ShortTerm, Content: "Again", Importance: 0.5}); err == nil {
+		t.Error("Store should still reject duplicate IDs")
+	}
+
+	store.mu.RLock()
+	if len(store.memories) != 1 {
+		t.Errorf("Expected 1 memory, got %d", len(store.memories))
+	}
+	stored := store.memories["event-1"]
+	if stored != first {
+		t.Error("Upsert should update the existing memory in place")
+	}
+	if stored.Content != "Rollback finished" || stored.Importance != 0.7 {
+		t.Errorf("Memory not updated: %+v", stored)
+	}
+	if _, inOldType := store.typeIndex[ShortTerm]["event-1"]; inOldType {
+		t.Error("Memory still indexed under its old type")
+	}
+	if _, inNewType := store.typeIndex[Episodic]["event-1"]; !inNewType {
+		t.Error("Memory not indexed under its new type")
+	}
+	store.mu.RUnlock()
+
+	if results := store.findByKeywords([]string{"deployment"}); len(results) != 0 {
+		t.Errorf("Old content still indexed, got %d results", len(results))
+	}
+	if results := store.findByKeywords([]string{"rollback"}); len(results) != 1 {
+		t.Errorf("Expected new content to be indexed, got %d results", len(results))
+	}
+}
+
+// Test time indexing and cleanup at minute and day granularity
+func TestTimeBucketGranularity(t *testing.T) {
+	tests := []struct {
+		granularity string
+		layout      string
+		sameBucket  time.Duration // offset that must share a bucket with base
+		otherBucket time.Duration // offset that must land in a different bucket
+	}{
+		{granularity: "minute", layout: "2006-01-02-15-04", sameBucket: 10 * time.Second, otherBucket: 5 * time.Minute},
+		{granularity: "day", layout: "2006-01-02", sameBucket: time.Minute, otherBucket: 3 * 24 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.granularity, func(t *testing.T) {
+			config := DefaultConfig()
+			config.MaxMemories = 10
+			config.TimeBucket = tt.granularity
+			if err := config.Validate(); err != nil {
+				t.Fatalf("Validate failed: %v", err)
+			}
+			store := NewMemoryStoreWithConfig(config)
+			defer store.Shutdown()
+
+			base := time.Now().Truncate(24 * time.Hour).Add(12 * time.Hour)
+			memories := []*Memory{
+				{ID: "base", Type: ShortTerm, Content: "Base", Importance: 0.5, Timestamp: base},
+				{ID: "same", Type: ShortTerm, Content: "Same bucket", Importance: 0.5, Timestamp: base.Add(tt.sameBucket)},
+				{ID: "other", Type: ShortTerm, Content: "Other bucket", Importance: 0.5, Timestamp: base.Add(-tt.otherBucket)},
+			}
+			for _, m := range memories {
+				if err := store.Store(m); err != nil {
+					t.Fatalf("Failed to store memory: %v", err)
+				}
+			}
+
+			store.timeIndex.mu.RLock()
+			bucketCount := len(store.timeIndex.buckets)
+			baseBucket := store.timeIndex.buckets[base.UTC().Format(tt.layout)]
+			store.timeIndex.mu.RUnlock()
+			if bucketCount != 2 {
+				t.Errorf("Expected 2 buckets, got %d", bucketCount)
+			}
+			if len(baseBucket) != 2 {
+				t.Errorf("Expected 2 memories in base bucket, got %d", len(baseBucket))
+			}
+
+			results := store.findTemporal(base.Add(-time.Second), base.Add(tt.sameBucket+time.Second))
+			if len(results) != 2 {
+				t.Errorf("Expected 2 temporal results, got %d", len(results))
+			}
+
+			// Buckets older than the retention cutoff are dropped in the same layout
+			oldBucket := time.Now().Add(-10 * 24 * time.Hour).UTC().Format(tt.layout)
+			store.timeIndex.mu.Lock()
+			store.timeIndex.buckets[oldBucket] = []*Memory{{ID: "old", Content: "Old"}}
+			store.timeIndex.mu.Unlock()
+
+			store.cleanupTimeBuckets()
+
+			store.timeIndex.mu.RLock()
+			_, oldExists := store.timeIndex.buckets[oldBucket]
+			store.timeIndex.mu.RUnlock()
+			if oldExists {
+				t.Error("Old bucket should have been cleaned up")
+			}
+		})
+	}
+
+	config := DefaultConfig()
+	config.TimeBucket = "week"
+	if err := config.Validate(); err == nil {
+		t.Error("Expected validation error for unknown granularity")
+	}
+}
+
+// Test that temporal queries find old live memories but not removed ones
+func TestTimeRetentionKeepsLiveMemories(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxMemories = 10
+	config.TimeRetention = 7 * 24 * time.Hour
+	store := NewMemoryStoreWithConfig(config)
+	defer store.Shutdown()
+
+	tenDaysAgo := time.Now().Add(-10 * 24 * time.Hour)
+	memories := []*Memory{
+		{ID: "old-live", Type: LongTerm, Content: "Old but still relevant", Importance: 0.9, Timestamp: tenDaysAgo},
+		{ID: "old-removed", Type: ShortTerm, Content: "Old and forgotten", Importance: 0.5, Timestamp: tenDaysAgo},
+	}
+	for _, m := range memories {
+		if err := store.Store(m); err != nil {
+			t.Fatalf("Failed to store memory: %v", err)
+		}
+	}
+
+	store.mu.Lock()
+	store.removeMemory("old-removed")
+	store.cleanupTimeBuckets()
+	store.mu.Unlock()
+
+	results := store.findTemporal(tenDaysAgo.Add(-time.Hour), time.Now())
+	if len(results) != 1 || results[0].ID != "old-live" {
+		ids := make([]string, len(results))
+		for i, mem := range results {
+			ids[i] = mem.ID
+		}
+		t.Errorf("Expected only old-live, got %v", ids)
+	}
+}
+
+// Test content length enforcement in reject and truncate modes
+func TestContentLengthLimit(t *testing.T) {
+	longContent := strings.Repeat("word ", 50) // 250 characters
+
+	t.Run("reject", func(t *testing.T) {
+		config := DefaultConfig()
+		config.MaxMemories = 10
+		config.MaxContentLength = 100
+		config.ContentOverflow = "reject"
+		store := NewMemoryStoreWithConfig(config)
+		defer store.Shutdown()
+
+		err := store.Store(&Memory{ID: "long", Type: ShortTerm, Content: longContent, Importance: 0.5})
+		if err == nil {
+			t.Fatal("Expected oversized content to be rejected")
+		}
+		if len(store.memories) != 0 {
+			t.Errorf("Rejected memory should not be stored")
+		}
+		if err := store.Store(&Memory{ID: "short", Type: ShortTerm, Content: "fits", Importance: 0.5}); err != nil {
+			t.Errorf("Content within limit should be stored: %v", err)
+		}
+	})
+
+	t.Run("truncate", func(t *testing.T) {
+		config := DefaultConfig()
+		config.MaxMemories = 10
+		config.MaxContentLength = 100
+		config.ContentOverflow = "truncate"
+		store := NewMemoryStoreWithConfig(config)
+		defer store.Shutdown()
+
+		memory := &Memory{ID: "long", Type: ShortTerm, Content: longContent, Importance: 0.5}
+		if err := store.Store(memory); err != nil {
+			t.Fatalf("Expected oversized content to be truncated, got error: %v", err)
+		}
+		if len([]rune(memory.Content)) != 100 {
+			t.Errorf("Expected content truncated to 100 characters, got %d", len([]rune(memory.Content)))
+		}
+		if !memory.Truncated {
+			t.Error("Expected truncated flag to be set")
+		}
+	})
+
+	t.Run("unlimited by default", func(t *testing.T) {
+		store := NewMemoryStore(10)
+		defer store.Shutdown()
+
+		huge := strings.Repeat("word ", 5000)
+		if err := store.Store(&Memory{ID: "huge", Type: ShortTerm, Content: huge, Importance: 0.5}); err != nil {
+			t.Errorf("Expected no content limit by default, got %v", err)
+		}
+	})
+
+	config := DefaultConfig()
+	config.ContentOverflow = "drop"
+	if err := config.Validate(); err == nil {
+		t.Error("Expected validation error for unknown overflow mode")
+	}
+}
+
+// Test that oversized and deeply nested metadata is rejected on store and upsert
+func TestMetadataLimits(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxMemories = 10
+	config.MaxMetadataBytes = 100
+	config.MaxMetadataDepth = 3
+	store := NewMemoryStoreWithConfig(config)
+	defer store.Shutdown()
+	server := &MCPServer{store: store}
+
+	oversized := map[string]interface{}{"blob": strings.Repeat("x", 200)}
+	_, err := server.StoreMemory(context.Background(), StoreMemoryArgs{ID: "big", Content: "Big metadata", Importance: 0.5, Metadata: oversized})
+	if !errors.Is(err, ErrValidation) || !strings.Contains(err.Error(), "size") {
+		t.Errorf("Expected a size validation error, got %v", err)
+	}
+
+	// Depth 4: metadata -> a -> b -> c
+	nested := map[string]interface{}{"a": map[string]interface{}{"b": []interface{}{map[string]interface{}{"c": 1}}}}
+	if depth := metadataDepth(nested); depth != 4 {
+		t.Errorf("Expected depth 4, got %d", depth)
+	}
+	if err := store.Store(&Memory{ID: "deep", Type: ShortTerm, Content: "Deep metadata", Importance: 0.5, Metadata: nested}); !errors.Is(err, ErrValidation) || !strings.Contains(err.Error(), "depth") {
+		t.Errorf("Expected a depth validation error, got %v", err)
+	}
+
+	fits := map[string]interface{}{"a": map[string]interface{}{"b": []interface{}{"c"}}}
+	if err := store.Store(&Memory{ID: "ok", Type: ShortTerm, Content: "Fitting metadata", Importance: 0.5, Metadata: fits}); err != nil {
+		t.Fatalf("Expected metadata within limits to be stored: %v", err)
+	}
+	if err := store.Upsert(&Memory{ID: "ok", Type: ShortTerm, Content: "Fitting metadata", Importance: 0.5, Metadata: oversized}); !errors.Is(err, ErrValidation) {
+		t.Errorf("Expected upsert with oversized metadata to be rejected, got %v", err)
+	}
+	if len(store.memories) != 1 || store.memories["ok"].Metadata["blob"] != nil {
+		t.Error("Rejected metadata should not be stored")
+	}
+
+	config.MaxMetadataDepth = -1
+	if err := config.Validate(); err == nil {
+		t.Error("Expected validation error for a negative depth limit")
+	}
+}
+
+// Test that content normalization detects duplicates that differ in case and whitespace
+func TestContentNormalizationDedup(t *testing.T) {
+	config := DefaultConfig()
+	config.ContentNormalization = "lowercase"
+	store := NewMemoryStoreWithConfig(config)
+	defer store.Shutdown()
+
+	original := "The deploy runs on Tuesdays"
+	if err := store.Store(&Memory{ID: "first", Type: Semantic, Content: original, Importance: 0.5}); err != nil {
+		t.Fatalf("Failed to store memory: %v", err)
+	}
+
+	err := store.Store(&Memory{ID: "second", Type: Semantic, Content: "  the DEPLOY runs\n on   tuesdays ", Importance: 0.5})
+	if !errors.Is(err, ErrDuplicateID) || !strings.Contains(err.Error(), "first") {
+		t.Fatalf("Expected a duplicate content error naming first, got %v", err)
+	}
+	if len(store.memories) != 1 || store.memories["first"].Content != original {
+		t.Errorf("Expected only first with its original content, got %v", store.memories)
+	}
+
+	// Updating a memory with its own content in another form is not a duplicate
+	if err := store.Upsert(&Memory{ID: "first", Type: Semantic, Content: "THE DEPLOY RUNS ON TUESDAYS", Importance: 0.6}); err != nil {
+		t.Errorf("Expected an upsert of the same memory to succeed, got %v", err)
+	}
+
+	// The old content is released once a memory changes or is removed
+	store.Upsert(&Memory{ID: "first", Type: Semantic, Content: "The deploy moved to Wednesdays", Importance: 0.5})
+	if err := store.Store(&Memory{ID: "second", Type: Semantic, Content: "the deploy runs on tuesdays", Importance: 0.5}); err != nil {
+		t.Errorf("Expected released content to be storable, got %v", err)
+	}
+	store.mu.Lock()
+	store.removeMemory("first")
+	store.mu.Unlock()
+	if err := store.Store(&Memory{ID: "third", Type: Semantic, Content: "The deploy moved to  Wednesdays", Importance: 0.5}); err != nil {
+		t.Errorf("Expected a removed memory's content to be storable, got %v", err)
+	}
+
+	// Whitespace mode still tells case apart
+	config.ContentNormalization = "whitespace"
+	caseSensitive := NewMemoryStoreWithConfig(config)
+	defer caseSensitive.Shutdown()
+	caseSensitive.Store(&Memory{ID: "a", Type: Semantic, Content: "Use Go", Importance: 0.5})
+	if err := caseSensitive.Store(&Memory{ID: "b", Type: Semantic, Content: "use go", Importance: 0.5}); err != nil {
+		t.Errorf("Expected different case to be distinct in whitespace mode, got %v", err)
+	}
+	if err := caseSensitive.Store(&Memory{ID: "c", Type: Semantic, Content: " Use\tGo ", Importance: 0.5}); !errors.Is(err, ErrDuplicateID) {
+		t.Errorf("Expected different whitespace to be a duplicate, got %v", err)
+	}
+}
+
+// Test that content IDs make re-storing the same content a duplicate
+func TestContentIDs(t *testing.T) {
+	config := DefaultConfig()
+	config.IDMode = "content"
+	config.IDNamespace = "import"
+	store := NewMemoryStoreWithConfig(config)
+	defer store.Shutdown()
+	server := &MCPServer{store: store}
+
+	first, err := server.StoreMemory(nil, StoreMemoryArgs{Type: Semantic, Content: "The deploy runs on Tuesdays", Importance: 0.5})
+	if err != nil {
+		t.Fatalf("Failed to store memory: %v", err)
+	}
+	_, err = server.StoreMemory(nil, StoreMemoryArgs{Type: Semantic, Content: " The deploy  runs on Tuesdays\n", Importance: 0.5})
+	if !errors.Is(err, ErrDuplicateID) {
+		t.Fatalf("Expected a duplicate ID error for the same content, got %v", err)
+	}
+
+	// Replaying with upsert updates the same memory
+	updated, err := server.StoreMemory(nil, StoreMemoryArgs{Type: Semantic, Content: "The deploy runs on Tuesdays", Importance: 0.8, Upsert: true})
+	if err != nil {
+		t.Fatalf("Failed to upsert memory: %v", err)
+	}
+	if updated.ID != first.ID || len(store.memories) != 1 {
+		t.Errorf("Expected upsert to update %s in place, got %s with %d memories", first.ID, updated.ID, len(store.memories))
+	}
+
+	// Another namespace derives a different ID for the same content
+	config.IDNamespace = "other"
+	other := NewMemoryStoreWithConfig(config)
+	defer other.Shutdown()
+	if id := other.contentID("The deploy runs on Tuesdays"); id == first.ID {
+		t.Errorf("Expected a different ID in another namespace, got %s for both", id)
+	}
+
+	// Timestamp IDs stay the default
+	plain := &MCPServer{store: NewMemoryStore(10)}
+	defer plain.store.Shutdown()
+	a, _ := plain.StoreMemory(nil, StoreMemoryArgs{Type: Semantic, Content: "same", Importance: 0.5})
+	b, err := plain.StoreMemory(nil, StoreMemoryArgs{Type: Semantic, Content: "same", Importance: 0.5})
+	if err != nil || a.ID == b.ID {
+		t.Errorf("Expected distinct timestamp IDs, got %v and %v (err %v)", a.ID, b, err)
+	}
+}
+
+// Test snippet extraction around keyword matches
+func TestMakeSnippet(t *testing.T) {
+	content := strings.Repeat("filler text about nothing in particular. ", 10) +
+		"The deploy pipeline runs Kubernetes jobs and the Kubernetes cluster scales. " +
+		strings.Repeat("more unrelated filler sentences here. ", 10) +
+		"A lone deploy note at the end."
+
+	const maxLen = 80
+	snippet := makeSnippet(content, []string{"kubernetes", "deploy"}, maxLen, false)
+
+	if !strings.Contains(snippet, "**Kubernetes**") {
+		t.Errorf("Snippet should mark the keyword match, got %q", snippet)
+	}
+	if !strings.Contains(snippet, "**deploy**") {
+		t.Errorf("Snippet should pick the window with the most matches, got %q", snippet)
+	}
+
+	excerpt := strings.TrimSuffix(strings.TrimPrefix(snippet, "..."), "...")
+	excerpt = strings.ReplaceAll(excerpt, "**", "")
+	if len([]rune(excerpt)) > maxLen {
+		t.Errorf("Excerpt length %d exceeds max %d", len([]rune(excerpt)), maxLen)
+	}
+
+	short := makeSnippet("Short note", []string{"missing"}, maxLen, false)
+	if short != "Short note" {
+		t.Errorf("Expected short content unchanged, got %q", short)
+	}
+}
+
+// Test that posting lists behave the same below and above the map threshold
+func TestPostingList(t *testing.T) {
+	p := &postingList{}
+	count := postingListMapThreshold * 2
+	for i := 0; i < count; i++ {
+		p.add(&Memory{ID: fmt.Sprintf("m%d", i)})
+		p.add(&Memory{ID: fmt.Sprintf("m%d", i)}) // re-adding replaces rather than duplicates
+		if p.len() != i+1 {
+			t.Fatalf("Expected %d postings, got %d", i+1, p.len())
+		}
+	}
+	if p.large == nil {
+		t.Error("Expected a large posting list to switch to a map")
+	}
+
+	for i := 0; i < count; i += 2 {
+		p.remove(fmt.Sprintf("m%d", i))
+	}
+	if p.len() != count/2 || p.contains("m0") || !p.contains("m1") {
+		t.Errorf("Unexpected postings after removal: len %d", p.len())
+	}
+
+	seen := 0
+	p.each(func(*Memory) { seen++ })
+	if seen != count/2 {
+		t.Errorf("Expected each to visit %d memories, got %d", count/2, seen)
+	}
+
+	small := &postingList{}
+	small.add(&Memory{ID: "a"})
+	small.add(&Memory{ID: "b"})
+	small.remove("a")
+	if small.large != nil || small.len() != 1 || small.contains("a") || !small.contains("b") {
+		t.Errorf("Unexpected small posting list state: %+v", small)
+	}
+}
+
+// Test that a keyword query without keywords fails by default, or lists
+// everything up to the limit when configured to
+func TestEmptyKeywordQuery(t *testing.T) {
+	for _, mode := range []string{"reject", "all"} {
+		config := DefaultConfig()
+		config.MaxMemories = 10
+		config.EmptyKeywordQuery = mode
+		store := NewMemoryStoreWithConfig(config)
+		defer store.Shutdown()
+
+		for i := 0; i < 5; i++ {
+			store.Store(&Memory{ID: fmt.Sprintf("mem-%d", i), Type: allMemoryTypes[i], Content: fmt.Sprintf("Memory %d", i), Importance: float32(i+1) / 10})
+		}
+
+		results, err := store.Query(QueryCriteria{Type: "keywords", Limit: 3})
+		if mode == "reject" {
+			if !errors.Is(err, ErrValidation) {
+				t.Errorf("Expected a validation error for no keywords, got %v (%d results)", err, len(results))
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+		var ids []string
+		for _, mem := range results {
+			ids = append(ids, mem.ID)
+		}
+		if !reflect.DeepEqual(ids, []string{"mem-4", "mem-3", "mem-2"}) {
+			t.Errorf("Expected the 3 most important memories, got %v", ids)
+		}
+	}
+}
+
+// Test that phrase queries match adjacent words in order, and scattered ones only within a distance
+func TestPhraseQuery(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxMemories = 10
+	config.PositionalIndex = true
+	store := NewMemoryStoreWithConfig(config)
+	defer store.Shutdown()
+
+	store.Store(&Memory{ID: "adjacent", Type: Semantic, Content: "The deploy failed on the build server today", Importance: 0.5})
+	store.Store(&Memory{ID: "scattered", Type: Semantic, Content: "The build passed, but the server later failed to deploy", Importance: 0.6})
+	store.Store(&Memory{ID: "reversed", Type: Semantic, Content: "Our server build is slow", Importance: 0.4})
+
+	phraseIDs := func(phrase string, within int) []string {
+		results, err := store.Query(QueryCriteria{Type: "phrase", Phrase: phrase, Within: within})
+		if err != nil {
+			t.Fatalf("Phrase query %q failed: %v", phrase, err)
+		}
+		var ids []string
+		for _, mem := range results {
+			ids = append(ids, mem.ID)
+		}
+		return ids
+	}
+
+	if ids := phraseIDs("build server", 0); !reflect.DeepEqual(ids, []string{"adjacent"}) {
+		t.Errorf("Expected only the adjacent phrase to match, got %v", ids)
+	}
+	// Short words are skipped but keep their place
+	if ids := phraseIDs("failed on the build", 0); !reflect.DeepEqual(ids, []string{"adjacent"}) {
+		t.Errorf("Expected the phrase with short words to match, got %v", ids)
+	}
+	if ids := phraseIDs("build server", 1); !reflect.DeepEqual(ids, []string{"adjacent", "reversed"}) {
+		t.Errorf("Expected adjacent words in either order within 1, got %v", ids)
+	}
+	if ids := phraseIDs("build server", 4); !reflect.DeepEqual(ids, []string{"scattered", "adjacent", "reversed"}) {
+		t.Errorf("Expected every memory within 4 words, got %v", ids)
+	}
+	// Each repeat of a word needs its own occurrence
+	if ids := phraseIDs("build build", 3); len(ids) != 0 {
+		t.Errorf("Expected one build to match only one term, got %v", ids)
+	}
+	store.Store(&Memory{ID: "twice", Type: Semantic, Content: "Build after build", Importance: 0.3})
+	if ids := phraseIDs("build build", 3); !reflect.DeepEqual(ids, []string{"twice"}) {
+		t.Errorf("Expected only the memory with two builds to match, got %v", ids)
+	}
+
+	// Updates reindex positions
+	store.Upsert(&Memory{ID: "adjacent", Type: Semantic, Content: "The server for the build was replaced", Importance: 0.5})
+	if ids := phraseIDs("build server", 0); len(ids) != 0 {
+		t.Errorf("Expected no match after the update, got %v", ids)
+	}
+
+	plain := NewMemoryStore(10)
+	defer plain.Shutdown()
+	if _, err := plain.Query(QueryCriteria{Type: "phrase", Phrase: "build server"}); !errors.Is(err, ErrValidation) {
+		t.Errorf("Expected a validation error without the positional index, got %v", err)
+	}
+}
+
+// Test that repeated reads by ID hit the recent cache until the memory changes
+func TestRecentCache(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxMemories = 10
+	config.RecentCacheSize = 2
+	store := NewMemoryStoreWithConfig(config)
+	defer store.Shutdown()
+
+	store.Store(&Memory{ID: "hot", Type: Semantic, Content: "Read over and over", Importance: 0.5})
+	store.Store(&Memory{ID: "cold", Type: Semantic, Content: "Read once", Importance: 0.5})
+
+	first, err := store.GetByID("hot")
+	if err != nil {
+		t.Fatalf("GetByID failed: %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		if again, _ := store.GetByID("hot"); again != first {
+			t.Fatal("Expected repeated reads to return the cached snapshot")
+		}
+	}
+	stats := store.recentCache.stats()
+	if stats["hits"] != uint64(4) || stats["misses"] != uint64(1) {
+		t.Errorf("Expected 4 hits and 1 miss, got %v", stats)
+	}
+
+	// An update drops the snapshot, so the next read sees it
+	store.Upsert(&Memory{ID: "hot", Type: Semantic, Content: "Read over and over, revised", Importance: 0.5})
+	if updated, _ := store.GetByID("hot"); updated.Content != "Read over and over, revised" {
+		t.Errorf("Expected the updated content after invalidation, got %q", updated.Content)
+	}
+	if stats := store.recentCache.stats(); stats["misses"] != uint64(2) {
+		t.Errorf("Expected the read after the update to miss, got %v", stats)
+	}
+
+	// A removed memory is never served from the cache
+	store.GetByID("cold")
+	store.mu.Lock()
+	store.removeMemory("cold")
+	store.mu.Unlock()
+	if _, err := store.GetByID("cold"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected a removed memory to be not found, got %v", err)
+	}
+
+	// A snapshot taken before a concurrent invalidation is not cached
+	generation := store.recentCache.currentGeneration()
+	store.recentCache.invalidate("hot")
+	store.recentCache.put(&Memory{ID: "hot", Content: "Stale"}, generation)
+	if _, ok := store.recentCache.get("hot"); ok {
+		t.Error("Expected a snapshot older than an invalidation to be dropped")
+	}
+}
+
+// Test that pruning drops one-off keywords of unimportant memories and keeps the rest
+func TestPruneKeywords(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxMemories = 10
+	config.KeywordPruneImportance = 0.3
+	store := NewMemoryStoreWithConfig(config)
+	defer store.Shutdown()
+
+	store.Store(&Memory{ID: "noisy", Type: ShortTerm, Content: "Deploy log for request x7f3qz9 with a tpyo", Importance: 0.1})
+	store.Store(&Memory{ID: "important", Type: Semantic, Content: "Deploy checklist mentions zebracorn", Importance: 0.9})
+	store.Store(&Memory{ID: "pinned", Type: ShortTerm, Content: "Deploy token k9v2", Importance: 0.1, Pinned: true})
+
+	report := store.PruneKeywords(true)
+	want := []string{"for", "log", "request", "tpyo", "with", "x7f3qz9"}
+	if !reflect.DeepEqual(report.Keywords, want) || report.Pruned {
+		t.Fatalf("Expected a report of %v without pruning, got %+v", want, report)
+	}
+	if results, _ := store.Query(QueryCriteria{Type: "keywords", Keywords: []string{"x7f3qz9"}}); len(results) != 1 {
+		t.Errorf("Expected a report-only pass to leave the index alone, got %d results", len(results))
+	}
+
+	store.PruneKeywords(false)
+	for keyword, wantMatches := range map[string]int{
+		"x7f3qz9":   0, // one-off in an unimportant memory
+		"tpyo":      0,
+		"deploy":    3, // shared by several memories
+		"zebracorn": 1, // one-off in an important memory
+		"k9v2":      1, // one-off in a pinned memory
+	} {
+		results, err := store.Query(QueryCriteria{Type: "keywords", Keywords: []string{keyword}})
+		if err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+		if len(results) != wantMatches {
+			t.Errorf("Expected %d memories for %q after pruning, got %d", wantMatches, keyword, len(results))
+		}
+	}
+
+	// Pruned keywords no longer co-occur with the memory's other keywords
+	for _, count := range store.CooccurringKeywords("deploy", 0) {
+		if count.Keyword == "x7f3qz9" || count.Keyword == "tpyo" {
+			t.Errorf("Expected pruned keyword %q not to co-occur with deploy", count.Keyword)
+		}
+	}
+
+	// Removing the memory still works with its keywords pruned
+	store.mu.Lock()
+	store.removeMemory("noisy")
+	store.mu.Unlock()
+	if results, _ := store.Query(QueryCriteria{Type: "keywords", Keywords: []string{"deploy"}}); len(results) != 2 {
+		t.Errorf("Expected 2 deploy memories after removal, got %d", len(results))
+	}
+
+	// A read-only store only reports
+	store.Store(&Memory{ID: "frozen", Type: ShortTerm, Content: "Frozen qq81zz", Importance: 0.1})
+	store.SetReadOnly(true)
+	if report := store.PruneKeywords(false); report.Pruned || !slices.Contains(report.Keywords, "qq81zz") {
+		t.Errorf("Expected a read-only store to report without pruning, got %+v", report)
+	}
+	if results, _ := store.Query(QueryCriteria{Type: "keywords", Keywords: []string{"qq81zz"}}); len(results) != 1 {
+		t.Errorf("Expected a read-only store to keep its keywords, got %d results", len(results))
+	}
+	config.KeywordPrune = "prune"
+	config.ReadOnly = true
+	if err := config.Validate(); err == nil {
+		t.Error("Expected --keyword-prune=prune with --read-only to fail validation")
+	}
+}
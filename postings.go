@@ -0,0 +1,93 @@
+package main
+
+// postingListMapThreshold is the size at which a posting list switches from a
+// slice to a map. Most terms occur in only a few memories, and a short slice
+// costs far less memory than a map while scanning it is just as fast.
+const postingListMapThreshold = 32
+
+// postingList holds the memories containing one indexed term. Short lists
+// are a slice; lists that outgrow postingListMapThreshold move to a map so
+// membership checks and removals on common terms stay O(1).
+type postingList struct {
+	small []*Memory
+	large map[string]*Memory
+}
+
+// add links the memory, replacing any entry with the same ID
+func (p *postingList) add(memory *Memory) {
+	if p.large != nil {
+		p.large[memory.ID] = memory
+		return
+	}
+
+	for i, mem := range p.small {
+		if mem.ID == memory.ID {
+			p.small[i] = memory
+			return
+		}
+	}
+	p.small = append(p.small, memory)
+
+	if len(p.small) > postingListMapThreshold {
+		p.large = make(map[string]*Memory, len(p.small))
+		for _, mem := range p.small {
+			p.large[mem.ID] = mem
+		}
+		p.small = nil
+	}
+}
+
+// remove unlinks the memory with the given ID
+func (p *postingList) remove(id string) {
+	if p.large != nil {
+		delete(p.large, id)
+		return
+	}
+
+	for i, mem := range p.small {
+		if mem.ID == id {
+			last := len(p.small) - 1
+			p.small[i] = p.small[last]
+			p.small[last] = nil
+			p.small = p.small[:last]
+			return
+		}
+	}
+}
+
+// contains reports whether the memory with the given ID is linked
+func (p *postingList) contains(id string) bool {
+	if p.large != nil {
+		_, ok := p.large[id]
+		return ok
+	}
+
+	for _, mem := range p.small {
+		if mem.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// len returns the number of linked memories
+func (p *postingList) len() int {
+	if p.large != nil {
+		return len(p.large)
+	}
+	return len(p.small)
+}
+
+// each calls fn for every linked memory, in no particular order
+func (p *postingList) each(fn func(*Memory)) {
+	if p.large != nil {
+		for _, mem := range p.large {
+			fn(mem)
+		}
+		return
+	}
+
+	for _, mem := range p.small {
+		fn(mem)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+// newProfilingMux routes the pprof handlers on a dedicated mux so nothing
+// else registered on http.DefaultServeMux is exposed
+func newProfilingMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// startProfiling serves pprof on addr in the background and returns the
+// listener, whose address reflects the chosen port when addr uses port 0
+func startProfiling(addr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for profiling: %w", err)
+	}
+
+	go func() {
+		if err := http.Serve(listener, newProfilingMux()); err != nil {
+			slog.Error("Profiling server stopped", "err", err)
+		}
+	}()
+
+	return listener, nil
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// Test that pprof handlers are reachable once profiling starts
+func TestStartProfiling(t *testing.T) {
+	listener, err := startProfiling("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("startProfiling failed: %v", err)
+	}
+	defer listener.Close()
+
+	resp, err := http.Get("http://" + listener.Addr().String() + "/debug/pprof/heap?debug=1")
+	if err != nil {
+		t.Fatalf("Failed to reach pprof: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"container/list"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// QueryCache is a small LRU of keyword query results keyed by canonical query.
+// It stores memory IDs rather than memories so entries never pin removed
+// memories, and it is cleared on every store mutation. A nil cache is disabled.
+type QueryCache struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	entries  map[string]*list.Element
+	order    *list.List // front is most recently used
+	hits     uint64
+	misses   uint64
+}
+
+// queryCacheEntry is one cached result set
+type queryCacheEntry struct {
+	key     string
+	ids     []string
+	expires time.Time
+}
+
+// NewQueryCache creates a cache holding up to capacity queries, or nil if capacity is 0
+func NewQueryCache(capacity int, ttl time.Duration) *QueryCache {
+	if capacity <= 0 {
+		return nil
+	}
+	return &QueryCache{
+		capacity: capacity,
+		ttl:      ttl,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// queryCacheKey canonicalizes keyword query criteria so equivalent queries share an entry
+func queryCacheKey(criteria QueryCriteria) string {
+	keywords := make([]string, 0, len(criteria.Keywords))
+	seen := make(map[string]bool, len(criteria.Keywords))
+	for _, keyword := range criteria.Keywords {
+		lower := strings.ToLower(keyword)
+		if !seen[lower] {
+			seen[lower] = true
+			keywords = append(keywords, lower)
+		}
+	}
+	sort.Strings(keywords)
+
+	return criteria.Type + "|" + string(criteria.MemoryType) + "|" +
+		strconv.Itoa(criteria.Limit) + "|" + strings.Join(keywords, ",")
+}
+
+// get returns the cached IDs for key, counting a hit or miss
+func (qc *QueryCache) get(key string, now time.Time) ([]string, bool) {
+	if qc == nil {
+		return nil, false
+	}
+
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+
+	elem, ok := qc.entries[key]
+	if !ok {
+		qc.misses++
+		return nil, false
+	}
+
+	entry := elem.Value.(*queryCacheEntry)
+	if now.After(entry.expires) {
+		qc.order.Remove(elem)
+		delete(qc.entries, key)
+		qc.misses++
+		return nil, false
+	}
+
+	qc.order.MoveToFront(elem)
+	qc.hits++
+	return entry.ids, true
+}
+
+// put caches the IDs of a result set, evicting the least recently used entry when full
+func (qc *QueryCache) put(key string, results []*Memory, now time.Time) {
+	if qc == nil {
+		return
+	}
+
+	ids := make([]string, len(results))
+	for i, mem := range results {
+		ids[i] = mem.ID
+	}
+
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+
+	if elem, ok := qc.entries[key]; ok {
+		entry := elem.Value.(*queryCacheEntry)
+		entry.ids = ids
+		entry.expires = now.Add(qc.ttl)
+		qc.order.MoveToFront(elem)
+		return
+	}
+
+	if qc.order.Len() >= qc.capacity {
+		oldest := qc.order.Back()
+		qc.order.Remove(oldest)
+		delete(qc.entries, oldest.Value.(*queryCacheEntry).key)
+	}
+
+	qc.entries[key] = qc.order.PushFront(&queryCacheEntry{key: key, ids: ids, expires: now.Add(qc.ttl)})
+}
+
+// invalidate drops every cached entry
+func (qc *QueryCache) invalidate() {
+	if qc == nil {
+		return
+	}
+
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+
+	if len(qc.entries) == 0 {
+		return
+	}
+	qc.entries = make(map[string]*list.Element)
+	qc.order.Init()
+}
+
+// stats reports cache size and hit rate
+func (qc *QueryCache) stats() map[string]interface{} {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+
+	hitRate := 0.0
+	if total := qc.hits + qc.misses; total > 0 {
+		hitRate = float64(qc.hits) / float64(total)
+	}
+
+	return map[string]interface{}{
+		"entries":  len(qc.entries),
+		"hits":     qc.hits,
+		"misses":   qc.misses,
+		"hit_rate": hitRate,
+	}
+}
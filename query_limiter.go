@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// QueryLimiter caps how many similarity and keyword queries run at once.
+// Queries over the cap wait in line for a slot, so a burst from many shared
+// clients queues up instead of every scan competing for CPU. A nil limiter
+// is unlimited.
+type QueryLimiter struct {
+	slots   chan struct{}
+	waiting atomic.Int64
+}
+
+// NewQueryLimiter creates a limiter allowing max concurrent queries, or nil if max is 0
+func NewQueryLimiter(max int) *QueryLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &QueryLimiter{slots: make(chan struct{}, max)}
+}
+
+// acquire waits for a free slot, giving up when ctx is done
+func (ql *QueryLimiter) acquire(ctx context.Context) error {
+	if ql == nil {
+		return nil
+	}
+
+	// Skip the waiting count when a slot is free
+	select {
+	case ql.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	ql.waiting.Add(1)
+	defer ql.waiting.Add(-1)
+	select {
+	case ql.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release frees a slot taken by acquire
+func (ql *QueryLimiter) release() {
+	if ql != nil {
+		<-ql.slots
+	}
+}
+
+// stats reports the limit and how many queries are running and waiting
+func (ql *QueryLimiter) stats() map[string]interface{} {
+	return map[string]interface{}{
+		"max_concurrent": cap(ql.slots),
+		"running":        len(ql.slots),
+		"waiting":        ql.waiting.Load(),
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// RecentCache is a small LRU of snapshots of recently read memories, so
+// agents re-reading the same few memories by ID are served without taking
+// the store lock. Any change to a memory, including decay and recorded
+// accesses, drops its snapshot. A nil cache is disabled.
+type RecentCache struct {
+	mu         sync.Mutex
+	capacity   int
+	entries    map[string]*list.Element
+	order      *list.List // front is most recently used
+	generation uint64     // bumped by every invalidation
+	hits       uint64
+	misses     uint64
+}
+
+// NewRecentCache creates a cache holding up to capacity memories, or nil if capacity is 0
+func NewRecentCache(capacity int) *RecentCache {
+	if capacity <= 0 {
+		return nil
+	}
+	return &RecentCache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// get returns the cached snapshot for id, counting a hit or miss
+func (rc *RecentCache) get(id string) (*Memory, bool) {
+	if rc == nil {
+		return nil, false
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	elem, ok := rc.entries[id]
+	if !ok {
+		rc.misses++
+		return nil, false
+	}
+	rc.order.MoveToFront(elem)
+	rc.hits++
+	return elem.Value.(*Memory), true
+}
+
+// currentGeneration returns the invalidation generation, to pass to put
+func (rc *RecentCache) currentGeneration() uint64 {
+	if rc == nil {
+		return 0
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.generation
+}
+
+// put caches a snapshot taken at generation, evicting the least recently
+// used one when full. A snapshot taken before any later invalidation may be
+// stale, so it is dropped rather than cached.
+func (rc *RecentCache) put(snapshot *Memory, generation uint64) {
+	if rc == nil {
+		return
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if generation != rc.generation {
+		return
+	}
+
+	if elem, ok := rc.entries[snapshot.ID]; ok {
+		elem.Value = snapshot
+		rc.order.MoveToFront(elem)
+		return
+	}
+
+	if rc.order.Len() >= rc.capacity {
+		oldest := rc.order.Back()
+		rc.order.Remove(oldest)
+		delete(rc.entries, oldest.Value.(*Memory).ID)
+	}
+	rc.entries[snapshot.ID] = rc.order.PushFront(snapshot)
+}
+
+// invalidate drops the snapshot of one memory
+func (rc *RecentCache) invalidate(id string) {
+	if rc == nil {
+		return
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	rc.generation++
+	if elem, ok := rc.entries[id]; ok {
+		rc.order.Remove(elem)
+		delete(rc.entries, id)
+	}
+}
+
+// clear drops every snapshot
+func (rc *RecentCache) clear() {
+	if rc == nil {
+		return
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	rc.generation++
+	if len(rc.entries) == 0 {
+		return
+	}
+	rc.entries = make(map[string]*list.Element)
+	rc.order.Init()
+}
+
+// stats reports cache size and hit rate
+func (rc *RecentCache) stats() map[string]interface{} {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	hitRate := 0.0
+	if total := rc.hits + rc.misses; total > 0 {
+		hitRate = float64(rc.hits) / float64(total)
+	}
+
+	return map[string]interface{}{
+		"entries":  len(rc.entries),
+		"capacity": rc.capacity,
+		"hits":     rc.hits,
+		"misses":   rc.misses,
+		"hit_rate": hitRate,
+	}
+}
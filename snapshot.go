@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"time"
+)
+
+// StoreSnapshot is a point-in-time copy of every memory and relation
+type StoreSnapshot struct {
+	CreatedAt    time.Time        `json:"created_at"`
+	StoreVersion uint64           `json:"store_version"`
+	Memories     []Memory         `json:"memories"`
+	Relations    []MemoryRelation `json:"relations"`
+}
+
+// Snapshot copies the store's memories, sorted by ID, and the relations
+// between them, sorted by endpoints and type
+func (ms *MemoryStore) Snapshot() *StoreSnapshot {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	snapshot := &StoreSnapshot{
+		CreatedAt:    time.Now(),
+		StoreVersion: ms.version,
+		Memories:     make([]Memory, 0, len(ms.memories)),
+		Relations:    make([]MemoryRelation, 0),
+	}
+	for _, mem := range ms.memories {
+		snapshot.Memories = append(snapshot.Memories, eventSnapshot(mem))
+	}
+	sort.Slice(snapshot.Memories, func(i, j int) bool {
+		return snapshot.Memories[i].ID < snapshot.Memories[j].ID
+	})
+
+	for from, relations := range ms.relations {
+		if _, ok := ms.memories[from]; !ok {
+			continue
+		}
+		for _, rel := range relations {
+			if _, ok := ms.memories[rel.To]; ok {
+				snapshot.Relations = append(snapshot.Relations, *rel)
+			}
+		}
+	}
+	sort.Slice(snapshot.Relations, func(i, j int) bool {
+		a, b := snapshot.Relations[i], snapshot.Relations[j]
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		if a.To != b.To {
+			return a.To < b.To
+		}
+		return a.Type < b.Type
+	})
+
+	return snapshot
+}
+
+// Restore replaces every memory and relation with the snapshot's. The
+// snapshot is checked before anything is removed, and a memory rejected
+// during the restore itself, e.g. a duplicate under content normalization,
+// rolls the store back, so a failed restore leaves the store as it was.
+func (ms *MemoryStore) Restore(snapshot *StoreSnapshot) error {
+	if err := ms.checkWritable(); err != nil {
+		return err
+	}
+
+	memories := make([]*Memory, len(snapshot.Memories))
+	seen := make(map[string]bool, len(snapshot.Memories))
+	for i := range snapshot.Memories {
+		memory := snapshot.Memories[i]
+		ms.applyImportanceOverflow(&memory)
+		if err := validateMemory(&memory); err != nil {
+			return err
+		}
+		if seen[memory.ID] {
+			return errorf(ErrValidation, "snapshot has memory %s more than once", memory.ID)
+		}
+		seen[memory.ID] = true
+		if err := ms.enforceContentLength(&memory); err != nil {
+			return err
+		}
+		if err := ms.enforceMetadataLimits(&memory); err != nil {
+			return err
+		}
+		memories[i] = &memory
+	}
+	for _, rel := range snapshot.Relations {
+		if !seen[rel.From] || !seen[rel.To] {
+			return errorf(ErrValidation, "snapshot relation from %s to %s references a missing memory", rel.From, rel.To)
+		}
+	}
+
+	ms.mu.Lock()
+	defer ms.unlockAndFlush()
+
+	if len(memories) > ms.maxMemories {
+		return errorf(ErrCapacity, "snapshot has %d memories, above the capacity of %d", len(memories), ms.maxMemories)
+	}
+
+	// Restore into fresh maps, keeping the old ones to roll back to
+	oldMemories, oldRelations, oldRelationTypeIndex := ms.memories, ms.relations, ms.relationTypeIndex
+	oldRemovalEvents, oldRemovalStart := slices.Clone(ms.removalEvents), ms.removalStart
+	ms.memories = make(map[string]*Memory, len(memories))
+	ms.relations = make(map[string][]*MemoryRelation)
+	ms.relationTypeIndex = make(map[string][]*MemoryRelation)
+	ms.rebuildIndexes()
+	ms.recentCache.clear()
+	ms.markChanged(nil)
+
+	err := ms.restoreLocked(memories, snapshot.Relations)
+	if err != nil {
+		ms.memories, ms.relations, ms.relationTypeIndex = oldMemories, oldRelations, oldRelationTypeIndex
+		ms.removalEvents, ms.removalStart = oldRemovalEvents, oldRemovalStart
+		ms.rebuildIndexes()
+		ms.recentCache.clear()
+		ms.markChanged(nil)
+		ms.discardEvents()
+	}
+	ms.updateCapacityWarning()
+	return err
+}
+
+// restoreLocked inserts a snapshot's memories and relations into the
+// emptied store. Caller must hold ms.mu.
+func (ms *MemoryStore) restoreLocked(memories []*Memory, relations []MemoryRelation) error {
+	for _, memory := range memories {
+		if err := ms.insertMemory(memory); err != nil {
+			return fmt.Errorf("restore memory %s: %w", memory.ID, err)
+		}
+	}
+	for _, rel := range relations {
+		args := CreateRelationArgs{FromID: rel.From, ToID: rel.To, RelationType: rel.Type, Strength: rel.Strength}
+		if err := ms.addRelation(args); err != nil {
+			return fmt.Errorf("restore relation from %s to %s: %w", rel.From, rel.To, err)
+		}
+	}
+	return nil
+}
+
+// SaveSnapshot writes a snapshot to the configured snapshot path and returns
+// the bytes written. It writes a temporary file and renames it over the old
+// snapshot once synced, so a crash mid-write never leaves a partial one.
+// Concurrent saves run one at a time.
+func (ms *MemoryStore) SaveSnapshot() (*StoreSnapshot, int64, error) {
+	if ms.snapshotPath == "" {
+		return nil, 0, errorf(ErrValidation, "no snapshot path configured; start the server with --snapshot-path")
+	}
+
+	ms.snapshotMu.Lock()
+	defer ms.snapshotMu.Unlock()
+
+	snapshot := ms.Snapshot()
+	file, err := os.CreateTemp(filepath.Dir(ms.snapshotPath), filepath.Base(ms.snapshotPath)+".*.tmp")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer os.Remove(file.Name()) // no-op once renamed
+
+	w := bufio.NewWriter(file)
+	err = json.NewEncoder(w).Encode(snapshot)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	var size int64
+	if err == nil {
+		var info os.FileInfo
+		if info, err = file.Stat(); err == nil {
+			size = info.Size()
+		}
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if err := os.Rename(file.Name(), ms.snapshotPath); err != nil {
+		return nil, 0, err
+	}
+	return snapshot, size, nil
+}
+
+// LoadSnapshotFile reads a snapshot written by SaveSnapshot
+func LoadSnapshotFile(path string) (*StoreSnapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshot StoreSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, errorf(ErrValidation, "%s is not a snapshot: %v", path, err)
+	}
+	return &snapshot, nil
+}
+
+// encodeSnapshot gzips a snapshot's JSON and base64-encodes it, for clients
+// that store it as an opaque string
+func encodeSnapshot(snapshot *StoreSnapshot) (string, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(snapshot); err != nil {
+		return "", err
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// decodeSnapshot reverses encodeSnapshot
+func decodeSnapshot(data string) (*StoreSnapshot, error) {
+	compressed, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, errorf(ErrValidation, "snapshot data is not base64: %v", err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, errorf(ErrValidation, "snapshot data is not gzipped: %v", err)
+	}
+	raw, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, errorf(ErrValidation, "snapshot data is corrupt: %v", err)
+	}
+
+	var snapshot StoreSnapshot
+	if err := json.Unmarshal(raw, &snapshot); err != nil {
+		return nil, errorf(ErrValidation, "snapshot data is not a snapshot: %v", err)
+	}
+	return &snapshot, nil
+}